@@ -0,0 +1,291 @@
+// Typed client of the payment API.
+//
+// The package wraps the v1 HTTP endpoints with plain Go methods so consumers don't need
+// to build requests and parse responses by hand. Check the README.md file to get the
+// description of the endpoints.
+package client
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    defaultTimeout = 10*time.Second
+    defaultBackoff = 100*time.Millisecond
+    maxBackoff = 5*time.Second
+)
+
+// Config defines how the client connects to the API.
+type Config struct {
+    // BaseURL is the address of the API server, like http://localhost:8080.
+    BaseURL string
+    // Token is sent in the Authorization header as a bearer token if not empty.
+    Token string
+    // Timeout limits the duration of a single attempt to make a request.
+    Timeout time.Duration
+    // Retries is the number of additional attempts for the idempotent calls.
+    Retries int
+    // Backoff is the delay before the first retry. It doubles with every attempt.
+    Backoff time.Duration
+    // HTTPClient is used to send requests; http.DefaultClient is used if nil.
+    HTTPClient *http.Client
+}
+
+// DefaultConfig returns a configuration with reasonable timeouts and retries.
+func DefaultConfig(baseURL string) Config {
+    return Config{BaseURL:baseURL, Timeout:defaultTimeout, Retries:3, Backoff:defaultBackoff}
+}
+
+// Client sends requests to the payment API.
+type Client struct {
+    Config
+}
+
+// New creates a client using the configuration conf.
+func New(conf Config) *Client {
+    if conf.Timeout <= 0 {
+        conf.Timeout = defaultTimeout
+    }
+    if conf.Backoff <= 0 {
+        conf.Backoff = defaultBackoff
+    }
+    if conf.HTTPClient == nil {
+        conf.HTTPClient = http.DefaultClient
+    }
+    conf.BaseURL = strings.TrimRight(conf.BaseURL, "/")
+    return &Client{conf}
+}
+
+// Account represents a payment system's account.
+type Account struct {
+    ID string            `json:"id"`
+    Currency string      `json:"currency"`
+    // Tier selects the fee schedules of the account.
+    Tier string          `json:"tier"`
+    Balance int64        `json:"balance"`
+    // Available is the part of the balance which is not reserved by the holds,
+    // including the unused part of the overdraft limit.
+    Available int64      `json:"available"`
+    Ledger int64         `json:"ledger"`
+    // OverdraftLimit is how far the balance can go below zero; OverdraftUsed is the
+    // part of it which is spent.
+    OverdraftLimit int64 `json:"overdraft_limit"`
+    OverdraftUsed int64  `json:"overdraft_used"`
+    // InterestBps is the annual interest rate charged on the negative balance.
+    InterestBps int64    `json:"interest_bps"`
+    Created time.Time    `json:"created"`
+}
+
+// Payment contains an information about a money transfer between accounts.
+// The amount is an integer number of cents.
+type Payment struct {
+    ID int                     `json:"id"`
+    From string                `json:"from"`
+    To string                  `json:"to"`
+    Time time.Time             `json:"time_utc"`
+    Amount int64               `json:"amount"`
+    Currency string            `json:"currency"`
+    // Kind is transfer, refund, reversal, split, split_leg or fee.
+    Kind string                `json:"kind"`
+    // OriginalID is the ID of the payment compensated by a refund or a reversal.
+    OriginalID int             `json:"original_id,omitempty"`
+    // Status is pending, processing, completed, failed, reversed or cancelled.
+    Status string              `json:"status"`
+    // ParentID is the ID of the split payment which the leg belongs to.
+    ParentID int               `json:"parent_id,omitempty"`
+    // Fees are the payments charging the fees of a transfer.
+    Fees []Payment             `json:"fees,omitempty"`
+    // Reference, Memo and Metadata describe the payment on behalf of its sender.
+    Reference string           `json:"reference,omitempty"`
+    Memo string                `json:"memo,omitempty"`
+    Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// TransferRequest describes a money transfer.
+//
+// If IdempotencyKey is empty, the client generates a random one. The key is reused by
+// the retries of the same call, so the transfer is never performed twice.
+type TransferRequest struct {
+    From string                `json:"from"`
+    To string                  `json:"to"`
+    Amount int64               `json:"amount"`
+    // Pending creates a payment which reserves the funds until it is completed.
+    Pending bool               `json:"pending,omitempty"`
+    IdempotencyKey string      `json:"-"`
+    // Reference is an identifier of the payment, e.g. an invoice number. If
+    // UniqueReference is set, the transfer fails with ErrDuplicateReference when the
+    // sender has already used the reference.
+    Reference string           `json:"reference,omitempty"`
+    UniqueReference bool       `json:"unique_reference,omitempty"`
+    Memo string                `json:"memo,omitempty"`
+    Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ListAccounts returns all available accounts.
+func (c *Client) ListAccounts(ctx context.Context) ([]Account, error) {
+    var result struct {
+        Accounts []Account `json:"accounts"`
+    }
+    err := c.do(ctx, "GET", "/v1/accounts", nil, nil, &result)
+    return result.Accounts, err
+}
+
+// GetAccount returns an account with the given identifier.
+func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
+    var result struct {
+        Account *Account `json:"account"`
+    }
+    err := c.do(ctx, "GET", "/v1/accounts/"+url.PathEscape(id), nil, nil, &result)
+    return result.Account, err
+}
+
+// Approval is a transfer above the approval threshold waiting for the decision of
+// a second principal.
+type Approval struct {
+    ID int            `json:"id"`
+    From string       `json:"from"`
+    To string         `json:"to"`
+    Amount int64      `json:"amount"`
+    Currency string   `json:"currency"`
+    // Status is pending, approved, rejected, expired, executed or failed.
+    Status string     `json:"status"`
+    Initiator string  `json:"initiator"`
+    DecidedBy string  `json:"decided_by,omitempty"`
+    // PaymentID is the ID of the payment made when the transfer is executed.
+    PaymentID int     `json:"payment_id,omitempty"`
+    Created time.Time `json:"created"`
+    Expires time.Time `json:"expires"`
+}
+
+// ApprovalPendingError is returned by Transfer when the transfer waits for the
+// approval instead of being made:
+//
+//     var pending *client.ApprovalPendingError
+//     if errors.As(err, &pending) { ... pending.Approval.ID ... }
+type ApprovalPendingError struct {
+    Approval Approval
+}
+
+func (e *ApprovalPendingError) Error() string {
+    return fmt.Sprintf("transfer is waiting for approval %d", e.Approval.ID)
+}
+
+// Transfer moves funds between the accounts. A transfer above the approval threshold
+// returns ApprovalPendingError.
+func (c *Client) Transfer(ctx context.Context, req TransferRequest) (*Payment, error) {
+    key := req.IdempotencyKey
+    if key == "" {
+        key = newIdempotencyKey()
+    }
+    var result struct {
+        Payment *Payment   `json:"payment"`
+        Approval *Approval `json:"approval"`
+    }
+    headers := map[string]string{"Idempotency-Key": key}
+    err := c.do(ctx, "POST", "/v1/transfers", req, headers, &result)
+    if err == nil && result.Approval != nil {
+        return nil, &ApprovalPendingError{*result.Approval}
+    }
+    return result.Payment, err
+}
+
+// do sends a request and decodes the response into the result.
+//
+// GET requests and requests with the Idempotency-Key header are retried in case of
+// network errors and server-side failures.
+func (c *Client) do(
+    ctx context.Context,
+    method, path string,
+    body interface{},
+    headers map[string]string,
+    result interface{},
+) error {
+    var encoded []byte
+    if body != nil {
+        var err error
+        if encoded, err = json.Marshal(body); err != nil {
+            return fmt.Errorf("encoding error: %s", err)
+        }
+    }
+
+    retries := 0
+    if method == "GET" || headers["Idempotency-Key"] != "" {
+        retries = c.Retries
+    }
+
+    backoff := c.Backoff
+    for attempt := 0; ; attempt++ {
+        err := c.attempt(ctx, method, path, encoded, headers, result)
+        if err == nil || attempt >= retries || !retryable(err) {
+            return err
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(backoff):
+        }
+        if backoff *= 2; backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// attempt makes a single HTTP request.
+func (c *Client) attempt(
+    ctx context.Context,
+    method, path string,
+    body []byte,
+    headers map[string]string,
+    result interface{},
+) error {
+    ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Accept", "application/json")
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if c.Token != "" {
+        req.Header.Set("Authorization", "Bearer "+c.Token)
+    }
+    for key, value := range headers {
+        req.Header.Set(key, value)
+    }
+
+    resp, err := c.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return decodeError(resp)
+    }
+    if err = json.NewDecoder(resp.Body).Decode(result); err != nil && err != io.EOF {
+        return fmt.Errorf("decoding error: %s", err)
+    }
+    return nil
+}
+
+// newIdempotencyKey generates a random key to deduplicate transfer requests.
+func newIdempotencyKey() string {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        panic(fmt.Sprintf("cannot generate idempotency key: %s", err))
+    }
+    return hex.EncodeToString(buf)
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestTransfer_RetriesWithSameKey(t *testing.T) {
+    var keys []string
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        keys = append(keys, req.Header.Get("Idempotency-Key"))
+        if len(keys) == 1 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        writeJSON(w, http.StatusAccepted, map[string]interface{}{
+            "payment": map[string]interface{}{"id": 7, "from": "A", "to": "B", "amount": 100},
+        })
+    }))
+    defer server.Close()
+
+    c := New(Config{BaseURL:server.URL, Retries:2, Backoff:time.Millisecond})
+    payment, err := c.Transfer(context.Background(), TransferRequest{From:"A", To:"B", Amount:100})
+    if err != nil {
+        t.Fatalf("unexpected error: %s", err)
+    }
+    if payment.ID != 7 || payment.Amount != 100 {
+        t.Errorf("invalid payment: %#v", payment)
+    }
+    if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+        t.Errorf("the same idempotency key was expected: %v", keys)
+    }
+}
+
+func TestTransfer_ApprovalPending(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        writeJSON(w, http.StatusAccepted, map[string]interface{}{
+            "payment": nil,
+            "approval": map[string]interface{}{"id": 3, "from": "A", "to": "B", "amount": 500000, "status": "pending"},
+        })
+    }))
+    defer server.Close()
+
+    c := New(Config{BaseURL:server.URL})
+    payment, err := c.Transfer(context.Background(), TransferRequest{From:"A", To:"B", Amount:500000})
+    var pending *ApprovalPendingError
+    if payment != nil || !errors.As(err, &pending) || pending.Approval.ID != 3 {
+        t.Errorf("the pending approval was expected: %v", err)
+    }
+}
+
+func TestTransfer_DuplicateReference(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        writeJSON(w, http.StatusConflict, map[string]interface{}{
+            "error": `reference "INV-1" was already used by the sender`, "code": "duplicate_reference", "status": 409,
+        })
+    }))
+    defer server.Close()
+
+    c := New(Config{BaseURL:server.URL})
+    _, err := c.Transfer(context.Background(), TransferRequest{From:"A", To:"B", Amount:100, Reference:"INV-1", UniqueReference:true})
+    if !errors.Is(err, ErrDuplicateReference) || errors.Is(err, ErrIdempotencyConflict) {
+        t.Errorf("ErrDuplicateReference was expected: %v", err)
+    }
+}
+
+func TestGetAccount_TypedError(t *testing.T) {
+    attempts := 0
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        attempts++
+        if req.Header.Get("Authorization") != "Bearer secret" {
+            t.Errorf("missing authorization header")
+        }
+        writeJSON(w, http.StatusNotFound, map[string]interface{}{
+            "error": "account is not found", "code": "account_not_found", "status": 404,
+        })
+    }))
+    defer server.Close()
+
+    c := New(Config{BaseURL:server.URL, Token:"secret", Retries:3, Backoff:time.Millisecond})
+    _, err := c.GetAccount(context.Background(), "X")
+    if !errors.Is(err, ErrAccountNotFound) {
+        t.Errorf("ErrAccountNotFound was expected: %v", err)
+    }
+    var apiErr *Error
+    if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+        t.Errorf("invalid error: %#v", err)
+    }
+    if attempts != 1 {
+        t.Errorf("client errors should not be retried: %d attempts", attempts)
+    }
+}
+
+func TestGetAccount_AuthErrors(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if req.Header.Get("Authorization") == "" {
+            writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+                "error": "authentication is required", "code": "unauthorized", "status": 401,
+            })
+            return
+        }
+        writeJSON(w, http.StatusForbidden, map[string]interface{}{
+            "error": "access to account B is denied", "code": "forbidden", "status": 403,
+        })
+    }))
+    defer server.Close()
+
+    if _, err := New(Config{BaseURL:server.URL}).GetAccount(context.Background(), "B"); !errors.Is(err, ErrUnauthorized) {
+        t.Errorf("ErrUnauthorized was expected: %v", err)
+    }
+    if _, err := New(Config{BaseURL:server.URL, Token:"secret"}).GetAccount(context.Background(), "B"); !errors.Is(err, ErrForbidden) {
+        t.Errorf("ErrForbidden was expected: %v", err)
+    }
+}
+
+func TestListPayments_Iterator(t *testing.T) {
+    pages := map[string]map[string]interface{}{
+        "": {"payments": []Payment{{ID:3}, {ID:2}}, "next_cursor": "2"},
+        "2": {"payments": []Payment{{ID:1}}, "next_cursor": ""},
+    }
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if req.URL.Path != "/v1/accounts/A/payments" || req.URL.Query().Get("limit") != "2" {
+            t.Errorf("unexpected request: %s", req.URL)
+        }
+        writeJSON(w, http.StatusOK, pages[req.URL.Query().Get("cursor")])
+    }))
+    defer server.Close()
+
+    c := New(Config{BaseURL:server.URL})
+    it := c.ListPayments("A", 2)
+    var ids []int
+    for it.Next(context.Background()) {
+        ids = append(ids, it.Payment().ID)
+    }
+    if err := it.Err(); err != nil {
+        t.Fatalf("unexpected error: %s", err)
+    }
+    if len(ids) != 3 || ids[0] != 3 || ids[2] != 1 {
+        t.Errorf("invalid payments: %v", ids)
+    }
+}
+
+func TestVerifyReceipt(t *testing.T) {
+    public, private, _ := ed25519.GenerateKey(rand.Reader)
+    keys := []ReceiptKey{{ID:"rk_1", Algorithm:"Ed25519", PublicKey:base64.StdEncoding.EncodeToString(public)}}
+    // the receipt as it is sent by the server
+    signed := `{"amount":1000,"currency":"USD","from":"A","key_id":"rk_1","payment_id":1,` +
+        `"status":"completed","time_utc":"2019-03-01T09:00:00.5Z","to":"B","version":1}`
+    document := fmt.Sprintf(`{"payload": %s, "signature": %q}`, signed,
+        base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(signed))))
+    var receipt Receipt
+    if err := json.Unmarshal([]byte(document), &receipt); err != nil {
+        t.Fatal(err)
+    }
+    if err := VerifyReceipt(receipt, keys); err != nil {
+        t.Errorf("the receipt should be valid: %s", err)
+    }
+
+    tampered := receipt
+    tampered.Payload.Amount = 100000
+    if err := VerifyReceipt(tampered, keys); !errors.Is(err, ErrInvalidReceipt) {
+        t.Errorf("the tampered receipt should be rejected: %v", err)
+    }
+    if err := VerifyReceipt(receipt, []ReceiptKey{{ID:"rk_2", Algorithm:"Ed25519", PublicKey:keys[0].PublicKey}}); !errors.Is(err, ErrInvalidReceipt) {
+        t.Errorf("the receipt signed with an unknown key should be rejected: %v", err)
+    }
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// Error is returned when the API rejects a request.
+//
+// The Code field contains a machine-readable reason of the failure. The errors can be
+// compared with the predefined values using errors.Is:
+//
+//     if errors.Is(err, client.ErrInsufficientFunds) { ... }
+type Error struct {
+    StatusCode int      `json:"status"`
+    Code string         `json:"code"`
+    Message string      `json:"error"`
+    Fields []FieldError `json:"fields"`
+    // Limit describes the limit exceeded by a transfer; it is set with ErrLimitExceeded.
+    Limit *Limit        `json:"limit"`
+}
+
+// FieldError describes a problem with a single field of the request. The list of
+// such problems is returned with ErrValidationFailed.
+type FieldError struct {
+    Field string   `json:"field"`
+    Message string `json:"message"`
+}
+
+// Limit reports the usage of a transfer limit: max_transfer, daily, monthly or
+// hourly_count. The Value is zero and the Remaining allowance is nil if the limit is
+// not set.
+type Limit struct {
+    Limit string      `json:"limit"`
+    Value int64       `json:"value"`
+    Used int64        `json:"used"`
+    Remaining *int64  `json:"remaining"`
+    Resets *time.Time `json:"resets"`
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("api error %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports if the target is an API error with the same code.
+func (e *Error) Is(target error) bool {
+    t, ok := target.(*Error)
+    return ok && t.Code == e.Code
+}
+
+// Errors returned by the API.
+var (
+    ErrInvalidRequest = &Error{Code:"invalid_request"}
+    ErrNotFound = &Error{Code:"not_found"}
+    ErrInternal = &Error{Code:"internal"}
+    ErrAccountNotFound = &Error{Code:"account_not_found"}
+    ErrCurrencyMismatch = &Error{Code:"currency_mismatch"}
+    ErrInsufficientFunds = &Error{Code:"insufficient_funds"}
+    ErrIdempotencyConflict = &Error{Code:"idempotency_conflict"}
+    ErrValidationFailed = &Error{Code:"validation_failed"}
+    ErrBodyTooLarge = &Error{Code:"body_too_large"}
+    ErrUnauthorized = &Error{Code:"unauthorized"}
+    ErrForbidden = &Error{Code:"forbidden"}
+    ErrInvalidState = &Error{Code:"invalid_state"}
+    ErrLimitExceeded = &Error{Code:"limit_exceeded"}
+    ErrApprovalRequired = &Error{Code:"approval_required"}
+    ErrDuplicateReference = &Error{Code:"duplicate_reference"}
+)
+
+// decodeError converts an error response into Error.
+func decodeError(resp *http.Response) error {
+    apiErr := &Error{}
+    if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+        apiErr.Code = ErrInternal.Code
+        apiErr.Message = http.StatusText(resp.StatusCode)
+    }
+    apiErr.StatusCode = resp.StatusCode
+    return apiErr
+}
+
+// retryable checks if a failed request can be repeated.
+func retryable(err error) bool {
+    var apiErr *Error
+    if errors.As(err, &apiErr) {
+        return apiErr.StatusCode == http.StatusTooManyRequests ||
+            apiErr.StatusCode >= http.StatusInternalServerError
+    }
+    return true
+}
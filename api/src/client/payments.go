@@ -0,0 +1,80 @@
+package client
+
+import (
+    "context"
+    "fmt"
+    "net/url"
+)
+
+// PaymentIterator walks over the account's payments from the newest to the oldest,
+// fetching the pages lazily.
+//
+// Example:
+//
+//     it := c.ListPayments("first", 100)
+//     for it.Next(ctx) {
+//         fmt.Println(it.Payment())
+//     }
+//     if err := it.Err(); err != nil { ... }
+type PaymentIterator struct {
+    client *Client
+    accountId string
+    pageSize int
+    cursor string
+    page []Payment
+    current Payment
+    last bool
+    err error
+}
+
+// ListPayments returns an iterator over payments of the account accountId.
+// The pageSize defines how many payments are fetched with a single request;
+// the server's default is used if it is zero.
+func (c *Client) ListPayments(accountId string, pageSize int) *PaymentIterator {
+    return &PaymentIterator{client:c, accountId:accountId, pageSize:pageSize}
+}
+
+// Next advances the iterator to the next payment. It returns false when there are
+// no more payments, or an error has happened.
+func (it *PaymentIterator) Next(ctx context.Context) bool {
+    for len(it.page) == 0 {
+        if it.last || it.err != nil {
+            return false
+        }
+        it.err = it.fetch(ctx)
+    }
+    it.current, it.page = it.page[0], it.page[1:]
+    return true
+}
+
+// Payment returns the current payment.
+func (it *PaymentIterator) Payment() Payment {
+    return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *PaymentIterator) Err() error {
+    return it.err
+}
+
+func (it *PaymentIterator) fetch(ctx context.Context) error {
+    query := url.Values{}
+    if it.pageSize > 0 {
+        query.Set("limit", fmt.Sprint(it.pageSize))
+    }
+    if it.cursor != "" {
+        query.Set("cursor", it.cursor)
+    }
+    path := fmt.Sprintf("/v1/accounts/%s/payments?%s", url.PathEscape(it.accountId), query.Encode())
+
+    var result struct {
+        Payments []Payment `json:"payments"`
+        NextCursor string  `json:"next_cursor"`
+    }
+    if err := it.client.do(ctx, "GET", path, nil, nil, &result); err != nil {
+        return err
+    }
+    it.page, it.cursor = result.Payments, result.NextCursor
+    it.last = it.cursor == ""
+    return nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+    "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// ErrInvalidReceipt is returned by VerifyReceipt when the receipt is not signed by
+// any of the given keys.
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+// Receipt proves that a payment was completed. The Signature is the base64-encoded
+// Ed25519 signature of the canonical JSON encoding of the Payload.
+type Receipt struct {
+    Payload ReceiptPayload `json:"payload"`
+    Signature string       `json:"signature"`
+}
+
+// ReceiptPayload is the signed part of a receipt. The fields are declared in the
+// order of their JSON keys, so encoding/json produces the canonical encoding.
+type ReceiptPayload struct {
+    Amount int64    `json:"amount"`
+    Currency string `json:"currency"`
+    From string     `json:"from"`
+    // KeyID is the ID of the key which signed the receipt.
+    KeyID string    `json:"key_id"`
+    PaymentID int   `json:"payment_id"`
+    Status string   `json:"status"`
+    Time time.Time  `json:"time_utc"`
+    To string       `json:"to"`
+    Version int     `json:"version"`
+}
+
+// ReceiptKey is a public key verifying the receipts. The retired keys don't sign the
+// new receipts but still verify the old ones.
+type ReceiptKey struct {
+    ID string          `json:"id"`
+    Algorithm string   `json:"algorithm"`
+    // PublicKey is the base64-encoded Ed25519 public key.
+    PublicKey string   `json:"public_key"`
+    Created time.Time  `json:"created"`
+    Retired *time.Time `json:"retired,omitempty"`
+}
+
+// Receipt returns the signed receipt of a completed payment.
+func (c *Client) Receipt(ctx context.Context, paymentId int) (*Receipt, error) {
+    var result struct {
+        Receipt *Receipt `json:"receipt"`
+    }
+    err := c.do(ctx, "GET", fmt.Sprintf("/v1/payments/%d/receipt", paymentId), nil, nil, &result)
+    return result.Receipt, err
+}
+
+// ReceiptKeys returns the published keys verifying the receipts. The keys can be
+// saved to verify the receipts offline.
+func (c *Client) ReceiptKeys(ctx context.Context) ([]ReceiptKey, error) {
+    var result struct {
+        Keys []ReceiptKey `json:"keys"`
+    }
+    err := c.do(ctx, "GET", "/.well-known/receipt-keys", nil, nil, &result)
+    return result.Keys, err
+}
+
+// VerifyReceipt checks the signature of the receipt with the key it names. No requests
+// are made, so the keys should be fetched with ReceiptKeys beforehand:
+//
+//     if err := client.VerifyReceipt(receipt, keys); err != nil { ... }
+func VerifyReceipt(receipt Receipt, keys []ReceiptKey) error {
+    var key *ReceiptKey
+    for i := range keys {
+        if keys[i].ID == receipt.Payload.KeyID {
+            key = &keys[i]
+        }
+    }
+    if key == nil {
+        return fmt.Errorf("%w: unknown key %q", ErrInvalidReceipt, receipt.Payload.KeyID)
+    }
+    public, err := base64.StdEncoding.DecodeString(key.PublicKey)
+    if err != nil || key.Algorithm != "Ed25519" || len(public) != ed25519.PublicKeySize {
+        return fmt.Errorf("%w: unsupported key %q", ErrInvalidReceipt, key.ID)
+    }
+    signature, err := base64.StdEncoding.DecodeString(receipt.Signature)
+    if err != nil {
+        return fmt.Errorf("%w: malformed signature", ErrInvalidReceipt)
+    }
+    payload := receipt.Payload
+    payload.Time = payload.Time.UTC()
+    message, err := json.Marshal(payload)
+    if err != nil {
+        return fmt.Errorf("encoding error: %s", err)
+    }
+    if !ed25519.Verify(public, message, signature) {
+        return fmt.Errorf("%w: signature mismatch", ErrInvalidReceipt)
+    }
+    return nil
+}
@@ -1,24 +1,191 @@
 package main
 
 import (
+    "./client"
     "./server"
     "context"
+    "encoding/json"
+    "errors"
     "fmt"
     "log"
+    "net"
     "net/http"
     "os"
     "strconv"
+    "strings"
 )
 
 func main() {
-    conf := server.Config{Host:"", Port:mustGetPort(), DatabaseConn:connString()}
+    if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+        os.Exit(verifyAudit())
+    }
+    if len(os.Args) > 1 && os.Args[1] == "verify-receipt" {
+        os.Exit(verifyReceipt(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+        os.Exit(reconcile(os.Args[2:]))
+    }
+    tokens, err := server.ParseTokens(os.Getenv("API_TOKENS"))
+    if err != nil {
+        log.Fatalf("configuration error: %s", err)
+    }
+    conf := server.Config{
+        Host:"",
+        Port:mustGetPort("PORT"),
+        DatabaseConn:connString(),
+        GRPCPort:optionalPort("GRPC_PORT"),
+        Tokens:tokens,
+        InterestAccount:os.Getenv("INTEREST_ACCOUNT"),
+        ApprovalThreshold:server.Cents(optionalInt("APPROVAL_THRESHOLD")),
+        ReceiptKey:os.Getenv("RECEIPT_KEY"),
+        ReceiptKeyFile:os.Getenv("RECEIPT_KEY_FILE")}
+    if err := conf.Check(); err != nil {
+        log.Fatalf("configuration error: %s", err)
+    }
     srv := server.NewBillingAPI(conf)
+    if err := srv.InitReceiptKey(); err != nil {
+        log.Fatalf("receipt key error: %s", err)
+    }
+
+    if conf.GRPCPort != 0 {
+        listener, err := net.Listen("tcp", conf.GRPCAddr())
+        if err != nil {
+            log.Fatalf("grpc server error: %s", err)
+        }
+        grpcServer := server.NewGRPCServer(srv)
+        defer grpcServer.GracefulStop()
+        go func() {
+            if err := grpcServer.Serve(listener); err != nil {
+                log.Fatalf("grpc server error: %s", err)
+            }
+        }()
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go srv.RunEventFeed(ctx)
+    go srv.RunDispatcher(ctx)
+    go srv.RunHoldExpiry(ctx)
+    go srv.RunScheduler(ctx)
+    go srv.RunInterestAccrual(ctx)
+    go srv.RunBalanceSnapshots(ctx)
+    go srv.RunRollups(ctx)
+    go srv.RunApprovalExpiry(ctx)
+
     if err := srv.ListenAndServe(); err != http.ErrServerClosed {
         log.Fatalf("server error: %s", err)
     }
     _ = srv.Shutdown(context.TODO())
 }
 
+// verifyAudit prints the verification report of the audit log and returns a non-zero
+// exit code if the hash chain is broken.
+func verifyAudit() int {
+    manager, err := server.NewBillingManager(connString())
+    if err != nil {
+        log.Printf("database error: %s", err)
+        return 2
+    }
+    defer manager.Close()
+    report, err := manager.VerifyAudit()
+    if err != nil {
+        log.Printf("verification error: %s", err)
+        return 2
+    }
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    _ = encoder.Encode(report)
+    if !report.Valid {
+        return 1
+    }
+    return 0
+}
+
+// reconcile prints the discrepancy report of the balances and returns a non-zero exit
+// code if there are discrepancies. With the --adjust flag, the adjustments resolving
+// the discrepancies are requested; they are made once approved by an operator.
+func reconcile(args []string) int {
+    adjust := len(args) == 1 && args[0] == "--adjust"
+    if len(args) > 1 || len(args) == 1 && !adjust {
+        log.Printf("usage: reconcile [--adjust]")
+        return 2
+    }
+    manager, err := server.NewBillingManager(connString())
+    if err != nil {
+        log.Printf("database error: %s", err)
+        return 2
+    }
+    defer manager.Close()
+    report, err := server.Reconcile(manager, "reconcile", adjust)
+    if report != nil {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        _ = encoder.Encode(report)
+    }
+    if err != nil {
+        log.Printf("reconciliation error: %s", err)
+        return 2
+    }
+    if len(report.Discrepancies) > 0 {
+        return 1
+    }
+    return 0
+}
+
+// verifyReceipt checks the receipt file given in the first argument with the keys
+// from the file or the API server given in the second one. The receipt file contains
+// either the receipt or the response of GET /v1/payments/{id}/receipt, and the keys
+// file contains the response of GET /.well-known/receipt-keys.
+func verifyReceipt(args []string) int {
+    if len(args) != 2 {
+        log.Printf("usage: verify-receipt <receipt.json> <keys.json | http://api.host>")
+        return 2
+    }
+    var document struct {
+        client.Receipt
+        Wrapped *client.Receipt `json:"receipt"`
+    }
+    if err := readJSON(args[0], &document); err != nil {
+        log.Printf("cannot read the receipt: %s", err)
+        return 2
+    }
+    receipt := document.Receipt
+    if document.Wrapped != nil {
+        receipt = *document.Wrapped
+    }
+    var published struct {
+        Keys []client.ReceiptKey `json:"keys"`
+    }
+    var err error
+    if strings.HasPrefix(args[1], "http://") || strings.HasPrefix(args[1], "https://") {
+        published.Keys, err = client.New(client.DefaultConfig(args[1])).ReceiptKeys(context.Background())
+    } else {
+        err = readJSON(args[1], &published)
+    }
+    if err != nil {
+        log.Printf("cannot read the keys: %s", err)
+        return 2
+    }
+    if err := client.VerifyReceipt(receipt, published.Keys); err != nil {
+        fmt.Println(err)
+        if errors.Is(err, client.ErrInvalidReceipt) {
+            return 1
+        }
+        return 2
+    }
+    fmt.Printf("receipt of payment %d is valid (key %s)\n", receipt.Payload.PaymentID, receipt.Payload.KeyID)
+    return 0
+}
+
+// readJSON decodes the JSON file.
+func readJSON(path string, value interface{}) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, value)
+}
+
 // connString builds a connection string using the environment variables.
 func connString() string {
     var (
@@ -33,10 +200,30 @@ func connString() string {
         host, port, user, password, dbname, sslmode)
 }
 
-func mustGetPort() int {
-    if port, err := strconv.Atoi(os.Getenv("PORT")); err != nil {
+func mustGetPort(name string) int {
+    if port, err := strconv.Atoi(os.Getenv(name)); err != nil {
         panic(err)
     } else {
         return port
     }
-}
\ No newline at end of file
+}
+
+// optionalPort returns zero if the environment variable is not set.
+func optionalPort(name string) int {
+    if os.Getenv(name) == "" {
+        return 0
+    }
+    return mustGetPort(name)
+}
+
+// optionalInt returns zero if the environment variable is not set.
+func optionalInt(name string) int64 {
+    if os.Getenv(name) == "" {
+        return 0
+    }
+    value, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+    if err != nil {
+        panic(err)
+    }
+    return value
+}
@@ -0,0 +1,341 @@
+// Analytics of the payment volume.
+//
+// The analytics report the number and the sum of the booked payments by the currency
+// and by the hour, day, week or month, of all accounts or of a single one, and the
+// counterparties of an account with the largest volumes. The days, the weeks starting
+// on Monday and the months are UTC ones.
+//
+// The reports are not computed from the whole payment history. The rollup job sums the
+// payments booked within every closed hour up by the account and the counterparty, once,
+// and records the hour as rolled up in the same transaction. The hour is rolled up an
+// hour after it ends, when the transactions which booked payments within it are surely
+// committed. A report reads the rollups of the rolled up hours, and sums up the payments
+// booked since the last rolled up hour, which are a couple of hours of payments at most.
+// Every payment is rolled up twice: as sent by its sender and as received by its
+// recipient; the volume of all accounts counts the sent payments only.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+const (
+    // rollupJob is the name of the rollup job's advisory lock.
+    rollupJob = "payment-rollup"
+    rollupInterval = 10 * time.Minute
+    rollupDelay = time.Hour
+    rollupBatchSize = 24
+    defaultCounterparties = 10
+)
+
+// Buckets of the payment volume.
+const (
+    bucketHour = "hour"
+    bucketDay = "day"
+    bucketWeek = "week"
+    bucketMonth = "month"
+)
+
+// maxVolumePeriod bounds the period of a volume report, so the report has a few
+// hundred buckets at most.
+var maxVolumePeriod = map[string]time.Duration{
+    bucketHour: 31 * 24 * time.Hour,
+    bucketDay: 366 * 24 * time.Hour,
+    bucketWeek: 5 * 366 * 24 * time.Hour,
+    bucketMonth: 10 * 366 * 24 * time.Hour,
+}
+
+// AnalyticsManager maintains the rollups of the payments and reports the volume.
+type AnalyticsManager interface {
+    // RollupPayments rolls up the payments of up to limit hours which end before the
+    // time until and are not rolled up yet, starting from the earliest one, and returns
+    // the number of the rolled up hours.
+    RollupPayments(until time.Time, limit int) (int, error)
+    // PaymentVolume returns the volume of the payments booked within [from, to) by the
+    // bucket and the currency, ordered by both, of the account, or of all accounts if
+    // the account is empty.
+    PaymentVolume(account, bucket string, from, to time.Time) ([]VolumePoint, error)
+    // TopCounterparties returns up to limit counterparties of the account with the
+    // largest volumes of the payments booked within [from, to).
+    TopCounterparties(account string, from, to time.Time, limit int) ([]CounterpartyVolume, error)
+}
+
+// VolumePoint is the volume of the payments in a currency booked within the bucket
+// starting at the Start.
+type VolumePoint struct {
+    Start time.Time `db:"start" json:"start"`
+    Currency string `db:"currency" json:"currency"`
+    Count int64     `db:"count" json:"count"`
+    Amount Cents    `db:"amount" json:"amount"`
+}
+
+// CounterpartyVolume is the volume of the payments between an account and its
+// counterparty in both directions; the Amount is the sum of the sent and the received
+// amounts.
+type CounterpartyVolume struct {
+    Counterparty string  `db:"counterparty_id" json:"counterparty"`
+    Currency string      `db:"currency" json:"currency"`
+    SentCount int64      `db:"sent_count" json:"sent_count"`
+    SentAmount Cents     `db:"sent_amount" json:"sent_amount"`
+    ReceivedCount int64  `db:"received_count" json:"received_count"`
+    ReceivedAmount Cents `db:"received_amount" json:"received_amount"`
+    Amount Cents         `db:"amount" json:"amount"`
+}
+
+// bucketStart returns the start of the bucket containing the time, like date_trunc.
+func bucketStart(t time.Time, bucket string) time.Time {
+    t = t.UTC()
+    switch bucket {
+    case bucketHour:
+        return t.Truncate(time.Hour)
+    case bucketWeek:
+        day := dayStart(t)
+        return day.AddDate(0, 0, -(int(day.Weekday()) + 6) % 7)
+    case bucketMonth:
+        return monthStart(t)
+    }
+    return dayStart(t)
+}
+
+// nextBucket returns the start of the bucket following the one starting at the start.
+func nextBucket(start time.Time, bucket string) time.Time {
+    switch bucket {
+    case bucketHour:
+        return start.Add(time.Hour)
+    case bucketWeek:
+        return start.AddDate(0, 0, 7)
+    case bucketMonth:
+        return start.AddDate(0, 1, 0)
+    }
+    return start.AddDate(0, 0, 1)
+}
+
+// bookedMovements selects the booked payments twice, as the movements of the sender
+// and of the recipient.
+const bookedMovements = `
+    FROM payment p
+    JOIN payment_status s ON s.payment_id = p.payment_id AND s.status = 'completed'
+    CROSS JOIN LATERAL (VALUES
+        (p.from_id, p.to_id, 1, p.amount, 0, 0),
+        (p.to_id, p.from_id, 0, 0, 1, p.amount)
+    ) AS m (account_id, counterparty_id, sent_count, sent_amount, received_count, received_amount)
+    WHERE p.kind <> 'split'`
+
+// paymentRollups selects the rollups within [$1, $2) of the account $3, or of all
+// accounts if it's empty: the hours before $4 are rolled up, and the payments booked
+// since then are summed up by the hour.
+const paymentRollups = `
+    SELECT hour, account_id, counterparty_id, currency::TEXT AS currency,
+        sent_count, sent_amount, received_count, received_amount
+    FROM payment_rollup
+    WHERE hour >= $1 AND hour < LEAST($2, $4) AND ($3 = '' OR account_id = $3)
+    UNION ALL
+    SELECT date_trunc('hour', s.changed_at), m.account_id, m.counterparty_id, p.currency::TEXT,
+        SUM(m.sent_count), SUM(m.sent_amount), SUM(m.received_count), SUM(m.received_amount)` +
+    bookedMovements + `
+        AND s.changed_at >= GREATEST($1, $4) AND s.changed_at < $2 AND ($3 = '' OR m.account_id = $3)
+    GROUP BY 1, 2, 3, 4`
+
+// RollupPayments rolls up every hour in its own transaction.
+func (m BillingManager) RollupPayments(until time.Time, limit int) (int, error) {
+    start, err := nextRollupHour(m.DB)
+    if err != nil || start == nil {
+        return 0, err
+    }
+    rolled := 0
+    for hour := *start; rolled < limit && !hour.Add(time.Hour).After(until); hour = hour.Add(time.Hour) {
+        if err = m.rollupHour(hour); err != nil {
+            return rolled, internalError(err)
+        }
+        rolled++
+    }
+    return rolled, nil
+}
+
+// nextRollupHour returns the hour following the last rolled up one or, if none is, the
+// hour of the earliest booked payment; it returns nil if there are no payments.
+func nextRollupHour(q sqlx.Queryer) (*time.Time, error) {
+    var hour *time.Time
+    err := sqlx.Get(q, &hour, "SELECT MAX(hour) + INTERVAL '1 hour' FROM rollup_hour")
+    if err == nil && hour == nil {
+        err = sqlx.Get(q, &hour, "SELECT date_trunc('hour', MIN(changed_at)) FROM payment_status WHERE status = 'completed'")
+    }
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return hour, nil
+}
+
+func (m BillingManager) rollupHour(hour time.Time) error {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(`
+        INSERT INTO payment_rollup (hour, account_id, counterparty_id, currency, sent_count, sent_amount, received_count, received_amount)
+        SELECT $1, m.account_id, m.counterparty_id, p.currency,
+            SUM(m.sent_count), SUM(m.sent_amount), SUM(m.received_count), SUM(m.received_amount)` +
+        bookedMovements + ` AND s.changed_at >= $1 AND s.changed_at < $2
+        GROUP BY m.account_id, m.counterparty_id, p.currency`, hour, hour.Add(time.Hour))
+    if err == nil {
+        _, err = tx.Exec("INSERT INTO rollup_hour (hour, rolled_at) VALUES ($1, $2)", hour, time.Now().UTC())
+    }
+    if err != nil {
+        mustRollback(tx)
+        return err
+    }
+    return tx.Commit()
+}
+
+// PaymentVolume reads in a read-only transaction with the repeatable read isolation,
+// so the rolled up hours are consistent with the rollups.
+func (m BillingManager) PaymentVolume(account, bucket string, from, to time.Time) ([]VolumePoint, error) {
+    points := make([]VolumePoint, 0)
+    err := m.readRollups(func(tx *sqlx.Tx, rolled time.Time) error {
+        return tx.Select(&points, `
+            SELECT date_trunc($5, r.hour) AS start, r.currency,
+                SUM(CASE WHEN $3 = '' THEN r.sent_count ELSE r.sent_count + r.received_count END) AS count,
+                SUM(CASE WHEN $3 = '' THEN r.sent_amount ELSE r.sent_amount + r.received_amount END) AS amount
+            FROM (` + paymentRollups + `) r
+            GROUP BY 1, 2
+            ORDER BY 1, 2`, from, to, account, rolled, bucket)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return points, nil
+}
+
+func (m BillingManager) TopCounterparties(account string, from, to time.Time, limit int) ([]CounterpartyVolume, error) {
+    counterparties := make([]CounterpartyVolume, 0)
+    err := m.readRollups(func(tx *sqlx.Tx, rolled time.Time) error {
+        return tx.Select(&counterparties, `
+            SELECT r.counterparty_id, r.currency,
+                SUM(r.sent_count) AS sent_count, SUM(r.sent_amount) AS sent_amount,
+                SUM(r.received_count) AS received_count, SUM(r.received_amount) AS received_amount,
+                SUM(r.sent_amount + r.received_amount) AS amount
+            FROM (` + paymentRollups + `) r
+            GROUP BY 1, 2
+            ORDER BY amount DESC, r.counterparty_id
+            LIMIT $5`, from, to, account, rolled, limit)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return counterparties, nil
+}
+
+// readRollups calls read with the end of the rolled up hours, or the zero time if no
+// hour is rolled up yet.
+func (m BillingManager) readRollups(read func(tx *sqlx.Tx, rolled time.Time) error) error {
+    tx, err := m.DB.BeginTxx(context.Background(), &sql.TxOptions{Isolation:sql.LevelRepeatableRead, ReadOnly:true})
+    if err != nil {
+        return internalError(err)
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    var rolled *time.Time
+    if err = tx.Get(&rolled, "SELECT MAX(hour) + INTERVAL '1 hour' FROM rollup_hour"); err != nil {
+        return internalError(err)
+    }
+    if rolled == nil {
+        rolled = &time.Time{}
+    }
+    if err = read(tx, *rolled); err != nil {
+        return internalError(err)
+    }
+    return nil
+}
+
+// RunRollups rolls up the payments using the shared Manager until the context is
+// cancelled, while the instance leads the rollup job.
+func (api *BillingAPI) RunRollups(ctx context.Context) {
+    api.runLeader(ctx, rollupJob, rollupInterval, func(m Manager) error {
+        until := time.Now().UTC().Add(-rollupDelay)
+        for {
+            rolled, err := m.RollupPayments(until, rollupBatchSize)
+            if err != nil || rolled < rollupBatchSize {
+                return err
+            }
+        }
+    })
+}
+
+// paymentVolume reports the volume of the payments by the bucket given by the bucket
+// parameter, a day by default, for the period given by the from and to days, inclusive.
+// The volume of all accounts is reported to the operators only; the volume of the
+// account given by the account parameter is reported to its clients as well.
+func (api *BillingAPI) paymentVolume(m Manager, resp *Responder, req *http.Request) {
+    query := VolumeQuery{Bucket:bucketDay}
+    if err := decodeQuery(req, &query); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var err error
+    if query.Account == "" {
+        err = requireOperator(req.Context())
+    } else {
+        err = authorize(req.Context(), query.Account)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    from, to, err := parsePeriod(query.From, query.To)
+    if err == nil && to.Sub(from) > maxVolumePeriod[query.Bucket] {
+        err = validationError([]FieldError{{"to", "the period is too long for the bucket"}})
+    }
+    if err == nil && query.Account != "" {
+        _, err = m.GetAccount(query.Account)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    from = bucketStart(from, query.Bucket)
+    if start := bucketStart(to, query.Bucket); start.Before(to) {
+        to = nextBucket(start, query.Bucket)
+    }
+    points, err := m.PaymentVolume(query.Account, query.Bucket, from, to)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(VolumeResponse{query.Account, query.Bucket, from, to, points})
+}
+
+// topCounterparties reports the counterparties of the account with the largest
+// volumes for the period given by the from and to days, inclusive; the limit parameter
+// is the number of the counterparties, 10 by default.
+func (api *BillingAPI) topCounterparties(m Manager, resp *Responder, req *http.Request) {
+    accountId := req.PathValue("id")
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    query := CounterpartyQuery{Limit:defaultCounterparties}
+    err := decodeQuery(req, &query)
+    var from, to time.Time
+    if err == nil {
+        from, to, err = parsePeriod(query.From, query.To)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if _, err = m.GetAccount(accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    counterparties, err := m.TopCounterparties(accountId, from, to, query.Limit)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(CounterpartiesResponse{accountId, from, to, counterparties})
+}
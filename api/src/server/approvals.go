@@ -0,0 +1,579 @@
+// Maker-checker approvals of the large transfers.
+//
+// A transfer requested with POST /v1/transfers for more than the approval threshold
+// is not performed at once: it becomes a pending approval which is approved or
+// rejected by a second principal, who can access the sender's account but is not the
+// initiator of the transfer. The transfer is made only when it is approved, with an
+// idempotency key derived from the approval, so a failed execution can be retried by
+// approving the transfer again. An approval which is not decided before it expires
+// cannot be approved anymore; the expired approvals are marked by a background job,
+// see RunApprovalExpiry. The other endpoints moving or reserving the funds, i.e. the
+// legacy transfers, the batches, the splits, the holds, the schedules, the ISO 20022
+// imports and the gRPC transfers, reject the amounts above the threshold, and so does
+// the scheduler for the schedules created before the threshold was lowered.
+//
+// The adjustments of the ledger found by the reconciliation are approved the same way,
+// by the operators only; see reconcile.go.
+//
+// Every change of an approval, with the principal making it, is recorded in the
+// approval's history.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+)
+
+// Statuses of the approvals. An approved transfer becomes executed once its payment
+// is created, or failed if the transfer is rejected.
+const (
+    approvalPending = "pending"
+    approvalApproved = "approved"
+    approvalRejected = "rejected"
+    approvalExpired = "expired"
+    approvalExecuted = "executed"
+    approvalFailed = "failed"
+)
+
+// Kinds of the approvals. An adjustment's sender and recipient are both the adjusted
+// account, and its amount is signed.
+const (
+    approvalTransfer = "transfer"
+    approvalAdjustment = "adjustment"
+)
+
+// approvalRequested is the action of the first record of an approval's history; the
+// other actions are the statuses set by the changes.
+const approvalRequested = "requested"
+
+const (
+    defaultApprovalTTL = 24*time.Hour
+    // approvalExpiryJob is the name of the approval expiry job's advisory lock.
+    approvalExpiryJob = "approval-expiry"
+    approvalExpiryInterval = time.Minute
+)
+
+// ApprovalManager keeps the transfers waiting for the approval.
+type ApprovalManager interface {
+    // RequestApproval records a pending approval of the transfer. If the approval has
+    // an idempotency key, it is requested at most once per sender and key.
+    RequestApproval(approval Approval) (*Approval, error)
+    GetApproval(id int) (*Approval, error)
+    // ListApprovals returns up to limit approvals with the status, oldest first. The
+    // approvals are filtered by the sender's accounts unless the accounts are nil.
+    ListApprovals(status string, accounts []string, limit int) ([]Approval, error)
+    // DecideApproval approves or rejects the pending approval on behalf of the
+    // principal, who should not be its initiator. Approving an approved transfer
+    // again returns it unchanged.
+    DecideApproval(id int, status, principal, reason string) (*Approval, error)
+    // CompleteApproval records the outcome of the approved transfer: its payment, if
+    // any, or the code and the message of the error it was rejected with.
+    CompleteApproval(id int, paymentId *int, errorCode, errorMessage string) (*Approval, error)
+    // ExpireApprovals marks the pending approvals expired at now as expired and
+    // returns their number.
+    ExpireApprovals(now time.Time) (int, error)
+    // GetApprovalHistory returns the changes of the approval, oldest first.
+    GetApprovalHistory(id int) ([]ApprovalEvent, error)
+}
+
+// Approval is a transfer or an adjustment waiting for the decision of a second principal.
+type Approval struct {
+    ID int                        `db:"approval_id" json:"id"`
+    Kind string                   `db:"kind" json:"kind"`
+    From string                   `db:"from_id" json:"from"`
+    To string                     `db:"to_id" json:"to"`
+    Amount Cents                  `db:"amount" json:"amount"`
+    Currency string               `db:"currency" json:"currency"`
+    // Pending makes the approved transfer create a pending payment.
+    Pending bool                  `db:"pending" json:"pending,omitempty"`
+    Status string                 `db:"status" json:"status"`
+    Initiator string              `db:"initiator" json:"initiator"`
+    DecidedBy string              `db:"decided_by" json:"decided_by,omitempty"`
+    Reason string                 `db:"reason" json:"reason,omitempty"`
+    PaymentID *int                `db:"payment_id" json:"payment_id,omitempty"`
+    ErrorCode string              `db:"error_code" json:"error_code,omitempty"`
+    Error string                  `db:"error" json:"error,omitempty"`
+    IdempotencyKey sql.NullString `db:"idempotency_key" json:"-"`
+    Created time.Time             `db:"created_on" json:"created"`
+    Expires time.Time             `db:"expires_at" json:"expires"`
+    Decided *time.Time            `db:"decided_at" json:"decided,omitempty"`
+    // PaymentDetails are given to the payment of the approved transfer.
+    PaymentDetails
+}
+
+// ApprovalEvent is a record of the approval's history.
+type ApprovalEvent struct {
+    ID int            `db:"event_id" json:"-"`
+    ApprovalID int    `db:"approval_id" json:"-"`
+    Action string     `db:"action" json:"action"`
+    Principal string  `db:"principal" json:"principal,omitempty"`
+    Reason string     `db:"reason" json:"reason,omitempty"`
+    Created time.Time `db:"created_at" json:"time"`
+}
+
+// effective returns the approval with the status it has at the moment now: a pending
+// approval is reported as expired as soon as it expires.
+func (a Approval) effective(now time.Time) Approval {
+    if a.Status == approvalPending && !a.Expires.After(now) {
+        a.Status = approvalExpired
+    }
+    return a
+}
+
+// idempotencyKey returns the key of the approved transfer, so the transfer is never
+// made twice, even if its execution is retried.
+func (a Approval) idempotencyKey() string {
+    return fmt.Sprintf("approval-%d", a.ID)
+}
+
+func approvalNotFound() managerError {
+    return inputError(codeNotFound, "approval is not found")
+}
+
+// checkDecision verifies that the principal can approve or reject the approval.
+func checkDecision(approval Approval, status, principal string, now time.Time) error {
+    if principal == approval.Initiator {
+        return inputError(codeForbidden, "the transfer should be decided by another principal")
+    }
+    current := approval.effective(now).Status
+    if current == approvalPending || current == approvalApproved && status == approvalApproved {
+        return nil
+    }
+    return inputError(codeInvalidState, "cannot decide on an approval which is " + current)
+}
+
+// checkThreshold rejects the amounts which should be approved with POST /v1/transfers.
+func (api *BillingAPI) checkThreshold(amount Cents) error {
+    if api.Config.ApprovalThreshold > 0 && amount > api.Config.ApprovalThreshold {
+        return inputError(codeApprovalRequired, fmt.Sprintf(
+            "cannot make a transaction: amounts above %d require an approval", int64(api.Config.ApprovalThreshold)))
+    }
+    return nil
+}
+
+func (m BillingManager) RequestApproval(approval Approval) (*Approval, error) {
+    if approval.IdempotencyKey.Valid {
+        if existing, err := m.findApproval(approval.From, approval.IdempotencyKey.String); err != nil || existing != nil {
+            return checkApprovalReplay(existing, approval, err)
+        }
+    }
+    accounts, err := m.GetAccounts([]string{approval.From, approval.To})
+    if err != nil {
+        return nil, internalError(err)
+    }
+    if approval.Kind == "" {
+        approval.Kind = approvalTransfer
+    }
+    from, to, ok := pickPair(accounts, approval.From, approval.To)
+    if approval.Kind == approvalAdjustment {
+        ok = len(accounts) == 1 && approval.From == approval.To
+        if ok {
+            from, to = accounts[0], accounts[0]
+        }
+    }
+    if !ok {
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if from.Currency != to.Currency {
+        return nil, inputError(codeCurrencyMismatch, "cannot transfer money between accounts with different currency")
+    }
+    approval.Currency, approval.Status = from.Currency, approvalPending
+
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO approval (kind, from_id, to_id, amount, currency, pending, status, initiator, idempotency_key,
+            created_on, expires_at, reference, unique_reference, memo, metadata)
+        VALUES (:kind, :from_id, :to_id, :amount, :currency, :pending, :status, :initiator, :idempotency_key,
+            :created_on, :expires_at, :reference, :unique_reference, :memo, :metadata)
+        RETURNING approval_id`)
+    if err == nil {
+        err = stmt.Get(&approval.ID, approval)
+    }
+    if err == nil {
+        err = recordApproval(tx, approval.ID, approvalRequested, approval.Initiator, "", approval.Created)
+    }
+    if err == nil {
+        err = m.audit(tx, "approval.requested", approvalResource(approval.ID), nil, &approval)
+    }
+    if err != nil {
+        mustRollback(tx)
+        if isUniqueViolation(err) && approval.IdempotencyKey.Valid {
+            // A concurrent request with the same key has won the race.
+            existing, err := m.findApproval(approval.From, approval.IdempotencyKey.String)
+            return checkApprovalReplay(existing, approval, err)
+        }
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &approval, nil
+}
+
+// findApproval returns the approval requested by the sender with the idempotency key,
+// or nil if there is no such approval.
+func (m BillingManager) findApproval(fromId, key string) (*Approval, error) {
+    var approvals []Approval
+    err := m.DB.Select(&approvals, "SELECT * FROM approval WHERE from_id = $1 AND idempotency_key = $2", fromId, key)
+    if err != nil || len(approvals) == 0 {
+        return nil, err
+    }
+    return &approvals[0], nil
+}
+
+// checkApprovalReplay verifies that the repeated request has the parameters of the
+// existing approval.
+func checkApprovalReplay(existing *Approval, requested Approval, err error) (*Approval, error) {
+    if err != nil {
+        return nil, internalError(err)
+    }
+    if existing.To != requested.To || existing.Amount != requested.Amount || existing.Pending != requested.Pending {
+        return nil, inputError(codeIdempotencyConflict, "idempotency key was already used with different parameters")
+    }
+    return existing, nil
+}
+
+// recordApproval appends the action to the approval's history.
+func recordApproval(tx *sqlx.Tx, approvalId int, action, principal, reason string, now time.Time) error {
+    _, err := tx.Exec(
+        "INSERT INTO approval_event (approval_id, action, principal, reason, created_at) VALUES ($1, $2, $3, $4, $5)",
+        approvalId, action, principal, reason, now)
+    return err
+}
+
+func (m BillingManager) GetApproval(id int) (*Approval, error) {
+    var approvals []Approval
+    if err := m.DB.Select(&approvals, "SELECT * FROM approval WHERE approval_id = $1", id); err != nil {
+        return nil, internalError(err)
+    }
+    if len(approvals) == 0 {
+        return nil, approvalNotFound()
+    }
+    approval := approvals[0].effective(time.Now().UTC())
+    return &approval, nil
+}
+
+func (m BillingManager) ListApprovals(status string, accounts []string, limit int) ([]Approval, error) {
+    now := time.Now().UTC()
+    // the pending approvals which have expired are not marked yet
+    condition := "status = $1 AND NOT (status = 'pending' AND expires_at <= $2)"
+    if status == approvalExpired {
+        condition = "(status = $1 OR status = 'pending' AND expires_at <= $2)"
+    }
+    var approvals []Approval
+    err := m.DB.Select(&approvals, `
+        SELECT * FROM approval
+        WHERE ` + condition + ` AND ($3::VARCHAR[] IS NULL OR from_id = any($3))
+        ORDER BY approval_id
+        LIMIT $4`, status, now, pq.Array(accounts), limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    for i := range approvals {
+        approvals[i] = approvals[i].effective(now)
+    }
+    return approvals, nil
+}
+
+func approvalResource(id int) string {
+    return "approval/" + strconv.Itoa(id)
+}
+
+// lockApproval selects the approval for update within the transaction tx.
+func lockApproval(tx *sqlx.Tx, id int) (*Approval, error) {
+    var approvals []Approval
+    if err := tx.Select(&approvals, "SELECT * FROM approval WHERE approval_id = $1 FOR UPDATE", id); err != nil {
+        return nil, err
+    }
+    if len(approvals) == 0 {
+        return nil, approvalNotFound()
+    }
+    return &approvals[0], nil
+}
+
+func (m BillingManager) DecideApproval(id int, status, principal, reason string) (*Approval, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    approval, err := lockApproval(tx, id)
+    if err == nil {
+        err = checkDecision(*approval, status, principal, now)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if approval.Status == status {
+        mustRollback(tx)
+        return approval, nil
+    }
+    before := *approval
+    approval.Status, approval.DecidedBy, approval.Reason, approval.Decided = status, principal, reason, &now
+    _, err = tx.NamedExec(`
+        UPDATE approval SET status = :status, decided_by = :decided_by, reason = :reason, decided_at = :decided_at
+        WHERE approval_id = :approval_id`, approval)
+    if err == nil {
+        err = recordApproval(tx, id, status, principal, reason, now)
+    }
+    if err == nil {
+        err = m.audit(tx, "approval." + status, approvalResource(id), &before, approval)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return approval, nil
+}
+
+func (m BillingManager) CompleteApproval(id int, paymentId *int, errorCode, errorMessage string) (*Approval, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    approval, err := lockApproval(tx, id)
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if approval.Status != approvalApproved {
+        // the outcome is already recorded by a concurrent execution
+        mustRollback(tx)
+        return approval, nil
+    }
+    before := *approval
+    approval.Status, approval.PaymentID = approvalExecuted, paymentId
+    if errorCode != "" {
+        approval.Status, approval.ErrorCode, approval.Error = approvalFailed, errorCode, errorMessage
+    }
+    _, err = tx.NamedExec(`
+        UPDATE approval SET status = :status, payment_id = :payment_id, error_code = :error_code, error = :error
+        WHERE approval_id = :approval_id`, approval)
+    if err == nil {
+        err = recordApproval(tx, id, approval.Status, "", errorMessage, time.Now().UTC())
+    }
+    if err == nil {
+        err = m.audit(tx, "approval." + approval.Status, approvalResource(id), &before, approval)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return approval, nil
+}
+
+func (m BillingManager) ExpireApprovals(now time.Time) (int, error) {
+    result, err := m.DB.Exec(`
+        WITH expired AS (
+            UPDATE approval SET status = $1
+            WHERE status = $2 AND expires_at <= $3
+            RETURNING approval_id, expires_at)
+        INSERT INTO approval_event (approval_id, action, principal, reason, created_at)
+        SELECT approval_id, $1, '', '', expires_at FROM expired`, approvalExpired, approvalPending, now)
+    if err != nil {
+        return 0, internalError(err)
+    }
+    n, _ := result.RowsAffected()
+    return int(n), nil
+}
+
+func (m BillingManager) GetApprovalHistory(id int) ([]ApprovalEvent, error) {
+    var history []ApprovalEvent
+    err := m.DB.Select(&history, "SELECT * FROM approval_event WHERE approval_id = $1 ORDER BY event_id", id)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return history, nil
+}
+
+// RunApprovalExpiry periodically marks the expired approvals using the shared Manager
+// until the context is cancelled, while the instance leads the approval expiry job.
+func (api *BillingAPI) RunApprovalExpiry(ctx context.Context) {
+    api.runLeader(ctx, approvalExpiryJob, approvalExpiryInterval, func(m Manager) error {
+        _, err := m.ExpireApprovals(time.Now().UTC())
+        return err
+    })
+}
+
+// requestApproval queues the transfer above the approval threshold.
+func (api *BillingAPI) requestApproval(m Manager, req *http.Request, body TransferRequest, key string) (*Approval, error) {
+    now := time.Now().UTC()
+    return m.RequestApproval(Approval{
+        Kind:approvalTransfer,
+        From:body.From,
+        To:body.To,
+        Amount:body.Amount,
+        Pending:body.Pending,
+        Initiator:PrincipalFrom(req.Context()).Name,
+        IdempotencyKey:nullString(key),
+        PaymentDetails:body.PaymentDetails,
+        Created:now,
+        Expires:now.Add(api.approvalTTL())})
+}
+
+// approvalTTL returns the time to decide on an approval.
+func (api *BillingAPI) approvalTTL() time.Duration {
+    if api.Config.ApprovalTTL == 0 {
+        return defaultApprovalTTL
+    }
+    return api.Config.ApprovalTTL
+}
+
+// execute makes the approved transfer, or records the approved adjustment, and records
+// its outcome. An execution which fails because of an internal error is not recorded,
+// so it can be retried.
+func (api *BillingAPI) execute(m Manager, approval *Approval) (*Approval, error) {
+    var paymentId *int
+    var err error
+    if approval.Kind == approvalAdjustment {
+        _, err = m.RecordAdjustment(*approval)
+    } else {
+        transfer := m.Transfer
+        if approval.Pending {
+            transfer = m.TransferPending
+        }
+        var payment *Payment
+        if payment, err = transfer(approval.From, approval.To, approval.Amount, approval.idempotencyKey(), approval.PaymentDetails); err == nil {
+            paymentId = &payment.ID
+        }
+    }
+    if err != nil {
+        e, ok := err.(managerError)
+        if !ok || e.internal {
+            return nil, err
+        }
+        return m.CompleteApproval(approval.ID, nil, e.code, e.message)
+    }
+    return m.CompleteApproval(approval.ID, paymentId, "", "")
+}
+
+// listApprovals returns the approval queue: the oldest approvals with the status,
+// pending by default. The clients see the approvals of their accounts only.
+func (api *BillingAPI) listApprovals(m Manager, resp *Responder, req *http.Request) {
+    query := ApprovalQuery{Status:approvalPending, Limit:defaultPageSize}
+    if err := decodeQuery(req, &query); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var accounts []string
+    if principal := PrincipalFrom(req.Context()); principal.Role != RoleOperator {
+        accounts = append(make([]string, 0), principal.Accounts...)
+    }
+    approvals, err := m.ListApprovals(query.Status, accounts, query.Limit)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if approvals == nil {
+        approvals = make([]Approval, 0)
+    }
+    resp.SendSuccess(ApprovalListResponse{approvals})
+}
+
+// getApproval returns the approval identified by the path parameter.
+func (api *BillingAPI) getApproval(m Manager, resp *Responder, req *http.Request) {
+    approval, err := accessibleApproval(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ApprovalResponse{approval})
+}
+
+// approve approves the transfer and makes it. The approver should not be the
+// initiator of the transfer.
+//
+// Example of possible request's body:
+//
+//     {"reason": "checked with the customer"}
+func (api *BillingAPI) approve(m Manager, resp *Responder, req *http.Request) {
+    api.decide(m, resp, req, approvalApproved)
+}
+
+// reject rejects the transfer.
+//
+// Example of possible request's body:
+//
+//     {"reason": "unknown recipient"}
+func (api *BillingAPI) reject(m Manager, resp *Responder, req *http.Request) {
+    api.decide(m, resp, req, approvalRejected)
+}
+
+// decide records the decision of the caller, and executes the approved transfer. The
+// adjustments are decided by the operators only.
+func (api *BillingAPI) decide(m Manager, resp *Responder, req *http.Request, status string) {
+    var body DecisionRequest
+    if req.ContentLength != 0 {
+        if err := decodeRequest(resp, req, &body); err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+    }
+    approval, err := accessibleApproval(m, req)
+    if err == nil && approval.Kind == approvalAdjustment {
+        err = requireOperator(req.Context())
+    }
+    if err == nil {
+        approval, err = m.DecideApproval(approval.ID, status, PrincipalFrom(req.Context()).Name, body.Reason)
+    }
+    if err == nil && approval.Status == approvalApproved {
+        approval, err = api.execute(m, approval)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ApprovalResponse{approval})
+}
+
+// approvalHistory returns the changes of the approval with the principals who made them.
+func (api *BillingAPI) approvalHistory(m Manager, resp *Responder, req *http.Request) {
+    approval, err := accessibleApproval(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    history, err := m.GetApprovalHistory(approval.ID)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if history == nil {
+        history = make([]ApprovalEvent, 0)
+    }
+    resp.SendSuccess(ApprovalHistoryResponse{approval.ID, approval.Status, history})
+}
+
+// accessibleApproval returns the approval identified by the path parameter if the
+// caller can access its sender's account.
+func accessibleApproval(m Manager, req *http.Request) (*Approval, error) {
+    id, err := pathID(req, "id")
+    if err != nil {
+        return nil, err
+    }
+    approval, err := m.GetApproval(id)
+    if err != nil {
+        return nil, err
+    }
+    if err := authorize(req.Context(), approval.From); err != nil {
+        return nil, err
+    }
+    return approval, nil
+}
@@ -0,0 +1,331 @@
+// Tamper-evident audit log of the mutating actions.
+//
+// Every action changing the payments, the accounts, the limits, the fees, the holds,
+// the schedules, the approvals, the ledger, the receipt keys or the webhooks is
+// appended to the audit log with the principal who made it, the ID of the request,
+// and the values of the changed resource before and after the change. The actions
+// made by the background jobs are recorded with the job's name as the actor, and the
+// receipt key published by the server at the start is recorded without an actor. The
+// bookkeeping of the webhook deliveries and the balance snapshots, and the expiry of
+// the holds and the approvals are not audited.
+//
+// The entries are hash-chained: the hash of an entry covers its fields and the hash
+// of the previous entry, and the entries are numbered without gaps, so an edited,
+// inserted or deleted entry breaks the chain. The verification walks the chain from
+// the first entry and reports the first broken link; the removal of the newest
+// entries is detected by comparing the reported head with a previously saved one.
+//
+// The entry is appended within the transaction of the change, so the change is
+// committed together with its entry or not at all; an entry which cannot be appended
+// fails the change. The application's database role can only read and append the
+// entries, so the log cannot be rewritten through it, see db/init.sql.
+package server
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "reflect"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+const (
+    // auditLockKey is the key of the advisory lock serializing the appends to the chain.
+    auditLockKey = 4242
+    maxRequestIDLength = 64
+)
+
+// AuditLog keeps the hash-chained audit entries.
+type AuditLog interface {
+    // AppendAudit links the entry to the end of the chain and stores it.
+    AppendAudit(entry AuditEntry) (*AuditEntry, error)
+    // Audited returns the manager recording its changes in the log on behalf of the
+    // actor, with the ID of the request which made them.
+    Audited(actor, requestId string) Manager
+    // ListAudit returns a page of the entries, newest first.
+    ListAudit(page PageRequest) ([]AuditEntry, error)
+    // VerifyAudit walks the chain from the first entry and reports the first broken link.
+    VerifyAudit() (*AuditReport, error)
+}
+
+// AuditEntry is a record of the audit log. The Before and After values are JSON
+// documents, empty if the resource didn't exist before or after the action.
+type AuditEntry struct {
+    Seq int          `db:"seq"`
+    Time time.Time   `db:"created_at"`
+    Actor string     `db:"actor"`
+    RequestID string `db:"request_id"`
+    Action string    `db:"action"`
+    Resource string  `db:"resource"`
+    Before string    `db:"before_value"`
+    After string     `db:"after_value"`
+    PrevHash string  `db:"prev_hash"`
+    Hash string      `db:"hash"`
+}
+
+// AuditReport is the result of the chain's verification. The Head is the newest
+// verified entry; the Broken link is reported if the chain is not Valid.
+type AuditReport struct {
+    Valid bool         `json:"valid"`
+    Checked int        `json:"checked"`
+    Head *AuditLink    `json:"head,omitempty"`
+    Broken *AuditBreak `json:"broken,omitempty"`
+}
+
+// AuditLink identifies an entry of the chain.
+type AuditLink struct {
+    Seq int     `json:"seq"`
+    Hash string `json:"hash"`
+}
+
+// AuditBreak describes the first entry which doesn't fit the chain.
+type AuditBreak struct {
+    Seq int       `json:"seq"`
+    Reason string `json:"reason"`
+}
+
+// digest returns the hash of the entry's fields and the previous entry's hash.
+func (e AuditEntry) digest() string {
+    fields, _ := json.Marshal([]interface{}{
+        e.Seq, e.Time.UTC().Format(time.RFC3339Nano), e.Actor, e.RequestID, e.Action, e.Resource,
+        e.Before, e.After, e.PrevHash})
+    sum := sha256.Sum256(fields)
+    return hex.EncodeToString(sum[:])
+}
+
+// link makes the entry the next one after the previous entry, which is nil for the
+// first entry of the chain. The time is truncated to the precision of the database.
+func (e AuditEntry) link(prev *AuditEntry) AuditEntry {
+    e.Seq, e.PrevHash = 1, ""
+    if prev != nil {
+        e.Seq, e.PrevHash = prev.Seq + 1, prev.Hash
+    }
+    e.Time = e.Time.UTC().Truncate(time.Microsecond)
+    e.Hash = e.digest()
+    return e
+}
+
+// auditChain verifies the entries one by one, from the oldest to the newest.
+type auditChain struct {
+    report AuditReport
+    prev *AuditEntry
+}
+
+func newAuditChain() *auditChain {
+    return &auditChain{report:AuditReport{Valid:true}}
+}
+
+// next checks that the entry follows the previous one, and returns false when the
+// chain is broken.
+func (c *auditChain) next(entry AuditEntry) bool {
+    expected := entry.link(c.prev)
+    reason := ""
+    switch {
+    case entry.Seq != expected.Seq:
+        reason = fmt.Sprintf("entry %d was expected", expected.Seq)
+    case entry.PrevHash != expected.PrevHash:
+        reason = "the previous hash doesn't match"
+    case entry.Hash != expected.Hash:
+        reason = "the hash doesn't match the entry"
+    }
+    if reason != "" {
+        c.report.Valid = false
+        c.report.Broken = &AuditBreak{Seq:entry.Seq, Reason:reason}
+        return false
+    }
+    c.prev = &entry
+    c.report.Checked++
+    c.report.Head = &AuditLink{Seq:entry.Seq, Hash:entry.Hash}
+    return true
+}
+
+func (m BillingManager) AppendAudit(entry AuditEntry) (*AuditEntry, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    appended, err := appendAudit(tx, entry)
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return appended, nil
+}
+
+// appendAudit links the entry to the end of the chain and stores it within the
+// transaction tx. The advisory lock serializes the appends until the transaction ends,
+// so it is taken after the other locks of the transaction.
+func appendAudit(tx *sqlx.Tx, entry AuditEntry) (*AuditEntry, error) {
+    var last []AuditEntry
+    _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", auditLockKey)
+    if err == nil {
+        err = tx.Select(&last, "SELECT * FROM audit_log ORDER BY seq DESC LIMIT 1")
+    }
+    if err != nil {
+        return nil, err
+    }
+    var prev *AuditEntry
+    if len(last) > 0 {
+        prev = &last[0]
+    }
+    entry = entry.link(prev)
+    _, err = tx.NamedExec(`
+        INSERT INTO audit_log (seq, created_at, actor, request_id, action, resource, before_value, after_value,
+            prev_hash, hash)
+        VALUES (:seq, :created_at, :actor, :request_id, :action, :resource, :before_value, :after_value,
+            :prev_hash, :hash)`, entry)
+    if err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
+
+// Audited returns a copy of the manager recording its changes on behalf of the actor.
+func (m BillingManager) Audited(actor, requestId string) Manager {
+    m.actor, m.requestId = actor, requestId
+    return m
+}
+
+// audit appends the action to the audit log within the transaction tx of the change,
+// so the entry is committed or rolled back together with the change.
+func (m BillingManager) audit(tx *sqlx.Tx, action, resource string, before, after interface{}) error {
+    _, err := appendAudit(tx, newAuditEntry(m.actor, m.requestId, action, resource, before, after))
+    return err
+}
+
+func (m BillingManager) ListAudit(page PageRequest) ([]AuditEntry, error) {
+    before := page.Before
+    if before <= 0 {
+        before = math.MaxInt32
+    }
+    var entries []AuditEntry
+    err := m.DB.Select(&entries, "SELECT * FROM audit_log WHERE seq < $1 ORDER BY seq DESC LIMIT $2", before, page.Limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return entries, nil
+}
+
+// VerifyAudit streams the entries, so the whole log is never loaded into the memory.
+func (m BillingManager) VerifyAudit() (*AuditReport, error) {
+    rows, err := m.DB.Queryx("SELECT * FROM audit_log ORDER BY seq")
+    if err != nil {
+        return nil, internalError(err)
+    }
+    defer rows.Close()
+    chain := newAuditChain()
+    for rows.Next() {
+        var entry AuditEntry
+        if err := rows.StructScan(&entry); err != nil {
+            return nil, internalError(err)
+        }
+        if !chain.next(entry) {
+            break
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, internalError(err)
+    }
+    return &chain.report, nil
+}
+
+// newRequestID generates a random ID for a request which doesn't have one.
+func newRequestID() string {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        panic(fmt.Sprintf("cannot generate a request ID: %s", err))
+    }
+    return hex.EncodeToString(buf)
+}
+
+// requestID returns the X-Request-ID header of the request, or a generated ID if the
+// header is missing or too long.
+func requestID(req *http.Request) string {
+    if id := req.Header.Get("X-Request-ID"); id != "" && len(id) <= maxRequestIDLength {
+        return id
+    }
+    return newRequestID()
+}
+
+// listAudit returns the audit entries page by page, starting from the newest one.
+// The next_cursor field is empty when there are no more pages.
+func (api *BillingAPI) listAudit(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    page, err := parsePage(req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    limit := page.Limit
+    page.Limit++ // fetch one extra item to find out if there is a next page
+    entries, err := m.ListAudit(page)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    next := ""
+    if len(entries) > limit {
+        entries = entries[:limit]
+        next = strconv.Itoa(entries[limit-1].Seq)
+    }
+    result := make([]AuditView, 0, len(entries))
+    for _, entry := range entries {
+        result = append(result, newAuditView(entry))
+    }
+    resp.SendSuccess(AuditPageResponse{result, next})
+}
+
+// verifyAudit walks the audit chain and reports the first broken link.
+func (api *BillingAPI) verifyAudit(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    report, err := m.VerifyAudit()
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(AuditReportResponse{report})
+}
+
+// newAuditEntry returns the entry of the action with the JSON documents of the values
+// before and after it; the nil values are recorded as empty.
+func newAuditEntry(actor, requestId, action, resource string, before, after interface{}) AuditEntry {
+    return AuditEntry{
+        Time:time.Now().UTC(),
+        Actor:actor,
+        RequestID:requestId,
+        Action:action,
+        Resource:resource,
+        Before:auditValue(before),
+        After:auditValue(after)}
+}
+
+func auditValue(value interface{}) string {
+    if v := reflect.ValueOf(value); !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+        return ""
+    }
+    encoded, err := json.Marshal(value)
+    if err != nil {
+        return ""
+    }
+    return string(encoded)
+}
+
+func paymentResource(id int) string {
+    return "payment/" + strconv.Itoa(id)
+}
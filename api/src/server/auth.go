@@ -0,0 +1,167 @@
+// Authentication and authorization of the API callers.
+//
+// The callers present a bearer token which is mapped to a Principal. The mapping is
+// configured with Config.Tokens; if no tokens are configured, the authentication is
+// disabled and every caller acts as an anonymous operator. A context without a
+// principal, e.g. of a public path, has no access. The same Authenticator is used by
+// the HTTP and gRPC servers.
+package server
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+// Roles of the principals.
+const (
+    // RoleClient can access only the accounts listed in the Principal.Accounts.
+    RoleClient = "client"
+    // RoleOperator can access every account.
+    RoleOperator = "operator"
+)
+
+// Principal is an authenticated caller of the API.
+type Principal struct {
+    Name string
+    Role string
+    Accounts []string
+}
+
+var (
+    // anonymous is every caller when the authentication is disabled.
+    anonymous = &Principal{Name:"anonymous", Role:RoleOperator}
+    // nobody has no access; it is the caller of a context without a principal, e.g. of
+    // a public path.
+    nobody = &Principal{}
+)
+
+// CanAccess checks if the principal is allowed to read and to move funds from the
+// account.
+func (p *Principal) CanAccess(accountId string) bool {
+    if p.Role == RoleOperator {
+        return true
+    }
+    for _, acc := range p.Accounts {
+        if acc == accountId {
+            return true
+        }
+    }
+    return false
+}
+
+// ParseTokens reads the tokens configuration from a string like:
+//
+//     token1:alice:client:first|second,token2:bob:operator
+//
+// Every comma-separated entry contains a token, a principal's name, a role and,
+// for the clients, a list of accessible accounts separated with pipes.
+func ParseTokens(spec string) (map[string]Principal, error) {
+    tokens := make(map[string]Principal)
+    for _, entry := range strings.Split(spec, ",") {
+        if entry = strings.TrimSpace(entry); entry == "" {
+            continue
+        }
+        parts := strings.Split(entry, ":")
+        if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+            return nil, fmt.Errorf("invalid token entry: %q", entry)
+        }
+        principal := Principal{Name:parts[1], Role:parts[2]}
+        if principal.Role != RoleClient && principal.Role != RoleOperator {
+            return nil, fmt.Errorf("unknown role of %s: %q", principal.Name, principal.Role)
+        }
+        if len(parts) == 4 {
+            principal.Accounts = strings.Split(parts[3], "|")
+        }
+        tokens[parts[0]] = principal
+    }
+    return tokens, nil
+}
+
+// Authenticator maps the tokens to principals.
+type Authenticator struct {
+    Tokens map[string]Principal
+}
+
+// Authenticate returns the principal presenting the token.
+func (a Authenticator) Authenticate(token string) (*Principal, error) {
+    if len(a.Tokens) == 0 {
+        return anonymous, nil
+    }
+    if token == "" {
+        return nil, inputError(codeUnauthorized, "authentication is required")
+    }
+    principal, ok := a.Tokens[token]
+    if !ok {
+        return nil, inputError(codeUnauthorized, "invalid token")
+    }
+    return &principal, nil
+}
+
+// Middleware authenticates the HTTP requests and stores the principal in the request's
+// context. The public paths are served without authentication.
+func (a Authenticator) Middleware(next http.Handler, public ...string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        for _, path := range public {
+            if req.URL.Path == path {
+                next.ServeHTTP(w, req)
+                return
+            }
+        }
+        token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+        principal, err := a.Authenticate(token)
+        if err != nil {
+            resp := NewJSONResponse(w)
+            writeManagerError(err, &resp)
+            return
+        }
+        next.ServeHTTP(w, req.WithContext(withPrincipal(req.Context(), principal)))
+    })
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+    return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal stored in the context by the authentication
+// layer. If there is no principal, the one without access is returned.
+func PrincipalFrom(ctx context.Context) *Principal {
+    if principal, ok := ctx.Value(principalKey{}).(*Principal); ok {
+        return principal
+    }
+    return nobody
+}
+
+// authorize checks if the caller can access every account from the list.
+func authorize(ctx context.Context, accountIds ...string) error {
+    principal := PrincipalFrom(ctx)
+    for _, id := range accountIds {
+        if !principal.CanAccess(id) {
+            return inputError(codeForbidden, fmt.Sprintf("access to account %s is denied", id))
+        }
+    }
+    return nil
+}
+
+// requireOperator checks if the caller has the operator role.
+func requireOperator(ctx context.Context) error {
+    if PrincipalFrom(ctx).Role != RoleOperator {
+        return inputError(codeForbidden, "the operation is allowed to operators only")
+    }
+    return nil
+}
+
+// accessible filters out the accounts the caller cannot access.
+func accessible(ctx context.Context, accounts []Account) []Account {
+    principal := PrincipalFrom(ctx)
+    result := make([]Account, 0, len(accounts))
+    for _, acc := range accounts {
+        if principal.CanAccess(acc.Identifier) {
+            result = append(result, acc)
+        }
+    }
+    return result
+}
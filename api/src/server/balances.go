@@ -0,0 +1,169 @@
+// Point-in-time balances.
+//
+// The balance of an account at a past time is computed from the payment history: it
+// is the balance after the payments booked before that time, the same balance which
+// opens the account's statement starting then. To keep the computation cheap for any
+// time, the snapshot job records the balance of every account at the start of every
+// UTC day. The balance at a time is the balance of the latest snapshot taken before
+// it plus the payments booked since the snapshot, so at most a day of payments is
+// summed up; the times before the first snapshot are computed back from the current
+// balance.
+//
+// The snapshot of a day is taken an hour after the day starts, when the transactions
+// which booked payments before the midnight are surely committed. A snapshot is never
+// changed, and a day which was missed, e.g. while the service was down, has no
+// snapshot: the earlier snapshot is used for it.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "time"
+)
+
+const (
+    // snapshotJob is the name of the snapshot job's advisory lock.
+    snapshotJob = "balance-snapshot"
+    snapshotInterval = time.Hour
+    snapshotDelay = time.Hour
+    snapshotBatchSize = 500
+)
+
+// BalanceManager computes the historical balances.
+type BalanceManager interface {
+    // BalanceAt returns the balance of the account after the payments booked before
+    // the time at.
+    BalanceAt(accountId string, at time.Time) (*HistoricalBalance, error)
+    // SnapshotBalances records the balances at the start of the day of up to limit
+    // accounts which don't have the snapshot of the day yet, and returns the number of
+    // the recorded snapshots.
+    SnapshotBalances(day time.Time, limit int) (int, error)
+}
+
+// HistoricalBalance is the balance of an account at a time. The Snapshot is the day
+// of the snapshot the balance was computed from, if any.
+type HistoricalBalance struct {
+    Account string
+    Currency string
+    At time.Time
+    Amount Cents
+    Snapshot *time.Time
+}
+
+// BalanceAt reads the snapshot and the payments in a read-only transaction with the
+// repeatable read isolation, so the current balance is consistent with the payments
+// when there is no snapshot.
+func (m BillingManager) BalanceAt(accountId string, at time.Time) (*HistoricalBalance, error) {
+    tx, err := m.DB.BeginTxx(context.Background(), &sql.TxOptions{Isolation:sql.LevelRepeatableRead, ReadOnly:true})
+    if err != nil {
+        return nil, internalError(err)
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    var accounts []Account
+    if err = tx.Select(&accounts, accountQuery + " WHERE a.identifier = $2", time.Now().UTC(), accountId); err != nil {
+        return nil, internalError(err)
+    }
+    if len(accounts) == 0 {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    balance := &HistoricalBalance{Account:accountId, Currency:accounts[0].Currency, At:at}
+
+    var snapshots []struct {
+        Day time.Time `db:"day"`
+        Amount Cents  `db:"amount"`
+    }
+    err = tx.Select(&snapshots, `
+        SELECT day, amount FROM balance_snapshot
+        WHERE account_id = $1 AND day <= $2
+        ORDER BY day DESC
+        LIMIT 1`, accountId, at)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    net := `SELECT COALESCE(SUM(CASE WHEN p.to_id = $1 THEN p.amount ELSE -p.amount END), 0)` + bookedPayments
+    if len(snapshots) == 0 {
+        var since Cents
+        if err = tx.Get(&since, net, accountId, at); err != nil {
+            return nil, internalError(err)
+        }
+        balance.Amount = accounts[0].Amount - since
+        return balance, nil
+    }
+    var booked Cents
+    if err = tx.Get(&booked, net + " AND s.changed_at < $3", accountId, snapshots[0].Day, at); err != nil {
+        return nil, internalError(err)
+    }
+    day := snapshots[0].Day.UTC()
+    balance.Amount, balance.Snapshot = snapshots[0].Amount + booked, &day
+    return balance, nil
+}
+
+// SnapshotBalances computes the balances with a single statement, which sees the
+// balances and the payments consistent with each other.
+func (m BillingManager) SnapshotBalances(day time.Time, limit int) (int, error) {
+    day = dayStart(day)
+    result, err := m.DB.Exec(`
+        INSERT INTO balance_snapshot (account_id, day, amount, taken_at)
+        SELECT a.identifier, $1, a.amount - COALESCE((
+            SELECT SUM(CASE WHEN p.to_id = a.identifier THEN p.amount ELSE -p.amount END)
+            FROM payment p
+            JOIN payment_status s ON s.payment_id = p.payment_id AND s.status = 'completed'
+            WHERE (p.from_id = a.identifier OR p.to_id = a.identifier) AND p.kind <> 'split' AND s.changed_at >= $1
+        ), 0), $2
+        FROM account a
+        WHERE NOT EXISTS (SELECT 1 FROM balance_snapshot b WHERE b.account_id = a.identifier AND b.day = $1)
+        ORDER BY a.identifier
+        LIMIT $3
+        ON CONFLICT DO NOTHING`, day, time.Now().UTC(), limit)
+    if err != nil {
+        return 0, internalError(err)
+    }
+    recorded, _ := result.RowsAffected()
+    return int(recorded), nil
+}
+
+// RunBalanceSnapshots takes the daily balance snapshots using the shared Manager
+// until the context is cancelled, while the instance leads the snapshot job.
+func (api *BillingAPI) RunBalanceSnapshots(ctx context.Context) {
+    api.runLeader(ctx, snapshotJob, snapshotInterval, func(m Manager) error {
+        day := time.Now().UTC().Add(-snapshotDelay)
+        for {
+            recorded, err := m.SnapshotBalances(day, snapshotBatchSize)
+            if err != nil || recorded < snapshotBatchSize {
+                return err
+            }
+        }
+    })
+}
+
+// accountBalance returns the balance of the account at the time given by the at
+// parameter, or the current one.
+func (api *BillingAPI) accountBalance(m Manager, resp *Responder, req *http.Request) {
+    accountId := req.PathValue("id")
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var query BalanceQuery
+    if err := decodeQuery(req, &query); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    now := time.Now().UTC()
+    at := query.At.UTC()
+    switch {
+    case query.At.IsZero():
+        at = now
+    case at.After(now):
+        writeManagerError(validationError([]FieldError{{"at", "should not be in the future"}}), resp)
+        return
+    }
+    balance, err := m.BalanceAt(accountId, at)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(newBalanceResponse(*balance))
+}
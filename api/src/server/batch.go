@@ -0,0 +1,281 @@
+// Batch transfers.
+//
+// A batch moves funds with many transfers at once, e.g. for payrolls and payouts. In
+// the all-or-nothing mode the whole batch is made in a single transaction: if any
+// transfer cannot be made, none is. In the best-effort mode every transfer is made
+// separately, and the result of each one is reported.
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// Modes of the batch transfers.
+const (
+    batchAllOrNothing = "all_or_nothing"
+    batchBestEffort = "best_effort"
+)
+
+// BatchTransfer is a single transfer of a batch. The idempotency key and the details
+// are optional.
+type BatchTransfer struct {
+    From string
+    To string
+    Amount Cents
+    IdempotencyKey string
+    Details PaymentDetails
+}
+
+// BatchResult is the outcome of a single transfer of a batch: either the created
+// payment or the error code with its description.
+type BatchResult struct {
+    Payment *Payment `json:"payment,omitempty"`
+    Code string      `json:"code,omitempty"`
+    Error string     `json:"error,omitempty"`
+}
+
+// batchResult converts the outcome of a transfer into the batch's result.
+func batchResult(payment *Payment, err error) BatchResult {
+    if err == nil {
+        return BatchResult{Payment:payment}
+    }
+    e := internalError(err)
+    if e.internal {
+        return BatchResult{Code:e.code, Error:"internal error"}
+    }
+    return BatchResult{Code:e.code, Error:e.message}
+}
+
+// batchError reports the failed transfer of an all-or-nothing batch.
+func batchError(index int, err error) error {
+    e := internalError(err)
+    if !e.internal {
+        e.message = fmt.Sprintf("transfers[%d]: %s", index, e.message)
+    }
+    return e
+}
+
+// transferEach makes the transfers of a best-effort batch one by one.
+func transferEach(
+    transfer func(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error),
+    transfers []BatchTransfer,
+) []BatchResult {
+    results := make([]BatchResult, len(transfers))
+    for i, t := range transfers {
+        results[i] = batchResult(transfer(t.From, t.To, t.Amount, t.IdempotencyKey, t.Details))
+    }
+    return results
+}
+
+// TransferBatch makes the transfers of the batch. If atomic is true, all transfers
+// are made in a single transaction, and the error of the first transfer which cannot
+// be made is returned. Otherwise, the result of every transfer is reported.
+//
+// The atomic batch locks the rows of all involved accounts at once, in the order of
+// the identifiers, so the concurrent batches and transfers cannot deadlock. The
+// transfers of the batch see the balances changed by the preceding ones and their
+// fees. If the batch was already made with the same idempotency keys, the original
+// payments are returned.
+func (m BillingManager) TransferBatch(transfers []BatchTransfer, atomic bool) ([]BatchResult, error) {
+    if !atomic {
+        return transferEach(m.Transfer, transfers), nil
+    }
+    if results, err := m.replayBatch(transfers); err != nil || results != nil {
+        return results, err
+    }
+    results, err := m.transferAll(transfers)
+    if err != nil && isUniqueViolation(err) {
+        // A concurrent request with the same keys has won the race.
+        if results, _ := m.replayBatch(transfers); results != nil {
+            return results, nil
+        }
+    }
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return results, nil
+}
+
+func (m BillingManager) transferAll(transfers []BatchTransfer) ([]BatchResult, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    schedules, err := listFeeSchedules(tx)
+    if err != nil {
+        mustRollback(tx)
+        return nil, err
+    }
+    pairs := make([][2]string, len(transfers))
+    for i, t := range transfers {
+        pairs[i] = [2]string{t.From, t.To}
+    }
+    now := time.Now().UTC()
+    locked, err := lockWithFees(tx, schedules, pairs, now)
+    if err != nil {
+        mustRollback(tx)
+        return nil, err
+    }
+    accounts := accountMap(locked)
+
+    limits := make(batchLimits)
+    results := make([]BatchResult, len(transfers))
+    for i, t := range transfers {
+        from, to := accounts[t.From], accounts[t.To]
+        var payment *Payment
+        switch {
+        case from == nil || to == nil || t.From == t.To:
+            err = inputError(codeAccountNotFound, "cannot find the accounts")
+        case from.Currency != to.Currency:
+            err = inputError(codeCurrencyMismatch, "cannot transfer money between accounts with different currency")
+        case from.Available() < t.Amount:
+            err = inputError(codeInsufficientFunds, "cannot make a transaction: insufficient funds")
+        default:
+            err = limits.check(tx, *from, t.Amount, now)
+        }
+        if err == nil {
+            err = checkReference(tx, t.From, t.Details)
+        }
+        if err == nil {
+            payment, err = move(tx, *from, *to, Payment{
+                Time:now,
+                Amount:t.Amount,
+                Kind:paymentTransfer,
+                IdempotencyKey:nullString(t.IdempotencyKey),
+                PaymentDetails:t.Details})
+        }
+        if err == nil {
+            fees := transferFees(schedules, *from, *to, t.Amount)
+            from.Amount -= t.Amount
+            to.Amount += t.Amount
+            err = chargeFees(tx, accounts, payment, fees, now)
+        }
+        if err != nil {
+            mustRollback(tx)
+            if isUniqueViolation(err) {
+                return nil, err
+            }
+            return nil, batchError(i, err)
+        }
+        results[i] = BatchResult{Payment:payment}
+    }
+    for _, result := range results {
+        if err = m.audit(tx, "payment.created", paymentResource(result.Payment.ID), nil, result.Payment); err != nil {
+            mustRollback(tx)
+            return nil, internalError(err)
+        }
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return results, nil
+}
+
+// replayBatch returns the payments of an atomic batch which was already made with
+// the same idempotency keys. Nil is returned if none of the keys was used. Since the
+// transfers of an atomic batch are committed together, a batch can be replayed only
+// if all of its transfers have keys.
+func (m BillingManager) replayBatch(transfers []BatchTransfer) ([]BatchResult, error) {
+    results := make([]BatchResult, len(transfers))
+    found := 0
+    for i, t := range transfers {
+        if t.IdempotencyKey == "" {
+            continue
+        }
+        payment, err := m.findIdempotent(t.From, t.IdempotencyKey)
+        if err != nil {
+            return nil, err
+        }
+        if payment != nil {
+            if payment, err = m.withFees(checkReplay(payment, t.To, t.Amount)); err != nil {
+                return nil, batchError(i, err)
+            }
+            results[i] = BatchResult{Payment:payment}
+            found++
+        }
+    }
+    if found == 0 {
+        return nil, nil
+    }
+    if found != len(transfers) {
+        return nil, inputError(codeIdempotencyConflict, "idempotency keys were already used with a different batch")
+    }
+    return results, nil
+}
+
+// check rejects the transfers reusing the idempotency key of a preceding transfer
+// from the same account, since a batch cannot be a replay of itself.
+func (r BatchRequest) check() error {
+    var errs []FieldError
+    seen := make(map[[2]string]bool)
+    for i, item := range r.Transfers {
+        if item.IdempotencyKey == "" {
+            continue
+        }
+        key := [2]string{item.From, item.IdempotencyKey}
+        if seen[key] {
+            errs = append(errs, FieldError{fmt.Sprintf("transfers[%d].idempotency_key", i), "is used by another transfer from the account"})
+        }
+        seen[key] = true
+    }
+    if len(errs) > 0 {
+        return validationError(errs)
+    }
+    return nil
+}
+
+// createBatch makes many transfers at once.
+//
+// Example of possible request's body:
+//
+//     {"mode": "best_effort", "transfers": [
+//         {"from": "account_1", "to": "account_2", "amount": 1000,
+//          "idempotency_key": "payroll-7-1"},
+//         {"from": "account_1", "to": "account_3", "amount": 2000,
+//          "idempotency_key": "payroll-7-2"}]}
+//
+// The all-or-nothing mode is used by default. The caller should have access to the
+// senders' accounts of all transfers, and the transfers above the approval threshold
+// are rejected.
+func (api *BillingAPI) createBatch(m Manager, resp *Responder, req *http.Request) {
+    var body BatchRequest
+    err := decodeRequest(resp, req, &body)
+    if err == nil {
+        err = body.check()
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if body.Mode == "" {
+        body.Mode = batchAllOrNothing
+    }
+    transfers := make([]BatchTransfer, len(body.Transfers))
+    for i, item := range body.Transfers {
+        err := authorize(req.Context(), item.From)
+        if err == nil {
+            err = api.checkThreshold(item.Amount)
+        }
+        if err != nil {
+            writeManagerError(batchError(i, err), resp)
+            return
+        }
+        transfers[i] = BatchTransfer{item.From, item.To, item.Amount, item.IdempotencyKey, item.PaymentDetails}
+    }
+    results, err := m.TransferBatch(transfers, body.Mode == batchAllOrNothing)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    response := BatchResponse{Mode:body.Mode, Results:results}
+    for _, result := range results {
+        if result.Payment != nil {
+            response.Succeeded++
+        } else {
+            response.Failed++
+        }
+    }
+    resp.SendSuccess(response)
+}
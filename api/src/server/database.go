@@ -5,11 +5,13 @@
 package server
 
 import (
+    "database/sql"
     "fmt"
     "github.com/jmoiron/sqlx"
     "github.com/lib/pq"
     _ "github.com/lib/pq"
     "io"
+    "math"
     "sync"
     "time"
 )
@@ -18,8 +20,42 @@ type Manager interface {
     io.Closer
     GetAvailableAccounts() ([]Account, error)
     GetAccounts(identifiers []string) ([]Account, error)
-    Transfer(fromId, toId string, amount Cents) (*Payment, error)
+    GetAccount(identifier string) (*Account, error)
+    Transfer(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error)
+    TransferBatch(transfers []BatchTransfer, atomic bool) ([]BatchResult, error)
     GetPayments(accountId string) ([]Payment, error)
+    // ListPayments returns a page of the account's payments which match the filter,
+    // the newest first.
+    ListPayments(accountId string, page PageRequest, filter PaymentFilter) ([]Payment, error)
+    // GetChildren returns the payments linked to the parent one: the legs of a split,
+    // or the fees of a transfer.
+    GetChildren(parentId int) ([]Payment, error)
+    HoldManager
+    RefundManager
+    StatusManager
+    ScheduleManager
+    SplitManager
+    FeeManager
+    LimitManager
+    OverdraftManager
+    ApprovalManager
+    AuditLog
+    ReceiptManager
+    StatementManager
+    BalanceManager
+    ReconcileManager
+    SearchManager
+    AnalyticsManager
+    EventFeed
+    LeaderElector
+    WebhookStore
+}
+
+// PageRequest selects a window of items ordered from the newest to the oldest.
+// Before is an exclusive upper bound on the item ID; zero means "from the newest".
+type PageRequest struct {
+    Before int
+    Limit int
 }
 
 // A Manager is responsible for interaction with the persistent storage.
@@ -28,6 +64,11 @@ type Manager interface {
 // with the database are delegated to Manager.
 type BillingManager struct {
     DB *sqlx.DB
+    // connStr opens the connection listening to the outbox notifications.
+    connStr string
+    // actor and requestId are recorded in the audit entries of the changes.
+    actor string
+    requestId string
 }
 
 func NewBillingManager(connStr string) (Manager, error) {
@@ -35,7 +76,7 @@ func NewBillingManager(connStr string) (Manager, error) {
     if err != nil {
         return nil, err
     } else {
-        var manager Manager = BillingManager{conn}
+        var manager Manager = BillingManager{DB:conn, connStr:connStr}
         return manager, nil
     }
 }
@@ -44,10 +85,20 @@ func (m BillingManager) Close() error {
     return m.DB.Close()
 }
 
+// accountQuery selects the accounts with the sum of their holds active at $1 and
+// their outgoing payments which are not settled yet.
+const accountQuery = `
+    SELECT a.*, COALESCE((
+        SELECT SUM(h.amount) FROM hold h
+        WHERE h.from_id = a.identifier AND h.status = 'active' AND h.expires_at > $1), 0) + COALESCE((
+        SELECT SUM(p.amount) FROM payment p
+        WHERE p.from_id = a.identifier AND p.status IN ('pending', 'processing')), 0) AS held
+    FROM account a`
+
 // GetAvailableAccounts returns an array of all available accounts.
 func (m BillingManager) GetAvailableAccounts() ([]Account, error) {
     var accounts []Account
-    err := m.DB.Select(&accounts, "SELECT * FROM account")
+    err := m.DB.Select(&accounts, accountQuery, time.Now().UTC())
     if err != nil { return nil, err }
     return accounts, nil
 }
@@ -55,67 +106,182 @@ func (m BillingManager) GetAvailableAccounts() ([]Account, error) {
 // GetAccounts returns a subset of accounts using identifiers array to make a selection.
 func (m BillingManager) GetAccounts(identifiers []string) ([]Account, error) {
     var accounts []Account
-    err := m.DB.Select(&accounts, "SELECT * FROM account WHERE identifier = any($1)", pq.Array(identifiers))
+    err := m.DB.Select(&accounts, accountQuery + " WHERE a.identifier = any($2)",
+        time.Now().UTC(), pq.Array(identifiers))
     if err != nil { return nil, err }
     return accounts, nil
 }
 
+// lockAccounts selects the accounts for update within the transaction tx. The rows
+// are locked in the order of the identifiers, so the concurrent transactions locking
+// the same accounts cannot deadlock.
+func lockAccounts(tx *sqlx.Tx, identifiers []string, now time.Time) ([]Account, error) {
+    var accounts []Account
+    err := tx.Select(&accounts, accountQuery + `
+        WHERE a.identifier = any($2)
+        ORDER BY a.identifier
+        FOR UPDATE OF a`, now, pq.Array(identifiers))
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return accounts, nil
+}
+
+// lockPair locks the sender's and the receiver's accounts.
+func lockPair(tx *sqlx.Tx, fromId, toId string, now time.Time) (from, to Account, err error) {
+    accounts, err := lockAccounts(tx, []string{fromId, toId}, now)
+    if err != nil {
+        return from, to, err
+    }
+    from, to, ok := pickPair(accounts, fromId, toId)
+    if !ok {
+        return from, to, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    return from, to, nil
+}
+
+// updateAccount changes the locked account with the query, which takes the account's
+// identifier as the first parameter, and records the action in the audit log.
+func (m BillingManager) updateAccount(identifier, action, query string, args ...interface{}) (*Account, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    var before, after []Account
+    if before, err = lockAccounts(tx, []string{identifier}, now); err == nil && len(before) == 0 {
+        err = inputError(codeAccountNotFound, "account is not found")
+    }
+    if err == nil {
+        _, err = tx.Exec(query, append([]interface{}{identifier}, args...)...)
+    }
+    if err == nil {
+        err = tx.Select(&after, accountQuery + " WHERE a.identifier = $2", now, identifier)
+    }
+    if err == nil {
+        err = m.audit(tx, action, "account/" + identifier, &before[0], &after[0])
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &after[0], nil
+}
+
+// GetAccount returns a single account or an error if the account doesn't exist.
+func (m BillingManager) GetAccount(identifier string) (*Account, error) {
+    accounts, err := m.GetAccounts([]string{identifier})
+    if err != nil {
+        return nil, internalError(err)
+    }
+    if len(accounts) == 0 {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    return &accounts[0], nil
+}
+
 // Transfer moves amount of cents between fromId and toId accounts.
 //
 // Accounts fromId and toId should be in the same currency. Also, the account fromId
-// should have sufficient amount of funds to perform a transaction. In case if any
-// of these preconditions is violated, or accounts with these IDs are not found,
-// then the error is returned.
+// should have sufficient amount of available funds, i.e. the funds which are not
+// reserved by the holds and the pending payments, to perform a transaction, and the
+// transfer should fit the limits of the sender, see limits.go. In case if any of these
+// preconditions is violated, or accounts with these IDs are not found, then the error
+// is returned.
 //
-// The process of accounts updating performed as a single transaction. In case if
-// the transaction cannot be rolled back, the method panics.
-func (m BillingManager) Transfer(fromId, toId string, amount Cents) (*Payment, error) {
-    accounts, err := m.GetAccounts([]string{fromId, toId})
-    if err != nil || len(accounts) != 2 {
-        return nil, inputError("cannot find the accounts")
-    }
-    fromAcc, toAcc := accounts[0], accounts[1]
-    if fromAcc.Currency != toAcc.Currency {
-        return nil, inputError("cannot transfer money between accounts with different currency")
-    }
-    if fromAcc.Amount < amount {
-        return nil, inputError("cannot make a transaction: insufficient funds")
-    }
-
-    var mutex sync.Mutex
-    mutex.Lock()
-    fromAcc.Amount -= amount
-    toAcc.Amount += amount
-    mutex.Unlock()
+// If idempotencyKey is not empty, the transfer is performed at most once per sender
+// and key: a repeated call with the same key returns the originally created payment
+// instead of moving the funds again.
+//
+// The process of accounts updating performed as a single transaction which locks the
+// accounts' rows, so the concurrent transfers and holds cannot overspend. The
+// payment.created event is written to the outbox and the audit entry to the audit log
+// within the same transaction. In case if the transaction cannot be rolled back, the
+// method panics.
+func (m BillingManager) Transfer(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error) {
+    return m.transfer(fromId, toId, amount, idempotencyKey, statusCompleted, details)
+}
 
+// transfer creates a payment with the initial status, which is either completed
+// or pending. The funds of a pending payment are reserved instead of being moved.
+// The fees are charged for the completed payments; the revenue accounts of the fee
+// schedules are locked together with the sender's and the recipient's ones.
+func (m BillingManager) transfer(fromId, toId string, amount Cents, idempotencyKey, status string, details PaymentDetails) (*Payment, error) {
+    if idempotencyKey != "" {
+        if payment, err := m.findIdempotent(fromId, idempotencyKey); err != nil {
+            return nil, err
+        } else if payment != nil {
+            return m.withFees(checkReplay(payment, toId, amount))
+        }
+    }
     tx, err := m.DB.Beginx()
     if err != nil { return nil, err }
 
-    _, err = tx.NamedExec("UPDATE account SET amount = :amount WHERE identifier = :identifier", fromAcc)
+    var schedules []FeeSchedule
+    if status == statusCompleted {
+        if schedules, err = listFeeSchedules(tx); err != nil {
+            mustRollback(tx)
+            return nil, err
+        }
+    }
+
+    now := time.Now().UTC()
+    locked, err := lockWithFees(tx, schedules, [][2]string{{fromId, toId}}, now)
     if err != nil {
         mustRollback(tx)
-        return nil, internalError(err)
+        return nil, err
+    }
+    fromAcc, toAcc, ok := pickPair(locked, fromId, toId)
+    if !ok {
+        mustRollback(tx)
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if fromAcc.Currency != toAcc.Currency {
+        mustRollback(tx)
+        return nil, inputError(codeCurrencyMismatch, "cannot transfer money between accounts with different currency")
+    }
+    if fromAcc.Available() < amount {
+        mustRollback(tx)
+        return nil, inputError(codeInsufficientFunds, "cannot make a transaction: insufficient funds")
+    }
+    if err = checkLimits(tx, fromAcc, amount, now); err == nil {
+        err = checkReference(tx, fromId, details)
     }
-
-    _, err = tx.NamedExec("UPDATE account SET amount = :amount WHERE identifier = :identifier", toAcc)
     if err != nil {
         mustRollback(tx)
         return nil, internalError(err)
     }
 
     payment := Payment{
-        From:fromAcc.Identifier,
-        To:toAcc.Identifier,
-        Time:time.Now().UTC(),
-        Amount:amount, Currency:fromAcc.Currency}
-
-    _, err = tx.NamedExec(`
-        INSERT INTO payment (from_id, to_id, transaction_time_utc, amount, currency)
-        VALUES (:from_id, :to_id, :transaction_time_utc, :amount, :currency)
-        `, payment)
-
+        Time:now,
+        Amount:amount,
+        Kind:paymentTransfer,
+        Status:status,
+        IdempotencyKey:nullString(idempotencyKey),
+        PaymentDetails:details}
+    var created *Payment
+    if status == statusPending {
+        created, err = insertPayment(tx, fromAcc, toAcc, payment)
+    } else if created, err = move(tx, fromAcc, toAcc, payment); err == nil {
+        accounts := accountMap(locked)
+        accounts[fromId].Amount -= amount
+        accounts[toId].Amount += amount
+        err = chargeFees(tx, accounts, created, transferFees(schedules, fromAcc, toAcc, amount), now)
+    }
+    if err == nil {
+        err = m.audit(tx, "payment.created", paymentResource(created.ID), nil, created)
+    }
     if err != nil {
         mustRollback(tx)
+        if isUniqueViolation(err) && idempotencyKey != "" {
+            // A concurrent request with the same key has won the race.
+            if existing, _ := m.findIdempotent(fromId, idempotencyKey); existing != nil {
+                return m.withFees(checkReplay(existing, toId, amount))
+            }
+        }
         return nil, internalError(err)
     }
 
@@ -124,6 +290,67 @@ func (m BillingManager) Transfer(fromId, toId string, amount Cents) (*Payment, e
         return nil, internalError(err)
     }
 
+    return created, nil
+}
+
+// move updates the balances of the accounts and records the payment within the
+// transaction tx. The payment's sender, recipient and currency are taken from the
+// accounts; the rest of its fields are set by the caller. The caller is responsible
+// for checking the preconditions of the transfer and holding the locks of the
+// accounts' rows.
+func move(tx *sqlx.Tx, fromAcc, toAcc Account, payment Payment) (*Payment, error) {
+    if err := shift(tx, fromAcc, toAcc, payment.Amount); err != nil {
+        return nil, err
+    }
+    return insertPayment(tx, fromAcc, toAcc, payment)
+}
+
+// shift moves the amount between the balances of the locked accounts.
+func shift(tx *sqlx.Tx, fromAcc, toAcc Account, amount Cents) error {
+    var mutex sync.Mutex
+    mutex.Lock()
+    fromAcc.Amount -= amount
+    toAcc.Amount += amount
+    mutex.Unlock()
+
+    _, err := tx.NamedExec("UPDATE account SET amount = :amount WHERE identifier = :identifier", fromAcc)
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.NamedExec("UPDATE account SET amount = :amount WHERE identifier = :identifier", toAcc)
+    return err
+}
+
+// insertPayment records the payment without touching the balances. The payment is
+// completed unless the caller has set another status; the status starts the
+// payment's history, and the payment.created event is written to the outbox.
+func insertPayment(tx *sqlx.Tx, fromAcc, toAcc Account, payment Payment) (*Payment, error) {
+    payment.From, payment.To, payment.Currency = fromAcc.Identifier, toAcc.Identifier, fromAcc.Currency
+    if payment.Status == "" {
+        payment.Status = statusCompleted
+    }
+
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO payment (from_id, to_id, transaction_time_utc, amount, currency, idempotency_key, kind, original_id, status, parent_id,
+            reference, unique_reference, memo, metadata)
+        VALUES (:from_id, :to_id, :transaction_time_utc, :amount, :currency, :idempotency_key, :kind, :original_id, :status, :parent_id,
+            :reference, :unique_reference, :memo, :metadata)
+        RETURNING payment_id
+        `)
+    if err == nil {
+        err = stmt.Get(&payment.ID, payment)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if err = recordStatus(tx, payment.ID, payment.Status, "", payment.Time); err != nil {
+        return nil, err
+    }
+    if err = enqueueEvent(tx, eventPaymentCreated, payment, payment.Time); err != nil {
+        return nil, err
+    }
     return &payment, nil
 }
 
@@ -135,16 +362,96 @@ func (m BillingManager) GetPayments(accountId string) ([]Payment, error) {
         return nil, internalError(err)
     }
     if len(accounts) == 0 {
-        return nil, inputError("account is not found")
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    var payments []Payment
+    err = m.DB.Select(&payments,"SELECT * FROM payment WHERE (from_id = $1 OR to_id = $1) AND kind <> 'split'", accountId)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return payments, nil
+}
+
+// ListPayments returns a page of transactions of the account accountId matching the
+// filter, ordered from the newest to the oldest one.
+func (m BillingManager) ListPayments(accountId string, page PageRequest, filter PaymentFilter) ([]Payment, error) {
+    if _, err := m.GetAccount(accountId); err != nil {
+        return nil, err
+    }
+    before := page.Before
+    if before <= 0 {
+        before = math.MaxInt32
     }
     var payments []Payment
-    err = m.DB.Select(&payments,"SELECT * FROM payment WHERE from_id = $1 OR to_id = $1", accountId)
+    err := m.DB.Select(&payments, `
+        SELECT * FROM payment p
+        WHERE (p.from_id = $1 OR p.to_id = $1) AND p.kind <> 'split' AND p.payment_id < $2` + paymentFilter + `
+        ORDER BY p.payment_id DESC
+        LIMIT $6`, accountId, before, filter.Reference, filter.MetadataKey, filter.MetadataValue, page.Limit)
     if err != nil {
         return nil, internalError(err)
     }
     return payments, nil
 }
 
+func (m BillingManager) GetChildren(parentId int) ([]Payment, error) {
+    var children []Payment
+    err := m.DB.Select(&children, "SELECT * FROM payment WHERE parent_id = $1 ORDER BY payment_id", parentId)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return children, nil
+}
+
+// findIdempotent looks up a payment previously created by the sender fromId
+// with the given idempotency key. Nil is returned if there is no such payment.
+func (m BillingManager) findIdempotent(fromId, key string) (*Payment, error) {
+    var payments []Payment
+    err := m.DB.Select(&payments,
+        "SELECT * FROM payment WHERE from_id = $1 AND idempotency_key = $2", fromId, key)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    if len(payments) == 0 {
+        return nil, nil
+    }
+    return &payments[0], nil
+}
+
+// checkReplay verifies that a repeated transfer request matches the payment
+// that was created when the idempotency key was used for the first time.
+func checkReplay(payment *Payment, toId string, amount Cents) (*Payment, error) {
+    if payment.To != toId || payment.Amount != amount {
+        return nil, inputError(codeIdempotencyConflict,
+            "idempotency key was already used with different parameters")
+    }
+    return payment, nil
+}
+
+// pickPair finds the sender's and the receiver's accounts in the accounts list.
+func pickPair(accounts []Account, fromId, toId string) (from, to Account, ok bool) {
+    var foundFrom, foundTo bool
+    for _, acc := range accounts {
+        switch acc.Identifier {
+        case fromId: from, foundFrom = acc, true
+        case toId: to, foundTo = acc, true
+        }
+    }
+    return from, to, foundFrom && foundTo && fromId != toId
+}
+
+// isUniqueViolation checks if the error was caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+    if err, ok := err.(*pq.Error); ok {
+        return err.Code == "23505"
+    }
+    return false
+}
+
+func nullString(s string) sql.NullString {
+    return sql.NullString{String:s, Valid:s != ""}
+}
+
 // mustRollback panics if a transaction cannot be rolled back.
 func mustRollback(tx *sqlx.Tx) {
     if err := tx.Rollback(); err != nil {
@@ -159,15 +466,40 @@ func mustRollback(tx *sqlx.Tx) {
 type Cents int64
 
 // Account represents information about payment system's account.
+//
+// The Amount is the ledger balance of the account. The Held amount is reserved by
+// the active holds and the outgoing payments which are not settled yet; it cannot be
+// spent until the holds are voided or expire, and the payments are completed or fail.
 type Account struct {
     ID int            `db:"user_id"`
     Identifier string `db:"identifier"`
     Currency string   `db:"currency"`
     Amount Cents      `db:"amount"`
     Created time.Time `db:"created_on"`
+    Tier string       `db:"tier"`
+    Overdraft Cents   `db:"overdraft_limit"`
+    InterestBps int64 `db:"interest_bps"`
+    Held Cents        `db:"held"`
+}
+
+// Available returns the amount of funds which can be spent, including the overdraft.
+func (a Account) Available() Cents {
+    return a.Amount + a.Overdraft - a.Held
+}
+
+// OverdraftUsed returns the part of the overdraft limit which is spent.
+func (a Account) OverdraftUsed() Cents {
+    if a.Amount >= 0 {
+        return 0
+    }
+    return -a.Amount
 }
 
 // Payment contains an information about a money transfer between accounts.
+//
+// The refunds and the reversals are the payments compensating the original transfer;
+// they are linked to it with the OriginalID. The balances are changed only by the
+// completed payments, see the status.go file.
 type Payment struct {
     ID int          `db:"payment_id" json:"id"`
     From string     `db:"from_id" json:"from"`
@@ -175,8 +507,23 @@ type Payment struct {
     Time time.Time  `db:"transaction_time_utc" json:"time_utc"`
     Amount Cents    `db:"amount" json:"amount"`
     Currency string `db:"currency" json:"currency"`
+    IdempotencyKey sql.NullString `db:"idempotency_key" json:"-"`
+    Kind string     `db:"kind" json:"kind"`
+    OriginalID *int `db:"original_id" json:"original_id,omitempty"`
+    Status string   `db:"status" json:"status"`
+    ParentID *int   `db:"parent_id" json:"parent_id,omitempty"`
+    // Fees are the payments charging the fees of the transfer, see fees.go.
+    Fees []Payment  `db:"-" json:"fees,omitempty"`
+    PaymentDetails
 }
 
+// Kinds of the payments.
+const (
+    paymentTransfer = "transfer"
+    paymentRefund = "refund"
+    paymentReversal = "reversal"
+)
+
 func (c Cents) String() string {
     whole, decimal := c / 100, c % 100
     return fmt.Sprintf("%s.%s", whole, decimal)
@@ -200,17 +547,51 @@ func connect(connStr string) (*sqlx.DB, error) {
 // due to wrong input or some internal bug.
 // Custom type helps to distinguish between these two types of errors and send
 // error message to the client only in case when the error is not internal one.
+//
+// Every error carries a short machine-readable code which is sent to the client
+// along with the message so API consumers don't need to parse the text.
 type managerError struct {
+    code string
     message string
     internal bool
+    fields []FieldError
+    // limit describes the exceeded limit of the limit_exceeded error.
+    limit *LimitStatus
 }
 
-func inputError(message string) managerError {
-    return managerError{message, false}
+// Error codes reported to the API clients.
+const (
+    codeInvalidRequest = "invalid_request"
+    codeNotFound = "not_found"
+    codeInternal = "internal"
+    codeAccountNotFound = "account_not_found"
+    codeCurrencyMismatch = "currency_mismatch"
+    codeInsufficientFunds = "insufficient_funds"
+    codeIdempotencyConflict = "idempotency_conflict"
+    codeValidationFailed = "validation_failed"
+    codeBodyTooLarge = "body_too_large"
+    codeUnauthorized = "unauthorized"
+    codeForbidden = "forbidden"
+    codeInvalidState = "invalid_state"
+    codeLimitExceeded = "limit_exceeded"
+    codeApprovalRequired = "approval_required"
+    codeDuplicateReference = "duplicate_reference"
+)
+
+func inputError(code, message string) managerError {
+    return managerError{code:code, message:message}
+}
+
+// validationError reports the list of invalid fields of the request.
+func validationError(fields []FieldError) managerError {
+    return managerError{code:codeValidationFailed, message:"request validation failed", fields:fields}
 }
 
 func internalError(err error) managerError {
-    return managerError{err.Error(), true}
+    if err, ok := err.(managerError); ok {
+        return err
+    }
+    return managerError{code:codeInternal, message:err.Error(), internal:true}
 }
 
 func (m managerError) Error() string {
@@ -0,0 +1,185 @@
+// Delivery of the outbox events to the webhooks.
+//
+// The Dispatcher polls the WebhookStore for the due deliveries and POSTs the events
+// to the subscribed URLs. Every request is signed with the webhook's secret:
+//
+//     X-Billing-Signature: t=1700000000,v1=<hex HMAC-SHA256 of "1700000000." + body>
+//
+// A delivery succeeds if the receiver replies with a 2xx status. Otherwise, it is
+// retried with an exponential backoff, and after MaxAttempts it is dead-lettered.
+package server
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Headers of the webhook requests.
+const (
+    headerSignature = "X-Billing-Signature"
+    headerEventID = "X-Billing-Event-Id"
+    headerEventType = "X-Billing-Event-Type"
+    headerDeliveryID = "X-Billing-Delivery-Id"
+)
+
+// Dispatcher sends the queued deliveries to the webhooks.
+type Dispatcher struct {
+    Store WebhookStore
+    Client *http.Client
+    // MaxAttempts is the number of attempts after which a delivery is dead-lettered.
+    MaxAttempts int
+    // Backoff is the delay after the first failed attempt; it doubles with every
+    // next attempt up to MaxBackoff.
+    Backoff time.Duration
+    MaxBackoff time.Duration
+    // Interval is the delay between the polls of the store.
+    Interval time.Duration
+    // Lease is the time after which a claimed delivery is retried if its attempt
+    // was never finished, for example because the process has crashed.
+    Lease time.Duration
+    BatchSize int
+
+    now func() time.Time
+}
+
+func NewDispatcher(store WebhookStore) *Dispatcher {
+    return &Dispatcher{
+        Store:store,
+        Client:&http.Client{Timeout:10*time.Second},
+        MaxAttempts:8,
+        Backoff:30*time.Second,
+        MaxBackoff:6*time.Hour,
+        Interval:5*time.Second,
+        Lease:time.Minute,
+        BatchSize:20,
+        now:func() time.Time { return time.Now().UTC() },
+    }
+}
+
+// Run dispatches the deliveries until the context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+    ticker := time.NewTicker(d.Interval)
+    defer ticker.Stop()
+    for {
+        if _, err := d.DispatchOnce(ctx); err != nil {
+            log.Printf("webhook dispatcher: %s", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// DispatchOnce sends a batch of due deliveries and returns the number of the
+// successful ones.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+    deliveries, err := d.Store.ClaimDeliveries(d.now(), d.Lease, d.BatchSize)
+    if err != nil {
+        return 0, err
+    }
+    delivered := 0
+    for _, delivery := range deliveries {
+        if ctx.Err() != nil {
+            break // the lease expires and the delivery is picked up later
+        }
+        err := d.send(ctx, delivery)
+        if err == nil {
+            delivered++
+            err = d.Store.CompleteDelivery(delivery.ID, d.now())
+        } else {
+            dead := delivery.Attempts >= d.MaxAttempts
+            retryAt := d.now().Add(d.backoff(delivery.Attempts))
+            if dead {
+                log.Printf("webhook delivery %d is dead after %d attempts: %s", delivery.ID, delivery.Attempts, err)
+            }
+            err = d.Store.FailDelivery(delivery.ID, err.Error(), retryAt, dead)
+        }
+        if err != nil {
+            return delivered, err
+        }
+    }
+    return delivered, nil
+}
+
+// backoff returns the delay before the attempt following the given one.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+    delay := d.Backoff
+    for i := 1; i < attempt && delay < d.MaxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > d.MaxBackoff {
+        delay = d.MaxBackoff
+    }
+    return delay
+}
+
+// send POSTs the signed event to the webhook's URL.
+func (d *Dispatcher) send(ctx context.Context, delivery WebhookDelivery) error {
+    body, err := json.Marshal(WebhookEvent{
+        ID:delivery.EventID,
+        Type:delivery.EventType,
+        Data:json.RawMessage(delivery.Payload)})
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(headerEventID, strconv.Itoa(delivery.EventID))
+    req.Header.Set(headerEventType, delivery.EventType)
+    req.Header.Set(headerDeliveryID, strconv.Itoa(delivery.ID))
+    req.Header.Set(headerSignature, signPayload(delivery.Secret, d.now().Unix(), body))
+
+    resp, err := d.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    _, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("receiver replied with status %d", resp.StatusCode)
+    }
+    return nil
+}
+
+// signPayload computes the value of the signature header. The timestamp is signed
+// along with the body, so the receivers can reject the replayed requests.
+func signPayload(secret string, timestamp int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    _, _ = fmt.Fprintf(mac, "%d.", timestamp)
+    mac.Write(body)
+    return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// RunDispatcher delivers the webhooks using the shared Manager until the context
+// is cancelled. If the Manager cannot be created, the dispatcher waits for the
+// database to become available.
+func (api *BillingAPI) RunDispatcher(ctx context.Context) {
+    for {
+        m, err := api.manager()
+        if err == nil {
+            NewDispatcher(m).Run(ctx)
+            return
+        }
+        log.Printf("webhook dispatcher: %s", err)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(5*time.Second):
+        }
+    }
+}
@@ -0,0 +1,717 @@
+// Request and response structures of the API endpoints.
+//
+// Every endpoint decodes its input into one of the *Request structures and replies
+// with one of the *Response structures, so the contract of the API is declared in
+// a single place. The validation rules are defined with `validate` tags, see the
+// Validate function for details.
+package server
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "reflect"
+    "strconv"
+    "time"
+)
+
+// ErrorResponse is sent whenever a request cannot be served.
+type ErrorResponse struct {
+    Error string         `json:"error"`
+    Code string          `json:"code"`
+    Status int           `json:"status"`
+    Fields []FieldError  `json:"fields,omitempty"`
+    // Limit describes the limit exceeded by the transfer.
+    Limit *LimitStatus   `json:"limit,omitempty"`
+}
+
+// StatusResponse is returned by the /status endpoint.
+type StatusResponse struct {
+    Success bool `json:"success"`
+}
+
+// ---------------
+// Legacy endpoints
+// ---------------
+
+// AccountInfo is a short description of an account returned by the /accounts endpoint.
+// The amount is formatted as a decimal number, like "12.34".
+type AccountInfo struct {
+    Name string     `json:"name"`
+    Currency string `json:"currency"`
+    Amount string   `json:"amount"`
+}
+
+// AccountsResponse is returned by the /accounts endpoint.
+type AccountsResponse struct {
+    Accounts []AccountInfo `json:"accounts"`
+}
+
+// LegacyTransferRequest is expected by the /transfer endpoint.
+type LegacyTransferRequest struct {
+    FromID string       `json:"fromId" validate:"required,max=36"`
+    ToID string         `json:"toId" validate:"required,max=36"`
+    Amount StringCents  `json:"amount" validate:"required,min=1"`
+}
+
+// PaymentsRequest is expected by the /payments endpoint.
+type PaymentsRequest struct {
+    AccountID string `json:"accountId" validate:"required,max=36"`
+}
+
+// PaymentEntry is a single item of the account's payments history.
+type PaymentEntry struct {
+    Account string    `json:"account"`
+    Amount float32    `json:"amount"`
+    Time time.Time    `json:"time"`
+    Reference string  `json:"reference,omitempty"`
+    Memo string       `json:"memo,omitempty"`
+    Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// PaymentHistory splits the account's payments by direction.
+type PaymentHistory struct {
+    Sent []PaymentEntry     `json:"sent"`
+    Received []PaymentEntry `json:"received"`
+}
+
+// PaymentsResponse is returned by the /payments endpoint.
+type PaymentsResponse struct {
+    Account string           `json:"account"`
+    Payments PaymentHistory  `json:"payments"`
+}
+
+// -----------------
+// Version 1 endpoints
+// -----------------
+
+// AccountView is a representation of an account returned by the v1 endpoints.
+//
+// The Ledger balance includes the funds reserved by the holds and the pending
+// payments, and the Available one doesn't. The Balance is the same as the Ledger and
+// kept for compatibility. The Available balance includes the unused part of the
+// overdraft limit.
+type AccountView struct {
+    ID string            `json:"id"`
+    Currency string      `json:"currency"`
+    Tier string          `json:"tier"`
+    Balance Cents        `json:"balance"`
+    Available Cents      `json:"available"`
+    Ledger Cents         `json:"ledger"`
+    OverdraftLimit Cents `json:"overdraft_limit"`
+    OverdraftUsed Cents  `json:"overdraft_used"`
+    InterestBps int64    `json:"interest_bps"`
+    Created time.Time    `json:"created"`
+}
+
+func newAccountView(acc Account) AccountView {
+    return AccountView{
+        acc.Identifier, acc.Currency, acc.Tier, acc.Amount, acc.Available(), acc.Amount,
+        acc.Overdraft, acc.OverdraftUsed(), acc.InterestBps, acc.Created,
+    }
+}
+
+// AccountListResponse is returned by GET /v1/accounts.
+type AccountListResponse struct {
+    Accounts []AccountView `json:"accounts"`
+}
+
+// AccountResponse is returned by GET /v1/accounts/{id}.
+type AccountResponse struct {
+    Account AccountView `json:"account"`
+}
+
+// BalanceQuery is accepted by GET /v1/accounts/{id}/balance. The current balance is
+// returned if the At time is omitted.
+type BalanceQuery struct {
+    At time.Time `query:"at"`
+}
+
+// BalanceResponse is returned by GET /v1/accounts/{id}/balance. The Snapshot is the
+// day of the balance snapshot the balance was computed from, if any.
+type BalanceResponse struct {
+    Account string  `json:"account"`
+    Currency string `json:"currency"`
+    At time.Time    `json:"at"`
+    Balance Cents   `json:"balance"`
+    Snapshot string `json:"snapshot,omitempty"`
+}
+
+func newBalanceResponse(b HistoricalBalance) BalanceResponse {
+    response := BalanceResponse{Account:b.Account, Currency:b.Currency, At:b.At, Balance:b.Amount}
+    if b.Snapshot != nil {
+        response.Snapshot = b.Snapshot.Format(dateLayout)
+    }
+    return response
+}
+
+// PageQuery contains pagination parameters of the list endpoints.
+type PageQuery struct {
+    Limit int     `query:"limit" validate:"min=1,max=100"`
+    Cursor string `query:"cursor" validate:"max=20"`
+}
+
+// PaymentQuery is accepted by GET /v1/accounts/{id}/payments: the page and the filter
+// of the payments.
+type PaymentQuery struct {
+    Limit int            `query:"limit" validate:"min=1,max=100"`
+    Cursor string        `query:"cursor" validate:"max=20"`
+    Reference string     `query:"reference" validate:"max=64"`
+    MetadataKey string   `query:"metadata_key" validate:"max=40"`
+    MetadataValue string `query:"metadata_value" validate:"max=500"`
+}
+
+// PaymentPageResponse is returned by GET /v1/accounts/{id}/payments.
+// The NextCursor is empty on the last page.
+type PaymentPageResponse struct {
+    Account string      `json:"account"`
+    Payments []Payment  `json:"payments"`
+    NextCursor string   `json:"next_cursor"`
+}
+
+// TransferRequest is expected by POST /v1/transfers.
+type TransferRequest struct {
+    From string  `json:"from" validate:"required,max=36"`
+    To string    `json:"to" validate:"required,max=36"`
+    Amount Cents `json:"amount" validate:"required,min=1"`
+    // Pending creates a payment which reserves the funds until it is completed.
+    Pending bool `json:"pending,omitempty"`
+    PaymentDetails
+}
+
+// TransferResponse is returned by the transfer endpoints. The transfers above the
+// approval threshold return the Approval instead of the Payment.
+type TransferResponse struct {
+    Payment *Payment   `json:"payment"`
+    Approval *Approval `json:"approval,omitempty"`
+}
+
+// BatchRequest is expected by POST /v1/transfers/batch. A batch has up to 100
+// transfers; the mode is all_or_nothing by default.
+type BatchRequest struct {
+    Mode string           `json:"mode,omitempty" validate:"oneof=all_or_nothing|best_effort"`
+    Transfers []BatchItem `json:"transfers" validate:"required,min=1,max=100"`
+}
+
+// BatchItem is a single transfer of a BatchRequest.
+type BatchItem struct {
+    From string           `json:"from" validate:"required,max=36"`
+    To string             `json:"to" validate:"required,max=36"`
+    Amount Cents          `json:"amount" validate:"required,min=1"`
+    IdempotencyKey string `json:"idempotency_key,omitempty" validate:"max=64"`
+    PaymentDetails
+}
+
+// BatchResponse is returned by POST /v1/transfers/batch. The results are listed in
+// the order of the transfers.
+type BatchResponse struct {
+    Mode string           `json:"mode"`
+    Succeeded int         `json:"succeeded"`
+    Failed int            `json:"failed"`
+    Results []BatchResult `json:"results"`
+}
+
+// SplitRequest is expected by POST /v1/splits. The legs have either the exact
+// amounts summing up to the Amount, or the percents summing up to 100.
+type SplitRequest struct {
+    From string      `json:"from" validate:"required,max=36"`
+    Amount Cents     `json:"amount" validate:"required,min=1"`
+    Legs []SplitItem `json:"legs" validate:"required,min=1,max=20"`
+}
+
+// SplitItem is a single leg of a SplitRequest.
+type SplitItem struct {
+    To string       `json:"to" validate:"required,max=36"`
+    Amount Cents    `json:"amount,omitempty" validate:"min=1"`
+    Percent float64 `json:"percent,omitempty" validate:"min=0.01,max=100"`
+}
+
+// SplitResponse is returned by POST /v1/splits. The legs are listed in the order of
+// the request.
+type SplitResponse struct {
+    Payment *Payment `json:"payment"`
+    Legs []Payment   `json:"legs"`
+}
+
+// RefundRequest is expected by POST /v1/payments/{id}/refunds.
+type RefundRequest struct {
+    Amount Cents `json:"amount" validate:"required,min=1"`
+}
+
+// PaymentDetailResponse is returned by GET /v1/payments/{id}. The Net amount is
+// the payment's amount minus the Refunded one. The Receipt is set for a completed
+// payment.
+type PaymentDetailResponse struct {
+    Payment *Payment  `json:"payment"`
+    Refunds []Payment `json:"refunds"`
+    Refunded Cents    `json:"refunded"`
+    Net Cents         `json:"net"`
+    Legs []Payment    `json:"legs,omitempty"`
+    Receipt *Receipt  `json:"receipt,omitempty"`
+}
+
+// StatusRequest is expected by POST /v1/payments/{id}/status.
+type StatusRequest struct {
+    Status string `json:"status" validate:"required,oneof=processing|completed|failed|cancelled"`
+    Reason string `json:"reason,omitempty" validate:"max=256"`
+}
+
+// StatusHistoryResponse is returned by GET /v1/payments/{id}/history.
+type StatusHistoryResponse struct {
+    PaymentID int          `json:"payment_id"`
+    Status string          `json:"status"`
+    History []StatusChange `json:"history"`
+}
+
+// StringCents is an amount of cents that is accepted either as a JSON number or as
+// a string of digits. The legacy endpoints receive numbers as strings from the
+// form-like clients, like httpie.
+type StringCents Cents
+
+func (s *StringCents) UnmarshalJSON(data []byte) error {
+    text := string(data)
+    if unquoted, err := strconv.Unquote(text); err == nil {
+        text = unquoted
+    }
+    value, err := strconv.ParseInt(text, 10, 64)
+    if err != nil {
+        return &json.UnmarshalTypeError{Value:string(data), Type:reflect.TypeOf(Cents(0))}
+    }
+    *s = StringCents(value)
+    return nil
+}
+
+// ---------------
+// Holds
+// ---------------
+
+// HoldRequest is expected by POST /v1/holds. The hold expires in 24 hours unless
+// the TTL is given.
+type HoldRequest struct {
+    From string  `json:"from" validate:"required,max=36"`
+    To string    `json:"to" validate:"required,max=36"`
+    Amount Cents `json:"amount" validate:"required,min=1"`
+    TTL int      `json:"ttl_seconds,omitempty" validate:"min=60,max=2592000"`
+}
+
+// CaptureRequest is expected by POST /v1/holds/{id}/capture. The whole hold is
+// captured if the amount is omitted.
+type CaptureRequest struct {
+    Amount Cents `json:"amount,omitempty" validate:"min=1"`
+}
+
+// HoldResponse is returned by the endpoints managing a single hold.
+type HoldResponse struct {
+    Hold *Hold `json:"hold"`
+}
+
+// CaptureResponse is returned by POST /v1/holds/{id}/capture.
+type CaptureResponse struct {
+    Hold *Hold       `json:"hold"`
+    Payment *Payment `json:"payment"`
+}
+
+// ---------------
+// Schedules
+// ---------------
+
+// ScheduleRequest is expected by POST /v1/schedules. The day of the month of a monthly
+// schedule is taken from the start if it is not given.
+type ScheduleRequest struct {
+    From string       `json:"from" validate:"required,max=36"`
+    To string         `json:"to" validate:"required,max=36"`
+    Amount Cents      `json:"amount" validate:"required,min=1"`
+    Recurrence string `json:"recurrence" validate:"required,oneof=once|daily|weekly|monthly"`
+    DayOfMonth int    `json:"day_of_month,omitempty" validate:"min=1,max=31"`
+    Start time.Time   `json:"start" validate:"required"`
+    End *time.Time    `json:"end,omitempty"`
+    MaxRuns int       `json:"max_runs,omitempty" validate:"min=1,max=10000"`
+}
+
+// ScheduleResponse is returned by the endpoints managing a single schedule.
+type ScheduleResponse struct {
+    Schedule *Schedule `json:"schedule"`
+}
+
+// ScheduleRunsResponse is returned by GET /v1/schedules/{id}/runs.
+type ScheduleRunsResponse struct {
+    ScheduleID int     `json:"schedule_id"`
+    Runs []ScheduleRun `json:"runs"`
+}
+
+// ---------------
+// Fees
+// ---------------
+
+// FeeScheduleRequest is expected by POST /v1/fees. The schedule without a tier
+// applies to the accounts of all tiers. The brackets of a tiered fee are ordered by
+// their up_to amounts, and the last one has no up_to.
+type FeeScheduleRequest struct {
+    Currency string       `json:"currency" validate:"required,oneof=USD|EUR"`
+    Tier string           `json:"tier,omitempty" validate:"max=16"`
+    Payer string          `json:"payer" validate:"required,oneof=sender|recipient"`
+    Kind string           `json:"kind" validate:"required,oneof=flat|percent|tiered"`
+    Flat Cents            `json:"flat,omitempty" validate:"min=1"`
+    RateBps int64         `json:"rate_bps,omitempty" validate:"min=1,max=10000"`
+    Min Cents             `json:"min,omitempty" validate:"min=1"`
+    Max Cents             `json:"max,omitempty" validate:"min=1"`
+    Brackets []FeeBracket `json:"brackets,omitempty" validate:"max=20"`
+    RevenueID string      `json:"revenue_account" validate:"required,max=36"`
+}
+
+// FeeScheduleResponse is returned by the endpoints managing a single fee schedule.
+type FeeScheduleResponse struct {
+    Schedule *FeeSchedule `json:"schedule"`
+}
+
+// FeeScheduleListResponse is returned by GET /v1/fees.
+type FeeScheduleListResponse struct {
+    Schedules []FeeSchedule `json:"schedules"`
+}
+
+// FeeQuoteRequest is expected by POST /v1/fees/quote.
+type FeeQuoteRequest struct {
+    From string  `json:"from" validate:"required,max=36"`
+    To string    `json:"to" validate:"required,max=36"`
+    Amount Cents `json:"amount" validate:"required,min=1"`
+}
+
+// FeeQuoteResponse is returned by POST /v1/fees/quote. The Debited amount is taken
+// from the sender, and the Credited one is left to the recipient.
+type FeeQuoteResponse struct {
+    Amount Cents   `json:"amount"`
+    Fees []Fee     `json:"fees"`
+    Debited Cents  `json:"debited"`
+    Credited Cents `json:"credited"`
+}
+
+// TierRequest is expected by POST /v1/accounts/{id}/tier.
+type TierRequest struct {
+    Tier string `json:"tier" validate:"required,max=16"`
+}
+
+// OverdraftRequest is expected by POST /v1/accounts/{id}/overdraft. The zero limit
+// disables the overdraft.
+type OverdraftRequest struct {
+    Limit Cents       `json:"limit" validate:"min=1"`
+    InterestBps int64 `json:"interest_bps,omitempty" validate:"min=1,max=10000"`
+}
+
+// ---------------
+// Limits
+// ---------------
+
+// LimitsRequest is expected by POST /v1/limits. The limits of the currency are set
+// unless the account is given; zero means there is no limit.
+type LimitsRequest struct {
+    Currency string   `json:"currency" validate:"required,oneof=USD|EUR"`
+    Account string    `json:"account,omitempty" validate:"max=36"`
+    MaxTransfer Cents `json:"max_transfer,omitempty" validate:"min=1"`
+    Daily Cents       `json:"daily,omitempty" validate:"min=1"`
+    Monthly Cents     `json:"monthly,omitempty" validate:"min=1"`
+    HourlyCount int   `json:"hourly_count,omitempty" validate:"min=1"`
+}
+
+// LimitRuleResponse is returned by POST /v1/limits.
+type LimitRuleResponse struct {
+    Currency string `json:"currency"`
+    Account string  `json:"account,omitempty"`
+    Limits Limits   `json:"limits"`
+}
+
+// LimitUsageResponse is returned by GET /v1/accounts/{id}/limits.
+type LimitUsageResponse struct {
+    Account string       `json:"account"`
+    Limits []LimitStatus `json:"limits"`
+}
+
+// ---------------
+// Approvals
+// ---------------
+
+// ApprovalQuery is accepted by GET /v1/approvals.
+type ApprovalQuery struct {
+    Status string `query:"status" validate:"oneof=pending|approved|rejected|expired|executed|failed"`
+    Limit int     `query:"limit" validate:"min=1,max=100"`
+}
+
+// DecisionRequest is accepted by POST /v1/approvals/{id}/approve and /reject.
+type DecisionRequest struct {
+    Reason string `json:"reason,omitempty" validate:"max=256"`
+}
+
+// ApprovalResponse is returned by the approval endpoints.
+type ApprovalResponse struct {
+    Approval *Approval `json:"approval"`
+}
+
+// ApprovalListResponse is returned by GET /v1/approvals.
+type ApprovalListResponse struct {
+    Approvals []Approval `json:"approvals"`
+}
+
+// ApprovalHistoryResponse is returned by GET /v1/approvals/{id}/history.
+type ApprovalHistoryResponse struct {
+    ApprovalID int          `json:"approval_id"`
+    Status string           `json:"status"`
+    History []ApprovalEvent `json:"history"`
+}
+
+// ---------------
+// Audit
+// ---------------
+
+// AuditView is a representation of an audit entry. The Before and After values are
+// omitted if the resource didn't exist before or after the action.
+type AuditView struct {
+    Seq int                `json:"seq"`
+    Time time.Time         `json:"time"`
+    Actor string           `json:"actor"`
+    RequestID string       `json:"request_id,omitempty"`
+    Action string          `json:"action"`
+    Resource string        `json:"resource"`
+    Before json.RawMessage `json:"before,omitempty"`
+    After json.RawMessage  `json:"after,omitempty"`
+    PrevHash string        `json:"prev_hash"`
+    Hash string            `json:"hash"`
+}
+
+func newAuditView(e AuditEntry) AuditView {
+    view := AuditView{
+        Seq:e.Seq,
+        Time:e.Time,
+        Actor:e.Actor,
+        RequestID:e.RequestID,
+        Action:e.Action,
+        Resource:e.Resource,
+        PrevHash:e.PrevHash,
+        Hash:e.Hash}
+    if e.Before != "" {
+        view.Before = json.RawMessage(e.Before)
+    }
+    if e.After != "" {
+        view.After = json.RawMessage(e.After)
+    }
+    return view
+}
+
+// AuditPageResponse is returned by GET /v1/audit. The NextCursor is empty on the last
+// page.
+type AuditPageResponse struct {
+    Entries []AuditView `json:"entries"`
+    NextCursor string   `json:"next_cursor"`
+}
+
+// AuditReportResponse is returned by GET /v1/audit/verify.
+type AuditReportResponse struct {
+    Report *AuditReport `json:"report"`
+}
+
+// AdjustmentRequest is accepted by POST /v1/reconciliation/adjustments. The
+// discrepancies of all accounts are adjusted if the accounts are not listed.
+type AdjustmentRequest struct {
+    Accounts []string `json:"accounts,omitempty" validate:"max=100"`
+}
+
+// ReconciliationResponse is returned by the reconciliation endpoints.
+type ReconciliationResponse struct {
+    Report *ReconciliationReport `json:"report"`
+}
+
+// ---------------
+// Search
+// ---------------
+
+// PaymentSearchQuery is accepted by GET /v1/payments/search. The syntax of the Q is
+// described in search.go; an empty query finds all payments.
+type PaymentSearchQuery struct {
+    Q string      `query:"q" validate:"max=500"`
+    Limit int     `query:"limit" validate:"min=1,max=100"`
+    Cursor string `query:"cursor" validate:"max=20"`
+}
+
+// PaymentSearchResponse is returned by GET /v1/payments/search. The NextCursor is
+// empty on the last page.
+type PaymentSearchResponse struct {
+    Payments []Payment `json:"payments"`
+    NextCursor string  `json:"next_cursor"`
+}
+
+// ---------------
+// Analytics
+// ---------------
+
+// VolumeQuery is accepted by GET /v1/analytics/volume. The From and To days are
+// inclusive; the volume of all accounts is reported if the Account is empty.
+type VolumeQuery struct {
+    Account string `query:"account" validate:"max=36"`
+    Bucket string  `query:"bucket" validate:"oneof=hour|day|week|month"`
+    From string    `query:"from" validate:"required,max=10"`
+    To string      `query:"to" validate:"required,max=10"`
+}
+
+// VolumeResponse is returned by GET /v1/analytics/volume. The period [From, To) is
+// extended to the whole buckets; the buckets without payments are not listed.
+type VolumeResponse struct {
+    Account string       `json:"account,omitempty"`
+    Bucket string        `json:"bucket"`
+    From time.Time       `json:"from"`
+    To time.Time         `json:"to"`
+    Points []VolumePoint `json:"points"`
+}
+
+// CounterpartyQuery is accepted by GET /v1/accounts/{id}/counterparties. The From
+// and To days are inclusive.
+type CounterpartyQuery struct {
+    From string `query:"from" validate:"required,max=10"`
+    To string   `query:"to" validate:"required,max=10"`
+    Limit int   `query:"limit" validate:"min=1,max=100"`
+}
+
+// CounterpartiesResponse is returned by GET /v1/accounts/{id}/counterparties, with
+// the counterparties ordered from the largest volume.
+type CounterpartiesResponse struct {
+    Account string                      `json:"account"`
+    From time.Time                      `json:"from"`
+    To time.Time                        `json:"to"`
+    Counterparties []CounterpartyVolume `json:"counterparties"`
+}
+
+// ---------------
+// Statements
+// ---------------
+
+// StatementQuery is accepted by GET /v1/accounts/{id}/statement. The From and To
+// days are inclusive.
+type StatementQuery struct {
+    From string   `query:"from" validate:"required,max=10"`
+    To string     `query:"to" validate:"required,max=10"`
+    Format string `query:"format" validate:"oneof=csv|jsonl|pdf|camt053"`
+}
+
+// ---------------
+// Receipts
+// ---------------
+
+// ReceiptResponse is returned by GET /v1/payments/{id}/receipt.
+type ReceiptResponse struct {
+    Receipt *Receipt `json:"receipt"`
+}
+
+// ReceiptKeyView is a published key verifying the receipts. The PublicKey is
+// base64-encoded; the Retired time is set once the key doesn't sign new receipts.
+type ReceiptKeyView struct {
+    ID string          `json:"id"`
+    Algorithm string   `json:"algorithm"`
+    PublicKey string   `json:"public_key"`
+    Created time.Time  `json:"created"`
+    Retired *time.Time `json:"retired,omitempty"`
+}
+
+func newReceiptKeyView(key SigningKey) ReceiptKeyView {
+    return ReceiptKeyView{
+        ID:key.ID,
+        Algorithm:receiptAlgorithm,
+        PublicKey:base64.StdEncoding.EncodeToString(key.PublicKey),
+        Created:key.Created,
+        Retired:key.Retired}
+}
+
+// ReceiptKeysResponse is returned by GET /.well-known/receipt-keys.
+type ReceiptKeysResponse struct {
+    Keys []ReceiptKeyView `json:"keys"`
+}
+
+// ReceiptKeyResponse is returned by POST /v1/receipt-keys/rotate.
+type ReceiptKeyResponse struct {
+    Key ReceiptKeyView `json:"key"`
+}
+
+// ---------------
+// Webhooks
+// ---------------
+
+// WebhookRequest is expected by POST /v1/webhooks. The secret is generated if it
+// is not given.
+type WebhookRequest struct {
+    URL string          `json:"url" validate:"required,max=2048"`
+    EventTypes []string `json:"event_types" validate:"required,min=1,max=16"`
+    Secret string       `json:"secret,omitempty" validate:"min=16,max=128"`
+}
+
+// WebhookView is a representation of a webhook subscription. The secret is shown
+// only once, when the webhook is created.
+type WebhookView struct {
+    ID int              `json:"id"`
+    URL string          `json:"url"`
+    EventTypes []string `json:"event_types"`
+    Active bool         `json:"active"`
+    Created time.Time   `json:"created"`
+    Secret string       `json:"secret,omitempty"`
+}
+
+func newWebhookView(hook Webhook) WebhookView {
+    return WebhookView{ID:hook.ID, URL:hook.URL, EventTypes:hook.EventTypes, Active:hook.Active, Created:hook.Created}
+}
+
+// WebhookResponse is returned by the endpoints managing a single webhook.
+type WebhookResponse struct {
+    Webhook WebhookView `json:"webhook"`
+}
+
+// WebhookListResponse is returned by GET /v1/webhooks.
+type WebhookListResponse struct {
+    Webhooks []WebhookView `json:"webhooks"`
+}
+
+// DeliveryQuery contains the filters of GET /v1/webhooks/deliveries.
+type DeliveryQuery struct {
+    Status string `query:"status" validate:"oneof=pending|delivered|dead"`
+    Limit int     `query:"limit" validate:"min=1,max=100"`
+}
+
+// DeliveryView is a representation of a webhook delivery.
+type DeliveryView struct {
+    ID int                 `json:"id"`
+    WebhookID int          `json:"webhook_id"`
+    EventID int            `json:"event_id"`
+    EventType string       `json:"event_type"`
+    Status string          `json:"status"`
+    Attempts int           `json:"attempts"`
+    NextAttempt time.Time  `json:"next_attempt"`
+    LastError string       `json:"last_error,omitempty"`
+    Delivered *time.Time   `json:"delivered,omitempty"`
+}
+
+func newDeliveryView(d WebhookDelivery) DeliveryView {
+    view := DeliveryView{
+        ID:d.ID,
+        WebhookID:d.WebhookID,
+        EventID:d.EventID,
+        EventType:d.EventType,
+        Status:d.Status,
+        Attempts:d.Attempts,
+        NextAttempt:d.NextAttempt,
+        LastError:d.LastError.String}
+    if d.Delivered.Valid {
+        view.Delivered = &d.Delivered.Time
+    }
+    return view
+}
+
+// DeliveryResponse is returned by POST /v1/webhooks/deliveries/{id}/redeliver.
+type DeliveryResponse struct {
+    Delivery DeliveryView `json:"delivery"`
+}
+
+// DeliveryListResponse is returned by GET /v1/webhooks/deliveries.
+type DeliveryListResponse struct {
+    Deliveries []DeliveryView `json:"deliveries"`
+}
+
+// WebhookEvent is the body of the requests sent to the webhooks. The ID is the same
+// for all deliveries of the event, so the receivers can drop the duplicates.
+type WebhookEvent struct {
+    ID int               `json:"id"`
+    Type string          `json:"type"`
+    Data json.RawMessage `json:"data"`
+}
@@ -0,0 +1,213 @@
+// Publish/subscribe bus delivering the committed payments to the streaming endpoints.
+//
+// Every instance feeds its bus from the outbox: the transaction creating a payment
+// writes the payment.created event and notifies the instances, which publish the
+// payment once the transaction is committed, see RunEventFeed. So a subscriber receives
+// the payments of its account made through any instance. The subscribers that missed
+// some payments (because they were disconnected or too slow) catch up with the database
+// using the payment IDs, see the replay function.
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/lib/pq"
+    "log"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// subscriptionBuffer is the number of payments a subscriber can fall behind before
+// it is disconnected from the bus.
+const subscriptionBuffer = 64
+
+// Bus delivers published payments to the subscribers of the sender's and the
+// recipient's accounts.
+type Bus struct {
+    mu sync.Mutex
+    subscribers map[string]map[*Subscription]bool
+}
+
+func NewBus() *Bus {
+    return &Bus{subscribers:make(map[string]map[*Subscription]bool)}
+}
+
+// Subscription receives payments of an account from the channel C. The channel is
+// closed when the subscription is closed, or when the subscriber falls too far behind.
+type Subscription struct {
+    C <-chan Payment
+    ch chan Payment
+    bus *Bus
+    account string
+}
+
+// Subscribe starts receiving payments of the account.
+func (b *Bus) Subscribe(accountId string) *Subscription {
+    ch := make(chan Payment, subscriptionBuffer)
+    sub := &Subscription{C:ch, ch:ch, bus:b, account:accountId}
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.subscribers[accountId] == nil {
+        b.subscribers[accountId] = make(map[*Subscription]bool)
+    }
+    b.subscribers[accountId][sub] = true
+    return sub
+}
+
+// Close stops the subscription. It is safe to call it more than once.
+func (s *Subscription) Close() {
+    s.bus.mu.Lock()
+    defer s.bus.mu.Unlock()
+    s.bus.remove(s)
+}
+
+// Publish sends the payment to the subscribers of its accounts. The subscribers that
+// cannot keep up are disconnected instead of blocking the publisher.
+func (b *Bus) Publish(p Payment) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for _, account := range []string{p.From, p.To} {
+        for sub := range b.subscribers[account] {
+            select {
+            case sub.ch <- p:
+            default:
+                b.remove(sub)
+            }
+        }
+    }
+}
+
+// remove unregisters the subscription; the caller should hold the lock.
+func (b *Bus) remove(sub *Subscription) {
+    if subs, ok := b.subscribers[sub.account]; ok && subs[sub] {
+        delete(subs, sub)
+        close(sub.ch)
+        if len(subs) == 0 {
+            delete(b.subscribers, sub.account)
+        }
+    }
+}
+
+// outboxChannel is notified with the ID of every event written to the outbox, see
+// enqueueEvent.
+const outboxChannel = "outbox_event"
+
+// EventFeed streams the events committed by any instance of the server.
+type EventFeed interface {
+    // FeedPayments calls publish with the payments created after the call, in the order
+    // of their commits, until the context is cancelled or the feed fails.
+    FeedPayments(ctx context.Context, publish func(Payment)) error
+}
+
+// RunEventFeed feeds the bus with the payments committed by any instance until the
+// context is cancelled. Unlike the background jobs, it runs on every instance.
+func (api *BillingAPI) RunEventFeed(ctx context.Context) {
+    for {
+        m, err := api.manager()
+        if err == nil {
+            err = m.FeedPayments(ctx, api.Events.Publish)
+        }
+        if err != nil {
+            log.Printf("event feed: %s", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(5*time.Second):
+        }
+    }
+}
+
+// FeedPayments listens to the outbox notifications and publishes the created payments,
+// except the split parents which don't move funds. The events committed while the
+// listener reconnects are read from the outbox after the last seen one.
+func (m BillingManager) FeedPayments(ctx context.Context, publish func(Payment)) error {
+    listener := pq.NewListener(m.connStr, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+        if err != nil {
+            log.Printf("event feed: %s", err)
+        }
+    })
+    defer listener.Close()
+    if err := listener.Listen(outboxChannel); err != nil {
+        return err
+    }
+
+    var last int
+    feed := func(condition string, eventId int) error {
+        var events []struct {
+            ID int         `db:"event_id"`
+            Payload []byte `db:"payload"`
+        }
+        err := m.DB.SelectContext(ctx, &events, `
+            SELECT event_id, payload FROM outbox_event
+            WHERE event_type = $1 AND event_id `+condition+` $2 ORDER BY event_id`,
+            eventPaymentCreated, eventId)
+        if err != nil {
+            return err
+        }
+        for _, event := range events {
+            var payment Payment
+            if err := json.Unmarshal(event.Payload, &payment); err != nil {
+                return err
+            }
+            if payment.Kind != paymentSplit {
+                publish(payment)
+            }
+            if event.ID > last {
+                last = event.ID
+            }
+        }
+        return nil
+    }
+
+    for {
+        var err error
+        select {
+        case <-ctx.Done():
+            return nil
+        case n := <-listener.Notify:
+            if n == nil {
+                err = feed(">", last) // reconnected, some notifications may be lost
+            } else if eventId, convErr := strconv.Atoi(n.Extra); convErr == nil {
+                err = feed("=", eventId)
+            }
+        }
+        if err != nil && ctx.Err() == nil {
+            return err
+        }
+    }
+}
+
+// replay sends the account's payments with IDs greater than after to the callback,
+// from the oldest to the newest one. The ID of the last sent payment is returned.
+func replay(m Manager, accountId string, after int, send func(Payment) error) (int, error) {
+    var missed []Payment
+    page := PageRequest{Limit:maxPageSize}
+    for {
+        payments, err := m.ListPayments(accountId, page, PaymentFilter{})
+        if err != nil {
+            return after, err
+        }
+        done := len(payments) < page.Limit
+        for _, p := range payments {
+            if p.ID <= after {
+                done = true
+                break
+            }
+            missed = append(missed, p)
+        }
+        if done {
+            break
+        }
+        page.Before = payments[len(payments)-1].ID
+    }
+    last := after
+    for i := len(missed) - 1; i >= 0; i-- {
+        if err := send(missed[i]); err != nil {
+            return last, err
+        }
+        last = missed[i].ID
+    }
+    return last, nil
+}
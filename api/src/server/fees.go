@@ -0,0 +1,542 @@
+// Transfer fees.
+//
+// The fees are defined by the fee schedules of a currency. A schedule charges either
+// the sender or the recipient of a transfer, and credits the fee to its revenue account.
+// A schedule can be limited to the payers of a single account tier; such a schedule
+// takes precedence over the schedule of the same currency and payer for all tiers. So
+// at most two fees are charged for a transfer: one paid by the sender and one paid by
+// the recipient.
+//
+// A fee is recorded as a payment of the fee kind, linked to the transfer with the
+// ParentID, and made in the same transaction which moves the funds of the transfer.
+// So the fees are charged for the transfers completed at once, including the batches
+// and the scheduled transfers, for the pending transfers when they are completed, and
+// for the captured amounts of the holds; the splits and the refunds are not charged.
+package server
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+)
+
+// Kinds of the fee schedules.
+const (
+    feeFlat = "flat"
+    feePercent = "percent"
+    feeTiered = "tiered"
+)
+
+// Payers of the fees.
+const (
+    feeSender = "sender"
+    feeRecipient = "recipient"
+)
+
+// paymentFee is the kind of the payments charging the fees.
+const paymentFee = "fee"
+
+// defaultTier is the tier of the new accounts.
+const defaultTier = "standard"
+
+// FeeManager keeps the fee schedules and the tiers of the accounts.
+type FeeManager interface {
+    CreateFeeSchedule(schedule FeeSchedule) (*FeeSchedule, error)
+    // ListFeeSchedules returns the active fee schedules.
+    ListFeeSchedules() ([]FeeSchedule, error)
+    // DeleteFeeSchedule deactivates the schedule; it doesn't charge the transfers
+    // made afterwards.
+    DeleteFeeSchedule(id int) (*FeeSchedule, error)
+    SetAccountTier(identifier, tier string) (*Account, error)
+}
+
+// FeeSchedule defines the fee of the transfers in its currency. An empty Tier means
+// all tiers. The Min and Max bounds apply to the fees of all kinds; zero Max means
+// there is no upper bound.
+type FeeSchedule struct {
+    ID int               `db:"fee_schedule_id" json:"id"`
+    Currency string      `db:"currency" json:"currency"`
+    Tier string          `db:"tier" json:"tier,omitempty"`
+    Payer string         `db:"payer" json:"payer"`
+    Kind string          `db:"kind" json:"kind"`
+    Flat Cents           `db:"flat" json:"flat,omitempty"`
+    RateBps int64        `db:"rate_bps" json:"rate_bps,omitempty"`
+    Min Cents            `db:"min_fee" json:"min,omitempty"`
+    Max Cents            `db:"max_fee" json:"max,omitempty"`
+    Brackets FeeBrackets `db:"brackets" json:"brackets,omitempty"`
+    RevenueID string     `db:"revenue_id" json:"revenue_account"`
+    Active bool          `db:"active" json:"active"`
+    Created time.Time    `db:"created_on" json:"created"`
+}
+
+// FeeBracket is the fee of the transfers with the amounts up to UpTo, inclusive. The
+// fee is the Flat part plus the rate given in basis points. Zero UpTo means there is
+// no upper bound.
+type FeeBracket struct {
+    UpTo Cents    `json:"up_to,omitempty" validate:"min=1"`
+    Flat Cents    `json:"flat,omitempty" validate:"min=1"`
+    RateBps int64 `json:"rate_bps,omitempty" validate:"min=1,max=10000"`
+}
+
+// FeeBrackets are the brackets of a tiered schedule ordered by the amounts. They are
+// stored as a JSON array.
+type FeeBrackets []FeeBracket
+
+func (b FeeBrackets) Value() (driver.Value, error) {
+    if b == nil {
+        return nil, nil
+    }
+    return json.Marshal(b)
+}
+
+func (b *FeeBrackets) Scan(src interface{}) error {
+    switch src := src.(type) {
+    case nil:
+        *b = nil
+        return nil
+    case []byte:
+        return json.Unmarshal(src, b)
+    case string:
+        return json.Unmarshal([]byte(src), b)
+    }
+    return fmt.Errorf("cannot scan %T into fee brackets", src)
+}
+
+// Fee is a fee charged for a transfer.
+type Fee struct {
+    ScheduleID int `json:"schedule_id"`
+    Payer string   `json:"payer"`
+    Revenue string `json:"revenue_account"`
+    Amount Cents   `json:"amount"`
+}
+
+// percentOf returns the part of the amount given in basis points, rounded half up.
+func percentOf(amount Cents, bps int64) Cents {
+    return Cents((int64(amount)*bps + 5000)/10000)
+}
+
+// fee returns the fee of a transfer of the amount.
+func (s FeeSchedule) fee(amount Cents) Cents {
+    var fee Cents
+    switch s.Kind {
+    case feeFlat:
+        fee = s.Flat
+    case feePercent:
+        fee = percentOf(amount, s.RateBps)
+    case feeTiered:
+        for _, bracket := range s.Brackets {
+            if bracket.UpTo == 0 || amount <= bracket.UpTo {
+                fee = bracket.Flat + percentOf(amount, bracket.RateBps)
+                break
+            }
+        }
+    }
+    if fee < s.Min {
+        fee = s.Min
+    }
+    if s.Max > 0 && fee > s.Max {
+        fee = s.Max
+    }
+    return fee
+}
+
+// transferFees returns the fees of the transfer of the amount between the accounts,
+// the sender's one first. The fees of zero amount, and the fees which the revenue
+// account would pay to itself, are skipped.
+func transferFees(schedules []FeeSchedule, from, to Account, amount Cents) []Fee {
+    var fees []Fee
+    for _, s := range []*FeeSchedule{pickSchedule(schedules, feeSender, from), pickSchedule(schedules, feeRecipient, to)} {
+        if s == nil {
+            continue
+        }
+        payer := from.Identifier
+        if s.Payer == feeRecipient {
+            payer = to.Identifier
+        }
+        if fee := s.fee(amount); fee > 0 && s.RevenueID != payer {
+            fees = append(fees, Fee{s.ID, payer, s.RevenueID, fee})
+        }
+    }
+    return fees
+}
+
+// pickSchedule returns the schedule charging the payer, preferring the one of the
+// payer's tier. Nil is returned if the payer is not charged.
+func pickSchedule(schedules []FeeSchedule, side string, payer Account) *FeeSchedule {
+    var picked *FeeSchedule
+    for i, s := range schedules {
+        if !s.Active || s.Currency != payer.Currency || s.Payer != side {
+            continue
+        }
+        if s.Tier == payer.Tier || (s.Tier == "" && picked == nil) {
+            picked = &schedules[i]
+        }
+    }
+    return picked
+}
+
+// feeRevenue returns the revenue accounts of the schedules which can charge the
+// transfers between the accounts, given as the pairs of the senders and the recipients,
+// whatever the tiers of the payers are. The pairs with a missing account are skipped.
+func feeRevenue(schedules []FeeSchedule, accounts map[string]*Account, pairs [][2]string) []string {
+    var ids []string
+    for _, pair := range pairs {
+        from, to := accounts[pair[0]], accounts[pair[1]]
+        if from == nil || to == nil {
+            continue
+        }
+        for _, s := range schedules {
+            payer := from
+            if s.Payer == feeRecipient {
+                payer = to
+            }
+            if s.Active && s.Currency == payer.Currency && !contains(ids, s.RevenueID) {
+                ids = append(ids, s.RevenueID)
+            }
+        }
+    }
+    return ids
+}
+
+// lockWithFees locks the accounts of the transfers, given as the pairs of the senders
+// and the recipients, together with the revenue accounts of the schedules which can
+// charge them, so the transfers charged in the other currencies don't wait. All
+// accounts are locked at once in their order, so the concurrent transfers cannot
+// deadlock; the schedules of all tiers are considered, as a tier read before locking
+// can change until the accounts are locked.
+func lockWithFees(tx *sqlx.Tx, schedules []FeeSchedule, pairs [][2]string, now time.Time) ([]Account, error) {
+    var ids []string
+    for _, pair := range pairs {
+        ids = append(ids, pair[0], pair[1])
+    }
+    if len(schedules) > 0 {
+        var current []Account
+        if err := tx.Select(&current, accountQuery + " WHERE a.identifier = any($2)", now, pq.Array(ids)); err != nil {
+            return nil, internalError(err)
+        }
+        ids = append(ids, feeRevenue(schedules, accountMap(current), pairs)...)
+    }
+    return lockAccounts(tx, ids, now)
+}
+
+// accountMap indexes the accounts by their identifiers.
+func accountMap(accounts []Account) map[string]*Account {
+    indexed := make(map[string]*Account, len(accounts))
+    for i := range accounts {
+        indexed[accounts[i].Identifier] = &accounts[i]
+    }
+    return indexed
+}
+
+// chargeFees moves the fees of the payment from the payers to the revenue accounts
+// and attaches the fee payments to the payment. The accounts should be locked and
+// have the balances changed by the payment itself. The fee payments are made at now.
+func chargeFees(tx *sqlx.Tx, accounts map[string]*Account, payment *Payment, fees []Fee, now time.Time) error {
+    for _, fee := range fees {
+        payer, revenue := accounts[fee.Payer], accounts[fee.Revenue]
+        if payer == nil || revenue == nil {
+            return fmt.Errorf("accounts of the fee %d are not locked", fee.ScheduleID)
+        }
+        if payer.Available() < fee.Amount {
+            return inputError(codeInsufficientFunds, "cannot make a transaction: insufficient funds to pay the fee")
+        }
+        charged, err := move(tx, *payer, *revenue, Payment{
+            Time:now,
+            Amount:fee.Amount,
+            Kind:paymentFee,
+            ParentID:&payment.ID})
+        if err != nil {
+            return err
+        }
+        payer.Amount -= fee.Amount
+        revenue.Amount += fee.Amount
+        payment.Fees = append(payment.Fees, *charged)
+    }
+    return nil
+}
+
+// withFees attaches the fees charged for the payment returned by a replayed request.
+func (m BillingManager) withFees(payment *Payment, err error) (*Payment, error) {
+    if err != nil {
+        return nil, err
+    }
+    children, err := m.GetChildren(payment.ID)
+    if err != nil {
+        return nil, err
+    }
+    for _, child := range children {
+        if child.Kind == paymentFee {
+            payment.Fees = append(payment.Fees, child)
+        }
+    }
+    return payment, nil
+}
+
+func feeScheduleNotFound() managerError {
+    return inputError(codeNotFound, "fee schedule is not found")
+}
+
+func (m BillingManager) CreateFeeSchedule(schedule FeeSchedule) (*FeeSchedule, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO fee_schedule (currency, tier, payer, kind, flat, rate_bps, min_fee, max_fee, brackets, revenue_id, active, created_on)
+        VALUES (:currency, :tier, :payer, :kind, :flat, :rate_bps, :min_fee, :max_fee, :brackets, :revenue_id, :active, :created_on)
+        RETURNING fee_schedule_id`)
+    if err == nil {
+        err = stmt.Get(&schedule.ID, schedule)
+    }
+    if err == nil {
+        err = m.audit(tx, "fee_schedule.created", feeScheduleResource(schedule.ID), nil, &schedule)
+    }
+    if err != nil {
+        mustRollback(tx)
+        if isUniqueViolation(err) {
+            return nil, inputError(codeInvalidState, "there is an active fee schedule for the currency, tier and payer")
+        }
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &schedule, nil
+}
+
+func feeScheduleResource(id int) string {
+    return "fee_schedule/" + strconv.Itoa(id)
+}
+
+func (m BillingManager) ListFeeSchedules() ([]FeeSchedule, error) {
+    return listFeeSchedules(m.DB)
+}
+
+// listFeeSchedules returns the active fee schedules, e.g. within the transaction
+// which charges the fees.
+func listFeeSchedules(q sqlx.Queryer) ([]FeeSchedule, error) {
+    schedules := make([]FeeSchedule, 0)
+    err := sqlx.Select(q, &schedules, "SELECT * FROM fee_schedule WHERE active ORDER BY fee_schedule_id")
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return schedules, nil
+}
+
+func (m BillingManager) DeleteFeeSchedule(id int) (*FeeSchedule, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var schedules []FeeSchedule
+    err = tx.Select(&schedules,
+        "UPDATE fee_schedule SET active = FALSE WHERE fee_schedule_id = $1 AND active RETURNING *", id)
+    if err == nil && len(schedules) == 0 {
+        err = feeScheduleNotFound()
+    }
+    if err == nil {
+        before := schedules[0]
+        before.Active = true
+        err = m.audit(tx, "fee_schedule.deleted", feeScheduleResource(id), &before, &schedules[0])
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &schedules[0], nil
+}
+
+func (m BillingManager) SetAccountTier(identifier, tier string) (*Account, error) {
+    return m.updateAccount(identifier, "account.tier_changed", "UPDATE account SET tier = $2 WHERE identifier = $1", tier)
+}
+
+func (r FeeScheduleRequest) check() error {
+    var errs []FieldError
+    switch {
+    case r.Kind == feeFlat && r.Flat == 0:
+        errs = append(errs, FieldError{"flat", "is required for the flat fee"})
+    case r.Kind == feePercent && r.RateBps == 0:
+        errs = append(errs, FieldError{"rate_bps", "is required for the percent fee"})
+    case r.Kind == feeTiered && len(r.Brackets) == 0:
+        errs = append(errs, FieldError{"brackets", "are required for the tiered fee"})
+    case r.Kind != feeTiered && len(r.Brackets) > 0:
+        errs = append(errs, FieldError{"brackets", "are allowed for the tiered fee only"})
+    }
+    for i, bracket := range r.Brackets {
+        last := i == len(r.Brackets) - 1
+        switch {
+        case last && bracket.UpTo != 0:
+            errs = append(errs, FieldError{fmt.Sprintf("brackets[%d].up_to", i), "must be omitted for the last bracket"})
+        case !last && bracket.UpTo == 0:
+            errs = append(errs, FieldError{fmt.Sprintf("brackets[%d].up_to", i), "is required"})
+        case i > 0 && !last && bracket.UpTo <= r.Brackets[i-1].UpTo:
+            errs = append(errs, FieldError{fmt.Sprintf("brackets[%d].up_to", i), "must be greater than the previous one"})
+        }
+    }
+    if r.Max != 0 && r.Max < r.Min {
+        errs = append(errs, FieldError{"max", "must not be less than min"})
+    }
+    if len(errs) > 0 {
+        return validationError(errs)
+    }
+    return nil
+}
+
+// createFeeSchedule adds a fee schedule. The revenue account should have the
+// schedule's currency.
+//
+// Example of possible request's body:
+//
+//     {"currency": "USD", "payer": "sender", "kind": "percent", "rate_bps": 150,
+//      "min": 25, "revenue_account": "revenue"}
+func (api *BillingAPI) createFeeSchedule(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body FeeScheduleRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    err := body.check()
+    if err == nil {
+        var revenue *Account
+        if revenue, err = m.GetAccount(body.RevenueID); err == nil && revenue.Currency != body.Currency {
+            err = validationError([]FieldError{{"revenue_account", "must have the currency of the schedule"}})
+        }
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    schedule, err := m.CreateFeeSchedule(FeeSchedule{
+        Currency:body.Currency,
+        Tier:body.Tier,
+        Payer:body.Payer,
+        Kind:body.Kind,
+        Flat:body.Flat,
+        RateBps:body.RateBps,
+        Min:body.Min,
+        Max:body.Max,
+        Brackets:body.Brackets,
+        RevenueID:body.RevenueID,
+        Active:true,
+        Created:time.Now().UTC()})
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(FeeScheduleResponse{schedule})
+}
+
+// listFeeSchedules returns the active fee schedules.
+func (api *BillingAPI) listFeeSchedules(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    schedules, err := m.ListFeeSchedules()
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(FeeScheduleListResponse{schedules})
+}
+
+// deleteFeeSchedule deactivates the fee schedule identified by the path parameter.
+func (api *BillingAPI) deleteFeeSchedule(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    id, err := pathID(req, "id")
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    schedule, err := m.DeleteFeeSchedule(id)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(FeeScheduleResponse{schedule})
+}
+
+// quoteFees previews the fees of a transfer without making it.
+//
+// Example of possible request's body:
+//
+//     {"from": "account_1", "to": "account_2", "amount": 1000}
+func (api *BillingAPI) quoteFees(m Manager, resp *Responder, req *http.Request) {
+    var body FeeQuoteRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if err := authorize(req.Context(), body.From); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    accounts, err := m.GetAccounts([]string{body.From, body.To})
+    if err != nil {
+        writeManagerError(internalError(err), resp)
+        return
+    }
+    from, to, ok := pickPair(accounts, body.From, body.To)
+    if !ok {
+        writeManagerError(inputError(codeAccountNotFound, "cannot find the accounts"), resp)
+        return
+    }
+    if from.Currency != to.Currency {
+        writeManagerError(inputError(codeCurrencyMismatch, "cannot transfer money between accounts with different currency"), resp)
+        return
+    }
+    schedules, err := m.ListFeeSchedules()
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    quote := FeeQuoteResponse{Amount:body.Amount, Fees:make([]Fee, 0), Debited:body.Amount, Credited:body.Amount}
+    for _, fee := range transferFees(schedules, from, to, body.Amount) {
+        quote.Fees = append(quote.Fees, fee)
+        if fee.Payer == from.Identifier {
+            quote.Debited += fee.Amount
+        } else {
+            quote.Credited -= fee.Amount
+        }
+    }
+    resp.SendSuccess(quote)
+}
+
+// setAccountTier changes the tier of the account which selects its fee schedules.
+//
+// Example of possible request's body:
+//
+//     {"tier": "premium"}
+func (api *BillingAPI) setAccountTier(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body TierRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    account, err := m.SetAccountTier(req.PathValue("id"), body.Tier)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(AccountResponse{newAccountView(*account)})
+}
@@ -0,0 +1,325 @@
+// gRPC interface of the payment API.
+//
+// The gRPC server shares the Manager instance and the Authenticator with BillingAPI,
+// so both interfaces see the same data and accept the same tokens. The protobuf
+// definition is stored in the billingpb package.
+package server
+
+import (
+    "context"
+    "strconv"
+    "strings"
+
+    "../billingpb"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// BillingService implements billingpb.BillingServer on top of BillingAPI.
+type BillingService struct {
+    billingpb.UnimplementedBillingServer
+    api *BillingAPI
+}
+
+// NewGRPCServer creates a gRPC server exposing the operations of the api. The callers
+// are authenticated with the same tokens as the HTTP requests.
+func NewGRPCServer(api *BillingAPI) *grpc.Server {
+    server := grpc.NewServer(
+        grpc.UnaryInterceptor(api.Auth.unaryInterceptor),
+        grpc.StreamInterceptor(api.Auth.streamInterceptor))
+    billingpb.RegisterBillingServer(server, &BillingService{api:api})
+    return server
+}
+
+func (s *BillingService) ListAccounts(
+    ctx context.Context,
+    req *billingpb.ListAccountsRequest,
+) (*billingpb.ListAccountsResponse, error) {
+    m, err := s.api.manager()
+    if err != nil {
+        return nil, grpcError(internalError(err))
+    }
+    accounts, err := m.GetAvailableAccounts()
+    if err != nil {
+        return nil, grpcError(internalError(err))
+    }
+    result := &billingpb.ListAccountsResponse{}
+    for _, acc := range accessible(ctx, accounts) {
+        result.Accounts = append(result.Accounts, accountMessage(acc))
+    }
+    return result, nil
+}
+
+func (s *BillingService) GetAccount(ctx context.Context, req *billingpb.GetAccountRequest) (*billingpb.Account, error) {
+    m, err := s.api.manager()
+    if err != nil {
+        return nil, grpcError(internalError(err))
+    }
+    if err := authorize(ctx, req.Id); err != nil {
+        return nil, grpcError(err)
+    }
+    acc, err := m.GetAccount(req.Id)
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    return accountMessage(*acc), nil
+}
+
+func (s *BillingService) Transfer(ctx context.Context, req *billingpb.TransferRequest) (*billingpb.Payment, error) {
+    m, err := s.api.manager()
+    if err != nil {
+        return nil, grpcError(internalError(err))
+    }
+    body := TransferRequest{From:req.From, To:req.To, Amount:Cents(req.Amount), Pending:req.Pending}
+    if err := validationResult(&body); err != nil {
+        return nil, grpcError(err)
+    }
+    if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+        return nil, grpcError(validationError([]FieldError{{"idempotency_key", "must have length at most 64"}}))
+    }
+    if err := authorize(ctx, body.From); err != nil {
+        return nil, grpcError(err)
+    }
+    if err := s.api.checkThreshold(body.Amount); err != nil {
+        return nil, grpcError(err)
+    }
+    requestId := newRequestID()
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+        if values := md.Get("x-request-id"); len(values) > 0 && values[0] != "" && len(values[0]) <= maxRequestIDLength {
+            requestId = values[0]
+        }
+    }
+    m = m.Audited(PrincipalFrom(ctx).Name, requestId)
+    transfer := m.Transfer
+    if body.Pending {
+        transfer = m.TransferPending
+    }
+    payment, err := transfer(body.From, body.To, body.Amount, req.IdempotencyKey, PaymentDetails{})
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    return paymentMessage(*payment), nil
+}
+
+func (s *BillingService) ListPayments(
+    ctx context.Context,
+    req *billingpb.ListPaymentsRequest,
+) (*billingpb.ListPaymentsResponse, error) {
+    m, err := s.api.manager()
+    if err != nil {
+        return nil, grpcError(internalError(err))
+    }
+    query := PageQuery{Limit:int(req.PageSize), Cursor:req.PageToken}
+    if query.Limit == 0 {
+        query.Limit = defaultPageSize
+    }
+    if err := validationResult(&query); err != nil {
+        return nil, grpcError(err)
+    }
+    page := PageRequest{Limit:query.Limit + 1}
+    if query.Cursor != "" {
+        if page.Before, err = strconv.Atoi(query.Cursor); err != nil || page.Before <= 0 {
+            return nil, grpcError(validationError([]FieldError{{"page_token", "is malformed"}}))
+        }
+    }
+    if err := authorize(ctx, req.AccountId); err != nil {
+        return nil, grpcError(err)
+    }
+
+    payments, err := m.ListPayments(req.AccountId, page, PaymentFilter{})
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    result := &billingpb.ListPaymentsResponse{}
+    if len(payments) > query.Limit {
+        payments = payments[:query.Limit]
+        result.NextPageToken = strconv.Itoa(payments[query.Limit-1].ID)
+    }
+    for _, p := range payments {
+        result.Payments = append(result.Payments, paymentMessage(p))
+    }
+    return result, nil
+}
+
+// WatchPayments streams the account's payments committed after the payment with
+// the ID equal to req.AfterId, until the client cancels the call. If AfterId is zero,
+// only the new payments are streamed.
+func (s *BillingService) WatchPayments(req *billingpb.WatchPaymentsRequest, stream billingpb.Billing_WatchPaymentsServer) error {
+    ctx := stream.Context()
+    m, err := s.api.manager()
+    if err != nil {
+        return grpcError(internalError(err))
+    }
+    if err := authorize(ctx, req.AccountId); err != nil {
+        return grpcError(err)
+    }
+    if _, err := m.GetAccount(req.AccountId); err != nil {
+        return grpcError(err)
+    }
+
+    sub := s.api.Events.Subscribe(req.AccountId)
+    defer sub.Close()
+
+    send := func(p Payment) error { return stream.Send(paymentMessage(p)) }
+    last := int(req.AfterId)
+    if last > 0 {
+        if last, err = replay(m, req.AccountId, last, send); err != nil {
+            return grpcError(err)
+        }
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case p, ok := <-sub.C:
+            if !ok {
+                return status.Error(codes.Unavailable, "the stream has fallen behind; resume with after_id")
+            }
+            if p.ID <= last {
+                continue
+            }
+            if err := send(p); err != nil {
+                return err
+            }
+            last = p.ID
+        }
+    }
+}
+
+func accountMessage(acc Account) *billingpb.Account {
+    return &billingpb.Account{
+        Id:acc.Identifier,
+        Currency:acc.Currency,
+        Balance:int64(acc.Amount),
+        Available:int64(acc.Available()),
+        Created:timestamppb.New(acc.Created),
+    }
+}
+
+func paymentMessage(p Payment) *billingpb.Payment {
+    message := &billingpb.Payment{
+        Id:int64(p.ID),
+        From:p.From,
+        To:p.To,
+        Time:timestamppb.New(p.Time),
+        Amount:int64(p.Amount),
+        Currency:p.Currency,
+        Kind:p.Kind,
+        Status:p.Status,
+    }
+    if p.OriginalID != nil {
+        message.OriginalId = int64(*p.OriginalID)
+    }
+    return message
+}
+
+// grpcError converts the Manager's error into a gRPC status. The error code is
+// attached as the reason of the ErrorInfo detail.
+func grpcError(err error) error {
+    e, ok := err.(managerError)
+    if !ok {
+        e = internalError(err)
+    }
+    message := e.message
+    if e.internal {
+        message = "internal error"
+    }
+    st := status.New(grpcCode(e.code), message)
+    info := &errdetails.ErrorInfo{Reason:e.code, Domain:"billing"}
+    if e.limit != nil {
+        info.Metadata = map[string]string{"limit": e.limit.Limit, "remaining": strconv.FormatInt(*e.limit.Remaining, 10)}
+    }
+    detailed, derr := st.WithDetails(info)
+    if derr != nil {
+        return st.Err()
+    }
+    if len(e.fields) > 0 {
+        violations := &errdetails.BadRequest{}
+        for _, field := range e.fields {
+            violations.FieldViolations = append(violations.FieldViolations,
+                &errdetails.BadRequest_FieldViolation{Field:field.Field, Description:field.Message})
+        }
+        if withFields, ferr := detailed.WithDetails(violations); ferr == nil {
+            detailed = withFields
+        }
+    }
+    return detailed.Err()
+}
+
+// grpcCode picks a gRPC status code matching the error code.
+func grpcCode(code string) codes.Code {
+    switch code {
+    case codeNotFound, codeAccountNotFound:
+        return codes.NotFound
+    case codeInvalidRequest, codeValidationFailed, codeBodyTooLarge:
+        return codes.InvalidArgument
+    case codeInsufficientFunds, codeCurrencyMismatch, codeInvalidState, codeApprovalRequired:
+        return codes.FailedPrecondition
+    case codeIdempotencyConflict, codeDuplicateReference:
+        return codes.AlreadyExists
+    case codeLimitExceeded:
+        return codes.ResourceExhausted
+    case codeUnauthorized:
+        return codes.Unauthenticated
+    case codeForbidden:
+        return codes.PermissionDenied
+    }
+    return codes.Internal
+}
+
+// authenticateContext reads the bearer token from the call's metadata and stores
+// the principal in the context.
+func (a Authenticator) authenticateContext(ctx context.Context) (context.Context, error) {
+    var token string
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+        if values := md.Get("authorization"); len(values) > 0 {
+            token = strings.TrimPrefix(values[0], "Bearer ")
+        }
+    }
+    principal, err := a.Authenticate(token)
+    if err != nil {
+        return nil, grpcError(err)
+    }
+    return withPrincipal(ctx, principal), nil
+}
+
+func (a Authenticator) unaryInterceptor(
+    ctx context.Context,
+    req interface{},
+    info *grpc.UnaryServerInfo,
+    handler grpc.UnaryHandler,
+) (interface{}, error) {
+    ctx, err := a.authenticateContext(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return handler(ctx, req)
+}
+
+func (a Authenticator) streamInterceptor(
+    srv interface{},
+    ss grpc.ServerStream,
+    info *grpc.StreamServerInfo,
+    handler grpc.StreamHandler,
+) error {
+    ctx, err := a.authenticateContext(ss.Context())
+    if err != nil {
+        return err
+    }
+    return handler(srv, authenticatedStream{ss, ctx})
+}
+
+// authenticatedStream replaces the stream's context with the one carrying the principal.
+type authenticatedStream struct {
+    grpc.ServerStream
+    ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+    return s.ctx
+}
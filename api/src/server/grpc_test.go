@@ -0,0 +1,127 @@
+package server
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+
+    "../billingpb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPC_Accounts(t *testing.T) {
+    makeGRPCRequest(t, Config{}, func(ctx context.Context, client billingpb.BillingClient) {
+        accounts, err := client.ListAccounts(ctx, &billingpb.ListAccountsRequest{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(accounts.Accounts) != len(items) {
+            t.Errorf("invalid number of accounts: %d", len(accounts.Accounts))
+        }
+
+        acc, err := client.GetAccount(ctx, &billingpb.GetAccountRequest{Id:"A"})
+        if err != nil || acc.Balance != 10000 {
+            t.Errorf("invalid account: %v, %v", acc, err)
+        }
+
+        _, err = client.GetAccount(ctx, &billingpb.GetAccountRequest{Id:"Unknown"})
+        if status.Code(err) != codes.NotFound {
+            t.Errorf("NotFound was expected: %v", err)
+        }
+    })
+}
+
+func TestGRPC_Transfer(t *testing.T) {
+    makeGRPCRequest(t, Config{}, func(ctx context.Context, client billingpb.BillingClient) {
+        payment, err := client.Transfer(ctx, &billingpb.TransferRequest{From:"A", To:"B", Amount:100})
+        if err != nil || payment.Amount != 100 || payment.Currency != "USD" {
+            t.Errorf("invalid payment: %v, %v", payment, err)
+        }
+
+        var testCases = []struct{
+            req *billingpb.TransferRequest
+            code codes.Code
+        }{
+            {&billingpb.TransferRequest{From:"A", To:"B", Amount:0}, codes.InvalidArgument},
+            {&billingpb.TransferRequest{From:"A", To:"C", Amount:100}, codes.FailedPrecondition},
+            {&billingpb.TransferRequest{From:"A", To:"B", Amount:999999}, codes.FailedPrecondition},
+            {&billingpb.TransferRequest{From:"X", To:"B", Amount:100}, codes.NotFound},
+        }
+        for _, test := range testCases {
+            if _, err := client.Transfer(ctx, test.req); status.Code(err) != test.code {
+                t.Errorf("%s was expected for %v: %v", test.code, test.req, err)
+            }
+        }
+    })
+}
+
+func TestGRPC_Payments(t *testing.T) {
+    makeGRPCRequest(t, Config{}, func(ctx context.Context, client billingpb.BillingClient) {
+        page, err := client.ListPayments(ctx, &billingpb.ListPaymentsRequest{AccountId:"A", PageSize:1})
+        if err != nil || len(page.Payments) != 1 || page.NextPageToken == "" {
+            t.Fatalf("invalid page: %v, %v", page, err)
+        }
+        req := &billingpb.ListPaymentsRequest{AccountId:"A", PageSize:1, PageToken:page.NextPageToken}
+        page, err = client.ListPayments(ctx, req)
+        if err != nil || len(page.Payments) != 1 || page.NextPageToken != "" {
+            t.Errorf("invalid last page: %v, %v", page, err)
+        }
+
+        stream, err := client.WatchPayments(ctx, &billingpb.WatchPaymentsRequest{AccountId:"A", AfterId:1})
+        if err != nil {
+            t.Fatal(err)
+        }
+        payment, err := stream.Recv()
+        if err != nil || payment.Id != 2 {
+            t.Errorf("payment 2 was expected: %v, %v", payment, err)
+        }
+    })
+}
+
+func TestGRPC_Auth(t *testing.T) {
+    conf := Config{Tokens:map[string]Principal{
+        "secret": {Name:"alice", Role:RoleClient, Accounts:[]string{"A"}},
+    }}
+    makeGRPCRequest(t, conf, func(ctx context.Context, client billingpb.BillingClient) {
+        _, err := client.ListAccounts(ctx, &billingpb.ListAccountsRequest{})
+        if status.Code(err) != codes.Unauthenticated {
+            t.Errorf("Unauthenticated was expected: %v", err)
+        }
+
+        ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+        accounts, err := client.ListAccounts(ctx, &billingpb.ListAccountsRequest{})
+        if err != nil || len(accounts.Accounts) != 1 {
+            t.Errorf("only the accessible account was expected: %v, %v", accounts, err)
+        }
+        _, err = client.GetAccount(ctx, &billingpb.GetAccountRequest{Id:"B"})
+        if status.Code(err) != codes.PermissionDenied {
+            t.Errorf("PermissionDenied was expected: %v", err)
+        }
+    })
+}
+
+func makeGRPCRequest(t *testing.T, conf Config, testCase func(context.Context, billingpb.BillingClient)) {
+    listener := bufconn.Listen(1 << 20)
+    server := NewGRPCServer(NewBillingAPI(conf))
+    go func() { _ = server.Serve(listener) }()
+    defer server.Stop()
+
+    dial := func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }
+    conn, err := grpc.NewClient("passthrough:///bufnet",
+        grpc.WithContextDialer(dial),
+        grpc.WithTransportCredentials(insecure.NewCredentials()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    testCase(ctx, billingpb.NewBillingClient(conn))
+}
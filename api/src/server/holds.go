@@ -0,0 +1,382 @@
+// Two-phase transfers: the funds are reserved with a hold and settled later.
+//
+// A hold reduces the available balance of the sender but not its ledger balance.
+// The hold is captured, in full or in part, to create a payment to the recipient;
+// the rest of the reserved funds is released. A hold which is neither captured nor
+// voided expires after its TTL: the expired holds don't reserve funds anymore, and
+// their status is updated by a background job, see RunHoldExpiry.
+//
+// The transfer limits are checked when the hold is authorized, and once more when it
+// is captured, since only the captured payment is counted in the usage.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// Statuses of the holds.
+const (
+    holdActive = "active"
+    holdCaptured = "captured"
+    holdVoided = "voided"
+    holdExpired = "expired"
+)
+
+const (
+    defaultHoldTTL = 24*time.Hour
+    // holdExpiryJob is the name of the hold expiry job's advisory lock.
+    holdExpiryJob = "hold-expiry"
+    holdExpiryInterval = time.Minute
+)
+
+// HoldManager implements the two-phase transfers.
+type HoldManager interface {
+    // Authorize reserves the amount on the sender's account for a payment to toId.
+    Authorize(fromId, toId string, amount Cents, ttl time.Duration) (*Hold, error)
+    GetHold(id int) (*Hold, error)
+    // Capture creates a payment of the amount reserved by the hold; zero amount
+    // captures the whole hold. The rest of the hold is released.
+    Capture(id int, amount Cents) (*Hold, *Payment, error)
+    Void(id int) (*Hold, error)
+    // ExpireHolds marks the active holds expired at now as expired and returns
+    // their number.
+    ExpireHolds(now time.Time) (int, error)
+}
+
+// Hold reserves funds of the sender's account for a payment to the recipient.
+type Hold struct {
+    ID int                  `db:"hold_id" json:"id"`
+    From string             `db:"from_id" json:"from"`
+    To string               `db:"to_id" json:"to"`
+    Amount Cents            `db:"amount" json:"amount"`
+    Currency string         `db:"currency" json:"currency"`
+    Status string           `db:"status" json:"status"`
+    Captured Cents          `db:"captured" json:"captured"`
+    PaymentID sql.NullInt64 `db:"payment_id" json:"-"`
+    Created time.Time       `db:"created_on" json:"created"`
+    Expires time.Time       `db:"expires_at" json:"expires"`
+}
+
+// effective returns the hold with the status it has at the moment now: an active
+// hold is reported as expired as soon as its TTL has passed.
+func (h Hold) effective(now time.Time) Hold {
+    if h.Status == holdActive && !h.Expires.After(now) {
+        h.Status = holdExpired
+    }
+    return h
+}
+
+func holdNotFound() managerError {
+    return inputError(codeNotFound, "hold is not found")
+}
+
+// checkCapture verifies that the hold can be captured for the amount. The amount
+// of the full capture is returned.
+func checkCapture(hold Hold, amount Cents, now time.Time) (Cents, error) {
+    if status := hold.effective(now).Status; status != holdActive {
+        return 0, inputError(codeInvalidState, "cannot capture a hold which is " + status)
+    }
+    if amount == 0 {
+        amount = hold.Amount
+    }
+    if amount > hold.Amount {
+        return 0, validationError([]FieldError{{"amount", "must not exceed the held amount"}})
+    }
+    return amount, nil
+}
+
+func (m BillingManager) Authorize(fromId, toId string, amount Cents, ttl time.Duration) (*Hold, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    fromAcc, toAcc, err := lockPair(tx, fromId, toId, now)
+    if err != nil {
+        mustRollback(tx)
+        return nil, err
+    }
+    if fromAcc.Currency != toAcc.Currency {
+        mustRollback(tx)
+        return nil, inputError(codeCurrencyMismatch, "cannot hold money for an account with different currency")
+    }
+    if fromAcc.Available() < amount {
+        mustRollback(tx)
+        return nil, inputError(codeInsufficientFunds, "cannot hold the funds: insufficient funds")
+    }
+    if err = checkLimits(tx, fromAcc, amount, now); err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+
+    hold := Hold{
+        From:fromId,
+        To:toId,
+        Amount:amount,
+        Currency:fromAcc.Currency,
+        Status:holdActive,
+        Created:now,
+        Expires:now.Add(ttl)}
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO hold (from_id, to_id, amount, currency, status, captured, created_on, expires_at)
+        VALUES (:from_id, :to_id, :amount, :currency, :status, :captured, :created_on, :expires_at)
+        RETURNING hold_id`)
+    if err == nil {
+        err = stmt.Get(&hold.ID, hold)
+    }
+    if err == nil {
+        err = m.audit(tx, "hold.created", holdResource(hold.ID), nil, &hold)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &hold, nil
+}
+
+func (m BillingManager) GetHold(id int) (*Hold, error) {
+    var holds []Hold
+    if err := m.DB.Select(&holds, "SELECT * FROM hold WHERE hold_id = $1", id); err != nil {
+        return nil, internalError(err)
+    }
+    if len(holds) == 0 {
+        return nil, holdNotFound()
+    }
+    hold := holds[0].effective(time.Now().UTC())
+    return &hold, nil
+}
+
+func holdResource(id int) string {
+    return "hold/" + strconv.Itoa(id)
+}
+
+// lockHold selects the hold for update within the transaction tx.
+func lockHold(tx *sqlx.Tx, id int) (*Hold, error) {
+    var holds []Hold
+    if err := tx.Select(&holds, "SELECT * FROM hold WHERE hold_id = $1 FOR UPDATE", id); err != nil {
+        return nil, internalError(err)
+    }
+    if len(holds) == 0 {
+        return nil, holdNotFound()
+    }
+    return &holds[0], nil
+}
+
+func (m BillingManager) Capture(id int, amount Cents) (*Hold, *Payment, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    hold, err := lockHold(tx, id)
+    if err == nil {
+        amount, err = checkCapture(*hold, amount, now)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, nil, err
+    }
+
+    var locked []Account
+    schedules, err := listFeeSchedules(tx)
+    if err == nil {
+        locked, err = lockWithFees(tx, schedules, [][2]string{{hold.From, hold.To}}, now)
+    }
+    fromAcc, toAcc, ok := pickPair(locked, hold.From, hold.To)
+    if err == nil && !ok {
+        err = inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    // the hold is still active, so it is included in the held amount
+    if err == nil && fromAcc.Available() + hold.Amount < amount {
+        err = inputError(codeInsufficientFunds, "cannot capture the hold: insufficient funds")
+    }
+    if err == nil {
+        err = checkLimits(tx, fromAcc, amount, now)
+    }
+    var payment *Payment
+    if err == nil {
+        payment, err = move(tx, fromAcc, toAcc, Payment{Time:now, Amount:amount, Kind:paymentTransfer})
+    }
+    if err == nil {
+        accounts := accountMap(locked)
+        accounts[hold.From].Amount -= amount
+        accounts[hold.From].Held -= hold.Amount
+        accounts[hold.To].Amount += amount
+        err = chargeFees(tx, accounts, payment, transferFees(schedules, fromAcc, toAcc, amount), now)
+    }
+    before := *hold
+    if err == nil {
+        hold.Status, hold.Captured = holdCaptured, amount
+        hold.PaymentID = sql.NullInt64{Int64:int64(payment.ID), Valid:true}
+        _, err = tx.NamedExec(
+            "UPDATE hold SET status = :status, captured = :captured, payment_id = :payment_id WHERE hold_id = :hold_id",
+            hold)
+    }
+    if err == nil {
+        err = m.audit(tx, "hold.captured", holdResource(id), &before, hold)
+    }
+    if err == nil {
+        err = m.audit(tx, "payment.created", paymentResource(payment.ID), nil, payment)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, nil, internalError(err)
+    }
+    return hold, payment, nil
+}
+
+func (m BillingManager) Void(id int) (*Hold, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    before, err := lockHold(tx, id)
+    if err == nil {
+        if status := before.effective(time.Now().UTC()).Status; status != holdActive {
+            err = inputError(codeInvalidState, "cannot void a hold which is " + status)
+        }
+    }
+    var hold Hold
+    if err == nil {
+        hold = *before
+        hold.Status = holdVoided
+        _, err = tx.Exec("UPDATE hold SET status = $2 WHERE hold_id = $1", id, holdVoided)
+    }
+    if err == nil {
+        err = m.audit(tx, "hold.voided", holdResource(id), before, &hold)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &hold, nil
+}
+
+func (m BillingManager) ExpireHolds(now time.Time) (int, error) {
+    result, err := m.DB.Exec(
+        "UPDATE hold SET status = $1 WHERE status = $2 AND expires_at <= $3", holdExpired, holdActive, now)
+    if err != nil {
+        return 0, internalError(err)
+    }
+    n, _ := result.RowsAffected()
+    return int(n), nil
+}
+
+// RunHoldExpiry periodically marks the expired holds using the shared Manager until
+// the context is cancelled, while the instance leads the hold expiry job.
+func (api *BillingAPI) RunHoldExpiry(ctx context.Context) {
+    api.runLeader(ctx, holdExpiryJob, holdExpiryInterval, func(m Manager) error {
+        _, err := m.ExpireHolds(time.Now().UTC())
+        return err
+    })
+}
+
+// createHold reserves funds for a payment.
+//
+// Example of possible request's body:
+//
+//     {"from": "account_1", "to": "account_2", "amount": 1000, "ttl_seconds": 3600}
+func (api *BillingAPI) createHold(m Manager, resp *Responder, req *http.Request) {
+    var body HoldRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    err := authorize(req.Context(), body.From)
+    if err == nil {
+        err = api.checkThreshold(body.Amount)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    ttl := defaultHoldTTL
+    if body.TTL > 0 {
+        ttl = time.Duration(body.TTL)*time.Second
+    }
+    hold, err := m.Authorize(body.From, body.To, body.Amount, ttl)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(HoldResponse{hold})
+}
+
+// getHold returns the hold identified by the path parameter.
+func (api *BillingAPI) getHold(m Manager, resp *Responder, req *http.Request) {
+    hold, err := api.accessibleHold(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(HoldResponse{hold})
+}
+
+// captureHold settles the hold. The optional amount allows capturing a part of
+// the hold; the whole hold is captured by default.
+func (api *BillingAPI) captureHold(m Manager, resp *Responder, req *http.Request) {
+    var body CaptureRequest
+    if req.ContentLength != 0 {
+        if err := decodeRequest(resp, req, &body); err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+    }
+    hold, err := api.accessibleHold(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    hold, payment, err := m.Capture(hold.ID, body.Amount)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(CaptureResponse{hold, payment})
+}
+
+// voidHold releases the funds reserved by the hold.
+func (api *BillingAPI) voidHold(m Manager, resp *Responder, req *http.Request) {
+    hold, err := api.accessibleHold(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if hold, err = m.Void(hold.ID); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(HoldResponse{hold})
+}
+
+// accessibleHold returns the hold identified by the path parameter if the caller
+// can access its sender's account.
+func (api *BillingAPI) accessibleHold(m Manager, req *http.Request) (*Hold, error) {
+    id, err := pathID(req, "id")
+    if err != nil {
+        return nil, err
+    }
+    hold, err := m.GetHold(id)
+    if err != nil {
+        return nil, err
+    }
+    if err := authorize(req.Context(), hold.From); err != nil {
+        return nil, err
+    }
+    return hold, nil
+}
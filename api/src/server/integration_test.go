@@ -0,0 +1,331 @@
+//go:build integration
+
+// Integration tests of BillingManager against the PostgreSQL database started by
+// docker-compose.yml. They are built with the integration tag only:
+//
+//     $ docker-compose up -d db
+//     $ go test -tags integration ./src/server
+//
+// The tests connect as the billing role, like the API does. The INTEGRATION_DB
+// variable overrides the connection string. Every run creates its own accounts and
+// tiers, so the runs don't interfere with each other or with the seed data.
+package server
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+const integrationConn = "host=localhost port=5432 user=billing password=billing dbname=docker sslmode=disable"
+
+var (
+    // runId makes the accounts and the tiers created by the run unique.
+    runId = strconv.FormatInt(time.Now().UnixNano(), 36)
+    accountSeq int64
+)
+
+// openDatabase connects to the database, skipping the test if it is not available.
+func openDatabase(t *testing.T) BillingManager {
+    conn := os.Getenv("INTEGRATION_DB")
+    if conn == "" {
+        conn = integrationConn
+    }
+    m, err := NewBillingManager(conn)
+    if err != nil {
+        t.Skipf("the database is not available: %s", err)
+    }
+    t.Cleanup(func() { _ = m.Close() })
+    return m.(BillingManager)
+}
+
+// createAccounts creates the USD accounts of the tier with the amounts and their
+// opening ledger entries, and returns their identifiers.
+func createAccounts(t *testing.T, m BillingManager, tier string, amounts ...Cents) []string {
+    var ids []string
+    for _, amount := range amounts {
+        id := fmt.Sprintf("it-%s-%d", runId, atomic.AddInt64(&accountSeq, 1))
+        _, err := m.DB.Exec("INSERT INTO account (identifier, currency, amount, tier) VALUES ($1, 'USD', $2, $3)",
+            id, amount, tier)
+        if err == nil {
+            _, err = m.DB.Exec("INSERT INTO ledger_entry (account_id, kind, amount, created_at) VALUES ($1, 'opening', $2, $3)",
+                id, amount, time.Now().UTC())
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids = append(ids, id)
+    }
+    return ids
+}
+
+// createFee creates the flat fee charging the senders of the tier, and deactivates
+// it when the test ends.
+func createFee(t *testing.T, m BillingManager, tier, revenue string, flat Cents) {
+    schedule, err := m.CreateFeeSchedule(FeeSchedule{
+        Currency:"USD",
+        Tier:tier,
+        Payer:feeSender,
+        Kind:feeFlat,
+        Flat:flat,
+        RevenueID:revenue,
+        Active:true,
+        Created:time.Now().UTC()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { _, _ = m.DeleteFeeSchedule(schedule.ID) })
+}
+
+// tier returns a tier unique to the run.
+func tier(n int) string {
+    return fmt.Sprintf("t%s%d", runId, n)
+}
+
+// expectBalances compares the amounts of the accounts.
+func expectBalances(t *testing.T, m BillingManager, ids []string, amounts ...Cents) {
+    t.Helper()
+    for i, id := range ids {
+        acc, err := m.GetAccount(id)
+        if err != nil || acc.Amount != amounts[i] {
+            t.Errorf("%s should have %d: %v, %v", id, int64(amounts[i]), acc, err)
+        }
+    }
+}
+
+func TestIntegration_TransferFees(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(1), 1000, 0, 0)
+    createFee(t, m, tier(1), ids[2], 10)
+
+    payment, err := m.Transfer(ids[0], ids[1], 100, "", PaymentDetails{})
+    if err != nil || len(payment.Fees) != 1 || payment.Fees[0].Amount != 10 {
+        t.Fatalf("the transfer should be charged the fee: %v, %v", payment, err)
+    }
+    expectBalances(t, m, ids, 890, 100, 10)
+
+    results, err := m.TransferBatch([]BatchTransfer{
+        {From:ids[0], To:ids[1], Amount:100},
+        {From:ids[1], To:ids[0], Amount:50},
+    }, true)
+    if err != nil || len(results) != 2 || results[0].Payment == nil || results[1].Payment == nil {
+        t.Fatalf("the batch should be made: %v, %v", results, err)
+    }
+    expectBalances(t, m, ids, 830, 140, 30)
+}
+
+func TestIntegration_ConcurrentTransfers(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(2), 1000, 1000, 0, 0)
+    createFee(t, m, tier(2), ids[2], 1)
+    createFee(t, m, tier(3), ids[3], 1)
+
+    // the tier changes between the reading and the locking of the accounts, so the
+    // revenue accounts of both tiers have to be locked
+    var group sync.WaitGroup
+    errs := make(chan error, 60)
+    for i := 0; i < 20; i++ {
+        group.Add(3)
+        go func() {
+            defer group.Done()
+            _, err := m.Transfer(ids[0], ids[1], 1, "", PaymentDetails{})
+            errs <- err
+        }()
+        go func() {
+            defer group.Done()
+            _, err := m.Transfer(ids[1], ids[0], 1, "", PaymentDetails{})
+            errs <- err
+        }()
+        go func(i int) {
+            defer group.Done()
+            _, err := m.SetAccountTier(ids[0], tier(2 + i%2))
+            errs <- err
+        }(i)
+    }
+    group.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Errorf("the concurrent changes should succeed: %s", err)
+        }
+    }
+
+    reconciled, err := m.Reconcile(ids)
+    if err != nil || len(reconciled) != len(ids) {
+        t.Fatalf("the accounts should be reconciled: %v, %v", reconciled, err)
+    }
+    var revenue Cents
+    for _, r := range reconciled {
+        if r.Discrepancy != 0 {
+            t.Errorf("%s has a discrepancy: %v", r.Account, r)
+        }
+        if r.Account == ids[2] || r.Account == ids[3] {
+            revenue += r.Balance
+        }
+    }
+    if revenue != 40 {
+        t.Errorf("every transfer should be charged the fee of 1: %d", int64(revenue))
+    }
+}
+
+func TestIntegration_CompletePayment(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(4), 1000, 0, 0)
+    createFee(t, m, tier(4), ids[2], 10)
+    audited := m.Audited("integration", "req-" + runId)
+
+    payment, err := audited.TransferPending(ids[0], ids[1], 200, "", PaymentDetails{})
+    if err != nil || payment.Status != statusPending {
+        t.Fatalf("a pending payment was expected: %v, %v", payment, err)
+    }
+    if acc, _ := m.GetAccount(ids[0]); acc.Amount != 1000 || acc.Held != 200 {
+        t.Errorf("the amount should be reserved: %v", acc)
+    }
+    payment, err = audited.SetPaymentStatus(payment.ID, statusCompleted, "")
+    if err != nil || payment.Status != statusCompleted || len(payment.Fees) != 1 {
+        t.Fatalf("the payment should be completed with the fee: %v, %v", payment, err)
+    }
+    expectBalances(t, m, ids, 790, 200, 10)
+
+    // the sender spent the reserved funds, e.g. by an adjustment of the balance
+    pending, err := m.TransferPending(ids[0], ids[1], 500, "", PaymentDetails{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = m.DB.Exec("UPDATE account SET amount = 300 WHERE identifier = $1", ids[0]); err != nil {
+        t.Fatal(err)
+    }
+    _, err = m.SetPaymentStatus(pending.ID, statusCompleted, "")
+    if e, ok := err.(managerError); !ok || e.code != codeInsufficientFunds {
+        t.Errorf("insufficient funds were expected: %v", err)
+    }
+
+    entries, err := m.ListAudit(PageRequest{Limit:maxPageSize})
+    found := false
+    for _, entry := range entries {
+        found = found || (entry.RequestID == "req-" + runId && entry.Action == "payment.status_changed")
+    }
+    if err != nil || !found {
+        t.Errorf("the status change should be audited: %v", err)
+    }
+}
+
+func TestIntegration_Limits(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(5), 1000, 0)
+    if _, err := m.SetLimits("USD", ids[0], Limits{Daily:150}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := m.Transfer(ids[0], ids[1], 100, "", PaymentDetails{}); err != nil {
+        t.Fatal(err)
+    }
+    _, err := m.Transfer(ids[0], ids[1], 100, "", PaymentDetails{})
+    if e, ok := err.(managerError); !ok || e.code != codeLimitExceeded {
+        t.Errorf("the daily limit should be exceeded: %v", err)
+    }
+    limits, usage, err := m.GetLimits(ids[0], time.Now().UTC())
+    if err != nil || limits.Daily != 150 || usage.Daily != 100 || usage.HourlyCount != 1 {
+        t.Errorf("invalid limits: %v, %v, %v", limits, usage, err)
+    }
+}
+
+func TestIntegration_Audit(t *testing.T) {
+    m := openDatabase(t)
+    entry, err := m.AppendAudit(newAuditEntry("integration", "req-" + runId, "test.appended", "test/" + runId, nil, runId))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = m.DB.Exec("UPDATE audit_log SET actor = 'nobody' WHERE seq = $1", entry.Seq); err == nil {
+        t.Error("the audit log should not be changed")
+    }
+    if _, err = m.DB.Exec("DELETE FROM audit_log WHERE seq = $1", entry.Seq); err == nil {
+        t.Error("the audit entries should not be deleted")
+    }
+    report, err := m.VerifyAudit()
+    if err != nil || !report.Valid || report.Head == nil {
+        t.Errorf("the chain should be valid: %v, %v", report, err)
+    }
+}
+
+func TestIntegration_History(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(6), 1000, 500)
+    start := time.Now().UTC()
+    if _, err := m.Transfer(ids[0], ids[1], 300, "", PaymentDetails{}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := m.Transfer(ids[1], ids[0], 100, "", PaymentDetails{}); err != nil {
+        t.Fatal(err)
+    }
+    end := time.Now().UTC().Add(time.Second)
+
+    var balance StatementBalance
+    var entries []StatementEntry
+    err := m.Statement(ids[0], start, end,
+        func(_ Account, b StatementBalance) error { balance = b; return nil },
+        func(e StatementEntry) error { entries = append(entries, e); return nil })
+    if err != nil || balance.Opening != 1000 || balance.Debits != 300 || balance.Credits != 100 || len(entries) != 2 {
+        t.Errorf("invalid statement: %v, %d entries, %v", balance, len(entries), err)
+    }
+
+    if before, err := m.BalanceAt(ids[0], start); err != nil || before.Amount != 1000 {
+        t.Errorf("the opening balance was expected: %v, %v", before, err)
+    }
+    if after, err := m.BalanceAt(ids[0], end); err != nil || after.Amount != 800 {
+        t.Errorf("the current balance was expected: %v, %v", after, err)
+    }
+
+    // only the hours which have ended are rolled up, the rest is read from the payments
+    if _, err := m.RollupPayments(time.Now().UTC(), 24*365); err != nil {
+        t.Fatal(err)
+    }
+    points, err := m.PaymentVolume(ids[0], bucketDay, dayStart(start), end)
+    if err != nil || len(points) != 1 || points[0].Count != 2 || points[0].Amount != 400 {
+        t.Errorf("invalid volume: %v, %v", points, err)
+    }
+
+    reconciled, err := m.Reconcile(ids)
+    if err != nil || len(reconciled) != 2 || reconciled[0].Discrepancy != 0 || reconciled[1].Discrepancy != 0 {
+        t.Errorf("the accounts should be reconciled: %v, %v", reconciled, err)
+    }
+}
+
+func TestIntegration_EventFeed(t *testing.T) {
+    m := openDatabase(t)
+    ids := createAccounts(t, m, tier(7), 1000, 0)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    published := make(chan Payment, 16)
+    go func() {
+        _ = m.FeedPayments(ctx, func(p Payment) {
+            if p.From == ids[0] {
+                published <- p
+            }
+        })
+    }()
+
+    // the feed starts listening asynchronously, so the transfers are repeated until the
+    // feed publishes one of them
+    made := make(map[int]bool)
+    for i := 0; i < 10; i++ {
+        payment, err := m.Transfer(ids[0], ids[1], 1, "", PaymentDetails{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        made[payment.ID] = true
+        select {
+        case p := <-published:
+            if !made[p.ID] || p.Amount != 1 || p.To != ids[1] {
+                t.Errorf("a committed payment was expected: %v", p)
+            }
+            return
+        case <-time.After(500*time.Millisecond):
+        }
+    }
+    t.Error("the committed payments should be published")
+}
@@ -0,0 +1,588 @@
+// ISO 20022 messages: camt.053 statements and pain.001 credit transfer initiations.
+//
+// The account statements are also rendered as camt.053.001.02 documents, the bank to
+// customer statements, with the opening and the closing booked balances, the totals
+// and an entry per payment. The account identifiers are reported as the proprietary
+// ("other") identifications, since the accounts don't have IBANs.
+//
+// The customers can initiate many transfers at once by uploading a pain.001.001.03
+// file. The file is validated against the bundled schema, and its number of
+// transactions and control sum are checked, at the group level and at the level of
+// each payment information block; a mismatch rejects the whole group or block. The
+// remaining instructions are checked like the transfers made with POST /v1/transfers
+// and are made one by one, in the best-effort mode, regardless of the requested
+// execution date. The outcome is returned as a pain.002.001.03 status report with
+// the status of every instruction and, for the rejected ones, the ISO reason code.
+//
+// Every instruction is made with an idempotency key derived from the message, the
+// payment information and the end-to-end IDs and the position of the instruction, so
+// uploading the same file again doesn't move funds twice: it reports the payments
+// made the first time.
+package server
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "math/big"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    statementCAMT053 = "camt053"
+
+    camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+    pain001Name = "pain.001.001.03"
+)
+
+// Bundled schemas of the messages.
+var (
+    camt053Schema = mustLoadSchema("schemas/camt.053.001.02.xsd")
+    pain001Schema = mustLoadSchema("schemas/pain.001.001.03.xsd")
+    pain002Schema = mustLoadSchema("schemas/pain.002.001.03.xsd")
+)
+
+// Statuses of the ISO 20022 status reports.
+const (
+    isoAccepted = "ACSC"
+    isoInProcess = "ACSP"
+    isoPartial = "PART"
+    isoRejected = "RJCT"
+)
+
+// isoReasons maps the error codes to the ISO 20022 status reason codes.
+var isoReasons = map[string]string{
+    codeAccountNotFound: "AC01",
+    codeInsufficientFunds: "AM04",
+    codeLimitExceeded: "AM02",
+    codeCurrencyMismatch: "AM03",
+    codeForbidden: "AG01",
+    codeApprovalRequired: "AG01",
+    codeIdempotencyConflict: "AM05",
+    codeDuplicateReference: "AM05",
+}
+
+// isoTime formats the time as an ISODateTime.
+func isoTime(t time.Time) string {
+    return t.UTC().Format(time.RFC3339)
+}
+
+// isoAmount formats the absolute value of the cents as an ISO 20022 amount.
+func isoAmount(c Cents) string {
+    if c < 0 {
+        c = -c
+    }
+    return decimal(c)
+}
+
+// isoIndicator returns the credit or debit indicator of the signed amount.
+func isoIndicator(c Cents) string {
+    if c < 0 {
+        return "DBIT"
+    }
+    return "CRDT"
+}
+
+// ---------------
+// camt.053
+// ---------------
+
+type camtAmount struct {
+    Currency string `xml:"Ccy,attr"`
+    Value string    `xml:",chardata"`
+}
+
+type camtGroupHeader struct {
+    MsgID string   `xml:"MsgId"`
+    Created string `xml:"CreDtTm"`
+}
+
+type camtPeriod struct {
+    From string `xml:"FrDtTm"`
+    To string   `xml:"ToDtTm"`
+}
+
+type camtAccount struct {
+    ID string       `xml:"Id>Othr>Id"`
+    Currency string `xml:"Ccy,omitempty"`
+}
+
+type camtBalance struct {
+    Code string       `xml:"Tp>CdOrPrtry>Cd"`
+    Amount camtAmount `xml:"Amt"`
+    Indicator string  `xml:"CdtDbtInd"`
+    Date string       `xml:"Dt>Dt"`
+}
+
+type camtTotals struct {
+    Entries int         `xml:"TtlNtries>NbOfNtries"`
+    Sum string          `xml:"TtlNtries>Sum"`
+    Net string          `xml:"TtlNtries>TtlNetNtryAmt"`
+    NetIndicator string `xml:"TtlNtries>CdtDbtInd"`
+    Credits int         `xml:"TtlCdtNtries>NbOfNtries"`
+    CreditSum string    `xml:"TtlCdtNtries>Sum"`
+    Debits int          `xml:"TtlDbtNtries>NbOfNtries"`
+    DebitSum string     `xml:"TtlDbtNtries>Sum"`
+}
+
+type camtEntry struct {
+    Amount camtAmount           `xml:"Amt"`
+    Indicator string            `xml:"CdtDbtInd"`
+    Status string               `xml:"Sts"`
+    Booked string               `xml:"BookgDt>DtTm"`
+    Reference string            `xml:"AcctSvcrRef"`
+    Code string                 `xml:"BkTxCd>Prtry>Cd"`
+    Transaction camtTransaction `xml:"NtryDtls>TxDtls"`
+}
+
+type camtTransaction struct {
+    Reference string     `xml:"Refs>AcctSvcrRef"`
+    Debtor camtAccount   `xml:"RltdPties>DbtrAcct"`
+    Creditor camtAccount `xml:"RltdPties>CdtrAcct"`
+    Remittance string    `xml:"RmtInf>Ustrd"`
+}
+
+// camtRemittance is the unstructured remittance information of the line: the memo, if
+// any, or the reference. Both fit in the 140 characters allowed.
+func camtRemittance(l StatementLine) string {
+    if l.Memo != "" {
+        return l.Memo
+    }
+    return l.Reference
+}
+
+// camtStatement writes the statement as a camt.053 document. The document is written
+// with a streaming encoder: the Stmt element is opened with the balances and closed
+// after the last entry.
+type camtStatement struct {
+    encoder *xml.Encoder
+    summary StatementSummary
+    err error
+}
+
+func (s *camtStatement) open(summary StatementSummary, balance StatementBalance) error {
+    s.summary = summary
+    now := isoTime(time.Now())
+    closing := balance.Closing()
+    net := balance.Credits - balance.Debits
+    s.token(xml.ProcInst{Target:"xml", Inst:[]byte(`version="1.0" encoding="UTF-8"`)})
+    s.start("Document", xml.Attr{Name:xml.Name{Local:"xmlns"}, Value:camt053Namespace})
+    s.start("BkToCstmrStmt")
+    s.element("GrpHdr", camtGroupHeader{MsgID:newRequestID(), Created:now})
+    s.start("Stmt")
+    s.element("Id", strings.ReplaceAll(summary.From + "-" + summary.To, "-", ""))
+    s.element("CreDtTm", now)
+    s.element("FrToDt", camtPeriod{From:summary.From + "T00:00:00Z", To:summary.To + "T23:59:59Z"})
+    s.element("Acct", camtAccount{ID:summary.Account, Currency:summary.Currency})
+    s.element("Bal", camtBalance{
+        Code:"OPBD",
+        Amount:camtAmount{summary.Currency, isoAmount(balance.Opening)},
+        Indicator:isoIndicator(balance.Opening),
+        Date:summary.From})
+    s.element("Bal", camtBalance{
+        Code:"CLBD",
+        Amount:camtAmount{summary.Currency, isoAmount(closing)},
+        Indicator:isoIndicator(closing),
+        Date:summary.To})
+    s.element("TxsSummry", camtTotals{
+        Entries:balance.CreditCount + balance.DebitCount,
+        Sum:isoAmount(balance.Credits + balance.Debits),
+        Net:isoAmount(net),
+        NetIndicator:isoIndicator(net),
+        Credits:balance.CreditCount,
+        CreditSum:isoAmount(balance.Credits),
+        Debits:balance.DebitCount,
+        DebitSum:isoAmount(balance.Debits)})
+    return s.flush()
+}
+
+func (s *camtStatement) line(l StatementLine) error {
+    entry := camtEntry{
+        Amount:camtAmount{s.summary.Currency, isoAmount(l.Amount)},
+        Indicator:isoIndicator(l.Amount),
+        Status:"BOOK",
+        Booked:isoTime(l.Booked),
+        Reference:strconv.Itoa(l.PaymentID),
+        Code:l.Kind,
+        Transaction:camtTransaction{
+            Reference:strconv.Itoa(l.PaymentID),
+            Debtor:camtAccount{ID:s.summary.Account},
+            Creditor:camtAccount{ID:l.Counterparty},
+            Remittance:camtRemittance(l)}}
+    if l.Amount > 0 {
+        entry.Transaction.Debtor, entry.Transaction.Creditor = entry.Transaction.Creditor, entry.Transaction.Debtor
+    }
+    s.element("Ntry", entry)
+    return s.flush()
+}
+
+func (s *camtStatement) close(summary StatementSummary) error {
+    s.end("Stmt")
+    s.end("BkToCstmrStmt")
+    s.end("Document")
+    return s.flush()
+}
+
+func (s *camtStatement) token(t xml.Token) {
+    if s.err == nil {
+        s.err = s.encoder.EncodeToken(t)
+    }
+}
+
+func (s *camtStatement) start(name string, attrs ...xml.Attr) {
+    s.token(xml.StartElement{Name:xml.Name{Local:name}, Attr:attrs})
+}
+
+func (s *camtStatement) end(name string) {
+    s.token(xml.EndElement{Name:xml.Name{Local:name}})
+}
+
+func (s *camtStatement) element(name string, value interface{}) {
+    if s.err == nil {
+        s.err = s.encoder.EncodeElement(value, xml.StartElement{Name:xml.Name{Local:name}})
+    }
+}
+
+func (s *camtStatement) flush() error {
+    if s.err == nil {
+        s.err = s.encoder.Flush()
+    }
+    return s.err
+}
+
+// ---------------
+// pain.001
+// ---------------
+
+// pain001Document is the part of a validated pain.001 file read by the service.
+type pain001Document struct {
+    MsgID string              `xml:"CstmrCdtTrfInitn>GrpHdr>MsgId"`
+    Created string            `xml:"CstmrCdtTrfInitn>GrpHdr>CreDtTm"`
+    Transactions string       `xml:"CstmrCdtTrfInitn>GrpHdr>NbOfTxs"`
+    ControlSum string         `xml:"CstmrCdtTrfInitn>GrpHdr>CtrlSum"`
+    Payments []pain001Payment `xml:"CstmrCdtTrfInitn>PmtInf"`
+}
+
+// pain001Payment is a payment information block: the transfers from a debtor account.
+type pain001Payment struct {
+    ID string                   `xml:"PmtInfId"`
+    Transactions string         `xml:"NbOfTxs"`
+    ControlSum string           `xml:"CtrlSum"`
+    Debtor pain001Account       `xml:"DbtrAcct"`
+    Transfers []pain001Transfer `xml:"CdtTrfTxInf"`
+}
+
+type pain001Account struct {
+    IBAN string     `xml:"Id>IBAN"`
+    Other string    `xml:"Id>Othr>Id"`
+    Currency string `xml:"Ccy"`
+}
+
+// identifier returns the account's identifier in the service.
+func (a pain001Account) identifier() string {
+    if a.Other != "" {
+        return a.Other
+    }
+    return a.IBAN
+}
+
+type pain001Transfer struct {
+    InstructionID string     `xml:"PmtId>InstrId"`
+    EndToEndID string        `xml:"PmtId>EndToEndId"`
+    Amount camtAmount        `xml:"Amt>InstdAmt"`
+    Creditor *pain001Account `xml:"CdtrAcct"`
+    Remittance []string      `xml:"RmtInf>Ustrd"`
+}
+
+// readPain001 validates the file against the schema and decodes it.
+func readPain001(data []byte) (*pain001Document, error) {
+    root, err := parseXML(bytes.NewReader(data))
+    if err != nil {
+        return nil, inputError(codeInvalidRequest, "request body is not a valid XML: " + err.Error())
+    }
+    if errs := pain001Schema.validate(root); len(errs) > 0 {
+        return nil, validationError(errs)
+    }
+    var doc pain001Document
+    if err = xml.Unmarshal(data, &doc); err != nil {
+        return nil, internalError(err)
+    }
+    return &doc, nil
+}
+
+// checkTotals compares the number of transactions and the control sum of a group or
+// a block with its transfers. The control sum is optional.
+func checkTotals(transactions, controlSum string, transfers []pain001Transfer) *pain002Reason {
+    if transactions != "" && transactions != strconv.Itoa(len(transfers)) {
+        return &pain002Reason{"AM18", fmt.Sprintf("NbOfTxs is %s, but there are %d transactions", transactions, len(transfers))}
+    }
+    if controlSum == "" {
+        return nil
+    }
+    sum := new(big.Rat)
+    for _, t := range transfers {
+        if amount, ok := new(big.Rat).SetString(t.Amount.Value); ok {
+            sum.Add(sum, amount)
+        }
+    }
+    if expected, ok := new(big.Rat).SetString(controlSum); !ok || expected.Cmp(sum) != 0 {
+        return &pain002Reason{"AM10", fmt.Sprintf("CtrlSum is %s, but the amounts sum up to %s", controlSum, sum.FloatString(2))}
+    }
+    return nil
+}
+
+// parseAmount converts a decimal amount of the money units into cents.
+func parseAmount(text string) (Cents, bool) {
+    amount, ok := new(big.Rat).SetString(text)
+    if !ok {
+        return 0, false
+    }
+    amount.Mul(amount, big.NewRat(100, 1))
+    if !amount.IsInt() || !amount.Num().IsInt64() {
+        return 0, false
+    }
+    return Cents(amount.Num().Int64()), true
+}
+
+// pain001Key derives the idempotency key of an instruction.
+func pain001Key(doc *pain001Document, payment pain001Payment, index int) string {
+    sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s",
+        doc.MsgID, payment.ID, index, payment.Transfers[index].EndToEndID)))
+    return "pain001:" + hex.EncodeToString(sum[:16])
+}
+
+// checkInstruction applies the checks of POST /v1/transfers to an instruction.
+func (api *BillingAPI) checkInstruction(
+    ctx context.Context,
+    m Manager,
+    payment pain001Payment,
+    transfer pain001Transfer,
+) (*BatchTransfer, *pain002Reason) {
+    from := payment.Debtor.identifier()
+    if err := authorize(ctx, from); err != nil {
+        return nil, isoReason(err)
+    }
+    if transfer.Creditor == nil {
+        return nil, &pain002Reason{"AC01", "creditor account is missing"}
+    }
+    if transfer.Amount.Value == "" {
+        return nil, &pain002Reason{"NARR", "only the instructed amounts are supported"}
+    }
+    amount, ok := parseAmount(transfer.Amount.Value)
+    if !ok || amount <= 0 {
+        return nil, &pain002Reason{"AM12", "amount should be positive with at most 2 fraction digits"}
+    }
+    account, err := m.GetAccount(from)
+    if err != nil {
+        return nil, isoReason(err)
+    }
+    if transfer.Amount.Currency != account.Currency ||
+        payment.Debtor.Currency != "" && payment.Debtor.Currency != account.Currency {
+        return nil, &pain002Reason{"AM03", "currency of the debtor account is " + account.Currency}
+    }
+    if err = api.checkThreshold(amount); err != nil {
+        return nil, isoReason(err)
+    }
+    return &BatchTransfer{From:from, To:transfer.Creditor.identifier(), Amount:amount, Details:pain001Details(transfer)}, nil
+}
+
+// pain001Details takes the reference of the payment from the end-to-end ID, unless it
+// is not provided, and the memo from the unstructured remittance information.
+func pain001Details(transfer pain001Transfer) PaymentDetails {
+    memo := []rune(strings.Join(transfer.Remittance, " "))
+    if len(memo) > maxMemoLength {
+        memo = memo[:maxMemoLength]
+    }
+    details := PaymentDetails{Memo:string(memo)}
+    if transfer.EndToEndID != "NOTPROVIDED" {
+        details.Reference = transfer.EndToEndID
+    }
+    return details
+}
+
+// isoReason converts an error into the reason of a rejection.
+func isoReason(err error) *pain002Reason {
+    e := internalError(err)
+    code, ok := isoReasons[e.code]
+    if !ok {
+        code = "NARR"
+    }
+    if e.internal {
+        return &pain002Reason{code, "internal error"}
+    }
+    return &pain002Reason{code, clip(e.message, 105)}
+}
+
+// initiateTransfers makes the transfers of the file and reports their statuses.
+func (api *BillingAPI) initiateTransfers(ctx context.Context, m Manager, doc *pain001Document) pain002Document {
+    report := pain002Document{
+        MsgID:newRequestID(),
+        Created:isoTime(time.Now()),
+        Group:pain002Group{
+            MsgID:doc.MsgID,
+            MsgName:pain001Name,
+            Created:doc.Created,
+            Transactions:doc.Transactions,
+            ControlSum:doc.ControlSum}}
+
+    var all []pain001Transfer
+    for _, payment := range doc.Payments {
+        all = append(all, payment.Transfers...)
+    }
+    if reason := checkTotals(doc.Transactions, doc.ControlSum, all); reason != nil {
+        report.Group.Status, report.Group.Reasons = isoRejected, []pain002Reason{*reason}
+        return report
+    }
+
+    // The instructions which pass the checks are made together; the statuses of the
+    // others are filled in right away.
+    var transfers []BatchTransfer
+    var pending []*pain002Transfer
+    report.Payments = make([]pain002Payment, len(doc.Payments))
+    for i, payment := range doc.Payments {
+        status := &report.Payments[i]
+        status.ID, status.Transactions, status.ControlSum = payment.ID, payment.Transactions, payment.ControlSum
+        if reason := checkTotals(payment.Transactions, payment.ControlSum, payment.Transfers); reason != nil {
+            status.Status, status.Reasons = isoRejected, []pain002Reason{*reason}
+            continue
+        }
+        status.Transfers = make([]pain002Transfer, len(payment.Transfers))
+        for j, transfer := range payment.Transfers {
+            result := &status.Transfers[j]
+            result.InstructionID, result.EndToEndID = transfer.InstructionID, transfer.EndToEndID
+            checked, reason := api.checkInstruction(ctx, m, payment, transfer)
+            if reason != nil {
+                result.Status, result.Reasons = isoRejected, []pain002Reason{*reason}
+                continue
+            }
+            checked.IdempotencyKey = pain001Key(doc, payment, j)
+            transfers = append(transfers, *checked)
+            pending = append(pending, result)
+        }
+    }
+    for i, result := range transferEach(m.Transfer, transfers) {
+        status := pending[i]
+        if result.Payment == nil {
+            status.Status = isoRejected
+            status.Reasons = []pain002Reason{*isoReason(inputError(result.Code, result.Error))}
+            continue
+        }
+        status.Status = isoInProcess
+        if result.Payment.Status == statusCompleted {
+            status.Status = isoAccepted
+        }
+        status.Accepted = isoTime(result.Payment.Time)
+        status.Reference = strconv.Itoa(result.Payment.ID)
+    }
+
+    var statuses []string
+    for i := range report.Payments {
+        payment := &report.Payments[i]
+        if payment.Status == "" {
+            var transfers []string
+            for _, transfer := range payment.Transfers {
+                transfers = append(transfers, transfer.Status)
+            }
+            payment.Status = groupStatus(transfers)
+        }
+        statuses = append(statuses, payment.Status)
+    }
+    report.Group.Status = groupStatus(statuses)
+    return report
+}
+
+// groupStatus sums up the statuses of the members of a group.
+func groupStatus(statuses []string) string {
+    counts := make(map[string]int)
+    for _, status := range statuses {
+        counts[status]++
+    }
+    switch {
+    case counts[isoRejected] == len(statuses):
+        return isoRejected
+    case counts[isoRejected] > 0 || counts[isoPartial] > 0:
+        return isoPartial
+    case counts[isoInProcess] > 0:
+        return isoInProcess
+    }
+    return isoAccepted
+}
+
+// ---------------
+// pain.002
+// ---------------
+
+type pain002Document struct {
+    XMLName xml.Name          `xml:"urn:iso:std:iso:20022:tech:xsd:pain.002.001.03 Document"`
+    MsgID string              `xml:"CstmrPmtStsRpt>GrpHdr>MsgId"`
+    Created string            `xml:"CstmrPmtStsRpt>GrpHdr>CreDtTm"`
+    Group pain002Group        `xml:"CstmrPmtStsRpt>OrgnlGrpInfAndSts"`
+    Payments []pain002Payment `xml:"CstmrPmtStsRpt>OrgnlPmtInfAndSts"`
+}
+
+type pain002Group struct {
+    MsgID string            `xml:"OrgnlMsgId"`
+    MsgName string          `xml:"OrgnlMsgNmId"`
+    Created string          `xml:"OrgnlCreDtTm,omitempty"`
+    Transactions string     `xml:"OrgnlNbOfTxs,omitempty"`
+    ControlSum string       `xml:"OrgnlCtrlSum,omitempty"`
+    Status string           `xml:"GrpSts"`
+    Reasons []pain002Reason `xml:"StsRsnInf"`
+}
+
+type pain002Payment struct {
+    ID string                   `xml:"OrgnlPmtInfId"`
+    Transactions string         `xml:"OrgnlNbOfTxs,omitempty"`
+    ControlSum string           `xml:"OrgnlCtrlSum,omitempty"`
+    Status string               `xml:"PmtInfSts"`
+    Reasons []pain002Reason     `xml:"StsRsnInf"`
+    Transfers []pain002Transfer `xml:"TxInfAndSts"`
+}
+
+type pain002Transfer struct {
+    InstructionID string    `xml:"OrgnlInstrId,omitempty"`
+    EndToEndID string       `xml:"OrgnlEndToEndId"`
+    Status string           `xml:"TxSts"`
+    Reasons []pain002Reason `xml:"StsRsnInf"`
+    Accepted string         `xml:"AccptncDtTm,omitempty"`
+    Reference string        `xml:"AcctSvcrRef,omitempty"`
+}
+
+// pain002Reason is the ISO code of the rejection with its description.
+type pain002Reason struct {
+    Code string `xml:"Rsn>Cd"`
+    Info string `xml:"AddtlInf,omitempty"`
+}
+
+// importPain001 makes the credit transfers of a pain.001 file and replies with the
+// pain.002 status report. A file which is not valid against the schema is rejected
+// with a JSON error, like the other requests.
+func (api *BillingAPI) importPain001(m Manager, resp *Responder, req *http.Request) {
+    data, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, maxBodySize))
+    if err != nil {
+        writeManagerError(decodingError(err), resp)
+        return
+    }
+    doc, err := readPain001(data)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    report := api.initiateTransfers(req.Context(), m, doc)
+    resp.Header().Set("Content-Type", "application/xml")
+    resp.WriteHeader(http.StatusOK)
+    _, _ = io.WriteString(resp, xml.Header)
+    encoder := xml.NewEncoder(resp)
+    encoder.Indent("", "  ")
+    if err = encoder.Encode(report); err != nil {
+        log.Printf("encoding error: %s", err)
+    }
+}
@@ -0,0 +1,347 @@
+// Transfer limits and velocity controls.
+//
+// The limits restrict the outgoing transfers of an account: the amount of a single
+// transfer, the totals sent during the current UTC day and month, and the number of
+// transfers made during the last hour. The limits are set for a currency, and can be
+// overridden for a single account: every limit of the account's rule which is set
+// replaces the currency's one. Zero means there is no limit.
+//
+// The usage is counted from the transfers and the splits sent by the account, except
+// the failed and the cancelled ones. The limits are checked in the transaction which
+// holds the lock of the sender's account, so the concurrent transfers of the account
+// cannot exceed them together. The holds are checked both when they are authorized
+// and when they are captured.
+package server
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// Names of the limits.
+const (
+    limitMaxTransfer = "max_transfer"
+    limitDaily = "daily"
+    limitMonthly = "monthly"
+    limitHourlyCount = "hourly_count"
+)
+
+// LimitManager keeps the limits of the outgoing transfers.
+type LimitManager interface {
+    // SetLimits replaces the limits of the currency, or of the account if accountId
+    // is not empty.
+    SetLimits(currency, accountId string, limits Limits) (*LimitRule, error)
+    // GetLimits returns the effective limits of the account and its usage at now.
+    GetLimits(accountId string, now time.Time) (*Limits, *Usage, error)
+    // GetLimitRule returns the limits set for the currency, or for the account if
+    // accountId is not empty; nil is returned if they are not set.
+    GetLimitRule(currency, accountId string) (*LimitRule, error)
+}
+
+// Limits of the outgoing transfers of an account. Zero means there is no limit.
+type Limits struct {
+    MaxTransfer Cents `db:"max_transfer" json:"max_transfer,omitempty"`
+    Daily Cents       `db:"daily" json:"daily,omitempty"`
+    Monthly Cents     `db:"monthly" json:"monthly,omitempty"`
+    HourlyCount int   `db:"hourly_count" json:"hourly_count,omitempty"`
+}
+
+// LimitRule sets the limits of a currency, or of a single account if the AccountID
+// is valid.
+type LimitRule struct {
+    ID int                   `db:"limit_id" json:"id"`
+    Currency string          `db:"currency" json:"currency"`
+    AccountID sql.NullString `db:"account_id" json:"-"`
+    Limits
+    Updated time.Time        `db:"updated_on" json:"updated"`
+}
+
+// Usage is the part of the limits used by the account. HourlyFrom is the time of the
+// oldest transfer made during the last hour.
+type Usage struct {
+    Daily Cents             `db:"daily"`
+    Monthly Cents           `db:"monthly"`
+    HourlyCount int         `db:"hourly_count"`
+    HourlyFrom sql.NullTime `db:"hourly_from"`
+}
+
+// LimitStatus reports the usage of a limit. The amounts are in cents, or in transfers
+// for the hourly count. The Value and the Remaining allowance are omitted if the
+// limit is not set.
+type LimitStatus struct {
+    Limit string      `json:"limit"`
+    Value int64       `json:"value,omitempty"`
+    Used int64        `json:"used"`
+    Remaining *int64  `json:"remaining,omitempty"`
+    Resets *time.Time `json:"resets,omitempty"`
+}
+
+// merge overrides the limits with the ones set by the other.
+func (l Limits) merge(other Limits) Limits {
+    if other.MaxTransfer != 0 {
+        l.MaxTransfer = other.MaxTransfer
+    }
+    if other.Daily != 0 {
+        l.Daily = other.Daily
+    }
+    if other.Monthly != 0 {
+        l.Monthly = other.Monthly
+    }
+    if other.HourlyCount != 0 {
+        l.HourlyCount = other.HourlyCount
+    }
+    return l
+}
+
+// dayStart and monthStart return the beginnings of the periods of the limits.
+func dayStart(now time.Time) time.Time {
+    return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(now time.Time) time.Time {
+    return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// status reports the usage of every limit at now.
+func (l Limits) status(usage Usage, now time.Time) []LimitStatus {
+    nextDay, nextMonth := dayStart(now).AddDate(0, 0, 1), monthStart(now).AddDate(0, 1, 0)
+    var hourly *time.Time
+    if usage.HourlyFrom.Valid {
+        resets := usage.HourlyFrom.Time.UTC().Add(time.Hour)
+        hourly = &resets
+    }
+    statuses := []LimitStatus{
+        {Limit:limitMaxTransfer, Value:int64(l.MaxTransfer)},
+        {Limit:limitDaily, Value:int64(l.Daily), Used:int64(usage.Daily), Resets:&nextDay},
+        {Limit:limitMonthly, Value:int64(l.Monthly), Used:int64(usage.Monthly), Resets:&nextMonth},
+        {Limit:limitHourlyCount, Value:int64(l.HourlyCount), Used:int64(usage.HourlyCount), Resets:hourly},
+    }
+    for i, s := range statuses {
+        if s.Value == 0 {
+            continue
+        }
+        remaining := s.Value - s.Used
+        if remaining < 0 {
+            remaining = 0
+        }
+        statuses[i].Remaining = &remaining
+    }
+    return statuses
+}
+
+// check verifies that a transfer of the amount fits the limits, and returns the
+// limit_exceeded error describing the first exceeded limit otherwise.
+func (l Limits) check(usage Usage, amount Cents, now time.Time) error {
+    for _, s := range l.status(usage, now) {
+        need := int64(amount)
+        if s.Limit == limitHourlyCount {
+            need = 1
+        }
+        if s.Remaining != nil && need > *s.Remaining {
+            e := inputError(codeLimitExceeded, fmt.Sprintf("cannot make a transaction: %s limit is exceeded", s.Limit))
+            e.limit = &s
+            return e
+        }
+    }
+    return nil
+}
+
+// add counts a transfer of the amount in the usage.
+func (u *Usage) add(amount Cents, at time.Time) {
+    u.Daily += amount
+    u.Monthly += amount
+    u.HourlyCount++
+    if !u.HourlyFrom.Valid {
+        u.HourlyFrom = sql.NullTime{Time:at, Valid:true}
+    }
+}
+
+// limitsTx returns the effective limits of the account and its usage at now.
+func limitsTx(q sqlx.Queryer, acc Account, now time.Time) (Limits, Usage, error) {
+    var limits Limits
+    var rules []LimitRule
+    err := sqlx.Select(q, &rules, `
+        SELECT * FROM transfer_limit
+        WHERE currency = $1 AND (account_id IS NULL OR account_id = $2)
+        ORDER BY account_id NULLS FIRST`, acc.Currency, acc.Identifier)
+    if err != nil {
+        return limits, Usage{}, err
+    }
+    for _, rule := range rules {
+        limits = limits.merge(rule.Limits)
+    }
+    var usage Usage
+    err = sqlx.Get(q, &usage, `
+        SELECT
+            COALESCE(SUM(amount) FILTER (WHERE transaction_time_utc >= $2), 0) AS daily,
+            COALESCE(SUM(amount) FILTER (WHERE transaction_time_utc >= $3), 0) AS monthly,
+            COUNT(*) FILTER (WHERE transaction_time_utc > $4) AS hourly_count,
+            MIN(transaction_time_utc) FILTER (WHERE transaction_time_utc > $4) AS hourly_from
+        FROM payment
+        WHERE from_id = $1 AND kind IN ('transfer', 'split') AND status NOT IN ('failed', 'cancelled')
+            AND transaction_time_utc >= LEAST($3, $4)`,
+        acc.Identifier, dayStart(now), monthStart(now), now.Add(-time.Hour))
+    return limits, usage, err
+}
+
+// checkLimits verifies that the sender of the locked account can send the amount.
+func checkLimits(tx *sqlx.Tx, from Account, amount Cents, now time.Time) error {
+    limits, usage, err := limitsTx(tx, from, now)
+    if err != nil {
+        return err
+    }
+    return limits.check(usage, amount, now)
+}
+
+// batchLimits keeps the limits and the usage of the senders of a batch, so every
+// transfer of the batch is checked against the usage including the preceding ones.
+type batchLimits map[string]*struct {
+    limits Limits
+    usage Usage
+}
+
+// check verifies that the sender of the locked account can send the amount, and
+// counts the transfer in the usage.
+func (b batchLimits) check(tx *sqlx.Tx, from Account, amount Cents, now time.Time) error {
+    sender, ok := b[from.Identifier]
+    if !ok {
+        limits, usage, err := limitsTx(tx, from, now)
+        if err != nil {
+            return err
+        }
+        sender = &struct {
+            limits Limits
+            usage Usage
+        }{limits, usage}
+        b[from.Identifier] = sender
+    }
+    if err := sender.limits.check(sender.usage, amount, now); err != nil {
+        return err
+    }
+    sender.usage.add(amount, now)
+    return nil
+}
+
+// SetLimits locks the replaced rule, so its audit entry records the values which
+// the concurrent changes didn't overwrite.
+func (m BillingManager) SetLimits(currency, accountId string, limits Limits) (*LimitRule, error) {
+    rule := LimitRule{Currency:currency, AccountID:nullString(accountId), Limits:limits, Updated:time.Now().UTC()}
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var rules []LimitRule
+    err = tx.Select(&rules,
+        "SELECT * FROM transfer_limit WHERE currency = $1 AND COALESCE(account_id, '') = $2 FOR UPDATE",
+        currency, accountId)
+    var stmt *sqlx.NamedStmt
+    if err == nil {
+        stmt, err = tx.PrepareNamed(`
+            INSERT INTO transfer_limit (currency, account_id, max_transfer, daily, monthly, hourly_count, updated_on)
+            VALUES (:currency, :account_id, :max_transfer, :daily, :monthly, :hourly_count, :updated_on)
+            ON CONFLICT (currency, COALESCE(account_id, '')) DO UPDATE SET
+                max_transfer = EXCLUDED.max_transfer, daily = EXCLUDED.daily, monthly = EXCLUDED.monthly,
+                hourly_count = EXCLUDED.hourly_count, updated_on = EXCLUDED.updated_on
+            RETURNING limit_id`)
+    }
+    if err == nil {
+        err = stmt.Get(&rule.ID, rule)
+    }
+    if err == nil {
+        var before *LimitRule
+        if len(rules) > 0 {
+            before = &rules[0]
+        }
+        resource := "limits/" + currency
+        if accountId != "" {
+            resource += "/" + accountId
+        }
+        err = m.audit(tx, "limits.changed", resource, before, &rule)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &rule, nil
+}
+
+func (m BillingManager) GetLimitRule(currency, accountId string) (*LimitRule, error) {
+    var rules []LimitRule
+    err := m.DB.Select(&rules,
+        "SELECT * FROM transfer_limit WHERE currency = $1 AND COALESCE(account_id, '') = $2", currency, accountId)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    if len(rules) == 0 {
+        return nil, nil
+    }
+    return &rules[0], nil
+}
+
+func (m BillingManager) GetLimits(accountId string, now time.Time) (*Limits, *Usage, error) {
+    acc, err := m.GetAccount(accountId)
+    if err != nil {
+        return nil, nil, err
+    }
+    limits, usage, err := limitsTx(m.DB, *acc, now)
+    if err != nil {
+        return nil, nil, internalError(err)
+    }
+    return &limits, &usage, nil
+}
+
+// setLimits replaces the limits of a currency, or of an account if it is given.
+//
+// Example of possible request's body:
+//
+//     {"currency": "USD", "account": "account_1", "daily": 100000, "hourly_count": 10}
+func (api *BillingAPI) setLimits(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body LimitsRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if body.Account != "" {
+        acc, err := m.GetAccount(body.Account)
+        if err == nil && acc.Currency != body.Currency {
+            err = validationError([]FieldError{{"account", "must have the currency of the limits"}})
+        }
+        if err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+    }
+    limits := Limits{body.MaxTransfer, body.Daily, body.Monthly, body.HourlyCount}
+    rule, err := m.SetLimits(body.Currency, body.Account, limits)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(LimitRuleResponse{Currency:rule.Currency, Account:body.Account, Limits:rule.Limits})
+}
+
+// accountLimits reports the usage of the account's limits.
+func (api *BillingAPI) accountLimits(m Manager, resp *Responder, req *http.Request) {
+    if err := authorize(req.Context(), req.PathValue("id")); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    now := time.Now().UTC()
+    limits, usage, err := m.GetLimits(req.PathValue("id"), now)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(LimitUsageResponse{Account:req.PathValue("id"), Limits:limits.status(*usage, now)})
+}
@@ -0,0 +1,328 @@
+// OpenAPI specification of the payment API.
+//
+// The specification is generated from the list of operations registered by the server
+// and from the request and response structures declared in dto.go, so it can't get out
+// of sync with the handlers. The validation rules from the `validate` tags are
+// converted into the JSON schema constraints.
+package server
+
+import (
+    _ "embed"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const openAPIVersion = "3.0.3"
+
+// Operation describes an API endpoint. The list of operations is used both to register
+// the handlers and to generate the OpenAPI specification.
+type Operation struct {
+    Method string
+    Path string
+    Summary string
+    // Legacy operations accept any HTTP method and are marked as deprecated.
+    Legacy bool
+    // Query, Request and Response are zero values of the DTOs used by the handler;
+    // nil means that the endpoint doesn't expect or return the corresponding data.
+    Query interface{}
+    Request interface{}
+    Response interface{}
+    // ContentType of the response if it is not JSON. The endpoints replying in
+    // several formats list the other content types in AltContentTypes.
+    ContentType string
+    AltContentTypes []string
+    // RequestContentType of the request's body if it is not JSON.
+    RequestContentType string
+    Handler http.Handler
+}
+
+// pattern returns the pattern used to register the operation in http.ServeMux.
+func (op Operation) pattern() string {
+    if op.Legacy {
+        return op.Path
+    }
+    return op.Method + " " + op.Path
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// openAPI serves the specification of the API.
+func (api *BillingAPI) openAPI(w http.ResponseWriter, req *http.Request) {
+    NewJSONResponse(w).SendJSON(http.StatusOK, OpenAPISpec(api.operations()))
+}
+
+// docs serves an HTML viewer of the OpenAPI specification.
+func (api *BillingAPI) docs(w http.ResponseWriter, req *http.Request) {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    _, _ = w.Write(docsPage)
+}
+
+// OpenAPISpec builds the OpenAPI document describing the operations.
+func OpenAPISpec(operations []Operation) map[string]interface{} {
+    gen := schemaGenerator{schemas:map[string]interface{}{}}
+    paths := map[string]interface{}{}
+    for _, op := range operations {
+        item, ok := paths[op.Path].(map[string]interface{})
+        if !ok {
+            item = map[string]interface{}{}
+            paths[op.Path] = item
+        }
+        item[strings.ToLower(op.Method)] = gen.operation(op)
+    }
+    gen.schema(reflect.TypeOf(ErrorResponse{}), "") // registers the component
+    return map[string]interface{}{
+        "openapi": openAPIVersion,
+        "info": map[string]interface{}{
+            "title": "Payment API",
+            "version": "1.0.0",
+            "description": "A simple generic payment service.",
+        },
+        "paths": paths,
+        "components": map[string]interface{}{"schemas": gen.schemas},
+    }
+}
+
+var pathParameter = regexp.MustCompile(`{(\w+)}`)
+
+// schemaGenerator converts Go types into JSON schemas. The named structures are
+// collected as reusable components and referenced with $ref.
+type schemaGenerator struct {
+    schemas map[string]interface{}
+}
+
+func (g schemaGenerator) operation(op Operation) map[string]interface{} {
+    var params []interface{}
+    for _, match := range pathParameter.FindAllStringSubmatch(op.Path, -1) {
+        params = append(params, map[string]interface{}{
+            "name": match[1], "in": "path", "required": true,
+            "schema": map[string]interface{}{"type": "string"},
+        })
+    }
+    if op.Query != nil {
+        t := reflect.TypeOf(op.Query)
+        for i := 0; i < t.NumField(); i++ {
+            field := t.Field(i)
+            if name := field.Tag.Get("query"); name != "" {
+                params = append(params, map[string]interface{}{
+                    "name": name, "in": "query", "required": false,
+                    "schema": g.schema(field.Type, field.Tag.Get("validate")),
+                })
+            }
+        }
+    }
+
+    errorResponse := map[string]interface{}{
+        "description": "Error",
+        "content": jsonContent(map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}),
+    }
+    successStatus := http.StatusAccepted
+    success := map[string]interface{}{"description": "Success"}
+    if op.Response != nil {
+        success["content"] = jsonContent(g.schema(reflect.TypeOf(op.Response), ""))
+    }
+    if op.ContentType != "" {
+        successStatus = http.StatusOK
+        content := make(map[string]interface{})
+        for _, contentType := range append([]string{op.ContentType}, op.AltContentTypes...) {
+            content[contentType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+        }
+        success["content"] = content
+    }
+
+    result := map[string]interface{}{
+        "summary": op.Summary,
+        "operationId": operationID(op),
+        "responses": map[string]interface{}{
+            strconv.Itoa(successStatus): success,
+            "default": errorResponse,
+        },
+    }
+    if params != nil {
+        result["parameters"] = params
+    }
+    if op.Request != nil {
+        result["requestBody"] = map[string]interface{}{
+            "required": true,
+            "content": jsonContent(g.schema(reflect.TypeOf(op.Request), "")),
+        }
+    }
+    if op.RequestContentType != "" {
+        result["requestBody"] = map[string]interface{}{
+            "required": true,
+            "content": map[string]interface{}{
+                op.RequestContentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+            },
+        }
+    }
+    if op.Legacy {
+        result["deprecated"] = true
+    }
+    return result
+}
+
+// schema returns the JSON schema of the type t restricted with the validation rules.
+func (g schemaGenerator) schema(t reflect.Type, rules string) map[string]interface{} {
+    switch t {
+    case reflect.TypeOf(time.Time{}):
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    case reflect.TypeOf(json.RawMessage{}):
+        // any JSON value
+        return map[string]interface{}{}
+    case reflect.TypeOf(StringCents(0)):
+        return withRules(map[string]interface{}{"oneOf": []interface{}{
+            map[string]interface{}{"type": "integer", "format": "int64"},
+            map[string]interface{}{"type": "string", "pattern": "^-?[0-9]+$"},
+        }}, rules)
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        schema := g.schema(t.Elem(), rules)
+        if _, ok := schema["$ref"]; ok {
+            return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+        }
+        schema["nullable"] = true
+        return schema
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+        return withRules(map[string]interface{}{"type": "integer", "format": "int32"}, rules)
+    case reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return withRules(map[string]interface{}{"type": "integer", "format": "int64"}, rules)
+    case reflect.Float32:
+        return withRules(map[string]interface{}{"type": "number", "format": "float"}, rules)
+    case reflect.Float64:
+        return withRules(map[string]interface{}{"type": "number", "format": "double"}, rules)
+    case reflect.String:
+        return withRules(map[string]interface{}{"type": "string"}, rules)
+    case reflect.Slice, reflect.Array:
+        schema := map[string]interface{}{"type": "array", "items": g.schema(t.Elem(), "")}
+        if t.Kind() == reflect.Slice {
+            schema["nullable"] = true
+        }
+        return withRules(schema, rules)
+    case reflect.Map:
+        return withRules(map[string]interface{}{
+            "type": "object", "additionalProperties": g.schema(t.Elem(), ""),
+        }, rules)
+    case reflect.Struct:
+        if t.Name() == "" {
+            return g.object(t)
+        }
+        if _, ok := g.schemas[t.Name()]; !ok {
+            g.schemas[t.Name()] = nil // reserve the name to support recursive types
+            g.schemas[t.Name()] = g.object(t)
+        }
+        return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+    case reflect.Interface:
+        return map[string]interface{}{}
+    }
+    panic(fmt.Sprintf("unsupported type: %s", t))
+}
+
+// object returns the schema of a structure. The fields are required if they have
+// the "required" validation rule, or if they are always present in the JSON.
+func (g schemaGenerator) object(t reflect.Type) map[string]interface{} {
+    properties := map[string]interface{}{}
+    var required []string
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := strings.Split(field.Tag.Get("json"), ",")
+        if field.PkgPath != "" || tag[0] == "-" {
+            continue
+        }
+        if field.Anonymous && field.Type.Kind() == reflect.Struct {
+            // the fields of the embedded struct are encoded as the struct's own ones
+            embedded := g.object(field.Type)
+            for name, property := range embedded["properties"].(map[string]interface{}) {
+                properties[name] = property
+            }
+            if fields, ok := embedded["required"].([]string); ok {
+                required = append(required, fields...)
+            }
+            continue
+        }
+        name := fieldName(field)
+        rules := field.Tag.Get("validate")
+        properties[name] = g.schema(field.Type, rules)
+        optional := len(tag) > 1 && tag[1] == "omitempty"
+        if hasRule(rules, "required") || (rules == "" && !optional) {
+            required = append(required, name)
+        }
+    }
+    schema := map[string]interface{}{
+        "type": "object",
+        "properties": properties,
+        "additionalProperties": false,
+    }
+    if required != nil {
+        schema["required"] = required
+    }
+    return schema
+}
+
+// withRules adds the constraints from the validation rules to the schema.
+func withRules(schema map[string]interface{}, rules string) map[string]interface{} {
+    for _, rule := range strings.Split(rules, ",") {
+        name, arg := rule, ""
+        if i := strings.Index(rule, "="); i >= 0 {
+            name, arg = rule[:i], rule[i+1:]
+        }
+        value, _ := strconv.Atoi(arg)
+        switch {
+        case name == "oneof":
+            var options []interface{}
+            for _, option := range strings.Split(arg, "|") {
+                options = append(options, option)
+            }
+            schema["enum"] = options
+        case schema["type"] == "string":
+            if name == "min" { schema["minLength"] = value }
+            if name == "max" { schema["maxLength"] = value }
+        case schema["type"] == "array":
+            if name == "min" { schema["minItems"] = value }
+            if name == "max" { schema["maxItems"] = value }
+        case schema["type"] == "object":
+            if name == "min" { schema["minProperties"] = value }
+            if name == "max" { schema["maxProperties"] = value }
+            if name == "keymax" { schema["propertyNames"] = map[string]interface{}{"maxLength": value} }
+            if name == "valuemax" { schema["additionalProperties"].(map[string]interface{})["maxLength"] = value }
+        default:
+            if name == "min" { schema["minimum"] = value }
+            if name == "max" { schema["maximum"] = value }
+        }
+    }
+    return schema
+}
+
+func hasRule(rules, rule string) bool {
+    for _, r := range strings.Split(rules, ",") {
+        if r == rule {
+            return true
+        }
+    }
+    return false
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+    return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// operationID builds a unique name of the operation, like "getV1AccountsId".
+func operationID(op Operation) string {
+    words := strings.FieldsFunc(op.Path, func(r rune) bool {
+        return r == '/' || r == '{' || r == '}' || r == '.' || r == '-'
+    })
+    id := strings.ToLower(op.Method)
+    for _, word := range words {
+        id += strings.ToUpper(word[:1]) + word[1:]
+    }
+    return id
+}
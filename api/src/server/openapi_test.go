@@ -0,0 +1,242 @@
+package server
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+// operationExamples contains a valid request for every documented operation.
+// The test fails if an operation is added without an example.
+var operationExamples = map[string]struct{
+    path string
+    body interface{}
+}{
+    "GET /status": {"status", nil},
+    "GET /accounts": {"accounts", nil},
+    "POST /transfer": {"transfer", map[string]string{"fromId": "A", "toId": "B", "amount": "100"}},
+    "POST /payments": {"payments", map[string]string{"accountId": "A"}},
+    "GET /v1/accounts": {"v1/accounts", nil},
+    "GET /v1/accounts/{id}": {"v1/accounts/A", nil},
+    "GET /v1/accounts/{id}/payments": {"v1/accounts/A/payments?limit=1", nil},
+    "GET /v1/accounts/{id}/events": {"v1/accounts/A/events", nil},
+    "GET /v1/accounts/{id}/balance": {"v1/accounts/A/balance?at=2019-03-01T00:00:00Z", nil},
+    "GET /v1/accounts/{id}/statement": {"v1/accounts/A/statement?from=2019-03-01&to=2019-03-31", nil},
+    "GET /v1/accounts/{id}/counterparties": {"v1/accounts/A/counterparties?from=2019-03-01&to=2019-03-31&limit=5", nil},
+    "POST /v1/accounts/{id}/tier": {"v1/accounts/A/tier", map[string]interface{}{"tier": "premium"}},
+    "POST /v1/accounts/{id}/overdraft": {"v1/accounts/C/overdraft", map[string]interface{}{"limit": 1000, "interest_bps": 1500}},
+    "GET /v1/accounts/{id}/limits": {"v1/accounts/A/limits", nil},
+    "POST /v1/transfers": {"v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 100, "pending": true}},
+    "POST /v1/transfers/pain001": {"v1/transfers/pain001", pain001Example},
+    "POST /v1/transfers/batch": {"v1/transfers/batch", map[string]interface{}{
+        "mode": "best_effort", "transfers": []interface{}{map[string]interface{}{"from": "B", "to": "A", "amount": 100}}}},
+    "POST /v1/splits": {"v1/splits", map[string]interface{}{
+        "from": "A", "amount": 1000, "legs": []interface{}{map[string]interface{}{"to": "B", "percent": 100}}}},
+    "POST /v1/fees": {"v1/fees", map[string]interface{}{
+        "currency": "USD", "payer": "sender", "kind": "percent", "rate_bps": 100, "min": 5, "revenue_account": "B"}},
+    "GET /v1/fees": {"v1/fees", nil},
+    "DELETE /v1/fees/{id}": {"v1/fees/1", nil},
+    "POST /v1/fees/quote": {"v1/fees/quote", map[string]interface{}{"from": "A", "to": "B", "amount": 1000}},
+    "POST /v1/limits": {"v1/limits", map[string]interface{}{"currency": "USD", "account": "A", "daily": 1000000}},
+    "GET /v1/approvals": {"v1/approvals", nil},
+    "GET /v1/approvals/{id}": {"v1/approvals/1", nil},
+    "POST /v1/approvals/{id}/approve": {"v1/approvals/1/approve", map[string]interface{}{"reason": "checked"}},
+    "POST /v1/approvals/{id}/reject": {"v1/approvals/2/reject", nil},
+    "GET /v1/approvals/{id}/history": {"v1/approvals/1/history", nil},
+    "GET /v1/audit": {"v1/audit?limit=5", nil},
+    "GET /v1/audit/verify": {"v1/audit/verify", nil},
+    "GET /v1/analytics/volume": {"v1/analytics/volume?bucket=week&from=2019-03-01&to=2019-03-31", nil},
+    "GET /v1/reconciliation": {"v1/reconciliation", nil},
+    "POST /v1/reconciliation/adjustments": {"v1/reconciliation/adjustments", map[string]interface{}{"accounts": []string{"C"}}},
+    "GET /v1/payments/search": {"v1/payments/search?q=currency:USD&limit=1", nil},
+    "GET /v1/payments/{id}": {"v1/payments/1", nil},
+    "POST /v1/payments/{id}/refunds": {"v1/payments/1/refunds", map[string]interface{}{"amount": 100}},
+    "POST /v1/payments/{id}/reversal": {"v1/payments/2/reversal", nil},
+    "POST /v1/payments/{id}/status": {"v1/payments/102/status", map[string]interface{}{"status": "completed"}},
+    "GET /v1/payments/{id}/receipt": {"v1/payments/1/receipt", nil},
+    "GET /v1/payments/{id}/history": {"v1/payments/102/history", nil},
+    "POST /v1/holds": {"v1/holds", map[string]interface{}{"from": "A", "to": "B", "amount": 100, "ttl_seconds": 600}},
+    "GET /v1/holds/{id}": {"v1/holds/1", nil},
+    "POST /v1/holds/{id}/capture": {"v1/holds/1/capture", map[string]interface{}{"amount": 50}},
+    "POST /v1/holds/{id}/void": {"v1/holds/2/void", nil},
+    "POST /v1/schedules": {"v1/schedules", map[string]interface{}{
+        "from": "A", "to": "B", "amount": 100, "recurrence": "weekly", "start": "2019-03-01T09:00:00Z", "max_runs": 4}},
+    "GET /v1/schedules/{id}": {"v1/schedules/1", nil},
+    "POST /v1/schedules/{id}/cancel": {"v1/schedules/1/cancel", nil},
+    "GET /v1/schedules/{id}/runs": {"v1/schedules/1/runs", nil},
+    "GET /.well-known/receipt-keys": {".well-known/receipt-keys", nil},
+    "POST /v1/receipt-keys/rotate": {"v1/receipt-keys/rotate", nil},
+    "POST /v1/webhooks": {"v1/webhooks", map[string]interface{}{"url": "https://example.com", "event_types": []string{"payment.created"}}},
+    "GET /v1/webhooks": {"v1/webhooks", nil},
+    "DELETE /v1/webhooks/{id}": {"v1/webhooks/1", nil},
+    "GET /v1/webhooks/deliveries": {"v1/webhooks/deliveries?status=dead", nil},
+    "POST /v1/webhooks/deliveries/{id}/redeliver": {"v1/webhooks/deliveries/1/redeliver", nil},
+}
+
+// TestOpenAPI_MatchesHandlers calls every documented operation and checks that the
+// response conforms to the schema served by /openapi.json.
+func TestOpenAPI_MatchesHandlers(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        spec := client.Request("GET", "openapi.json", nil, nil)
+        paths := spec["paths"].(map[string]interface{})
+        schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+        api := NewBillingAPI(Config{})
+        for _, op := range api.operations() {
+            key := op.Method + " " + op.Path
+            example, ok := operationExamples[key]
+            if !ok {
+                t.Errorf("no example for operation %s", key)
+                continue
+            }
+            documented, ok := paths[op.Path].(map[string]interface{})[strings.ToLower(op.Method)]
+            if !ok {
+                t.Errorf("operation %s is not documented", key)
+                continue
+            }
+
+            responses := documented.(map[string]interface{})["responses"].(map[string]interface{})
+            if op.ContentType != "" {
+                checkContentType(t, client, op, example.path, example.body, responses)
+                continue
+            }
+            success := responses["202"].(map[string]interface{})
+            schema := success["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"]
+
+            response := client.Request(op.Method, example.path, example.body, nil)
+            if _, failed := response["error"]; failed {
+                t.Errorf("%s failed: %v", key, response)
+                continue
+            }
+            for _, problem := range conforms(response, schema, schemas, "") {
+                t.Errorf("%s: %s", key, problem)
+            }
+        }
+
+        errorResponse := client.Request("GET", "v1/accounts/Unknown", nil, nil)
+        for _, problem := range conforms(errorResponse, schemas["ErrorResponse"], schemas, "") {
+            t.Errorf("error response: %s", problem)
+        }
+    })
+}
+
+// checkContentType verifies that a non-JSON endpoint replies with the documented
+// content. The body of a non-JSON request is given as a string.
+func checkContentType(t *testing.T, client TestClient, op Operation, path string, body interface{}, responses map[string]interface{}) {
+    contentType := op.ContentType
+    success, ok := responses["200"].(map[string]interface{})
+    if _, documented := success["content"].(map[string]interface{})[contentType]; !ok || !documented {
+        t.Errorf("%s: %s response is not documented", path, contentType)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    text, _ := body.(string)
+    req, _ := http.NewRequestWithContext(ctx, op.Method, client.URL(path), strings.NewReader(text))
+    req.Close = true
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Errorf("%s: %s", path, err)
+        return
+    }
+    defer resp.Body.Close()
+    if actual := resp.Header.Get("Content-Type"); !strings.HasPrefix(actual, contentType) {
+        t.Errorf("%s: content type %s was expected, got %s", path, contentType, actual)
+    }
+}
+
+func TestOpenAPI_Docs(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        resp, err := client.Get("docs")
+        if err != nil { t.Fatal(err) }
+        defer resp.Body.Close()
+        if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+            t.Errorf("HTML page was expected")
+        }
+    })
+}
+
+// conforms checks a JSON value against a subset of JSON schema used by the spec.
+func conforms(value interface{}, schema interface{}, schemas map[string]interface{}, path string) []string {
+    s := schema.(map[string]interface{})
+    if response, ok := value.(Response); ok {
+        value = map[string]interface{}(response)
+    }
+    if ref, ok := s["$ref"].(string); ok {
+        return conforms(value, schemas[strings.TrimPrefix(ref, "#/components/schemas/")], schemas, path)
+    }
+    if value == nil {
+        if s["nullable"] == true {
+            return nil
+        }
+        return []string{fmt.Sprintf("%s: null is not allowed", path)}
+    }
+    if allOf, ok := s["allOf"].([]interface{}); ok {
+        var problems []string
+        for _, sub := range allOf {
+            problems = append(problems, conforms(value, sub, schemas, path)...)
+        }
+        return problems
+    }
+    if oneOf, ok := s["oneOf"].([]interface{}); ok {
+        for _, sub := range oneOf {
+            if len(conforms(value, sub, schemas, path)) == 0 {
+                return nil
+            }
+        }
+        return []string{fmt.Sprintf("%s: no matching schema", path)}
+    }
+
+    var problems []string
+    switch s["type"] {
+    case "object":
+        object, ok := value.(map[string]interface{})
+        if !ok {
+            return []string{fmt.Sprintf("%s: object expected, got %T", path, value)}
+        }
+        properties, _ := s["properties"].(map[string]interface{})
+        required, _ := s["required"].([]interface{})
+        for _, name := range required {
+            if _, ok := object[name.(string)]; !ok {
+                problems = append(problems, fmt.Sprintf("%s.%s: missing", path, name))
+            }
+        }
+        for name, item := range object {
+            if sub, ok := properties[name]; ok {
+                problems = append(problems, conforms(item, sub, schemas, path+"."+name)...)
+            } else if extra, ok := s["additionalProperties"].(map[string]interface{}); ok {
+                problems = append(problems, conforms(item, extra, schemas, path+"."+name)...)
+            } else if s["additionalProperties"] == false {
+                problems = append(problems, fmt.Sprintf("%s.%s: undocumented property", path, name))
+            }
+        }
+    case "array":
+        items, ok := value.([]interface{})
+        if !ok {
+            return []string{fmt.Sprintf("%s: array expected, got %T", path, value)}
+        }
+        for i, item := range items {
+            problems = append(problems, conforms(item, s["items"], schemas, fmt.Sprintf("%s[%d]", path, i))...)
+        }
+    case "integer":
+        if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+            problems = append(problems, fmt.Sprintf("%s: integer expected, got %v", path, value))
+        }
+    case "number":
+        if _, ok := value.(float64); !ok {
+            problems = append(problems, fmt.Sprintf("%s: number expected, got %v", path, value))
+        }
+    case "string":
+        if _, ok := value.(string); !ok {
+            problems = append(problems, fmt.Sprintf("%s: string expected, got %v", path, value))
+        }
+    case "boolean":
+        if _, ok := value.(bool); !ok {
+            problems = append(problems, fmt.Sprintf("%s: boolean expected, got %v", path, value))
+        }
+    }
+    return problems
+}
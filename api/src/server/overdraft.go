@@ -0,0 +1,180 @@
+// Overdrafts and the interest on the negative balances.
+//
+// An account with an overdraft limit can spend more than its balance, down to the
+// negative limit: the limit is a part of the available funds, so the transfers, the
+// holds and the other operations checking the available funds allow the overdraft
+// without changes.
+//
+// Once a day, the interest job charges the interest of one day on the negative balance
+// of every account with an interest rate. The interest is moved to the configured
+// interest account with a payment of the interest kind; it can take the balance below
+// the overdraft limit. Every accrual is recorded for the account and the UTC day, so
+// a day is never charged twice, even if the job runs on several instances at once.
+package server
+
+import (
+    "context"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// paymentInterest is the kind of the payments charging the overdraft interest.
+const paymentInterest = "interest"
+
+const (
+    // interestJob is the name of the interest job's advisory lock.
+    interestJob = "interest"
+    interestInterval = time.Hour
+    interestBatchSize = 100
+)
+
+// OverdraftManager implements the overdrafts.
+type OverdraftManager interface {
+    // SetOverdraft changes the overdraft limit of the account, and the annual interest
+    // rate in basis points charged on its negative balance.
+    SetOverdraft(identifier string, limit Cents, interestBps int64) (*Account, error)
+    // AccrueInterest charges the interest of the day to up to limit accounts which
+    // were not charged for the day yet, and returns the charged payments.
+    AccrueInterest(day time.Time, interestId string, limit int) ([]Payment, error)
+}
+
+// dailyInterest returns the interest of one day on the negative balance at the annual
+// rate given in basis points, rounded half up.
+func dailyInterest(balance Cents, bps int64) Cents {
+    if balance >= 0 {
+        return 0
+    }
+    return Cents((-int64(balance)*bps + 365*10000/2)/(365*10000))
+}
+
+func (m BillingManager) SetOverdraft(identifier string, limit Cents, interestBps int64) (*Account, error) {
+    return m.updateAccount(identifier, "account.overdraft_changed",
+        "UPDATE account SET overdraft_limit = $2, interest_bps = $3 WHERE identifier = $1", limit, interestBps)
+}
+
+// AccrueInterest charges every account in its own transaction, which locks the
+// account's row and the interest account's one, and records the accrual.
+func (m BillingManager) AccrueInterest(day time.Time, interestId string, limit int) ([]Payment, error) {
+    day = dayStart(day)
+    var due []string
+    err := m.DB.Select(&due, `
+        SELECT a.identifier FROM account a
+        WHERE a.amount < 0 AND a.interest_bps > 0 AND a.identifier <> $1 AND NOT EXISTS (
+            SELECT 1 FROM interest_accrual i WHERE i.account_id = a.identifier AND i.day = $2)
+        ORDER BY a.identifier
+        LIMIT $3`, interestId, day, limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var charged []Payment
+    for _, id := range due {
+        payment, err := m.accrue(id, interestId, day)
+        if err != nil {
+            return charged, err
+        }
+        if payment != nil {
+            charged = append(charged, *payment)
+        }
+    }
+    return charged, nil
+}
+
+// accrue charges the interest of the day to the account. Nil is returned if the
+// account owes nothing or was already charged for the day.
+func (m BillingManager) accrue(accountId, interestId string, day time.Time) (*Payment, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    locked, err := lockAccounts(tx, []string{accountId, interestId}, now)
+    if err != nil {
+        mustRollback(tx)
+        return nil, err
+    }
+    acc, revenue, ok := pickPair(locked, accountId, interestId)
+    if !ok {
+        mustRollback(tx)
+        return nil, inputError(codeAccountNotFound, "cannot find the interest account")
+    }
+    interest := dailyInterest(acc.Amount, acc.InterestBps)
+    if acc.Currency != revenue.Currency {
+        interest = 0
+    }
+    payment, err := recordAccrual(tx, acc, revenue, day, interest, now)
+    if err == nil && payment != nil {
+        err = m.audit(tx, "interest.charged", paymentResource(payment.ID), nil, payment)
+    }
+    if err != nil {
+        mustRollback(tx)
+        if isUniqueViolation(err) {
+            return nil, nil
+        }
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return payment, nil
+}
+
+// recordAccrual records the accrual of the day, and moves the interest unless it is
+// zero. The accounts should be locked.
+func recordAccrual(tx *sqlx.Tx, acc, revenue Account, day time.Time, interest Cents, now time.Time) (*Payment, error) {
+    var accrualId int
+    err := tx.Get(&accrualId, `
+        INSERT INTO interest_accrual (account_id, day, balance, interest_bps, amount, accrued_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING accrual_id`, acc.Identifier, day, acc.Amount, acc.InterestBps, interest, now)
+    if err != nil || interest == 0 {
+        return nil, err
+    }
+    payment, err := move(tx, acc, revenue, Payment{Time:now, Amount:interest, Kind:paymentInterest})
+    if err != nil {
+        return nil, err
+    }
+    _, err = tx.Exec("UPDATE interest_accrual SET payment_id = $1 WHERE accrual_id = $2", payment.ID, accrualId)
+    return payment, err
+}
+
+// RunInterestAccrual charges the overdraft interest using the shared Manager until
+// the context is cancelled, while the instance leads the interest job. The job is
+// disabled if the interest account is not configured.
+func (api *BillingAPI) RunInterestAccrual(ctx context.Context) {
+    if api.Config.InterestAccount == "" {
+        return
+    }
+    api.runLeader(ctx, interestJob, interestInterval, func(m Manager) error {
+        for {
+            charged, err := m.AccrueInterest(time.Now().UTC(), api.Config.InterestAccount, interestBatchSize)
+            if err != nil || len(charged) < interestBatchSize {
+                return err
+            }
+        }
+    })
+}
+
+// setOverdraft changes the overdraft limit and the interest rate of the account.
+//
+// Example of possible request's body:
+//
+//     {"limit": 100000, "interest_bps": 1800}
+func (api *BillingAPI) setOverdraft(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body OverdraftRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    account, err := m.SetOverdraft(req.PathValue("id"), body.Limit, body.InterestBps)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(AccountResponse{newAccountView(*account)})
+}
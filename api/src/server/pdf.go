@@ -0,0 +1,133 @@
+// Minimal PDF writer of the plain text documents.
+//
+// The document is printed line by line with the Courier font on A4 pages. Only the
+// current page is kept in the memory: every page is written out as soon as it is
+// full, and the page tree and the cross-reference table, which need the offsets of
+// all objects, are written at the end. The text is limited to the printable ASCII
+// characters; the others are replaced with question marks.
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "strings"
+)
+
+const (
+    pdfLinesPerPage = 64
+    pdfFontSize = 8
+    pdfLineHeight = 12
+    pdfPageWidth = 595
+    pdfPageHeight = 842
+    pdfMargin = 36
+)
+
+// Numbers of the objects written before the pages.
+const (
+    pdfCatalog = 1
+    pdfPages = 2
+    pdfFont = 3
+)
+
+// pdfWriter writes a document to w. The first error stops the writing and is kept
+// in the err field.
+type pdfWriter struct {
+    w io.Writer
+    err error
+    // written is the number of the bytes written so far.
+    written int
+    // offsets are the positions of the objects, by their numbers minus one.
+    offsets []int
+    pages []int
+    page bytes.Buffer
+    lines int
+}
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+    pdf := &pdfWriter{w:w}
+    pdf.write("%PDF-1.4\n")
+    pdf.object(pdfCatalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPages))
+    pdf.offsets = append(pdf.offsets, 0) // the page tree is written at the end
+    pdf.object(pdfFont, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+    return pdf
+}
+
+// println adds a line to the current page, starting a new page if it is full.
+func (pdf *pdfWriter) println(text string) {
+    if pdf.lines == pdfLinesPerPage {
+        pdf.flushPage()
+    }
+    y := pdfPageHeight - pdfMargin - pdf.lines*pdfLineHeight
+    fmt.Fprintf(&pdf.page, "BT /F1 %d Tf %d %d Td (%s) Tj ET\n", pdfFontSize, pdfMargin, y, pdfEscape(text))
+    pdf.lines++
+}
+
+// close writes the last page, the page tree and the cross-reference table.
+func (pdf *pdfWriter) close() error {
+    if pdf.lines > 0 || len(pdf.pages) == 0 {
+        pdf.flushPage()
+    }
+    kids := make([]string, 0, len(pdf.pages))
+    for _, page := range pdf.pages {
+        kids = append(kids, fmt.Sprintf("%d 0 R", page))
+    }
+    pdf.object(pdfPages, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+
+    xref := pdf.written
+    pdf.write(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(pdf.offsets)+1))
+    for _, offset := range pdf.offsets {
+        pdf.write(fmt.Sprintf("%010d 00000 n \n", offset))
+    }
+    pdf.write(fmt.Sprintf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+        len(pdf.offsets)+1, pdfCatalog, xref))
+    return pdf.err
+}
+
+// flushPage writes the content stream and the object of the current page.
+func (pdf *pdfWriter) flushPage() {
+    content := len(pdf.offsets) + 1
+    pdf.offsets = append(pdf.offsets, 0, 0)
+    pdf.object(content, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", pdf.page.Len(), pdf.page.String()))
+    pdf.object(content+1, fmt.Sprintf(
+        "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >>",
+        pdfPages, pdfPageWidth, pdfPageHeight, pdfFont, content))
+    pdf.pages = append(pdf.pages, content+1)
+    pdf.page.Reset()
+    pdf.lines = 0
+}
+
+// object writes the object with the number n, which should be allocated in the offsets.
+func (pdf *pdfWriter) object(n int, body string) {
+    for len(pdf.offsets) < n {
+        pdf.offsets = append(pdf.offsets, 0)
+    }
+    pdf.offsets[n-1] = pdf.written
+    pdf.write(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", n, body))
+}
+
+func (pdf *pdfWriter) write(s string) {
+    if pdf.err != nil {
+        return
+    }
+    n, err := io.WriteString(pdf.w, s)
+    pdf.written += n
+    pdf.err = err
+}
+
+// pdfEscape escapes the special characters of a PDF string.
+func pdfEscape(text string) string {
+    var escaped strings.Builder
+    for _, r := range text {
+        switch {
+        case r == '\\' || r == '(' || r == ')':
+            escaped.WriteRune('\\')
+            escaped.WriteRune(r)
+        case r < ' ' || r > '~':
+            escaped.WriteRune('?')
+        default:
+            escaped.WriteRune(r)
+        }
+    }
+    return escaped.String()
+}
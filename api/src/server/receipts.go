@@ -0,0 +1,314 @@
+// Signed receipts of the completed payments.
+//
+// A receipt proves that a payment was completed: it contains the canonical JSON
+// encoding of the payment's fields signed with the server's Ed25519 key. The canonical
+// encoding is the compact JSON object with the keys in the lexicographic order, which
+// is what encoding/json produces for ReceiptPayload; a verifier decodes the payload
+// and encodes it again to get the signed bytes, so the receipt survives the
+// re-formatting of the document.
+//
+// The private key is loaded from the configuration, see Config.ReceiptKey, and only
+// the public keys are kept in the database. The configured key is published at
+// /.well-known/receipt-keys when the server starts, see InitReceiptKey, or when the
+// operators rotate the key after changing the configuration; the previous key is
+// retired but stays published, so the receipts signed before the rotation are still
+// verifiable. Reading a receipt never writes.
+package server
+
+import (
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    receiptVersion = 1
+    receiptAlgorithm = "Ed25519"
+)
+
+// ReceiptManager keeps the public keys verifying the receipts.
+type ReceiptManager interface {
+    // SigningKeys returns all keys, newest first.
+    SigningKeys() ([]SigningKey, error)
+    // RotateSigningKey makes the key the active one and retires the other ones. The
+    // key is stored unless it is stored already.
+    RotateSigningKey(key SigningKey) (*SigningKey, error)
+}
+
+// SigningKey is an Ed25519 key pair. The PrivateKey is set for the configured key
+// only and is never stored. The retired keys don't sign the receipts anymore, but
+// they are published to verify the receipts they signed.
+type SigningKey struct {
+    ID string          `db:"key_id"`
+    PublicKey []byte   `db:"public_key"`
+    PrivateKey []byte  `db:"-"`
+    Created time.Time  `db:"created_at"`
+    Retired *time.Time `db:"retired_at"`
+}
+
+// ParseReceiptKey decodes the base64-encoded 32-byte Ed25519 seed of the private key,
+// e.g. generated with `openssl rand -base64 32`.
+func ParseReceiptKey(text string) (ed25519.PrivateKey, error) {
+    seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+    if err != nil || len(seed) != ed25519.SeedSize {
+        return nil, fmt.Errorf("the receipt key should be a base64-encoded %d-byte seed", ed25519.SeedSize)
+    }
+    return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// newSigningKey identifies the key pair by the fingerprint of its public key.
+func newSigningKey(private ed25519.PrivateKey, now time.Time) SigningKey {
+    public := private.Public().(ed25519.PublicKey)
+    fingerprint := sha256.Sum256(public)
+    return SigningKey{
+        ID:"rk_" + hex.EncodeToString(fingerprint[:8]),
+        PublicKey:public,
+        PrivateKey:private,
+        Created:now.UTC()}
+}
+
+// receiptsEnabled checks if the key signing the receipts is configured.
+func (c Config) receiptsEnabled() bool {
+    return c.ReceiptKey != "" || c.ReceiptKeyFile != ""
+}
+
+// loadReceiptKey reads the configured key; nil is returned if the receipts are not
+// configured. The ReceiptKeyFile is read on every call, so the key can be changed
+// without restarting the server.
+func (c Config) loadReceiptKey() (*SigningKey, error) {
+    text := c.ReceiptKey
+    if c.ReceiptKeyFile != "" {
+        data, err := os.ReadFile(c.ReceiptKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        text = string(data)
+    }
+    if text == "" {
+        return nil, nil
+    }
+    private, err := ParseReceiptKey(text)
+    if err != nil {
+        return nil, err
+    }
+    key := newSigningKey(private, time.Now())
+    return &key, nil
+}
+
+// ReceiptPayload is the signed part of a receipt. The fields are declared in the
+// order of their JSON keys, so the encoding is canonical.
+type ReceiptPayload struct {
+    Amount Cents    `json:"amount"`
+    Currency string `json:"currency"`
+    From string     `json:"from"`
+    KeyID string    `json:"key_id"`
+    PaymentID int   `json:"payment_id"`
+    Status string   `json:"status"`
+    Time time.Time  `json:"time_utc"`
+    To string       `json:"to"`
+    Version int     `json:"version"`
+}
+
+// Receipt is a payload with its base64-encoded signature.
+type Receipt struct {
+    Payload ReceiptPayload `json:"payload"`
+    Signature string       `json:"signature"`
+}
+
+// signReceipt issues the receipt of the completed payment.
+func signReceipt(payment Payment, key SigningKey) (*Receipt, error) {
+    if payment.Status != statusCompleted {
+        return nil, inputError(codeInvalidState, fmt.Sprintf("payment %d is %s", payment.ID, payment.Status))
+    }
+    payload := ReceiptPayload{
+        Amount:payment.Amount,
+        Currency:payment.Currency,
+        From:payment.From,
+        KeyID:key.ID,
+        PaymentID:payment.ID,
+        Status:payment.Status,
+        Time:payment.Time.UTC(),
+        To:payment.To,
+        Version:receiptVersion}
+    message, err := json.Marshal(payload)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    signature := ed25519.Sign(ed25519.PrivateKey(key.PrivateKey), message)
+    return &Receipt{payload, base64.StdEncoding.EncodeToString(signature)}, nil
+}
+
+func (m BillingManager) SigningKeys() ([]SigningKey, error) {
+    keys := make([]SigningKey, 0)
+    if err := m.DB.Select(&keys, "SELECT * FROM signing_key ORDER BY created_at DESC"); err != nil {
+        return nil, internalError(err)
+    }
+    return keys, nil
+}
+
+// RotateSigningKey locks the table, so the instances publishing their keys
+// concurrently don't leave two active keys. A retired key configured again becomes
+// the newest one.
+func (m BillingManager) RotateSigningKey(key SigningKey) (*SigningKey, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var active []SigningKey
+    _, err = tx.Exec("LOCK TABLE signing_key IN EXCLUSIVE MODE")
+    if err == nil {
+        err = tx.Select(&active, "SELECT * FROM signing_key WHERE retired_at IS NULL ORDER BY created_at DESC LIMIT 1")
+    }
+    if err == nil {
+        _, err = tx.Exec(
+            "UPDATE signing_key SET retired_at = $2 WHERE retired_at IS NULL AND key_id <> $1", key.ID, key.Created)
+    }
+    if err == nil {
+        _, err = tx.NamedExec(`
+            INSERT INTO signing_key (key_id, public_key, created_at)
+            VALUES (:key_id, :public_key, :created_at)
+            ON CONFLICT (key_id) DO UPDATE SET created_at = excluded.created_at, retired_at = NULL
+            WHERE signing_key.retired_at IS NOT NULL`, key)
+    }
+    if err == nil {
+        var before *ReceiptKeyView
+        if len(active) > 0 {
+            view := newReceiptKeyView(active[0])
+            before = &view
+        }
+        after := newReceiptKeyView(key)
+        err = m.audit(tx, "receipt_key.rotated", "receipt_key/" + key.ID, before, &after)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &key, nil
+}
+
+// InitReceiptKey loads the configured key signing the receipts and publishes it,
+// unless it is the active key already. It is called when the server starts; the
+// receipts are disabled if the key is not configured.
+func (api *BillingAPI) InitReceiptKey() error {
+    key, err := api.loadReceiptKey()
+    if err != nil || key == nil {
+        return err
+    }
+    m, err := api.manager()
+    if err == nil {
+        _, err = api.publishKey(m, key)
+    }
+    return err
+}
+
+// publishKey makes the loaded key the active one, unless it is active already, and
+// keeps it to sign the receipts.
+func (api *BillingAPI) publishKey(m Manager, key *SigningKey) (*SigningKey, error) {
+    keys, err := m.SigningKeys()
+    if err != nil {
+        return nil, err
+    }
+    if len(keys) > 0 && keys[0].ID == key.ID && keys[0].Retired == nil {
+        key.Created = keys[0].Created
+    } else if key, err = m.RotateSigningKey(*key); err != nil {
+        return nil, err
+    }
+    api.keyMu.Lock()
+    api.receiptKey = key
+    api.keyMu.Unlock()
+    return key, nil
+}
+
+// signingKey returns the configured key signing the receipts. If another instance
+// has rotated the key, the configuration is read again to pick the new key up.
+func (api *BillingAPI) signingKey(m Manager) (*SigningKey, error) {
+    keys, err := m.SigningKeys()
+    if err != nil {
+        return nil, err
+    }
+    api.keyMu.Lock()
+    defer api.keyMu.Unlock()
+    if api.receiptKey == nil {
+        return nil, inputError(codeInvalidState, "the receipts are not configured")
+    }
+    if len(keys) > 0 && keys[0].Retired == nil && keys[0].ID != api.receiptKey.ID {
+        if loaded, err := api.loadReceiptKey(); err == nil && loaded != nil && loaded.ID == keys[0].ID {
+            api.receiptKey = loaded
+        }
+    }
+    for _, published := range keys {
+        if published.ID == api.receiptKey.ID {
+            return api.receiptKey, nil
+        }
+    }
+    return nil, internalError(fmt.Errorf("receipt key %s is not published", api.receiptKey.ID))
+}
+
+// getReceipt returns the signed receipt of a completed payment.
+func (api *BillingAPI) getReceipt(m Manager, resp *Responder, req *http.Request) {
+    payment, err := accessiblePayment(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    key, err := api.signingKey(m)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    receipt, err := signReceipt(*payment, *key)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ReceiptResponse{receipt})
+}
+
+// receiptKeys publishes the public keys verifying the receipts, newest first.
+func (api *BillingAPI) receiptKeys(m Manager, resp *Responder, req *http.Request) {
+    keys, err := m.SigningKeys()
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    result := make([]ReceiptKeyView, 0, len(keys))
+    for _, key := range keys {
+        result = append(result, newReceiptKeyView(key))
+    }
+    resp.SendSuccess(ReceiptKeysResponse{result})
+}
+
+// rotateReceiptKey publishes the key configured instead of the active one and retires
+// the latter; nothing changes if the configured key is active already. The key is
+// changed in the ReceiptKeyFile beforehand; with the key given in the environment,
+// the server is restarted instead.
+func (api *BillingAPI) rotateReceiptKey(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    key, err := api.loadReceiptKey()
+    if err != nil {
+        writeManagerError(internalError(err), resp)
+        return
+    }
+    if key == nil {
+        writeManagerError(inputError(codeInvalidState, "the receipts are not configured"), resp)
+        return
+    }
+    if key, err = api.publishKey(m, key); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ReceiptKeyResponse{newReceiptKeyView(*key)})
+}
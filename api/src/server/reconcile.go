@@ -0,0 +1,287 @@
+// Reconciliation of the balances with the ledger.
+//
+// The balances are stored in the accounts and updated in place, so nothing proves
+// that a balance is right by itself. The reconciliation computes the balance each
+// account is expected to have from the ledger: the entries recording the opening
+// balances and the adjustments, plus the payments booked on the account, i.e.
+// completed, except the parents of the splits, which don't move funds. The accounts
+// whose stored balances differ from the expected ones are reported with the
+// discrepancy. The reconciliation is served by GET /v1/reconciliation and by the
+// reconcile command.
+//
+// A discrepancy is resolved with an adjustment entry, which records it in the ledger
+// and so explains the stored balance; the balance itself is never changed, and a
+// balance which is wrong should be corrected with a transfer instead. The adjustments
+// are requested as approvals of the adjustment kind and recorded when a second
+// operator approves them. The adjustment is recorded only if the discrepancy hasn't
+// changed since it was requested, so an account is never adjusted twice for the same
+// discrepancy.
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+)
+
+// Kinds of the ledger entries.
+const (
+    entryOpening = "opening"
+    entryAdjustment = "adjustment"
+)
+
+// ReconcileManager compares the balances with the ledger.
+type ReconcileManager interface {
+    // Reconcile returns the reconciliation of the accounts, or of all accounts if the
+    // accounts are nil, ordered by the account.
+    Reconcile(accounts []string) ([]Reconciliation, error)
+    // RecordAdjustment records the adjustment entry of the approved adjustment, if the
+    // discrepancy of the account still equals the approval's amount. Recording the
+    // adjustment of the same approval again returns the recorded entry.
+    RecordAdjustment(approval Approval) (*LedgerEntry, error)
+}
+
+// LedgerEntry is an opening balance or an adjustment of an account. The adjustments
+// refer to their approvals.
+type LedgerEntry struct {
+    ID int            `db:"entry_id" json:"id"`
+    Account string    `db:"account_id" json:"account"`
+    Kind string       `db:"kind" json:"kind"`
+    Amount Cents      `db:"amount" json:"amount"`
+    ApprovalID *int   `db:"approval_id" json:"approval_id,omitempty"`
+    Created time.Time `db:"created_at" json:"created"`
+}
+
+// Reconciliation compares the stored balance of an account with the expected one:
+// the sum of the opening balances, the adjustments and the booked payments.
+type Reconciliation struct {
+    Account string    `db:"identifier" json:"account"`
+    Currency string   `db:"currency" json:"currency"`
+    Balance Cents     `db:"amount" json:"balance"`
+    Opening Cents     `db:"opening" json:"opening"`
+    Adjustments Cents `db:"adjustments" json:"adjustments"`
+    Payments Cents    `db:"payments" json:"payments"`
+    Expected Cents    `db:"-" json:"expected"`
+    Discrepancy Cents `db:"-" json:"discrepancy"`
+}
+
+// reconciled fills the expected balance and the discrepancy in.
+func (r Reconciliation) reconciled() Reconciliation {
+    r.Expected = r.Opening + r.Adjustments + r.Payments
+    r.Discrepancy = r.Balance - r.Expected
+    return r
+}
+
+// ReconciliationReport lists the accounts with the discrepancies among the Checked
+// ones, and the adjustments requested for them, if any.
+type ReconciliationReport struct {
+    Time time.Time                 `json:"time"`
+    Checked int                    `json:"checked"`
+    Discrepancies []Reconciliation `json:"discrepancies"`
+    Adjustments []Approval         `json:"adjustments,omitempty"`
+}
+
+// reconcileAccounts computes the reconciliation with a single statement, which sees
+// the balances and the ledger consistent with each other.
+func reconcileAccounts(q sqlx.Queryer, accounts []string) ([]Reconciliation, error) {
+    var reconciled []Reconciliation
+    err := sqlx.Select(q, &reconciled, `
+        SELECT a.identifier, a.currency, a.amount,
+            COALESCE(e.opening, 0) AS opening, COALESCE(e.adjustments, 0) AS adjustments,
+            COALESCE(n.payments, 0) AS payments
+        FROM account a
+        LEFT JOIN (
+            SELECT account_id,
+                SUM(amount) FILTER (WHERE kind = 'opening') AS opening,
+                SUM(amount) FILTER (WHERE kind = 'adjustment') AS adjustments
+            FROM ledger_entry
+            GROUP BY account_id
+        ) e ON e.account_id = a.identifier
+        LEFT JOIN (
+            SELECT m.account_id, SUM(m.amount) AS payments
+            FROM payment p
+            JOIN payment_status s ON s.payment_id = p.payment_id AND s.status = 'completed'
+            CROSS JOIN LATERAL (VALUES (p.to_id, p.amount), (p.from_id, -p.amount)) AS m (account_id, amount)
+            WHERE p.kind <> 'split'
+            GROUP BY m.account_id
+        ) n ON n.account_id = a.identifier
+        WHERE $1::VARCHAR[] IS NULL OR a.identifier = any($1)
+        ORDER BY a.identifier`, pq.Array(accounts))
+    if err != nil {
+        return nil, err
+    }
+    for i := range reconciled {
+        reconciled[i] = reconciled[i].reconciled()
+    }
+    return reconciled, nil
+}
+
+func (m BillingManager) Reconcile(accounts []string) ([]Reconciliation, error) {
+    reconciled, err := reconcileAccounts(m.DB, accounts)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return reconciled, nil
+}
+
+// RecordAdjustment locks the account, so the discrepancy is checked against the
+// balance which no concurrent transfer is changing.
+func (m BillingManager) RecordAdjustment(approval Approval) (*LedgerEntry, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    now := time.Now().UTC()
+    entry, err := recordAdjustment(tx, approval, now)
+    if err == nil {
+        err = m.audit(tx, "ledger.adjusted", "account/" + approval.From, nil, entry)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return entry, nil
+}
+
+func recordAdjustment(tx *sqlx.Tx, approval Approval, now time.Time) (*LedgerEntry, error) {
+    var entries []LedgerEntry
+    if err := tx.Select(&entries, "SELECT * FROM ledger_entry WHERE approval_id = $1", approval.ID); err != nil {
+        return nil, err
+    }
+    if len(entries) > 0 {
+        return &entries[0], nil
+    }
+    if _, err := lockAccounts(tx, []string{approval.From}, now); err != nil {
+        return nil, err
+    }
+    reconciled, err := reconcileAccounts(tx, []string{approval.From})
+    if err != nil {
+        return nil, err
+    }
+    if len(reconciled) == 0 {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    if err = checkAdjustment(reconciled[0], approval.Amount); err != nil {
+        return nil, err
+    }
+    entry := LedgerEntry{Account:approval.From, Kind:entryAdjustment, Amount:approval.Amount, ApprovalID:&approval.ID, Created:now}
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO ledger_entry (account_id, kind, amount, approval_id, created_at)
+        VALUES (:account_id, :kind, :amount, :approval_id, :created_at)
+        RETURNING entry_id`)
+    if err == nil {
+        err = stmt.Get(&entry.ID, entry)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
+
+// checkAdjustment verifies that the adjustment resolves the current discrepancy.
+func checkAdjustment(reconciled Reconciliation, amount Cents) error {
+    if reconciled.Discrepancy != amount {
+        return inputError(codeInvalidState, fmt.Sprintf(
+            "the discrepancy of account %s is %d instead of %d", reconciled.Account, int64(reconciled.Discrepancy), int64(amount)))
+    }
+    return nil
+}
+
+// Reconcile reconciles all accounts and, if adjust is set, requests the adjustments of
+// the discrepancies on behalf of the initiator. It is used by the reconcile command,
+// which accesses the database directly; the requests are recorded in the audit log
+// with the initiator as the actor.
+func Reconcile(m Manager, initiator string, adjust bool) (*ReconciliationReport, error) {
+    report, err := reconcile(m, nil)
+    if err == nil && adjust {
+        err = requestAdjustments(m.Audited(initiator, ""), report, initiator, defaultApprovalTTL)
+    }
+    return report, err
+}
+
+// reconcile reports the discrepancies of the accounts, or of all accounts if the
+// accounts are nil.
+func reconcile(m Manager, accounts []string) (*ReconciliationReport, error) {
+    reconciled, err := m.Reconcile(accounts)
+    if err != nil {
+        return nil, err
+    }
+    report := &ReconciliationReport{Time:time.Now().UTC(), Checked:len(reconciled), Discrepancies:make([]Reconciliation, 0)}
+    for _, r := range reconciled {
+        if r.Discrepancy != 0 {
+            report.Discrepancies = append(report.Discrepancies, r)
+        }
+    }
+    return report, nil
+}
+
+// requestAdjustments requests the approval of the adjustment of every discrepancy in
+// the report, and adds the approvals to it.
+func requestAdjustments(m Manager, report *ReconciliationReport, initiator string, ttl time.Duration) error {
+    now := time.Now().UTC()
+    for _, r := range report.Discrepancies {
+        approval, err := m.RequestApproval(Approval{
+            Kind:approvalAdjustment,
+            From:r.Account,
+            To:r.Account,
+            Amount:r.Discrepancy,
+            Initiator:initiator,
+            Created:now,
+            Expires:now.Add(ttl)})
+        if err != nil {
+            return err
+        }
+        report.Adjustments = append(report.Adjustments, *approval)
+    }
+    return nil
+}
+
+// getReconciliation reports the discrepancies of all accounts.
+func (api *BillingAPI) getReconciliation(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    report, err := reconcile(m, nil)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ReconciliationResponse{report})
+}
+
+// requestReconciliation requests the adjustments of the discrepancies of the accounts
+// listed in the request, or of all accounts. The adjustments are made when another
+// operator approves them.
+//
+// Example of possible request's body:
+//
+//     {"accounts": ["first", "second"]}
+func (api *BillingAPI) requestReconciliation(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body AdjustmentRequest
+    if req.ContentLength != 0 {
+        if err := decodeRequest(resp, req, &body); err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+    }
+    report, err := reconcile(m, body.Accounts)
+    if err == nil {
+        err = requestAdjustments(m, report, PrincipalFrom(req.Context()).Name, api.approvalTTL())
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ReconciliationResponse{report})
+}
@@ -0,0 +1,100 @@
+// Payment references, memos and metadata.
+//
+// The sender of a transfer can describe it with a reference, e.g. an invoice number,
+// a free-text memo and a small map of metadata, which are stored with the payment and
+// returned with it. A reference requested as unique is checked against all payments of
+// the sender: the transfer is rejected if the sender has already used the reference.
+// The check is made while the sender's account is locked, so two concurrent transfers
+// cannot both use it. The payments of an account can be searched by the reference and
+// by a metadata key, optionally with its value.
+//
+// The details are given to the transfers, the batches and the pain.001 files; the
+// payments made by the service itself, such as the fees and the refunds, have none.
+package server
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// maxMemoLength is the bound of the memo, as declared in its validation rule.
+const maxMemoLength = 140
+
+// PaymentDetails describe a payment on behalf of its sender. If UniqueReference is set,
+// the reference is unique among the sender's payments; it is ignored without the
+// reference. The details are accepted by the transfer endpoints as they are.
+type PaymentDetails struct {
+    Reference string     `db:"reference" json:"reference,omitempty" validate:"max=64"`
+    UniqueReference bool `db:"unique_reference" json:"unique_reference,omitempty"`
+    Memo string          `db:"memo" json:"memo,omitempty" validate:"max=140"`
+    Metadata Metadata    `db:"metadata" json:"metadata,omitempty" validate:"max=20,keymax=40,valuemax=500"`
+}
+
+// Metadata are the key/value pairs attached to a payment, stored as a JSON object.
+type Metadata map[string]string
+
+func (md Metadata) Value() (driver.Value, error) {
+    if md == nil {
+        return []byte("{}"), nil
+    }
+    return json.Marshal(md)
+}
+
+func (md *Metadata) Scan(src interface{}) error {
+    data, ok := src.([]byte)
+    if !ok {
+        return fmt.Errorf("cannot scan %T into metadata", src)
+    }
+    *md = nil
+    if err := json.Unmarshal(data, md); err != nil {
+        return err
+    }
+    if len(*md) == 0 {
+        *md = nil
+    }
+    return nil
+}
+
+// PaymentFilter selects the payments by the reference and by the metadata key, and
+// its value if the MetadataValue is not empty. The empty fields don't filter.
+type PaymentFilter struct {
+    Reference string
+    MetadataKey string
+    MetadataValue string
+}
+
+// matches checks the payment against the filter.
+func (f PaymentFilter) matches(p Payment) bool {
+    if f.Reference != "" && p.Reference != f.Reference {
+        return false
+    }
+    value, ok := p.Metadata[f.MetadataKey]
+    return f.MetadataKey == "" || ok && (f.MetadataValue == "" || value == f.MetadataValue)
+}
+
+// paymentFilter is the condition of the filter on the payments aliased as p, with the
+// parameters starting from $3.
+const paymentFilter = `
+    AND ($3 = '' OR p.reference = $3)
+    AND ($4 = '' OR p.metadata ? $4)
+    AND ($5 = '' OR p.metadata @> jsonb_build_object($4::TEXT, $5::TEXT))`
+
+// checkReference rejects the unique reference which the sender has already used. The
+// caller should hold the lock of the sender's account.
+func checkReference(tx *sqlx.Tx, fromId string, details PaymentDetails) error {
+    if !details.UniqueReference || details.Reference == "" {
+        return nil
+    }
+    var used bool
+    err := tx.Get(&used, "SELECT EXISTS (SELECT 1 FROM payment WHERE from_id = $1 AND reference = $2)", fromId, details.Reference)
+    if err != nil {
+        return err
+    }
+    if used {
+        return inputError(codeDuplicateReference, fmt.Sprintf("reference %q was already used by the sender", details.Reference))
+    }
+    return nil
+}
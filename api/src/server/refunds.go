@@ -0,0 +1,291 @@
+// Refunds and reversals of the payments.
+//
+// A refund sends a part of the transferred funds back from the recipient to the sender
+// of the original payment; the payment can be refunded several times, but the total
+// refunded amount never exceeds the original amount. A reversal is an operator's
+// correction of a mistaken transfer: it returns everything that was not refunded yet,
+// and the payment cannot be refunded after that. Both are recorded as payments linked
+// to the original one; only the completed payments can be compensated, and the reversed
+// payment gets the reversed status.
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// RefundManager implements the compensating payments.
+type RefundManager interface {
+    GetPayment(id int) (*Payment, error)
+    // GetRefunds returns the refunds and the reversal of the payment, oldest first.
+    GetRefunds(paymentId int) ([]Payment, error)
+    // Refund returns the amount to the sender of the payment. The idempotency key
+    // works the same way as in Transfer.
+    Refund(paymentId int, amount Cents, idempotencyKey string) (*Payment, error)
+    // Reverse returns the rest of the payment which was not refunded yet.
+    Reverse(paymentId int) (*Payment, error)
+}
+
+// refundable returns the part of the original payment which was not refunded yet.
+func refundable(original Payment, refunds []Payment) (Cents, error) {
+    if original.Kind != paymentTransfer && original.Kind != paymentSplitLeg {
+        return 0, inputError(codeInvalidState, "only transfers can be refunded")
+    }
+    if original.Status != statusCompleted {
+        return 0, inputError(codeInvalidState, "payment is " + original.Status)
+    }
+    remaining := original.Amount
+    for _, p := range refunds {
+        if p.Kind == paymentReversal {
+            return 0, inputError(codeInvalidState, "payment is reversed")
+        }
+        remaining -= p.Amount
+    }
+    return remaining, nil
+}
+
+// checkRefund verifies that a compensating payment of the kind can be made, and
+// returns its amount. Zero amount of a reversal means the whole remaining amount.
+func checkRefund(original Payment, refunds []Payment, amount Cents, kind string) (Cents, error) {
+    remaining, err := refundable(original, refunds)
+    if err != nil {
+        return 0, err
+    }
+    if remaining == 0 {
+        return 0, inputError(codeInvalidState, "payment is fully refunded")
+    }
+    if kind == paymentReversal {
+        return remaining, nil
+    }
+    if amount > remaining {
+        return 0, validationError([]FieldError{{"amount", fmt.Sprintf("must not exceed the refundable amount %d", remaining)}})
+    }
+    return amount, nil
+}
+
+func paymentNotFound() managerError {
+    return inputError(codeNotFound, "payment is not found")
+}
+
+func (m BillingManager) GetPayment(id int) (*Payment, error) {
+    var payments []Payment
+    if err := m.DB.Select(&payments, "SELECT * FROM payment WHERE payment_id = $1", id); err != nil {
+        return nil, internalError(err)
+    }
+    if len(payments) == 0 {
+        return nil, paymentNotFound()
+    }
+    return &payments[0], nil
+}
+
+func (m BillingManager) GetRefunds(paymentId int) ([]Payment, error) {
+    return selectRefunds(m.DB, paymentId)
+}
+
+func selectRefunds(q sqlx.Queryer, paymentId int) ([]Payment, error) {
+    var refunds []Payment
+    err := sqlx.Select(q, &refunds, "SELECT * FROM payment WHERE original_id = $1 ORDER BY payment_id", paymentId)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return refunds, nil
+}
+
+func (m BillingManager) Refund(paymentId int, amount Cents, idempotencyKey string) (*Payment, error) {
+    return m.compensate(paymentId, amount, paymentRefund, idempotencyKey)
+}
+
+func (m BillingManager) Reverse(paymentId int) (*Payment, error) {
+    return m.compensate(paymentId, 0, paymentReversal, "")
+}
+
+// compensate creates a refund or a reversal of the payment. The original payment's
+// row is locked, so the concurrent refunds cannot exceed the original amount.
+func (m BillingManager) compensate(paymentId int, amount Cents, kind, idempotencyKey string) (*Payment, error) {
+    var original *Payment
+    if idempotencyKey != "" {
+        var err error
+        if original, err = m.GetPayment(paymentId); err != nil {
+            return nil, err
+        }
+        if payment, err := m.findIdempotent(original.To, idempotencyKey); err != nil {
+            return nil, err
+        } else if payment != nil {
+            return checkReplay(payment, original.From, amount)
+        }
+    }
+
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    payment, err := compensateTx(tx, paymentId, amount, kind, idempotencyKey)
+    if err == nil {
+        err = m.audit(tx, kind + ".created", paymentResource(payment.ID), nil, payment)
+    }
+    if err != nil {
+        mustRollback(tx)
+        if isUniqueViolation(err) && original != nil {
+            // A concurrent request with the same key has won the race.
+            if existing, _ := m.findIdempotent(original.To, idempotencyKey); existing != nil {
+                return checkReplay(existing, original.From, amount)
+            }
+        }
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return payment, nil
+}
+
+func compensateTx(tx *sqlx.Tx, paymentId int, amount Cents, kind, idempotencyKey string) (*Payment, error) {
+    original, err := lockPayment(tx, paymentId)
+    if err != nil {
+        return nil, err
+    }
+    refunds, err := selectRefunds(tx, paymentId)
+    if err != nil {
+        return nil, err
+    }
+    if amount, err = checkRefund(*original, refunds, amount, kind); err != nil {
+        return nil, err
+    }
+
+    now := time.Now().UTC()
+    fromAcc, toAcc, err := lockPair(tx, original.To, original.From, now)
+    if err != nil {
+        return nil, err
+    }
+    if fromAcc.Available() < amount {
+        return nil, inputError(codeInsufficientFunds, "the recipient has insufficient funds to return the payment")
+    }
+    payment, err := move(tx, fromAcc, toAcc, Payment{
+        Time:now,
+        Amount:amount,
+        Kind:kind,
+        OriginalID:&original.ID,
+        IdempotencyKey:nullString(idempotencyKey)})
+    if err == nil && kind == paymentReversal {
+        err = changeStatus(tx, original, statusReversed, "", now)
+    }
+    return payment, err
+}
+
+// getPayment returns the payment identified by the path parameter with its refunds,
+// and with its fees or the legs of a split.
+func (api *BillingAPI) getPayment(m Manager, resp *Responder, req *http.Request) {
+    payment, err := accessiblePayment(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    refunds, err := m.GetRefunds(payment.ID)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    detail := PaymentDetailResponse{Payment:payment, Refunds:make([]Payment, 0, len(refunds)), Net:payment.Amount}
+    for _, refund := range refunds {
+        detail.Refunds = append(detail.Refunds, refund)
+        detail.Refunded += refund.Amount
+    }
+    detail.Net -= detail.Refunded
+    children, err := m.GetChildren(payment.ID)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    for _, child := range children {
+        switch child.Kind {
+        case paymentSplitLeg:
+            detail.Legs = append(detail.Legs, child)
+        case paymentFee:
+            payment.Fees = append(payment.Fees, child)
+        }
+    }
+    if payment.Status == statusCompleted && api.receiptsEnabled() {
+        key, err := api.signingKey(m)
+        if err == nil {
+            detail.Receipt, err = signReceipt(*payment, *key)
+        }
+        if err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+    }
+    resp.SendSuccess(detail)
+}
+
+// refundPayment returns a part of the payment to its sender. The refund is made by
+// the recipient of the payment; the Idempotency-Key header is honored.
+//
+// Example of possible request's body:
+//
+//     {"amount": 500}
+func (api *BillingAPI) refundPayment(m Manager, resp *Responder, req *http.Request) {
+    var body RefundRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    key := req.Header.Get("Idempotency-Key")
+    if len(key) > maxIdempotencyKeyLength {
+        writeManagerError(validationError([]FieldError{{"Idempotency-Key", "must have length at most 64"}}), resp)
+        return
+    }
+    original, err := accessiblePayment(m, req)
+    if err == nil {
+        err = authorize(req.Context(), original.To)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    refund, err := m.Refund(original.ID, body.Amount, key)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(TransferResponse{Payment:refund})
+}
+
+// reversePayment returns everything that was not refunded to the payment's sender.
+// The reversals are made by the operators.
+func (api *BillingAPI) reversePayment(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    id, err := pathID(req, "id")
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    reversal, err := m.Reverse(id)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(TransferResponse{Payment:reversal})
+}
+
+// accessiblePayment returns the payment identified by the path parameter if the
+// caller can access its sender's or recipient's account.
+func accessiblePayment(m Manager, req *http.Request) (*Payment, error) {
+    id, err := pathID(req, "id")
+    if err != nil {
+        return nil, err
+    }
+    payment, err := m.GetPayment(id)
+    if err != nil {
+        return nil, err
+    }
+    if principal := PrincipalFrom(req.Context()); !principal.CanAccess(payment.From) && !principal.CanAccess(payment.To) {
+        return nil, inputError(codeForbidden, fmt.Sprintf("access to payment %d is denied", id))
+    }
+    return payment, nil
+}
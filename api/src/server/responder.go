@@ -3,7 +3,6 @@ package server
 
 import (
     "encoding/json"
-    "fmt"
     "log"
     "net/http"
 )
@@ -16,22 +15,42 @@ type Responder struct {
 }
 
 func (r Responder) SendRequestError(message string) {
-    r.SendError(fmt.Errorf(message), http.StatusBadRequest)
+    r.SendCodedError(codeInvalidRequest, message, http.StatusBadRequest)
 }
 
 func (r Responder) SendServerError(message string) {
-    r.SendError(fmt.Errorf(message), http.StatusInternalServerError)
+    r.SendCodedError(codeInternal, message, http.StatusInternalServerError)
 }
 
 func (r Responder) SendError(err error, status int) {
-    r.WriteHeader(status)
-    err = r.Encode(Response{"error": err.Error(), "status": status})
-    if err != nil { log.Printf("encoding error: %s", err) }
+    code := codeInvalidRequest
+    if status >= http.StatusInternalServerError {
+        code = codeInternal
+    }
+    r.SendCodedError(code, err.Error(), status)
 }
 
-func (r Responder) SendSuccess(resp Response) {
-    r.WriteHeader(http.StatusAccepted)
+// SendCodedError writes an error response with a machine-readable error code.
+func (r Responder) SendCodedError(code, message string, status int) {
+    r.SendErrorResponse(ErrorResponse{Error:message, Code:code, Status:status})
+}
+
+func (r Responder) SendErrorResponse(resp ErrorResponse) {
+    r.Header().Set("Content-Type", "application/json")
+    r.WriteHeader(resp.Status)
     err := r.Encode(resp)
+    if err != nil { log.Printf("encoding error: %s", err) }
+}
+
+// SendSuccess writes one of the *Response structures declared in dto.go.
+func (r Responder) SendSuccess(resp interface{}) {
+    r.SendJSON(http.StatusAccepted, resp)
+}
+
+func (r Responder) SendJSON(status int, value interface{}) {
+    r.Header().Set("Content-Type", "application/json")
+    r.WriteHeader(status)
+    err := r.Encode(value)
     if err != nil { log.Print(err) }
 }
 
@@ -0,0 +1,186 @@
+// Execution of the scheduled transfers.
+//
+// Every API instance runs the scheduler loop, but only the leader executes the
+// schedules. The leader is elected with a session-level PostgreSQL advisory lock:
+// the instance holding the lock stays the leader until its connection is lost, and
+// then another instance takes the lock over. The transfers are made with the
+// idempotency keys derived from the occurrences, so an occurrence is paid once even
+// if two instances believe to be the leaders for a moment.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "log"
+    "time"
+)
+
+// schedulerJob is the name of the scheduler's advisory lock.
+const schedulerJob = "scheduler"
+
+// LeaderElector elects a single instance to run a background job.
+type LeaderElector interface {
+    // TryLead makes the instance the leader of the job if there is no other one.
+    // Nil is returned if the job is led by another instance.
+    TryLead(ctx context.Context, job string) (Lease, error)
+}
+
+// Lease is the leadership of a job, held until it is released or lost.
+type Lease interface {
+    Alive(ctx context.Context) bool
+    Release()
+}
+
+// pgLease holds the advisory lock on the dedicated connection.
+type pgLease struct {
+    conn *sql.Conn
+    job string
+}
+
+func (m BillingManager) TryLead(ctx context.Context, job string) (Lease, error) {
+    conn, err := m.DB.Conn(ctx)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var acquired bool
+    err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", job).Scan(&acquired)
+    if err != nil || !acquired {
+        _ = conn.Close()
+        if err != nil {
+            return nil, internalError(err)
+        }
+        return nil, nil
+    }
+    return &pgLease{conn, job}, nil
+}
+
+// Alive checks that the connection holding the lock is not lost.
+func (l *pgLease) Alive(ctx context.Context) bool {
+    _, err := l.conn.ExecContext(ctx, "SELECT 1")
+    return err == nil
+}
+
+func (l *pgLease) Release() {
+    _, _ = l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", l.job)
+    _ = l.conn.Close()
+}
+
+// Scheduler executes the due occurrences of the schedules.
+type Scheduler struct {
+    Manager Manager
+    // Interval is the delay between the checks of the due schedules.
+    Interval time.Duration
+    BatchSize int
+    // Check rejects the amounts which cannot be transferred without an approval, so
+    // the schedules created before the threshold was lowered cannot bypass it; nil
+    // accepts all amounts.
+    Check func(amount Cents) error
+
+    now func() time.Time
+}
+
+func NewScheduler(m Manager) *Scheduler {
+    return &Scheduler{
+        Manager:m,
+        Interval:10*time.Second,
+        BatchSize:50,
+        now:func() time.Time { return time.Now().UTC() },
+    }
+}
+
+// RunOnce executes a batch of the due occurrences and returns the number of the
+// recorded runs. A transfer rejected by the Manager is recorded as a failed run, and
+// the schedule proceeds to its next occurrence. A transfer which fails because of an
+// internal error is not recorded, so it is retried on the next call.
+func (s *Scheduler) RunOnce() (int, error) {
+    due, err := s.Manager.DueSchedules(s.now(), s.BatchSize)
+    if err != nil {
+        return 0, err
+    }
+    recorded := 0
+    for _, schedule := range due {
+        run := ScheduleRun{
+            ScheduleID:schedule.ID,
+            Occurrence:schedule.Runs + 1,
+            Scheduled:*schedule.NextRun,
+            Status:runSucceeded}
+        var payment *Payment
+        var err error
+        if s.Check != nil {
+            err = s.Check(schedule.Amount)
+        }
+        if err == nil {
+            payment, err = s.Manager.Transfer(schedule.From, schedule.To, schedule.Amount, run.idempotencyKey(), PaymentDetails{})
+        }
+        if err != nil {
+            e, ok := err.(managerError)
+            if !ok || e.internal {
+                log.Printf("schedule %d: %s", schedule.ID, err)
+                continue
+            }
+            run.Status, run.ErrorCode, run.Error = runFailed, e.code, e.message
+        } else {
+            run.PaymentID = &payment.ID
+        }
+        run.Executed = s.now()
+        if _, err := s.Manager.RecordRun(run); err != nil {
+            return recorded, err
+        }
+        recorded++
+    }
+    return recorded, nil
+}
+
+// RunScheduler executes the schedules using the shared Manager until the context is
+// cancelled, while the instance leads the scheduler job.
+func (api *BillingAPI) RunScheduler(ctx context.Context) {
+    scheduler := NewScheduler(nil)
+    scheduler.Check = api.checkThreshold
+    api.runLeader(ctx, schedulerJob, scheduler.Interval, func(m Manager) error {
+        scheduler.Manager = m
+        _, err := scheduler.RunOnce()
+        return err
+    })
+}
+
+// runLeader calls run on every tick while the instance is the leader of the job,
+// until the context is cancelled. The instance competes for the leadership on every
+// tick, so another instance takes the job over if the leader is lost.
+func (api *BillingAPI) runLeader(ctx context.Context, job string, interval time.Duration, run func(m Manager) error) {
+    var lease Lease
+    defer func() {
+        if lease != nil {
+            lease.Release()
+        }
+    }()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        m, err := api.manager()
+        if err != nil {
+            log.Printf("%s: %s", job, err)
+            continue
+        }
+        if lease != nil && !lease.Alive(ctx) {
+            log.Printf("%s: the leadership is lost", job)
+            lease.Release()
+            lease = nil
+        }
+        if lease == nil {
+            if lease, err = m.TryLead(ctx, job); err != nil || lease == nil {
+                if err != nil {
+                    log.Printf("%s: %s", job, err)
+                }
+                continue
+            }
+        }
+        if err := run(m.Audited(job, "")); err != nil {
+            log.Printf("%s: %s", job, err)
+        }
+    }
+}
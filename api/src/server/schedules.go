@@ -0,0 +1,418 @@
+// Scheduled and recurring transfers.
+//
+// A schedule describes a transfer which is made once at the given time, or repeated
+// daily, weekly or monthly on the given day until the end date or the number of runs
+// is reached. The schedules are executed by the Scheduler; every execution of an
+// occurrence is recorded as a run, so the failed transfers can be inspected.
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// Recurrences of the schedules.
+const (
+    recurOnce = "once"
+    recurDaily = "daily"
+    recurWeekly = "weekly"
+    recurMonthly = "monthly"
+)
+
+// Statuses of the schedules.
+const (
+    scheduleActive = "active"
+    scheduleFinished = "finished"
+    scheduleCancelled = "cancelled"
+)
+
+// Statuses of the schedule runs.
+const (
+    runSucceeded = "succeeded"
+    runFailed = "failed"
+)
+
+// ScheduleManager stores the schedules and their runs.
+type ScheduleManager interface {
+    CreateSchedule(schedule Schedule) (*Schedule, error)
+    GetSchedule(id int) (*Schedule, error)
+    CancelSchedule(id int) (*Schedule, error)
+    // GetScheduleRuns returns the runs of the schedule, oldest first.
+    GetScheduleRuns(id int) ([]ScheduleRun, error)
+    // DueSchedules returns the active schedules which should run at now, the most
+    // overdue first.
+    DueSchedules(now time.Time, limit int) ([]Schedule, error)
+    // RecordRun stores the run of the schedule's next occurrence and advances the
+    // schedule. A run of an occurrence which is already recorded is ignored.
+    RecordRun(run ScheduleRun) (*Schedule, error)
+}
+
+// Schedule is a transfer made at the given time, or repeated with a recurrence.
+//
+// The occurrences of a monthly schedule happen on the DayOfMonth, or on the last day
+// of the shorter months, at the clock time of the Start. The End and the MaxRuns are
+// optional.
+type Schedule struct {
+    ID int             `db:"schedule_id" json:"id"`
+    From string        `db:"from_id" json:"from"`
+    To string          `db:"to_id" json:"to"`
+    Amount Cents       `db:"amount" json:"amount"`
+    Recurrence string  `db:"recurrence" json:"recurrence"`
+    DayOfMonth int     `db:"day_of_month" json:"day_of_month,omitempty"`
+    Start time.Time    `db:"start_at" json:"start"`
+    End *time.Time     `db:"end_at" json:"end,omitempty"`
+    MaxRuns int        `db:"max_runs" json:"max_runs,omitempty"`
+    Runs int           `db:"runs" json:"runs"`
+    NextRun *time.Time `db:"next_run_at" json:"next_run,omitempty"`
+    Status string      `db:"status" json:"status"`
+    Created time.Time  `db:"created_on" json:"created"`
+}
+
+// ScheduleRun is an execution of a schedule's occurrence. The failed runs keep the
+// error which prevented the transfer.
+type ScheduleRun struct {
+    ID int              `db:"run_id" json:"id"`
+    ScheduleID int      `db:"schedule_id" json:"-"`
+    Occurrence int      `db:"occurrence" json:"occurrence"`
+    Scheduled time.Time `db:"scheduled_at" json:"scheduled"`
+    Executed time.Time  `db:"executed_at" json:"executed"`
+    Status string       `db:"status" json:"status"`
+    PaymentID *int      `db:"payment_id" json:"payment_id,omitempty"`
+    ErrorCode string    `db:"error_code" json:"error_code,omitempty"`
+    Error string        `db:"error" json:"error,omitempty"`
+}
+
+// idempotencyKey returns the key of the run's transfer. The key is derived from the
+// schedule and the occurrence, so an occurrence is never paid twice, even if its run
+// is executed again after a crash.
+func (r ScheduleRun) idempotencyKey() string {
+    return fmt.Sprintf("schedule-%d-%d", r.ScheduleID, r.Occurrence)
+}
+
+// occurrence returns the time of the schedule's n-th occurrence, counting from zero.
+func (s Schedule) occurrence(n int) time.Time {
+    switch s.Recurrence {
+    case recurDaily:
+        return s.Start.AddDate(0, 0, n)
+    case recurWeekly:
+        return s.Start.AddDate(0, 0, 7*n)
+    case recurMonthly:
+        if monthDay(s.Start, 0, s.DayOfMonth).Before(s.Start) {
+            n++
+        }
+        return monthDay(s.Start, n, s.DayOfMonth)
+    }
+    return s.Start
+}
+
+// monthDay returns the day of the month which is months after the month of t, at the
+// clock time of t. The day is limited by the length of the month.
+func monthDay(t time.Time, months, day int) time.Time {
+    year, month := t.Year(), t.Month() + time.Month(months)
+    if last := time.Date(year, month + 1, 0, 0, 0, 0, 0, t.Location()).Day(); day > last {
+        day = last
+    }
+    return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// advance returns the schedule after the run of its next occurrence. The schedule is
+// finished when there are no more occurrences.
+func (s Schedule) advance() Schedule {
+    s.Runs++
+    next := s.occurrence(s.Runs)
+    switch {
+    case s.Status != scheduleActive:
+        s.NextRun = nil
+    case s.Recurrence == recurOnce, s.MaxRuns > 0 && s.Runs >= s.MaxRuns, s.End != nil && next.After(*s.End):
+        s.Status, s.NextRun = scheduleFinished, nil
+    default:
+        s.NextRun = &next
+    }
+    return s
+}
+
+func scheduleNotFound() managerError {
+    return inputError(codeNotFound, "schedule is not found")
+}
+
+func (m BillingManager) CreateSchedule(schedule Schedule) (*Schedule, error) {
+    accounts, err := m.GetAccounts([]string{schedule.From, schedule.To})
+    if err != nil {
+        return nil, internalError(err)
+    }
+    from, to, ok := pickPair(accounts, schedule.From, schedule.To)
+    if !ok {
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if from.Currency != to.Currency {
+        return nil, inputError(codeCurrencyMismatch, "cannot schedule a transfer between accounts with different currency")
+    }
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO schedule (from_id, to_id, amount, recurrence, day_of_month, start_at, end_at, max_runs,
+            runs, next_run_at, status, created_on)
+        VALUES (:from_id, :to_id, :amount, :recurrence, :day_of_month, :start_at, :end_at, :max_runs,
+            :runs, :next_run_at, :status, :created_on)
+        RETURNING schedule_id`)
+    if err == nil {
+        err = stmt.Get(&schedule.ID, schedule)
+    }
+    if err == nil {
+        err = m.audit(tx, "schedule.created", scheduleResource(schedule.ID), nil, &schedule)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &schedule, nil
+}
+
+// lockSchedule selects the schedule for update within the transaction tx.
+func lockSchedule(tx *sqlx.Tx, id int) (*Schedule, error) {
+    var schedules []Schedule
+    if err := tx.Select(&schedules, "SELECT * FROM schedule WHERE schedule_id = $1 FOR UPDATE", id); err != nil {
+        return nil, err
+    }
+    if len(schedules) == 0 {
+        return nil, scheduleNotFound()
+    }
+    return &schedules[0], nil
+}
+
+func scheduleResource(id int) string {
+    return "schedule/" + strconv.Itoa(id)
+}
+
+func (m BillingManager) GetSchedule(id int) (*Schedule, error) {
+    var schedules []Schedule
+    if err := m.DB.Select(&schedules, "SELECT * FROM schedule WHERE schedule_id = $1", id); err != nil {
+        return nil, internalError(err)
+    }
+    if len(schedules) == 0 {
+        return nil, scheduleNotFound()
+    }
+    return &schedules[0], nil
+}
+
+func (m BillingManager) CancelSchedule(id int) (*Schedule, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    before, err := lockSchedule(tx, id)
+    if err == nil && before.Status != scheduleActive {
+        err = inputError(codeInvalidState, "cannot cancel a schedule which is " + before.Status)
+    }
+    var schedule Schedule
+    if err == nil {
+        schedule = *before
+        schedule.Status, schedule.NextRun = scheduleCancelled, nil
+        _, err = tx.Exec("UPDATE schedule SET status = $2, next_run_at = NULL WHERE schedule_id = $1", id, scheduleCancelled)
+    }
+    if err == nil {
+        err = m.audit(tx, "schedule.cancelled", scheduleResource(id), before, &schedule)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &schedule, nil
+}
+
+func (m BillingManager) GetScheduleRuns(id int) ([]ScheduleRun, error) {
+    if _, err := m.GetSchedule(id); err != nil {
+        return nil, err
+    }
+    var runs []ScheduleRun
+    if err := m.DB.Select(&runs, "SELECT * FROM schedule_run WHERE schedule_id = $1 ORDER BY run_id", id); err != nil {
+        return nil, internalError(err)
+    }
+    return runs, nil
+}
+
+func (m BillingManager) DueSchedules(now time.Time, limit int) ([]Schedule, error) {
+    var schedules []Schedule
+    err := m.DB.Select(&schedules, `
+        SELECT * FROM schedule
+        WHERE status = $1 AND next_run_at <= $2
+        ORDER BY next_run_at
+        LIMIT $3`, scheduleActive, now, limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return schedules, nil
+}
+
+func (m BillingManager) RecordRun(run ScheduleRun) (*Schedule, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    before, err := lockSchedule(tx, run.ScheduleID)
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if before.Runs + 1 != run.Occurrence {
+        mustRollback(tx)
+        return before, nil
+    }
+
+    schedule := before.advance()
+    _, err = tx.NamedExec(`
+        INSERT INTO schedule_run (schedule_id, occurrence, scheduled_at, executed_at, status, payment_id, error_code, error)
+        VALUES (:schedule_id, :occurrence, :scheduled_at, :executed_at, :status, :payment_id, :error_code, :error)`, run)
+    if err == nil {
+        _, err = tx.NamedExec(`
+            UPDATE schedule SET runs = :runs, next_run_at = :next_run_at, status = :status
+            WHERE schedule_id = :schedule_id`, schedule)
+    }
+    if err == nil {
+        err = m.audit(tx, "schedule.run", scheduleResource(run.ScheduleID), before, &schedule)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &schedule, nil
+}
+
+// createSchedule schedules a transfer from the caller's account.
+//
+// Example of possible request's body:
+//
+//     {"from": "account_1", "to": "account_2", "amount": 1000, "recurrence": "monthly",
+//      "day_of_month": 25, "start": "2019-03-25T09:00:00Z", "max_runs": 12}
+func (api *BillingAPI) createSchedule(m Manager, resp *Responder, req *http.Request) {
+    var body ScheduleRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    err := body.check()
+    if err == nil {
+        err = authorize(req.Context(), body.From)
+    }
+    if err == nil {
+        err = api.checkThreshold(body.Amount)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    schedule := Schedule{
+        From:body.From,
+        To:body.To,
+        Amount:body.Amount,
+        Recurrence:body.Recurrence,
+        DayOfMonth:body.DayOfMonth,
+        Start:body.Start.UTC(),
+        End:body.End,
+        MaxRuns:body.MaxRuns,
+        Status:scheduleActive,
+        Created:time.Now().UTC()}
+    if schedule.Recurrence == recurMonthly && schedule.DayOfMonth == 0 {
+        schedule.DayOfMonth = schedule.Start.Day()
+    }
+    first := schedule.occurrence(0)
+    if schedule.End != nil && first.After(*schedule.End) {
+        writeManagerError(validationError([]FieldError{{"end", "must not be before the first occurrence"}}), resp)
+        return
+    }
+    schedule.NextRun = &first
+    created, err := m.CreateSchedule(schedule)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ScheduleResponse{created})
+}
+
+// getSchedule returns the schedule identified by the path parameter.
+func (api *BillingAPI) getSchedule(m Manager, resp *Responder, req *http.Request) {
+    schedule, err := accessibleSchedule(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ScheduleResponse{schedule})
+}
+
+// cancelSchedule stops the future runs of the schedule.
+func (api *BillingAPI) cancelSchedule(m Manager, resp *Responder, req *http.Request) {
+    schedule, err := accessibleSchedule(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if schedule, err = m.CancelSchedule(schedule.ID); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(ScheduleResponse{schedule})
+}
+
+// scheduleRuns returns the run history of the schedule.
+func (api *BillingAPI) scheduleRuns(m Manager, resp *Responder, req *http.Request) {
+    schedule, err := accessibleSchedule(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    runs, err := m.GetScheduleRuns(schedule.ID)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if runs == nil {
+        runs = make([]ScheduleRun, 0)
+    }
+    resp.SendSuccess(ScheduleRunsResponse{schedule.ID, runs})
+}
+
+// accessibleSchedule returns the schedule identified by the path parameter if the
+// caller can access its sender's account.
+func accessibleSchedule(m Manager, req *http.Request) (*Schedule, error) {
+    id, err := pathID(req, "id")
+    if err != nil {
+        return nil, err
+    }
+    schedule, err := m.GetSchedule(id)
+    if err != nil {
+        return nil, err
+    }
+    if err := authorize(req.Context(), schedule.From); err != nil {
+        return nil, err
+    }
+    return schedule, nil
+}
+
+func (r ScheduleRequest) check() error {
+    var errs []FieldError
+    if r.Recurrence != recurMonthly && r.DayOfMonth != 0 {
+        errs = append(errs, FieldError{"day_of_month", "is allowed for the monthly recurrence only"})
+    }
+    if r.Recurrence == recurOnce && (r.End != nil || r.MaxRuns != 0) {
+        errs = append(errs, FieldError{"recurrence", "a single transfer cannot have end or max_runs"})
+    }
+    if len(errs) > 0 {
+        return validationError(errs)
+    }
+    return nil
+}
@@ -0,0 +1,382 @@
+// Search of the payments.
+//
+// The operators find the payments of all accounts with a query of terms separated by
+// spaces, e.g. `amount>100 currency:EUR memo:"invoice 42"`; a payment is found if it
+// matches all terms. The following terms are supported:
+//     * reference:text: the reference contains the text, ignoring the case
+//     * memo:text: the memo contains the words of the text in a row
+//     * account:id, from:id, to:id: either party, the sender or the recipient
+//     * currency:code, kind:kind, status:status: the exact values
+//     * amount:N, amount>N, amount>=N, amount<N, amount<=N: the amount in cents
+//     * date:D, date>D, date>=D, date<D, date<=D: the UTC day of the payment, as
+//       2006-01-02
+//     * text: the reference contains the text, or the memo has its words in a row
+// The values with spaces are quoted, and = is the same as the colon.
+//
+// The memo is searched with the full-text search of Postgres with the simple
+// configuration, i.e. the words are compared ignoring the case and without stemming;
+// the words of the in-memory implementation are the runs of letters and digits. The
+// references are searched with a trigram index, so neither search scans the payments.
+package server
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+
+    "github.com/lib/pq"
+)
+
+// maxSearchTerms bounds the number of the terms of a search query.
+const maxSearchTerms = 20
+
+// SearchManager finds the payments of all accounts.
+type SearchManager interface {
+    // SearchPayments returns a page of the payments matching the search, newest first.
+    SearchPayments(search PaymentSearch, page PageRequest) ([]Payment, error)
+}
+
+// PaymentSearch is a parsed search query. The empty fields and the nil bounds don't
+// filter; the amounts are within [MinAmount, MaxAmount] and the times within
+// [Since, Until).
+type PaymentSearch struct {
+    Texts []string
+    Reference string
+    Memo string
+    Account string
+    From string
+    To string
+    Currency string
+    Kind string
+    Status string
+    MinAmount *Cents
+    MaxAmount *Cents
+    Since *time.Time
+    Until *time.Time
+}
+
+// ParseSearch parses the search query described in the package documentation.
+func ParseSearch(query string) (PaymentSearch, error) {
+    var search PaymentSearch
+    terms, err := splitTerms(query)
+    if err != nil {
+        return search, err
+    }
+    if len(terms) > maxSearchTerms {
+        return search, fmt.Errorf("must have at most %d terms", maxSearchTerms)
+    }
+    for _, term := range terms {
+        if err = search.add(term); err != nil {
+            return search, err
+        }
+    }
+    return search, nil
+}
+
+// splitTerms splits the query by the spaces outside of the quotes. The quotes are kept,
+// so the term can tell the quoted text from the field names.
+func splitTerms(query string) ([]string, error) {
+    var (
+        terms []string
+        term strings.Builder
+        quoted bool
+    )
+    for _, r := range query {
+        switch {
+        case r == '"':
+            quoted = !quoted
+        case unicode.IsSpace(r) && !quoted:
+            if term.Len() > 0 {
+                terms = append(terms, term.String())
+                term.Reset()
+            }
+            continue
+        }
+        term.WriteRune(r)
+    }
+    if quoted {
+        return nil, fmt.Errorf("has an unterminated quote")
+    }
+    if term.Len() > 0 {
+        terms = append(terms, term.String())
+    }
+    return terms, nil
+}
+
+// add adds the term to the search. The term is a field if it starts with a name and
+// an operator outside of the quotes, and a text otherwise.
+func (s *PaymentSearch) add(term string) error {
+    end := strings.IndexAny(term, `:=<>"`)
+    if end <= 0 || term[end] == '"' {
+        s.Texts = append(s.Texts, unquote(term))
+        return nil
+    }
+    name, op := term[:end], term[end:end+1]
+    if strings.HasPrefix(term[end:], "<=") || strings.HasPrefix(term[end:], ">=") {
+        op = term[end:end+2]
+    }
+    if op == "=" {
+        op = ":"
+    }
+    value := unquote(term[end+len(op):])
+    if value == "" {
+        return fmt.Errorf("has no value of %s", name)
+    }
+    switch name {
+    case "amount":
+        return s.addAmount(op, value)
+    case "date":
+        return s.addDate(op, value)
+    }
+    if op != ":" {
+        return fmt.Errorf("cannot compare %s with %s", name, op)
+    }
+    fields := map[string]*string{
+        "reference": &s.Reference,
+        "memo": &s.Memo,
+        "account": &s.Account,
+        "from": &s.From,
+        "to": &s.To,
+        "currency": &s.Currency,
+        "kind": &s.Kind,
+        "status": &s.Status,
+    }
+    field, ok := fields[name]
+    if !ok {
+        return fmt.Errorf("has unknown field %s", name)
+    }
+    switch name {
+    case "currency":
+        value = strings.ToUpper(value)
+    case "kind", "status":
+        value = strings.ToLower(value)
+    }
+    *field = value
+    return nil
+}
+
+func (s *PaymentSearch) addAmount(op, value string) error {
+    n, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return fmt.Errorf("has invalid amount %s", value)
+    }
+    amount := Cents(n)
+    switch op {
+    case ">":
+        s.MinAmount = maxCents(s.MinAmount, amount + 1)
+    case ">=":
+        s.MinAmount = maxCents(s.MinAmount, amount)
+    case "<":
+        s.MaxAmount = minCents(s.MaxAmount, amount - 1)
+    case "<=":
+        s.MaxAmount = minCents(s.MaxAmount, amount)
+    default:
+        s.MinAmount, s.MaxAmount = maxCents(s.MinAmount, amount), minCents(s.MaxAmount, amount)
+    }
+    return nil
+}
+
+func (s *PaymentSearch) addDate(op, value string) error {
+    day, err := time.Parse(dateLayout, value)
+    if err != nil {
+        return fmt.Errorf("has invalid date %s", value)
+    }
+    next := day.AddDate(0, 0, 1)
+    switch op {
+    case ">":
+        s.Since = laterTime(s.Since, next)
+    case ">=":
+        s.Since = laterTime(s.Since, day)
+    case "<":
+        s.Until = earlierTime(s.Until, day)
+    case "<=":
+        s.Until = earlierTime(s.Until, next)
+    default:
+        s.Since, s.Until = laterTime(s.Since, day), earlierTime(s.Until, next)
+    }
+    return nil
+}
+
+// maxCents, minCents, laterTime and earlierTime narrow the bounds given more than once.
+func maxCents(bound *Cents, amount Cents) *Cents {
+    if bound != nil && *bound > amount {
+        return bound
+    }
+    return &amount
+}
+
+func minCents(bound *Cents, amount Cents) *Cents {
+    if bound != nil && *bound < amount {
+        return bound
+    }
+    return &amount
+}
+
+func laterTime(bound *time.Time, t time.Time) *time.Time {
+    if bound != nil && bound.After(t) {
+        return bound
+    }
+    return &t
+}
+
+func earlierTime(bound *time.Time, t time.Time) *time.Time {
+    if bound != nil && bound.Before(t) {
+        return bound
+    }
+    return &t
+}
+
+func unquote(text string) string {
+    return strings.ReplaceAll(text, `"`, "")
+}
+
+// matches checks the payment against the search.
+func (s PaymentSearch) matches(p Payment) bool {
+    for _, text := range s.Texts {
+        if !containsFold(p.Reference, text) && !containsPhrase(p.Memo, text) {
+            return false
+        }
+    }
+    exact := []struct{ want, actual string }{
+        {s.Currency, p.Currency},
+        {s.Kind, p.Kind},
+        {s.Status, p.Status},
+        {s.From, p.From},
+        {s.To, p.To},
+    }
+    for _, field := range exact {
+        if field.want != "" && field.want != field.actual {
+            return false
+        }
+    }
+    if s.Reference != "" && !containsFold(p.Reference, s.Reference) || s.Memo != "" && !containsPhrase(p.Memo, s.Memo) {
+        return false
+    }
+    if s.Account != "" && s.Account != p.From && s.Account != p.To {
+        return false
+    }
+    if s.MinAmount != nil && p.Amount < *s.MinAmount || s.MaxAmount != nil && p.Amount > *s.MaxAmount {
+        return false
+    }
+    return (s.Since == nil || !p.Time.Before(*s.Since)) && (s.Until == nil || p.Time.Before(*s.Until))
+}
+
+func containsFold(text, part string) bool {
+    return strings.Contains(strings.ToLower(text), strings.ToLower(part))
+}
+
+// containsPhrase checks that the words of the phrase follow each other in the text.
+func containsPhrase(text, phrase string) bool {
+    words, phraseWords := searchWords(text), searchWords(phrase)
+    if len(phraseWords) == 0 {
+        return false
+    }
+    for i := 0; i + len(phraseWords) <= len(words); i++ {
+        if strings.Join(words[i:i+len(phraseWords)], " ") == strings.Join(phraseWords, " ") {
+            return true
+        }
+    }
+    return false
+}
+
+func searchWords(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+// likePattern matches the strings containing the text with ILIKE.
+func likePattern(text string) string {
+    escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+    return "%" + escaped + "%"
+}
+
+// SearchPayments passes the texts with their LIKE patterns as two arrays, unnested
+// side by side.
+func (m BillingManager) SearchPayments(search PaymentSearch, page PageRequest) ([]Payment, error) {
+    before := page.Before
+    if before <= 0 {
+        before = math.MaxInt32
+    }
+    patterns := make([]string, len(search.Texts))
+    for i, text := range search.Texts {
+        patterns[i] = likePattern(text)
+    }
+    reference := ""
+    if search.Reference != "" {
+        reference = likePattern(search.Reference)
+    }
+    var payments []Payment
+    err := m.DB.Select(&payments, `
+        SELECT * FROM payment p
+        WHERE p.payment_id < $1
+            AND NOT EXISTS (
+                SELECT 1 FROM unnest($2::TEXT[], $3::TEXT[]) AS t (text, pattern)
+                WHERE NOT (p.reference ILIKE t.pattern OR to_tsvector('simple', p.memo) @@ phraseto_tsquery('simple', t.text)))
+            AND ($4 = '' OR p.reference ILIKE $4)
+            AND ($5 = '' OR to_tsvector('simple', p.memo) @@ phraseto_tsquery('simple', $5))
+            AND ($6 = '' OR p.from_id = $6 OR p.to_id = $6)
+            AND ($7 = '' OR p.from_id = $7)
+            AND ($8 = '' OR p.to_id = $8)
+            AND ($9 = '' OR p.currency::TEXT = $9)
+            AND ($10 = '' OR p.kind = $10)
+            AND ($11 = '' OR p.status = $11)
+            AND ($12::DECIMAL IS NULL OR p.amount >= $12)
+            AND ($13::DECIMAL IS NULL OR p.amount <= $13)
+            AND ($14::TIMESTAMP IS NULL OR p.transaction_time_utc >= $14)
+            AND ($15::TIMESTAMP IS NULL OR p.transaction_time_utc < $15)
+        ORDER BY p.payment_id DESC
+        LIMIT $16`,
+        before, pq.Array(search.Texts), pq.Array(patterns), reference, search.Memo,
+        search.Account, search.From, search.To, search.Currency, search.Kind, search.Status,
+        search.MinAmount, search.MaxAmount, search.Since, search.Until, page.Limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return payments, nil
+}
+
+// searchPayments finds the payments of all accounts with the search query given by
+// the q parameter, and accepts the limit and the cursor like the payments list.
+func (api *BillingAPI) searchPayments(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    query := PaymentSearchQuery{Limit:defaultPageSize}
+    err := decodeQuery(req, &query)
+    var search PaymentSearch
+    if err == nil {
+        if search, err = ParseSearch(query.Q); err != nil {
+            err = validationError([]FieldError{{"q", err.Error()}})
+        }
+    }
+    var page PageRequest
+    if err == nil {
+        page, err = pageRequest(query.Limit, query.Cursor)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    limit := page.Limit
+    page.Limit++ // fetch one extra item to find out if there is a next page
+    payments, err := m.SearchPayments(search, page)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    next := ""
+    if len(payments) > limit {
+        payments = payments[:limit]
+        next = strconv.Itoa(payments[limit-1].ID)
+    }
+    if payments == nil {
+        payments = make([]Payment, 0)
+    }
+    resp.SendSuccess(PaymentSearchResponse{payments, next})
+}
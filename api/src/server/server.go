@@ -4,67 +4,492 @@
 package server
 
 import (
-    "encoding/json"
+    "context"
     "fmt"
     "io"
     "log"
     "net/http"
-    "strconv"
+    "sync"
+    "time"
 )
 
+// Response is a generic JSON object. The endpoints reply with the structures
+// declared in dto.go, and the Response is convenient to decode them in tests.
 type Response map[string]interface{}
 
 type Config struct {
     Host string
     Port int
     DatabaseConn string
+    // GRPCPort is the port of the gRPC server; the server is disabled if it is zero.
+    GRPCPort int
+    // Tokens maps the bearer tokens to the callers; see ParseTokens for details.
+    Tokens map[string]Principal
+    // InterestAccount receives the overdraft interest; the interest is not charged
+    // if it is empty.
+    InterestAccount string
+    // ApprovalThreshold is the amount above which the transfers should be approved
+    // by a second principal; the approvals are disabled if it is zero.
+    ApprovalThreshold Cents
+    // ApprovalTTL is the time to approve a transfer, a day by default.
+    ApprovalTTL time.Duration
+    // ReceiptKey is the private key signing the receipts, see ParseReceiptKey; the
+    // receipts are disabled if neither it nor ReceiptKeyFile is set.
+    ReceiptKey string
+    // ReceiptKeyFile is the file containing the ReceiptKey, which takes precedence
+    // over the ReceiptKey itself. The file is read again when the key is rotated.
+    ReceiptKeyFile string
 }
 
 func (c Config) Addr() string { return fmt.Sprintf("%s:%d", c.Host, c.Port) }
 func (c Config) URL()  string { return fmt.Sprintf("http://%s", c.Addr()) }
+func (c Config) GRPCAddr() string { return fmt.Sprintf("%s:%d", c.Host, c.GRPCPort) }
+
+// Check rejects the settings which cannot work together. The approvals need the
+// authentication: without the tokens every caller is the same anonymous principal,
+// which cannot approve its own transfers, so the transfers above the threshold would
+// never be made.
+func (c Config) Check() error {
+    if c.ApprovalThreshold > 0 && len(c.Tokens) == 0 {
+        return fmt.Errorf("the approval threshold requires the API tokens to be configured")
+    }
+    return nil
+}
 
 // BillingAPI represents an HTTP-server serving the billing API.
 type BillingAPI struct {
     Config
     *http.Server
+    Auth Authenticator
+    // Events delivers the committed payments to the streaming endpoints.
+    Events *Bus
+
+    mu sync.Mutex
+    shared Manager
+    keyMu sync.Mutex
+    // receiptKey is the loaded key signing the receipts.
+    receiptKey *SigningKey
 }
 
 func NewBillingAPI(conf Config) *BillingAPI {
     mux := http.NewServeMux()
-    api := BillingAPI{conf, &http.Server{Addr:conf.Addr(), Handler:mux}}
+    api := &BillingAPI{Config:conf, Auth:Authenticator{conf.Tokens}, Events:NewBus()}
+    api.Server = &http.Server{Addr:conf.Addr(), Handler:api.Auth.Middleware(mux, publicPaths...)}
     mux.Handle("/", http.HandlerFunc(notFound))
-    mux.Handle("/status", http.HandlerFunc(api.status))
-    mux.Handle("/accounts", http.HandlerFunc(api.accounts))
-    mux.Handle("/transfer", http.HandlerFunc(api.transfer))
-    mux.Handle("/payments", http.HandlerFunc(api.payments))
-    return &api
+    mux.Handle("GET /openapi.json", http.HandlerFunc(api.openAPI))
+    mux.Handle("GET /docs", http.HandlerFunc(api.docs))
+    for _, op := range api.operations() {
+        mux.Handle(op.pattern(), op.Handler)
+    }
+    return api
+}
+
+// publicPaths are served without authentication.
+var publicPaths = []string{"/status", "/openapi.json", "/docs", "/.well-known/receipt-keys"}
+
+// operations lists the endpoints of the API. Every endpoint should be registered here
+// to be included in the OpenAPI specification.
+func (api *BillingAPI) operations() []Operation {
+    return []Operation{
+        {
+            Method:"GET", Path:"/status", Legacy:true,
+            Summary:"Checks if the server is up",
+            Response:StatusResponse{},
+            Handler:http.HandlerFunc(api.status),
+        },
+        {
+            Method:"GET", Path:"/accounts", Legacy:true,
+            Summary:"Lists available accounts",
+            Response:AccountsResponse{},
+            Handler:api.managed(api.accounts),
+        },
+        {
+            Method:"POST", Path:"/transfer", Legacy:true,
+            Summary:"Moves funds between accounts",
+            Request:LegacyTransferRequest{}, Response:TransferResponse{},
+            Handler:api.managed(api.transfer),
+        },
+        {
+            Method:"POST", Path:"/payments", Legacy:true,
+            Summary:"Reports payments of an account",
+            Request:PaymentsRequest{}, Response:PaymentsResponse{},
+            Handler:api.managed(api.payments),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts",
+            Summary:"Lists available accounts",
+            Response:AccountListResponse{},
+            Handler:api.managed(api.listAccounts),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}",
+            Summary:"Returns an account",
+            Response:AccountResponse{},
+            Handler:api.managed(api.getAccount),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/payments",
+            Summary:"Lists payments of an account, newest first",
+            Query:PaymentQuery{}, Response:PaymentPageResponse{},
+            Handler:api.managed(api.listPayments),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/events",
+            Summary:"Streams payment.sent and payment.received events of an account; " +
+                "supports the Last-Event-ID header",
+            ContentType:"text/event-stream",
+            Handler:api.managed(api.accountEvents),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/balance",
+            Summary:"Returns the balance of an account at a past time, or the current one",
+            Query:BalanceQuery{}, Response:BalanceResponse{},
+            Handler:api.managed(api.accountBalance),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/statement",
+            Summary:"Streams the statement of an account for a period of days in the CSV, JSON Lines, PDF " +
+                "or camt.053 format",
+            Query:StatementQuery{},
+            ContentType:"text/csv", AltContentTypes:[]string{"application/jsonl", "application/pdf", "application/xml"},
+            Handler:api.managed(api.accountStatement),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/counterparties",
+            Summary:"Lists the counterparties of the account with the largest payment volumes",
+            Query:CounterpartyQuery{}, Response:CounterpartiesResponse{},
+            Handler:api.managed(api.topCounterparties),
+        },
+        {
+            Method:"POST", Path:"/v1/accounts/{id}/tier",
+            Summary:"Changes the tier of an account which selects its fee schedules",
+            Request:TierRequest{}, Response:AccountResponse{},
+            Handler:api.managed(api.setAccountTier),
+        },
+        {
+            Method:"POST", Path:"/v1/accounts/{id}/overdraft",
+            Summary:"Changes the overdraft limit of an account and the interest rate on its negative balance",
+            Request:OverdraftRequest{}, Response:AccountResponse{},
+            Handler:api.managed(api.setOverdraft),
+        },
+        {
+            Method:"GET", Path:"/v1/accounts/{id}/limits",
+            Summary:"Reports the usage of the account's transfer limits",
+            Response:LimitUsageResponse{},
+            Handler:api.managed(api.accountLimits),
+        },
+        {
+            Method:"POST", Path:"/v1/transfers",
+            Summary:"Moves funds between accounts, or creates a pending payment reserving them; " +
+                "honors the Idempotency-Key header",
+            Request:TransferRequest{}, Response:TransferResponse{},
+            Handler:api.managed(api.createTransfer),
+        },
+        {
+            Method:"POST", Path:"/v1/transfers/batch",
+            Summary:"Makes up to 100 transfers in the all_or_nothing or best_effort mode",
+            Request:BatchRequest{}, Response:BatchResponse{},
+            Handler:api.managed(api.createBatch),
+        },
+        {
+            Method:"POST", Path:"/v1/transfers/pain001",
+            Summary:"Makes the credit transfers of an ISO 20022 pain.001 file and replies with the pain.002 " +
+                "status report",
+            RequestContentType:"application/xml", ContentType:"application/xml",
+            Handler:api.managed(api.importPain001),
+        },
+        {
+            Method:"GET", Path:"/v1/approvals",
+            Summary:"Lists the approval queue: the oldest approvals with the status, pending by default",
+            Query:ApprovalQuery{}, Response:ApprovalListResponse{},
+            Handler:api.managed(api.listApprovals),
+        },
+        {
+            Method:"GET", Path:"/v1/approvals/{id}",
+            Summary:"Returns a transfer waiting for the approval",
+            Response:ApprovalResponse{},
+            Handler:api.managed(api.getApproval),
+        },
+        {
+            Method:"POST", Path:"/v1/approvals/{id}/approve",
+            Summary:"Approves a transfer initiated by another principal and makes it",
+            Request:DecisionRequest{}, Response:ApprovalResponse{},
+            Handler:api.managed(api.approve),
+        },
+        {
+            Method:"POST", Path:"/v1/approvals/{id}/reject",
+            Summary:"Rejects a transfer initiated by another principal",
+            Request:DecisionRequest{}, Response:ApprovalResponse{},
+            Handler:api.managed(api.reject),
+        },
+        {
+            Method:"GET", Path:"/v1/approvals/{id}/history",
+            Summary:"Returns the changes of an approval with the principals who made them",
+            Response:ApprovalHistoryResponse{},
+            Handler:api.managed(api.approvalHistory),
+        },
+        {
+            Method:"POST", Path:"/v1/splits",
+            Summary:"Pays several recipients from one account by exact amounts or percents",
+            Request:SplitRequest{}, Response:SplitResponse{},
+            Handler:api.managed(api.createSplit),
+        },
+        {
+            Method:"POST", Path:"/v1/fees",
+            Summary:"Adds a flat, percent or tiered fee schedule of a currency and an account tier",
+            Request:FeeScheduleRequest{}, Response:FeeScheduleResponse{},
+            Handler:api.managed(api.createFeeSchedule),
+        },
+        {
+            Method:"GET", Path:"/v1/fees",
+            Summary:"Lists active fee schedules",
+            Response:FeeScheduleListResponse{},
+            Handler:api.managed(api.listFeeSchedules),
+        },
+        {
+            Method:"DELETE", Path:"/v1/fees/{id}",
+            Summary:"Deactivates a fee schedule",
+            Response:FeeScheduleResponse{},
+            Handler:api.managed(api.deleteFeeSchedule),
+        },
+        {
+            Method:"POST", Path:"/v1/fees/quote",
+            Summary:"Previews the fees of a transfer without making it",
+            Request:FeeQuoteRequest{}, Response:FeeQuoteResponse{},
+            Handler:api.managed(api.quoteFees),
+        },
+        {
+            Method:"POST", Path:"/v1/limits",
+            Summary:"Replaces the transfer limits of a currency or of an account",
+            Request:LimitsRequest{}, Response:LimitRuleResponse{},
+            Handler:api.managed(api.setLimits),
+        },
+        {
+            Method:"GET", Path:"/v1/audit",
+            Summary:"Lists the audit log page by page, starting from the newest entry",
+            Query:PageQuery{}, Response:AuditPageResponse{},
+            Handler:api.managed(api.listAudit),
+        },
+        {
+            Method:"GET", Path:"/v1/audit/verify",
+            Summary:"Walks the hash chain of the audit log and reports the first broken link",
+            Response:AuditReportResponse{},
+            Handler:api.managed(api.verifyAudit),
+        },
+        {
+            Method:"GET", Path:"/v1/analytics/volume",
+            Summary:"Reports the payment counts and amounts by the currency and the time bucket",
+            Query:VolumeQuery{}, Response:VolumeResponse{},
+            Handler:api.managed(api.paymentVolume),
+        },
+        {
+            Method:"GET", Path:"/v1/reconciliation",
+            Summary:"Compares the balances with the opening balances, the adjustments and the payments",
+            Response:ReconciliationResponse{},
+            Handler:api.managed(api.getReconciliation),
+        },
+        {
+            Method:"POST", Path:"/v1/reconciliation/adjustments",
+            Summary:"Requests the approvals of the adjustments resolving the discrepancies of the balances",
+            Request:AdjustmentRequest{}, Response:ReconciliationResponse{},
+            Handler:api.managed(api.requestReconciliation),
+        },
+        {
+            Method:"GET", Path:"/v1/payments/search",
+            Summary:"Searches the payments of all accounts, newest first",
+            Query:PaymentSearchQuery{}, Response:PaymentSearchResponse{},
+            Handler:api.managed(api.searchPayments),
+        },
+        {
+            Method:"GET", Path:"/v1/payments/{id}",
+            Summary:"Returns a payment with its refunds and net amount",
+            Response:PaymentDetailResponse{},
+            Handler:api.managed(api.getPayment),
+        },
+        {
+            Method:"POST", Path:"/v1/payments/{id}/refunds",
+            Summary:"Refunds a part of a payment to its sender; honors the Idempotency-Key header",
+            Request:RefundRequest{}, Response:TransferResponse{},
+            Handler:api.managed(api.refundPayment),
+        },
+        {
+            Method:"POST", Path:"/v1/payments/{id}/reversal",
+            Summary:"Reverses the part of a payment which was not refunded",
+            Response:TransferResponse{},
+            Handler:api.managed(api.reversePayment),
+        },
+        {
+            Method:"POST", Path:"/v1/payments/{id}/status",
+            Summary:"Changes the status of a payment; completing a pending payment moves the funds",
+            Request:StatusRequest{}, Response:TransferResponse{},
+            Handler:api.managed(api.setPaymentStatus),
+        },
+        {
+            Method:"GET", Path:"/v1/payments/{id}/receipt",
+            Summary:"Returns the signed receipt of a completed payment",
+            Response:ReceiptResponse{},
+            Handler:api.managed(api.getReceipt),
+        },
+        {
+            Method:"GET", Path:"/v1/payments/{id}/history",
+            Summary:"Returns the status history of a payment, oldest first",
+            Response:StatusHistoryResponse{},
+            Handler:api.managed(api.paymentHistory),
+        },
+        {
+            Method:"POST", Path:"/v1/holds",
+            Summary:"Reserves funds on the sender's account for a later capture",
+            Request:HoldRequest{}, Response:HoldResponse{},
+            Handler:api.managed(api.createHold),
+        },
+        {
+            Method:"GET", Path:"/v1/holds/{id}",
+            Summary:"Returns a hold",
+            Response:HoldResponse{},
+            Handler:api.managed(api.getHold),
+        },
+        {
+            Method:"POST", Path:"/v1/holds/{id}/capture",
+            Summary:"Captures a hold in full or in part, creating a payment",
+            Request:CaptureRequest{}, Response:CaptureResponse{},
+            Handler:api.managed(api.captureHold),
+        },
+        {
+            Method:"POST", Path:"/v1/holds/{id}/void",
+            Summary:"Releases the funds reserved by a hold",
+            Response:HoldResponse{},
+            Handler:api.managed(api.voidHold),
+        },
+        {
+            Method:"POST", Path:"/v1/schedules",
+            Summary:"Schedules a transfer at the given time, or a recurring one",
+            Request:ScheduleRequest{}, Response:ScheduleResponse{},
+            Handler:api.managed(api.createSchedule),
+        },
+        {
+            Method:"GET", Path:"/v1/schedules/{id}",
+            Summary:"Returns a schedule",
+            Response:ScheduleResponse{},
+            Handler:api.managed(api.getSchedule),
+        },
+        {
+            Method:"POST", Path:"/v1/schedules/{id}/cancel",
+            Summary:"Cancels the future runs of a schedule",
+            Response:ScheduleResponse{},
+            Handler:api.managed(api.cancelSchedule),
+        },
+        {
+            Method:"GET", Path:"/v1/schedules/{id}/runs",
+            Summary:"Lists the runs of a schedule with their payments or errors, oldest first",
+            Response:ScheduleRunsResponse{},
+            Handler:api.managed(api.scheduleRuns),
+        },
+        {
+            Method:"GET", Path:"/.well-known/receipt-keys",
+            Summary:"Publishes the public keys verifying the receipts, including the retired ones",
+            Response:ReceiptKeysResponse{},
+            Handler:api.managed(api.receiptKeys),
+        },
+        {
+            Method:"POST", Path:"/v1/receipt-keys/rotate",
+            Summary:"Publishes the configured key signing the receipts and retires the current one",
+            Response:ReceiptKeyResponse{},
+            Handler:api.managed(api.rotateReceiptKey),
+        },
+        {
+            Method:"POST", Path:"/v1/webhooks",
+            Summary:"Subscribes a URL to the events; the signing secret is returned only once",
+            Request:WebhookRequest{}, Response:WebhookResponse{},
+            Handler:api.managed(api.createWebhook),
+        },
+        {
+            Method:"GET", Path:"/v1/webhooks",
+            Summary:"Lists active webhook subscriptions",
+            Response:WebhookListResponse{},
+            Handler:api.managed(api.listWebhooks),
+        },
+        {
+            Method:"DELETE", Path:"/v1/webhooks/{id}",
+            Summary:"Deactivates a webhook subscription",
+            Response:WebhookResponse{},
+            Handler:api.managed(api.deleteWebhook),
+        },
+        {
+            Method:"GET", Path:"/v1/webhooks/deliveries",
+            Summary:"Lists webhook deliveries, newest first; status=dead lists the dead-lettered ones",
+            Query:DeliveryQuery{}, Response:DeliveryListResponse{},
+            Handler:api.managed(api.listDeliveries),
+        },
+        {
+            Method:"POST", Path:"/v1/webhooks/deliveries/{id}/redeliver",
+            Summary:"Queues a webhook delivery to be sent again",
+            Response:DeliveryResponse{},
+            Handler:api.managed(api.redeliver),
+        },
+    }
 }
 
 // createManager is a factory function that creates database management instance.
-// This function should be used in every API endpoint instead of direct BillingManager
-// initialization to make the endpoint testable.
+// This function should be used instead of direct BillingManager initialization to make
+// the endpoints testable.
 var createManager = NewBillingManager
 
+// manager returns the Manager shared by all endpoints of the HTTP and gRPC servers.
+// The instance is created on the first call; if the creation fails, the next call
+// tries again.
+func (api *BillingAPI) manager() (Manager, error) {
+    api.mu.Lock()
+    defer api.mu.Unlock()
+    if api.shared == nil {
+        m, err := createManager(api.DatabaseConn)
+        if err != nil {
+            return nil, err
+        }
+        api.shared = m
+    }
+    return api.shared, nil
+}
+
+// Shutdown gracefully stops the server and releases the shared Manager.
+func (api *BillingAPI) Shutdown(ctx context.Context) error {
+    err := api.Server.Shutdown(ctx)
+    api.mu.Lock()
+    defer api.mu.Unlock()
+    if api.shared != nil {
+        closeWithLog(api.shared)
+        api.shared = nil
+    }
+    return err
+}
+
+// managed wraps an endpoint with the Manager acquisition logic. The changes made by
+// the endpoint are audited on behalf of the caller with the request's X-Request-ID,
+// which is generated if the request doesn't have one.
+func (api *BillingAPI) managed(endpoint func(Manager, *Responder, *http.Request)) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        resp := NewJSONResponse(w)
+        m, err := api.manager()
+        if err != nil {
+            log.Println(err)
+            resp.SendServerError("internal error")
+            return
+        }
+        id := requestID(req)
+        w.Header().Set("X-Request-ID", id)
+        endpoint(m.Audited(PrincipalFrom(req.Context()).Name, id), &resp, req)
+    })
+}
+
 // status is a testing endpoint that helps to check if the API is up
 func (api *BillingAPI) status(w http.ResponseWriter, req *http.Request) {
     log.Printf("connected: %s", req.RemoteAddr)
     resp := NewJSONResponse(w)
-    resp.SendSuccess(Response{"success": true})
+    resp.SendSuccess(StatusResponse{Success:true})
 }
 
 // accounts endpoint returns list of available accounts.
 // The endpoint doesn't expect any parameters and pulls every item stored in the database.
-func (api *BillingAPI) accounts(w http.ResponseWriter, req *http.Request) {
-    resp := NewJSONResponse(w)
-
-    m, err := createManager(api.DatabaseConn)
-    if err != nil {
-        log.Println(err)
-        resp.SendServerError("internal error")
-        return
-    } else {
-        defer closeWithLog(m)
-    }
+func (api *BillingAPI) accounts(m Manager, resp *Responder, req *http.Request) {
     accounts, err := m.GetAvailableAccounts()
     if err != nil {
         log.Println(err)
@@ -72,17 +497,12 @@ func (api *BillingAPI) accounts(w http.ResponseWriter, req *http.Request) {
         return
     }
 
-    type info struct {
-        Name string     `json:"name"`
-        Currency string `json:"currency"`
-        Amount string   `json:"amount"`
-    }
-    result := make([]info, 0)
-    for _, acc := range accounts {
+    result := make([]AccountInfo, 0)
+    for _, acc := range accessible(req.Context(), accounts) {
         amount := fmt.Sprintf("%.2f", acc.Amount.AsFloat())
-        result = append(result, info{acc.Identifier, acc.Currency, amount})
+        result = append(result, AccountInfo{acc.Identifier, acc.Currency, amount})
     }
-    resp.SendSuccess(Response{"accounts": result})
+    resp.SendSuccess(AccountsResponse{result})
 }
 
 // transfer endpoint moves specified amount of funds from one account to another.
@@ -99,45 +519,30 @@ func (api *BillingAPI) accounts(w http.ResponseWriter, req *http.Request) {
 // Note that only transfer between accounts with the same currency is supported.
 // In case if any of accounts doesn't exist, if there is no enough funds, or
 // the currency of accounts is different, the error is returned.
-func (api *BillingAPI) transfer(w http.ResponseWriter, req *http.Request) {
-    resp := NewJSONResponse(w)
-
-    m, err := createManager(api.DatabaseConn)
-    if err != nil {
-        log.Println(err)
-        resp.SendServerError("internal error")
-        return
-    } else {
-        defer closeWithLog(m)
-    }
-
-    data := make(map[string]string)
-    err = json.NewDecoder(req.Body).Decode(&data)
-    if err != nil {
-        resp.SendRequestError("invalid request body")
+func (api *BillingAPI) transfer(m Manager, resp *Responder, req *http.Request) {
+    var body LegacyTransferRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
         return
     }
 
-    err = CheckParameters(data, "fromId", "toId", "amount")
-    if err != nil {
-        resp.SendRequestError(fmt.Sprintf("invalid request: %s", err))
+    if err := authorize(req.Context(), body.FromID); err != nil {
+        writeManagerError(err, resp)
         return
     }
 
-    amount, err := strconv.Atoi(data["amount"])
-    if err != nil || amount <= 0 {
-        resp.SendRequestError("invalid amount value")
+    if err := api.checkThreshold(Cents(body.Amount)); err != nil {
+        writeManagerError(err, resp)
         return
     }
 
-    fromId, toId := data["fromId"], data["toId"]
-    payment, err := m.Transfer(fromId, toId, Cents(amount))
+    payment, err := m.Transfer(body.FromID, body.ToID, Cents(body.Amount), "", PaymentDetails{})
     if err != nil {
-        writeManagerError(err, &resp);
+        writeManagerError(err, resp);
         return
     }
 
-    resp.SendSuccess(Response{"payment": payment})
+    resp.SendSuccess(TransferResponse{Payment:payment})
 }
 
 // payments endpoint reports transactions performed with a specific account.
@@ -146,67 +551,44 @@ func (api *BillingAPI) transfer(w http.ResponseWriter, req *http.Request) {
 //     * accountId: an account which transactions to report.
 //
 // The error is returned in case if the account doesn't exist.
-func (api *BillingAPI) payments(w http.ResponseWriter, req *http.Request) {
-    resp := NewJSONResponse(w)
-
-    m, err := createManager(api.DatabaseConn)
-    if err != nil {
-        log.Println(err)
-        resp.SendServerError("internal error")
+func (api *BillingAPI) payments(m Manager, resp *Responder, req *http.Request) {
+    var body PaymentsRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
         return
-    } else {
-        defer closeWithLog(m)
     }
 
-    data, err := decodeBody(req)
-    if err != nil {
-        resp.SendRequestError(fmt.Sprintf("invalid request: %s", err))
-        return
-    }
-
-    accountId, ok := data["accountId"]
-    if !ok {
-        resp.SendRequestError("invalid request: accountId is missing")
+    accountId := body.AccountID
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
         return
     }
 
     payments, err := m.GetPayments(accountId)
     if err != nil {
-        writeManagerError(err, &resp)
+        writeManagerError(err, resp)
         return
     }
 
-    var send, recv []map[string]interface{}
+    var history PaymentHistory
 
     for _, p := range payments {
-        item := make(map[string]interface{}, 0)
-        item["amount"] = p.Amount.AsFloat()
-        item["time"] = p.Time
+        item := PaymentEntry{Amount:p.Amount.AsFloat(), Time:p.Time, Reference:p.Reference, Memo:p.Memo, Metadata:p.Metadata}
         if p.From == accountId {
-            item["account"] = p.To
-            send = append(send, item)
+            item.Account = p.To
+            history.Sent = append(history.Sent, item)
         } else {
-            item["account"] = p.From
-            recv = append(recv, item)
+            item.Account = p.From
+            history.Received = append(history.Received, item)
         }
     }
 
-    transactions := map[string]interface{}{"sent": send, "received": recv}
-    resp.SendSuccess(Response{"account": accountId, "payments": transactions})
+    resp.SendSuccess(PaymentsResponse{accountId, history})
 }
 
 // notFound implements a custom 404 response.
 func notFound(w http.ResponseWriter, req *http.Request) {
-    NewJSONResponse(w).SendError(fmt.Errorf("not found"), http.StatusNotFound)
-}
-
-// decodeBody decodes request body into JSON.
-func decodeBody(req *http.Request) (map[string]string, error) {
-    data := make(map[string]string)
-    err := json.NewDecoder(req.Body).Decode(&data)
-    if err != nil { return nil, err }
-    _ = req.Body.Close()
-    return data, nil
+    NewJSONResponse(w).SendCodedError(codeNotFound, "not found", http.StatusNotFound)
 }
 
 // closeWithLog closes a closer and logs the error if the closing fails.
@@ -217,6 +599,25 @@ func closeWithLog(c io.Closer) {
     }
 }
 
+// errorStatus picks an HTTP status matching the error code.
+func errorStatus(code string) int {
+    switch code {
+    case codeNotFound, codeAccountNotFound:
+        return http.StatusNotFound
+    case codeUnauthorized:
+        return http.StatusUnauthorized
+    case codeForbidden:
+        return http.StatusForbidden
+    case codeIdempotencyConflict, codeInvalidState, codeDuplicateReference:
+        return http.StatusConflict
+    case codeBodyTooLarge:
+        return http.StatusRequestEntityTooLarge
+    case codeInsufficientFunds, codeCurrencyMismatch, codeLimitExceeded, codeApprovalRequired:
+        return http.StatusUnprocessableEntity
+    }
+    return http.StatusBadRequest
+}
+
 // writeManagerError sends error response to the client. In case if the error
 // comes from the invalid input, it is reported to the client. Otherwise, only
 // a generic message about internal error is sent.
@@ -226,7 +627,7 @@ func writeManagerError(err error, resp *Responder) {
             log.Printf("error: %s", err.message)
             resp.SendServerError("internal error")
         } else {
-            resp.SendRequestError(err.Error())
+            resp.SendErrorResponse(ErrorResponse{err.message, err.code, errorStatus(err.code), err.fields, err.limit})
         }
     } else {
         resp.SendError(err, http.StatusBadRequest)
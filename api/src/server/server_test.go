@@ -1,13 +1,27 @@
 package server
 
 import (
+    "bufio"
     "bytes"
     "context"
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/csv"
     "encoding/json"
+    "encoding/xml"
     "fmt"
     "log"
+    "net"
     "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
     "sync"
+    "sync/atomic"
     "testing"
     "time"
 )
@@ -128,137 +142,3501 @@ func TestPayments_InvalidParameters(t *testing.T) {
    })
 }
 
+func TestV1_GetAccount(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        response := client.Request("GET", "v1/accounts/A", nil, nil)
+        account, ok := response["account"].(map[string]interface{})
+        if !ok {
+            t.Fatalf("no 'account' key found: %#v", response)
+        }
+        if account["id"] != "A" || account["balance"] != float64(10000) {
+            t.Errorf("invalid account: %#v", account)
+        }
+
+        response = client.Request("GET", "v1/accounts/Unknown", nil, nil)
+        if response["code"] != codeAccountNotFound {
+            t.Errorf("account_not_found error was expected: %#v", response)
+        }
+    })
+}
+
+func TestV1_ListPayments_Pagination(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        first := client.Request("GET", "v1/accounts/A/payments?limit=1", nil, nil)
+        if items := first["payments"].([]interface{}); len(items) != 1 {
+            t.Fatalf("one payment was expected: %#v", first)
+        }
+        cursor, _ := first["next_cursor"].(string)
+        if cursor == "" {
+            t.Fatalf("next_cursor was expected: %#v", first)
+        }
+
+        second := client.Request("GET", "v1/accounts/A/payments?limit=1&cursor="+cursor, nil, nil)
+        if items := second["payments"].([]interface{}); len(items) != 1 {
+            t.Fatalf("one payment was expected: %#v", second)
+        }
+        if second["next_cursor"] != "" {
+            t.Errorf("the last page was expected: %#v", second)
+        }
+
+        invalid := client.Request("GET", "v1/accounts/A/payments?limit=1000", nil, nil)
+        if _, ok := invalid["error"]; !ok {
+            t.Errorf("error was expected: %#v", invalid)
+        }
+    })
+}
+
+func TestV1_Transfer(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        body := map[string]interface{}{"from": "A", "to": "B", "amount": 1000}
+        headers := map[string]string{"Idempotency-Key": "key-1"}
+        response := client.Request("POST", "v1/transfers", body, headers)
+        if _, ok := response["payment"]; !ok {
+            t.Errorf("no 'payment' key found: %#v", response)
+        }
+
+        body["to"] = "C"
+        response = client.Request("POST", "v1/transfers", body, nil)
+        if response["code"] != codeCurrencyMismatch {
+            t.Errorf("currency_mismatch error was expected: %#v", response)
+        }
+    })
+}
+
+func TestV1_PaymentDetails(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        body := map[string]interface{}{
+            "from": "A", "to": "B", "amount": 100,
+            "reference": "INV-1", "unique_reference": true, "memo": "March invoice",
+            "metadata": map[string]string{"order": "42", "channel": "web"}}
+        response := client.Request("POST", "v1/transfers", body, nil)
+        payment, ok := response["payment"].(map[string]interface{})
+        if !ok {
+            t.Fatalf("no 'payment' key found: %#v", response)
+        }
+        if payment["reference"] != "INV-1" || payment["memo"] != "March invoice" {
+            t.Errorf("the details were expected with the payment: %#v", payment)
+        }
+        if metadata, _ := payment["metadata"].(map[string]interface{}); metadata["order"] != "42" {
+            t.Errorf("the metadata were expected with the payment: %#v", payment)
+        }
+
+        response = client.Request("POST", "v1/transfers", body, nil)
+        if response["code"] != codeDuplicateReference {
+            t.Errorf("duplicate_reference error was expected: %#v", response)
+        }
+        body["unique_reference"] = false
+        body["metadata"] = map[string]string{"order": "43"}
+        if response = client.Request("POST", "v1/transfers", body, nil); response["payment"] == nil {
+            t.Errorf("the reference should be reused when it isn't unique: %#v", response)
+        }
+
+        var testCases = []struct{
+            query string
+            count int
+        }{
+            {"reference=INV-1", 2},
+            {"reference=INV-2", 0},
+            {"metadata_key=order", 2},
+            {"metadata_key=order&metadata_value=43", 1},
+            {"metadata_key=channel&metadata_value=43", 0},
+        }
+        for _, test := range testCases {
+            response := client.Request("GET", "v1/accounts/A/payments?"+test.query, nil, nil)
+            if items, _ := response["payments"].([]interface{}); len(items) != test.count {
+                t.Errorf("%s: %d payments were expected: %#v", test.query, test.count, response)
+            }
+        }
+        response = client.Request("GET", "v1/accounts/A/payments?metadata_value=43", nil, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("validation error was expected without the metadata key: %#v", response)
+        }
+
+        body["metadata"] = map[string]string{strings.Repeat("k", 41): "v"}
+        response = client.Request("POST", "v1/transfers", body, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("validation error was expected for the long metadata key: %#v", response)
+        }
+    })
+}
+
+func TestV1_TransferBatch(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        transfers := []map[string]interface{}{
+            {"from": "A", "to": "B", "amount": 100},
+            {"from": "A", "to": "C", "amount": 100},
+            {"from": "B", "to": "A", "amount": 100}}
+        response := client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": transfers}, nil)
+        if response["code"] != codeCurrencyMismatch || !strings.HasPrefix(response["error"].(string), "transfers[1]") {
+            t.Errorf("the atomic batch should fail at the second transfer: %v", response)
+        }
+
+        body := map[string]interface{}{"mode": "best_effort", "transfers": transfers}
+        response = client.Request("POST", "v1/transfers/batch", body, nil)
+        results, _ := response["results"].([]interface{})
+        if response["succeeded"] != float64(2) || response["failed"] != float64(1) || len(results) != 3 {
+            t.Fatalf("two of three transfers should succeed: %v", response)
+        }
+        if failed := results[1].(map[string]interface{}); failed["code"] != codeCurrencyMismatch || failed["payment"] != nil {
+            t.Errorf("the second transfer should fail with its own code: %v", failed)
+        }
+
+        // A has 9800 available cents
+        transfers = []map[string]interface{}{
+            {"from": "A", "to": "B", "amount": 5000},
+            {"from": "A", "to": "B", "amount": 5000}}
+        response = client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": transfers}, nil)
+        if response["code"] != codeInsufficientFunds {
+            t.Errorf("the batch should see the funds spent by its transfers: %v", response)
+        }
+        transfers[1]["to"] = "A"
+        transfers[1]["from"] = "B"
+        response = client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": transfers}, nil)
+        if response["succeeded"] != float64(2) || response["mode"] != batchAllOrNothing {
+            t.Errorf("the atomic batch should succeed: %v", response)
+        }
+
+        response = client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": []interface{}{}}, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("an empty batch should be rejected: %v", response)
+        }
+
+        transfers = []map[string]interface{}{
+            {"from": "A", "to": "B", "amount": 100, "idempotency_key": "payroll-1"},
+            {"from": "B", "to": "A", "amount": 100, "idempotency_key": "payroll-1"},
+            {"from": "A", "to": "B", "amount": 100, "idempotency_key": "payroll-1"}}
+        response = client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": transfers}, nil)
+        fields, _ := response["fields"].([]interface{})
+        if response["code"] != codeValidationFailed || len(fields) != 1 ||
+            fields[0].(map[string]interface{})["field"] != "transfers[2].idempotency_key" {
+            t.Errorf("the key reused by the sender should be rejected: %v", response)
+        }
+    })
+}
+
+func TestV1_Split(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        legs := []map[string]interface{}{
+            {"to": "B", "percent": 33.33},
+            {"to": "B", "percent": 33.33},
+            {"to": "B", "percent": 33.34}}
+        response := client.Request("POST", "v1/splits", map[string]interface{}{"from": "A", "amount": 100, "legs": legs}, nil)
+        parent, _ := response["payment"].(map[string]interface{})
+        created, _ := response["legs"].([]interface{})
+        if parent == nil || parent["kind"] != paymentSplit || parent["amount"] != float64(100) || len(created) != 3 {
+            t.Fatalf("a split with three legs was expected: %v", response)
+        }
+        for i, expected := range []float64{33, 33, 34} {
+            leg := created[i].(map[string]interface{})
+            if leg["amount"] != expected || leg["parent_id"] != parent["id"] || leg["kind"] != paymentSplitLeg {
+                t.Errorf("leg %d should have %v cents: %v", i, expected, leg)
+            }
+        }
+
+        detail := client.Request("GET", fmt.Sprintf("v1/payments/%v", parent["id"]), nil, nil)
+        if legs, _ := detail["legs"].([]interface{}); len(legs) != 3 {
+            t.Errorf("the parent payment should list its legs: %v", detail)
+        }
+        page := client.Request("GET", "v1/accounts/B/payments", nil, nil)
+        listed := 0
+        for _, item := range page["payments"].([]interface{}) {
+            p := item.(map[string]interface{})
+            if p["kind"] == paymentSplit {
+                t.Errorf("the parent payment should not be listed: %v", p)
+            }
+            if p["kind"] == paymentSplitLeg {
+                listed++
+            }
+        }
+        if listed != 3 {
+            t.Errorf("the recipient should see its legs: %v", page)
+        }
+
+        invalid := []map[string]interface{}{
+            {"legs": []map[string]interface{}{{"to": "B", "amount": 50}, {"to": "B", "percent": 50}}},
+            {"legs": []map[string]interface{}{{"to": "B", "amount": 50}}},
+            {"legs": []map[string]interface{}{{"to": "B", "percent": 60}, {"to": "B", "percent": 50}}},
+            {"legs": []map[string]interface{}{{"to": "B", "percent": 99.999}, {"to": "B", "percent": 0.001}}},
+            {"legs": []map[string]interface{}{{"to": "A", "amount": 100}}}}
+        for _, body := range invalid {
+            body["from"], body["amount"] = "A", 100
+            if response := client.Request("POST", "v1/splits", body, nil); response["code"] != codeValidationFailed {
+                t.Errorf("the split should be rejected: %v", response)
+            }
+        }
+        body := map[string]interface{}{"from": "A", "amount": 100, "legs": []map[string]interface{}{{"to": "C", "amount": 100}}}
+        if response := client.Request("POST", "v1/splits", body, nil); response["code"] != codeCurrencyMismatch {
+            t.Errorf("the legs should have the sender's currency: %v", response)
+        }
+    })
+}
+
+func TestSplitAmounts(t *testing.T) {
+    cases := []struct {
+        total Cents
+        shares []int64
+        expected []Cents
+    }{
+        {1000, []int64{8500, 1000, 500}, []Cents{850, 100, 50}},
+        {1001, []int64{5000, 5000}, []Cents{501, 500}},
+        {100, []int64{3333, 3333, 3334}, []Cents{33, 33, 34}},
+        {2, []int64{3334, 3333, 3333}, []Cents{1, 1, 0}},
+        {1, []int64{10000}, []Cents{1}},
+    }
+    for _, c := range cases {
+        amounts := splitAmounts(c.total, c.shares)
+        for i := range amounts {
+            if amounts[i] != c.expected[i] {
+                t.Errorf("splitting %d by %v: got %d instead of %d for the leg %d",
+                    int64(c.total), c.shares, int64(amounts[i]), int64(c.expected[i]), i)
+            }
+        }
+    }
+}
+
+func TestV1_Fees(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        percent := map[string]interface{}{
+            "currency": "USD", "payer": "sender", "kind": "percent", "rate_bps": 100, "min": 5, "revenue_account": "B"}
+        response := client.Request("POST", "v1/fees", percent, nil)
+        if schedule, _ := response["schedule"].(map[string]interface{}); schedule == nil || schedule["id"] != float64(1) {
+            t.Fatalf("a fee schedule was expected: %v", response)
+        }
+        if response := client.Request("POST", "v1/fees", percent, nil); response["code"] != codeInvalidState {
+            t.Errorf("a second schedule for the same payer should be rejected: %v", response)
+        }
+        invalid := []map[string]interface{}{
+            {"currency": "USD", "payer": "sender", "kind": "flat", "flat": 10, "revenue_account": "C"},
+            {"currency": "USD", "payer": "sender", "kind": "percent", "revenue_account": "B"},
+            {"currency": "USD", "payer": "sender", "kind": "tiered", "revenue_account": "B",
+                "brackets": []interface{}{map[string]interface{}{"up_to": 500, "flat": 2}}}}
+        for _, body := range invalid {
+            if response := client.Request("POST", "v1/fees", body, nil); response["code"] != codeValidationFailed {
+                t.Errorf("the schedule should be rejected: %v", response)
+            }
+        }
+        premium := map[string]interface{}{
+            "currency": "USD", "tier": "premium", "payer": "sender", "kind": "flat", "flat": 1, "revenue_account": "B"}
+        tiered := map[string]interface{}{
+            "currency": "USD", "payer": "recipient", "kind": "tiered", "revenue_account": "B",
+            "brackets": []interface{}{map[string]interface{}{"up_to": 500, "flat": 2}, map[string]interface{}{"rate_bps": 50}}}
+        client.Request("POST", "v1/fees", premium, nil)
+        client.Request("POST", "v1/fees", tiered, nil)
+
+        quote := client.Request("POST", "v1/fees/quote", map[string]interface{}{"from": "A", "to": "B", "amount": 1000}, nil)
+        fees, _ := quote["fees"].([]interface{})
+        if len(fees) != 1 || fees[0].(map[string]interface{})["amount"] != float64(10) || quote["debited"] != float64(1010) {
+            t.Errorf("the sender should pay 1%% of the amount: %v", quote)
+        }
+        account := client.Request("POST", "v1/accounts/A/tier", map[string]interface{}{"tier": "premium"}, nil)
+        if account["account"].(map[string]interface{})["tier"] != "premium" {
+            t.Errorf("the tier should be changed: %v", account)
+        }
+        quote = client.Request("POST", "v1/fees/quote", map[string]interface{}{"from": "A", "to": "B", "amount": 1000}, nil)
+        if quote["debited"] != float64(1001) {
+            t.Errorf("the schedule of the premium tier should be used: %v", quote)
+        }
+
+        // B is the revenue account, so it doesn't pay its own fee
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 1000}, nil)
+        payment := response["payment"].(map[string]interface{})
+        charged, _ := payment["fees"].([]interface{})
+        if len(charged) != 1 {
+            t.Fatalf("the recipient's fee was expected: %v", payment)
+        }
+        fee := charged[0].(map[string]interface{})
+        if fee["kind"] != paymentFee || fee["from"] != "A" || fee["to"] != "B" || fee["amount"] != float64(5) || fee["parent_id"] != payment["id"] {
+            t.Errorf("the recipient should pay 0.5%% of the amount to the revenue account: %v", fee)
+        }
+        detail := client.Request("GET", fmt.Sprintf("v1/payments/%v", payment["id"]), nil, nil)
+        if fees, _ := detail["payment"].(map[string]interface{})["fees"].([]interface{}); len(fees) != 1 {
+            t.Errorf("the payment should list its fees: %v", detail)
+        }
+
+        // the captured hold and the completed pending payment are charged as well
+        response = client.Request("POST", "v1/holds", map[string]interface{}{"from": "A", "to": "B", "amount": 1000}, nil)
+        response = client.Request("POST", fmt.Sprintf("v1/holds/%v/capture", response["hold"].(map[string]interface{})["id"]), nil, nil)
+        payment = response["payment"].(map[string]interface{})
+        if fees, _ := payment["fees"].([]interface{}); len(fees) != 1 || fees[0].(map[string]interface{})["parent_id"] != payment["id"] {
+            t.Errorf("the capture should charge the sender's fee: %v", response)
+        }
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 600, "pending": true}, nil)
+        if fees, _ := response["payment"].(map[string]interface{})["fees"].([]interface{}); len(fees) != 0 {
+            t.Errorf("the pending payment should not be charged yet: %v", response)
+        }
+        path := fmt.Sprintf("v1/payments/%v/status", response["payment"].(map[string]interface{})["id"])
+        response = client.Request("POST", path, map[string]interface{}{"status": "completed"}, nil)
+        payment = response["payment"].(map[string]interface{})
+        if fees, _ := payment["fees"].([]interface{}); len(fees) != 1 || fees[0].(map[string]interface{})["amount"] != float64(1) {
+            t.Errorf("the completion should charge the sender's fee: %v", response)
+        }
+
+        client.Request("DELETE", "v1/fees/1", nil, nil)
+        if schedules, _ := client.Request("GET", "v1/fees", nil, nil)["schedules"].([]interface{}); len(schedules) != 2 {
+            t.Errorf("the deleted schedule should not be listed: %v", schedules)
+        }
+    })
+}
+
+func TestFeeSchedule_Fee(t *testing.T) {
+    tiered := FeeSchedule{Kind:feeTiered, Brackets:FeeBrackets{{UpTo:1000, Flat:20}, {UpTo:10000, Flat:10, RateBps:100}, {RateBps:50}}}
+    cases := []struct {
+        schedule FeeSchedule
+        amount, expected Cents
+    }{
+        {FeeSchedule{Kind:feeFlat, Flat:25}, 1, 25},
+        {FeeSchedule{Kind:feePercent, RateBps:150}, 1001, 15},
+        {FeeSchedule{Kind:feePercent, RateBps:150}, 1034, 16},
+        {FeeSchedule{Kind:feePercent, RateBps:150, Min:30}, 1000, 30},
+        {FeeSchedule{Kind:feePercent, RateBps:150, Max:100}, 100000, 100},
+        {tiered, 1000, 20},
+        {tiered, 1001, 20},
+        {tiered, 20000, 100},
+    }
+    for _, c := range cases {
+        if fee := c.schedule.fee(c.amount); fee != c.expected {
+            t.Errorf("%s fee of %d: got %d instead of %d", c.schedule.Kind, int64(c.amount), int64(fee), int64(c.expected))
+        }
+    }
+
+    schedules := []FeeSchedule{
+        {ID:1, Currency:"USD", Payer:feeSender, Kind:feeFlat, Flat:10, RevenueID:"R", Active:true},
+        {ID:2, Currency:"USD", Tier:"premium", Payer:feeSender, Kind:feeFlat, Flat:1, RevenueID:"R", Active:true},
+        {ID:3, Currency:"EUR", Payer:feeRecipient, Kind:feeFlat, Flat:5, RevenueID:"R", Active:true},
+    }
+    from := Account{Identifier:"A", Currency:"USD", Tier:defaultTier}
+    to := Account{Identifier:"B", Currency:"USD", Tier:defaultTier}
+    if fees := transferFees(schedules, from, to, 100); len(fees) != 1 || fees[0].ScheduleID != 1 {
+        t.Errorf("the schedule for all tiers should be used: %d fees", len(fees))
+    }
+    from.Tier = "premium"
+    if fees := transferFees(schedules, from, to, 100); len(fees) != 1 || fees[0].ScheduleID != 2 {
+        t.Errorf("the schedule of the payer's tier should be used: %d fees", len(fees))
+    }
+
+    schedules[1].RevenueID = "P"
+    accounts := map[string]*Account{"A": &from, "B": &to}
+    if ids := feeRevenue(schedules, accounts, [][2]string{{"A", "B"}, {"A", "X"}}); fmt.Sprint(ids) != "[R P]" {
+        t.Errorf("the revenue accounts of the schedules of all tiers should be locked: %v", ids)
+    }
+}
+
+func TestV1_Limits(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        client.Request("POST", "v1/limits", map[string]interface{}{"currency": "USD", "max_transfer": 5000, "hourly_count": 3}, nil)
+        client.Request("POST", "v1/limits", map[string]interface{}{"currency": "USD", "account": "A", "daily": 2000}, nil)
+        if response := client.Request("POST", "v1/limits", map[string]interface{}{"currency": "EUR", "account": "A", "daily": 1}, nil); response["code"] != codeValidationFailed {
+            t.Errorf("the account should have the currency of the limits: %v", response)
+        }
+
+        usage := client.Request("GET", "v1/accounts/A/limits", nil, nil)
+        limits, _ := usage["limits"].([]interface{})
+        if len(limits) != 4 {
+            t.Fatalf("all limits should be reported: %v", usage)
+        }
+        // the fixture payments made today are counted
+        daily := limits[1].(map[string]interface{})
+        remaining, _ := daily["remaining"].(float64)
+        if daily["value"] != float64(2000) || remaining != 2000 - daily["used"].(float64) {
+            t.Errorf("the account's daily limit was expected: %v", daily)
+        }
+        if max := limits[0].(map[string]interface{}); max["value"] != float64(5000) {
+            t.Errorf("the currency's max_transfer limit was expected: %v", max)
+        }
+
+        if response := client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": remaining - 400}, nil); response["payment"] == nil {
+            t.Fatalf("the transfer should fit the limits: %v", response)
+        }
+        response := client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 500}, nil)
+        limit, _ := response["limit"].(map[string]interface{})
+        if response["code"] != codeLimitExceeded || response["status"] != float64(http.StatusUnprocessableEntity) ||
+            limit["limit"] != limitDaily || limit["remaining"] != float64(400) {
+            t.Errorf("the daily limit should be exceeded: %v", response)
+        }
+        transfers := []map[string]interface{}{{"from": "A", "to": "B", "amount": 300}, {"from": "A", "to": "B", "amount": 300}}
+        response = client.Request("POST", "v1/transfers/batch", map[string]interface{}{"transfers": transfers}, nil)
+        if response["code"] != codeLimitExceeded || !strings.HasPrefix(response["error"].(string), "transfers[1]") {
+            t.Errorf("the batch should count its own transfers: %v", response)
+        }
+        response = client.Request("POST", "v1/holds", map[string]interface{}{"from": "A", "to": "B", "amount": 500}, nil)
+        if response["code"] != codeLimitExceeded {
+            t.Errorf("the hold should not exceed the daily limit: %v", response)
+        }
+        response = client.Request("POST", "v1/holds", map[string]interface{}{"from": "A", "to": "B", "amount": 300}, nil)
+        capture := fmt.Sprintf("v1/holds/%v/capture", response["hold"].(map[string]interface{})["id"])
+        client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 300}, nil)
+        if response = client.Request("POST", capture, nil, nil); response["code"] != codeLimitExceeded {
+            t.Errorf("the capture should count the transfers made after the authorization: %v", response)
+        }
+
+        for i := 0; i < 3; i++ {
+            client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 10}, nil)
+        }
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 10}, nil)
+        if limit, _ := response["limit"].(map[string]interface{}); limit["limit"] != limitHourlyCount || limit["remaining"] != float64(0) {
+            t.Errorf("the hourly count should be exceeded: %v", response)
+        }
+        usage = client.Request("GET", "v1/accounts/B/limits", nil, nil)
+        if hourly := usage["limits"].([]interface{})[3].(map[string]interface{}); hourly["used"] != float64(3) || hourly["resets"] == nil {
+            t.Errorf("the hourly usage was expected: %v", hourly)
+        }
+    })
+}
+
+func TestV1_Overdraft(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        if response := client.Request("POST", "v1/accounts/B/overdraft", map[string]interface{}{"limit": -1}, nil); response["code"] != codeValidationFailed {
+            t.Errorf("the negative limit should be rejected: %v", response)
+        }
+        response := client.Request("POST", "v1/accounts/B/overdraft", map[string]interface{}{"limit": 500, "interest_bps": 1800}, nil)
+        account, _ := response["account"].(map[string]interface{})
+        if account["overdraft_limit"] != float64(500) || account["interest_bps"] != float64(1800) ||
+            account["available"] != float64(1500) || account["overdraft_used"] != float64(0) {
+            t.Fatalf("the overdraft should be set: %v", response)
+        }
+        if response := client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 1200}, nil); response["payment"] == nil {
+            t.Errorf("the transfer should use the overdraft: %v", response)
+        }
+        if response := client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 1600}, nil); response["code"] != codeInsufficientFunds {
+            t.Errorf("the transfer should exceed the overdraft: %v", response)
+        }
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 1100, "pending": true}, nil)
+        path := fmt.Sprintf("v1/payments/%v/status", response["payment"].(map[string]interface{})["id"])
+        response = client.Request("POST", path, map[string]interface{}{"status": "completed"}, nil)
+        if payment, _ := response["payment"].(map[string]interface{}); payment["status"] != statusCompleted {
+            t.Errorf("the pending payment should be completed with the overdraft: %v", response)
+        }
+    })
+}
+
+func TestDailyInterest(t *testing.T) {
+    cases := []struct {
+        balance Cents
+        bps int64
+        expected Cents
+    }{
+        {1000, 1800, 0},
+        {-100000, 1825, 50},
+        {-1000, 1800, 0},
+        {-1100, 1800, 1},
+    }
+    for _, c := range cases {
+        if actual := dailyInterest(c.balance, c.bps); actual != c.expected {
+            t.Errorf("interest on %d at %d bps: expected %d, got %d", int64(c.balance), c.bps, int64(c.expected), int64(actual))
+        }
+    }
+}
+
+func TestLimits_Check(t *testing.T) {
+    now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+    limits := Limits{MaxTransfer:1000, Daily:5000}.merge(Limits{Daily:2000, HourlyCount:2})
+    cases := []struct {
+        usage Usage
+        amount Cents
+        exceeded string
+    }{
+        {Usage{}, 1000, ""},
+        {Usage{}, 1001, limitMaxTransfer},
+        {Usage{Daily:1500, Monthly:1500}, 500, ""},
+        {Usage{Daily:1500, Monthly:1500}, 501, limitDaily},
+        {Usage{HourlyCount:2}, 1, limitHourlyCount},
+    }
+    for _, c := range cases {
+        err := limits.check(c.usage, c.amount, now)
+        exceeded := ""
+        if e, ok := err.(managerError); ok && e.limit != nil {
+            exceeded = e.limit.Limit
+        }
+        if exceeded != c.exceeded {
+            t.Errorf("a transfer of %d: %q limit was expected to be exceeded, got %q", int64(c.amount), c.exceeded, exceeded)
+        }
+    }
+    if statuses := limits.status(Usage{}, now); !statuses[1].Resets.Equal(time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)) ||
+        !statuses[2].Resets.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("the daily and monthly limits should reset at the next period")
+    }
+}
+
+func TestV1_Holds(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        // A has 10000 cents; 200 of them are held by the fixtures
+        response := client.Request("POST", "v1/holds", map[string]interface{}{"from": "A", "to": "B", "amount": 9000}, nil)
+        hold := response["hold"].(map[string]interface{})
+        if hold["status"] != holdActive {
+            t.Fatalf("an active hold was expected: %v", response)
+        }
+        holdPath := fmt.Sprintf("v1/holds/%v", hold["id"])
+
+        account := client.Request("GET", "v1/accounts/A", nil, nil)["account"].(map[string]interface{})
+        if account["available"] != float64(800) || account["ledger"] != float64(10000) {
+            t.Errorf("the hold should reduce the available balance only: %v", account)
+        }
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 1000}, nil)
+        if response["code"] != codeInsufficientFunds {
+            t.Errorf("the transfer should respect the holds: %v", response)
+        }
+
+        response = client.Request("POST", holdPath + "/capture", map[string]interface{}{"amount": 9001}, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("the capture should not exceed the hold: %v", response)
+        }
+        response = client.Request("POST", holdPath + "/capture", map[string]interface{}{"amount": 5000}, nil)
+        payment, _ := response["payment"].(map[string]interface{})
+        if payment["amount"] != float64(5000) || response["hold"].(map[string]interface{})["captured"] != float64(5000) {
+            t.Errorf("partial capture was expected: %v", response)
+        }
+        response = client.Request("POST", holdPath + "/void", nil, nil)
+        if response["code"] != codeInvalidState || response["status"] != float64(http.StatusConflict) {
+            t.Errorf("a captured hold cannot be voided: %v", response)
+        }
+
+        response = client.Request("POST", "v1/holds/1/void", nil, nil)
+        if response["hold"].(map[string]interface{})["status"] != holdVoided {
+            t.Errorf("the hold should be voided: %v", response)
+        }
+        response = client.Request("POST", "v1/holds/1/capture", nil, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a voided hold cannot be captured: %v", response)
+        }
+        response = client.Request("GET", "v1/holds/999", nil, nil)
+        if response["code"] != codeNotFound {
+            t.Errorf("not_found was expected: %v", response)
+        }
+    })
+}
+
+func TestV1_Refunds(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        // payment 1 moved 1000 cents from A to B
+        response := client.Request("POST", "v1/payments/1/refunds", map[string]interface{}{"amount": 600}, nil)
+        refund, _ := response["payment"].(map[string]interface{})
+        if refund["kind"] != paymentRefund || refund["original_id"] != float64(1) || refund["from"] != "B" {
+            t.Fatalf("a refund from B to A was expected: %v", response)
+        }
+        response = client.Request("POST", "v1/payments/1/refunds", map[string]interface{}{"amount": 500}, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("the refunds should not exceed the original amount: %v", response)
+        }
+        response = client.Request("POST", fmt.Sprintf("v1/payments/%v/refunds", refund["id"]), map[string]interface{}{"amount": 1}, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a refund cannot be refunded: %v", response)
+        }
+
+        response = client.Request("GET", "v1/payments/1", nil, nil)
+        if response["refunded"] != float64(600) || response["net"] != float64(400) || len(response["refunds"].([]interface{})) != 1 {
+            t.Errorf("invalid refund history: %v", response)
+        }
+
+        response = client.Request("POST", "v1/payments/1/reversal", nil, nil)
+        if reversal, _ := response["payment"].(map[string]interface{}); reversal["amount"] != float64(400) {
+            t.Errorf("the rest of the payment should be reversed: %v", response)
+        }
+        response = client.Request("POST", "v1/payments/1/refunds", map[string]interface{}{"amount": 1}, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a reversed payment cannot be refunded: %v", response)
+        }
+
+        // B has only 1000 cents to return
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 5000}, nil)
+        path := fmt.Sprintf("v1/payments/%v/refunds", response["payment"].(map[string]interface{})["id"])
+        response = client.Request("POST", path, map[string]interface{}{"amount": 5000}, nil)
+        if response["code"] != codeInsufficientFunds {
+            t.Errorf("insufficient_funds was expected: %v", response)
+        }
+    })
+}
+
+func TestV1_PaymentStatus(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        body := map[string]interface{}{"from": "A", "to": "B", "amount": 500, "pending": true}
+        response := client.Request("POST", "v1/transfers", body, nil)
+        payment, _ := response["payment"].(map[string]interface{})
+        if payment["status"] != statusPending {
+            t.Fatalf("a pending payment was expected: %v", response)
+        }
+        response = client.Request("GET", "v1/accounts/A", nil, nil)
+        if account := response["account"].(map[string]interface{}); account["available"] != float64(9300) {
+            t.Errorf("the pending payment should reserve the funds: %v", response)
+        }
+
+        path := fmt.Sprintf("v1/payments/%v/", payment["id"])
+        response = client.Request("POST", path + "refunds", map[string]interface{}{"amount": 100}, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a pending payment cannot be refunded: %v", response)
+        }
+        client.Request("POST", path + "status", map[string]interface{}{"status": "processing"}, nil)
+        response = client.Request("POST", path + "status", map[string]interface{}{"status": "cancelled"}, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a processing payment cannot be cancelled: %v", response)
+        }
+        response = client.Request("POST", path + "status", map[string]interface{}{"status": "completed", "reason": "settled"}, nil)
+        if payment, _ := response["payment"].(map[string]interface{}); payment["status"] != statusCompleted {
+            t.Errorf("the payment should be completed: %v", response)
+        }
+        response = client.Request("POST", path + "status", map[string]interface{}{"status": "reversed"}, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("the reversed status should be rejected: %v", response)
+        }
+
+        response = client.Request("GET", path + "history", nil, nil)
+        var statuses []interface{}
+        for _, change := range response["history"].([]interface{}) {
+            statuses = append(statuses, change.(map[string]interface{})["status"])
+        }
+        if fmt.Sprint(statuses) != "[pending processing completed]" || response["status"] != statusCompleted {
+            t.Errorf("invalid status history: %v", response)
+        }
+
+        client.Request("POST", "v1/accounts/B/overdraft", map[string]interface{}{"limit": 500}, nil)
+        response = client.Request("POST", "v1/transfers", map[string]interface{}{"from": "B", "to": "A", "amount": 1200, "pending": true}, nil)
+        path = fmt.Sprintf("v1/payments/%v/", response["payment"].(map[string]interface{})["id"])
+        client.Request("POST", "v1/accounts/B/overdraft", map[string]interface{}{"limit": 0}, nil)
+        response = client.Request("POST", path + "status", map[string]interface{}{"status": "completed"}, nil)
+        if response["code"] != codeInsufficientFunds {
+            t.Errorf("the payment should not be completed beyond the available funds: %v", response)
+        }
+
+        client.Request("POST", "v1/payments/2/reversal", nil, nil)
+        response = client.Request("GET", "v1/payments/2/history", nil, nil)
+        if response["status"] != statusReversed || len(response["history"].([]interface{})) != 2 {
+            t.Errorf("the reversed payment should change its status: %v", response)
+        }
+    })
+}
+
+func TestV1_Schedules(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        body := map[string]interface{}{
+            "from": "A", "to": "B", "amount": 100, "recurrence": "daily", "day_of_month": 5,
+            "start": "2019-03-01T09:00:00Z"}
+        response := client.Request("POST", "v1/schedules", body, nil)
+        if response["code"] != codeValidationFailed {
+            t.Errorf("day_of_month should be rejected for a daily schedule: %v", response)
+        }
+        body["recurrence"] = "monthly"
+        response = client.Request("POST", "v1/schedules", body, nil)
+        schedule, _ := response["schedule"].(map[string]interface{})
+        if schedule["next_run"] != "2019-03-05T09:00:00Z" || schedule["status"] != scheduleActive {
+            t.Fatalf("the schedule should run on the 5th: %v", response)
+        }
+
+        path := fmt.Sprintf("v1/schedules/%v", schedule["id"])
+        response = client.Request("GET", path + "/runs", nil, nil)
+        if runs, _ := response["runs"].([]interface{}); runs == nil || len(runs) != 0 {
+            t.Errorf("no runs were expected: %v", response)
+        }
+        response = client.Request("POST", path + "/cancel", nil, nil)
+        if schedule, _ := response["schedule"].(map[string]interface{}); schedule["status"] != scheduleCancelled {
+            t.Errorf("the schedule should be cancelled: %v", response)
+        }
+        response = client.Request("POST", path + "/cancel", nil, nil)
+        if response["code"] != codeInvalidState {
+            t.Errorf("a cancelled schedule cannot be cancelled again: %v", response)
+        }
+    })
+}
+
+func TestSchedule_Occurrences(t *testing.T) {
+    start := time.Date(2019, 1, 31, 9, 0, 0, 0, time.UTC)
+    monthly := Schedule{Recurrence:recurMonthly, DayOfMonth:31, Start:start, Status:scheduleActive}
+    for n, expected := range []string{"2019-01-31", "2019-02-28", "2019-03-31", "2019-04-30"} {
+        if day := monthly.occurrence(n).Format("2006-01-02"); day != expected {
+            t.Errorf("occurrence %d: %s was expected, got %s", n, expected, day)
+        }
+    }
+    monthly.DayOfMonth = 5
+    if day := monthly.occurrence(0).Format("2006-01-02"); day != "2019-02-05" {
+        t.Errorf("the first occurrence should not precede the start: %s", day)
+    }
+
+    end := start.AddDate(0, 0, 2)
+    daily := Schedule{Recurrence:recurDaily, Start:start, End:&end, Status:scheduleActive}
+    for i := 0; i < 3; i++ {
+        daily = daily.advance()
+    }
+    if daily.Status != scheduleFinished || daily.NextRun != nil || daily.Runs != 3 {
+        t.Errorf("the schedule should finish at the end date: %+v", daily)
+    }
+    weekly := Schedule{Recurrence:recurWeekly, Start:start, MaxRuns:1, Status:scheduleActive}.advance()
+    if weekly.Status != scheduleFinished {
+        t.Errorf("the schedule should finish after max_runs: %+v", weekly)
+    }
+}
+
+func TestScheduler_RunOnce(t *testing.T) {
+    m, _ := NewMockManager("")
+    now := time.Now().UTC()
+    start := now.Add(-time.Minute)
+    for _, schedule := range []Schedule{
+        {From:"A", To:"B", Amount:100, Recurrence:recurDaily, Start:start, MaxRuns:2},
+        {From:"B", To:"A", Amount:999999, Recurrence:recurOnce, Start:start},
+    } {
+        schedule.Status, schedule.NextRun = scheduleActive, &start
+        if _, err := m.CreateSchedule(schedule); err != nil {
+            t.Fatal(err)
+        }
+    }
+    scheduler := NewScheduler(m)
+    scheduler.now = func() time.Time { return now }
+
+    if n, err := scheduler.RunOnce(); n != 2 || err != nil {
+        t.Fatalf("both schedules should run: %d, %v", n, err)
+    }
+    if n, _ := scheduler.RunOnce(); n != 0 {
+        t.Errorf("the next occurrence is not due yet: %d", n)
+    }
+    runs, _ := m.GetScheduleRuns(2)
+    if len(runs) != 1 || runs[0].Status != runFailed || runs[0].ErrorCode != codeInsufficientFunds {
+        t.Errorf("a failed run was expected: %+v", runs)
+    }
+    if schedule, _ := m.GetSchedule(2); schedule.Status != scheduleFinished {
+        t.Errorf("a single transfer should finish after the failed run: %+v", schedule)
+    }
+
+    scheduler.now = func() time.Time { return now.AddDate(0, 0, 1) }
+    if n, _ := scheduler.RunOnce(); n != 1 {
+        t.Errorf("the second occurrence should run: %d", n)
+    }
+    runs, _ = m.GetScheduleRuns(1)
+    if len(runs) != 2 || runs[1].Occurrence != 2 || runs[1].PaymentID == nil {
+        t.Errorf("two successful runs were expected: %+v", runs)
+    }
+    if payment, _ := m.GetPayment(*runs[1].PaymentID); payment.IdempotencyKey.String != "schedule-1-2" {
+        t.Errorf("the idempotency key should be derived from the occurrence: %+v", payment)
+    }
+
+    // the schedule created before the threshold was lowered
+    schedule := Schedule{From:"A", To:"B", Amount:100, Recurrence:recurOnce, Start:start, Status:scheduleActive, NextRun:&start}
+    if _, err := m.CreateSchedule(schedule); err != nil {
+        t.Fatal(err)
+    }
+    scheduler.Check = NewBillingAPI(Config{ApprovalThreshold:50}).checkThreshold
+    scheduler.RunOnce()
+    if runs, _ := m.GetScheduleRuns(3); len(runs) != 1 || runs[0].ErrorCode != codeApprovalRequired {
+        t.Errorf("the scheduler should reject the amounts above the threshold: %+v", runs)
+    }
+
+    lease, _ := m.TryLead(context.Background(), schedulerJob)
+    if other, _ := m.TryLead(context.Background(), schedulerJob); lease == nil || other != nil {
+        t.Errorf("a single leader was expected")
+    }
+}
+
+func TestHold_Expiry(t *testing.T) {
+    m, _ := NewMockManager("")
+    hold, err := m.Authorize("A", "B", 1000, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := m.Capture(hold.ID, 0); err != nil {
+        t.Errorf("an active hold should be captured: %v", err)
+    }
+
+    hold, _ = m.Authorize("A", "B", 1000, time.Minute)
+    if n, _ := m.ExpireHolds(time.Now().Add(time.Hour)); n != 3 {
+        t.Errorf("the active holds should expire: %d", n)
+    }
+    if _, _, err := m.Capture(hold.ID, 0); err == nil || err.(managerError).code != codeInvalidState {
+        t.Errorf("an expired hold cannot be captured: %v", err)
+    }
+    if acc, _ := m.GetAccount("A"); acc.Available() != acc.Amount {
+        t.Errorf("the expired holds should not reserve funds: %v", acc)
+    }
+}
+
+func TestV1_Transfer_Validation(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        var testCases = []struct{
+            body interface{}
+            field string
+        }{
+            {map[string]interface{}{"from": "A", "to": "B"}, "amount"},
+            {map[string]interface{}{"from": "A", "to": "B", "amount": -5}, "amount"},
+            {map[string]interface{}{"from": "A", "to": "B", "amount": "100"}, "amount"},
+            {map[string]interface{}{"to": "B", "amount": 100}, "from"},
+            {map[string]interface{}{"from": "A", "to": "B", "amount": 100, "note": "x"}, "note"},
+        }
+        for _, test := range testCases {
+            response := client.Request("POST", "v1/transfers", test.body, nil)
+            if response["code"] != codeValidationFailed {
+                t.Errorf("validation error was expected for %v: %#v", test.body, response)
+                continue
+            }
+            fields := response["fields"].([]interface{})
+            if field := fields[0].(map[string]interface{})["field"]; field != test.field {
+                t.Errorf("error for field %s was expected, got %v", test.field, field)
+            }
+        }
+    })
+}
+
+func TestDecodeRequest_BodyTooLarge(t *testing.T) {
+    body := fmt.Sprintf(`{"from": "%s"}`, strings.Repeat("A", maxBodySize))
+    req := httptest.NewRequest("POST", "/v1/transfers", strings.NewReader(body))
+    err := decodeRequest(httptest.NewRecorder(), req, &TransferRequest{})
+    if err, ok := err.(managerError); !ok || err.code != codeBodyTooLarge {
+        t.Errorf("body_too_large error was expected: %#v", err)
+    }
+}
+
+func TestValidate(t *testing.T) {
+    type item struct {
+        Name string `json:"name" validate:"required,max=3"`
+    }
+    type Tags struct {
+        Labels map[string]string `json:"labels" validate:"keymax=3,valuemax=3"`
+    }
+    type request struct {
+        Kind string  `json:"kind" validate:"oneof=a|b"`
+        Count int    `json:"count" validate:"min=1,max=10"`
+        Items []item `json:"items" validate:"max=2"`
+        Tags
+    }
+    errs := Validate(request{Kind:"c", Count:11, Items:[]item{{"ok"}, {"long"}}, Tags:Tags{map[string]string{"key":"value"}}})
+    expected := []string{"kind", "count", "items[1].name", "labels"}
+    if len(errs) != len(expected) {
+        t.Fatalf("invalid number of errors: %v", errs)
+    }
+    for i, field := range expected {
+        if errs[i].Field != field {
+            t.Errorf("error for field %s was expected, got %v", field, errs[i])
+        }
+    }
+    if errs := Validate(request{}); len(errs) != 0 {
+        t.Errorf("optional fields should be skipped: %v", errs)
+    }
+}
+
+func TestAuth(t *testing.T) {
+    tokens, err := ParseTokens("secret:alice:client:A,admin:bob:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens})
+
+    var testCases = []struct{
+        token, path string
+        status int
+    }{
+        {"", "/status", http.StatusAccepted},
+        {"", "/v1/accounts", http.StatusUnauthorized},
+        {"wrong", "/v1/accounts", http.StatusUnauthorized},
+        {"secret", "/v1/accounts/A", http.StatusAccepted},
+        {"secret", "/v1/accounts/B", http.StatusForbidden},
+        {"admin", "/v1/accounts/B", http.StatusAccepted},
+    }
+    for _, test := range testCases {
+        req := httptest.NewRequest("GET", test.path, nil)
+        if test.token != "" {
+            req.Header.Set("Authorization", "Bearer "+test.token)
+        }
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        if recorder.Code != test.status {
+            t.Errorf("%s with token %q: status %d was expected, got %d",
+                test.path, test.token, test.status, recorder.Code)
+        }
+    }
+
+    ctx := context.Background()
+    if err := requireOperator(ctx); err == nil || authorize(ctx, "A") == nil {
+        t.Errorf("a context without a principal should have no access")
+    }
+    if principal, _ := (Authenticator{}).Authenticate(""); principal.Role != RoleOperator {
+        t.Errorf("the disabled authentication should grant the operator role: %+v", principal)
+    }
+}
+
+func TestConfig_Check(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,bob:bob:client:A")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := (Config{ApprovalThreshold:1000}).Check(); err == nil {
+        t.Errorf("the approvals should not be enabled without the authentication")
+    }
+    if err := (Config{ApprovalThreshold:1000, Tokens:tokens}).Check(); err != nil {
+        t.Errorf("the approvals should be enabled with the tokens: %s", err)
+    }
+    if err := (Config{}).Check(); err != nil {
+        t.Errorf("the authentication should be optional without the approvals: %s", err)
+    }
+}
+
+func TestV1_Approvals(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,bob:bob:client:A,ops:ops:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens, ApprovalThreshold:1000})
+    call := func(token, method, path string, body interface{}) Response {
+        encoded, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+        req.Header.Set("Authorization", "Bearer "+token)
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        var response Response
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response
+    }
+
+    transfer := map[string]interface{}{"from": "A", "to": "B", "amount": 3000}
+    response := call("alice", "POST", "/v1/transfers", transfer)
+    approval, _ := response["approval"].(map[string]interface{})
+    if response["payment"] != nil || approval["status"] != approvalPending || approval["initiator"] != "alice" {
+        t.Fatalf("the transfer should wait for the approval: %v", response)
+    }
+    path := fmt.Sprintf("/v1/approvals/%v", approval["id"])
+    if response := call("alice", "POST", "/v1/transfers/batch", map[string]interface{}{"transfers": []interface{}{transfer}}); response["code"] != codeApprovalRequired {
+        t.Errorf("the batch should not bypass the approval: %v", response)
+    }
+    if response := call("alice", "POST", "/v1/holds", transfer); response["code"] != codeApprovalRequired {
+        t.Errorf("the hold should not bypass the approval: %v", response)
+    }
+    schedule := map[string]interface{}{"from": "A", "to": "B", "amount": 3000, "recurrence": "once", "start": "2019-03-01T09:00:00Z"}
+    if response := call("alice", "POST", "/v1/schedules", schedule); response["code"] != codeApprovalRequired {
+        t.Errorf("the schedule should not bypass the approval: %v", response)
+    }
+
+    queue := call("bob", "GET", "/v1/approvals", nil)
+    if approvals, _ := queue["approvals"].([]interface{}); len(approvals) != 3 {
+        t.Errorf("the fixture and the created approvals should be queued: %v", queue)
+    }
+    if response := call("alice", "POST", path+"/approve", nil); response["code"] != codeForbidden {
+        t.Errorf("the initiator should not approve the transfer: %v", response)
+    }
+    response = call("bob", "POST", path+"/approve", map[string]interface{}{"reason": "checked"})
+    approval, _ = response["approval"].(map[string]interface{})
+    if approval["status"] != approvalExecuted || approval["decided_by"] != "bob" || approval["payment_id"] == nil {
+        t.Fatalf("the approved transfer should be made: %v", response)
+    }
+    if response := call("ops", "POST", path+"/reject", nil); response["code"] != codeInvalidState {
+        t.Errorf("the executed transfer should not be rejected: %v", response)
+    }
+
+    history, _ := call("alice", "GET", path+"/history", nil)["history"].([]interface{})
+    var actions []string
+    for _, event := range history {
+        actions = append(actions, event.(map[string]interface{})["action"].(string))
+    }
+    if strings.Join(actions, ",") != "requested,approved,executed" {
+        t.Errorf("the changes should be audited: %v", actions)
+    }
+
+    if response := call("ops", "POST", "/v1/approvals/2/reject", map[string]interface{}{"reason": "unknown recipient"}); response["approval"].(map[string]interface{})["status"] != approvalRejected {
+        t.Errorf("the transfer should be rejected: %v", response)
+    }
+}
+
+func TestApproval_Expires(t *testing.T) {
+    m, _ := NewMockManager("")
+    now := time.Now().UTC()
+    approval, _ := m.RequestApproval(Approval{From:"A", To:"B", Amount:5000, Initiator:"alice", Created:now, Expires:now.Add(time.Minute)})
+    if _, err := m.DecideApproval(approval.ID, approvalApproved, "bob", ""); err != nil {
+        t.Errorf("the approval should be decided before it expires: %s", err)
+    }
+
+    approval, _ = m.RequestApproval(Approval{From:"A", To:"B", Amount:5000, Initiator:"alice", Created:now, Expires:now})
+    if _, err := m.DecideApproval(approval.ID, approvalApproved, "bob", ""); err == nil {
+        t.Errorf("the expired approval should not be approved")
+    }
+    if expired, _ := m.ExpireApprovals(now); expired != 1 {
+        t.Errorf("the expired approval should be marked: %d", expired)
+    }
+    if history, _ := m.GetApprovalHistory(approval.ID); len(history) != 2 || history[1].Action != approvalExpired {
+        t.Errorf("the expiry should be audited: %d records", len(history))
+    }
+}
+
+func TestV1_Audit(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,ops:ops:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens})
+    call := func(token, method, path string, body interface{}) (Response, *httptest.ResponseRecorder) {
+        encoded, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+        req.Header.Set("Authorization", "Bearer "+token)
+        req.Header.Set("X-Request-ID", "req-1")
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        var response Response
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response, recorder
+    }
+
+    _, recorder := call("alice", "POST", "/v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 300})
+    if recorder.Header().Get("X-Request-ID") != "req-1" {
+        t.Errorf("the request ID should be echoed: %q", recorder.Header().Get("X-Request-ID"))
+    }
+    if response, _ := call("alice", "GET", "/v1/audit", nil); response["code"] != codeForbidden {
+        t.Errorf("a client should not read the audit log: %v", response)
+    }
+    response, _ := call("ops", "GET", "/v1/audit?limit=1", nil)
+    entries, _ := response["entries"].([]interface{})
+    if len(entries) != 1 {
+        t.Fatalf("the transfer should be audited: %v", response)
+    }
+    entry := entries[0].(map[string]interface{})
+    if entry["action"] != "payment.created" || entry["actor"] != "alice" || entry["request_id"] != "req-1" ||
+        entry["before"] != nil || entry["after"] == nil {
+        t.Errorf("the entry should describe the transfer: %v", entry)
+    }
+
+    response, _ = call("ops", "GET", "/v1/audit/verify", nil)
+    report, _ := response["report"].(map[string]interface{})
+    if report["valid"] != true || report["checked"] != float64(1) {
+        t.Errorf("the chain should be valid: %v", response)
+    }
+}
+
+func TestAuditChain(t *testing.T) {
+    m, _ := NewMockManager("")
+    mock := m.(MockManager)
+    for i := 0; i < 4; i++ {
+        _, _ = m.AppendAudit(AuditEntry{Time:time.Now(), Actor:"ops", Action:"limits.set", Resource:"limits/USD"})
+    }
+    if report, _ := m.VerifyAudit(); !report.Valid || report.Checked != 4 || report.Head.Seq != 4 {
+        t.Fatalf("the chain should be valid: %+v", report)
+    }
+
+    mock.state.audit[2].Actor = "alice"
+    if report, _ := m.VerifyAudit(); report.Valid || report.Broken.Seq != 3 || report.Head.Seq != 2 {
+        t.Errorf("the edited entry should break the chain: %+v", report)
+    }
+    mock.state.audit = append(mock.state.audit[:2], mock.state.audit[3:]...)
+    if report, _ := m.VerifyAudit(); report.Valid || report.Broken.Seq != 4 {
+        t.Errorf("the deleted entry should break the chain: %+v", report)
+    }
+}
+
+func TestAudited(t *testing.T) {
+    m, _ := NewMockManager("")
+    hold, _ := m.Audited("ops", "req-2").Authorize("A", "B", 100, time.Hour)
+    if _, err := m.Audited("ops", "req-3").Void(hold.ID); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := m.Audited("ops", "req-4").Void(hold.ID); err == nil {
+        t.Fatalf("the voided hold should not be voided again")
+    }
+    entries, _ := m.ListAudit(PageRequest{Limit:10})
+    if len(entries) != 2 {
+        t.Fatalf("the failed change should not be audited: %d entries", len(entries))
+    }
+    voided := entries[0]
+    if voided.Action != "hold.voided" || voided.Actor != "ops" || voided.RequestID != "req-3" ||
+        !strings.Contains(voided.Before, `"active"`) || !strings.Contains(voided.After, `"voided"`) {
+        t.Errorf("the entry should describe the void: %+v", voided)
+    }
+}
+
+func TestV1_Receipts(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,ops:ops:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyFile := filepath.Join(t.TempDir(), "receipt.key")
+    if err := os.WriteFile(keyFile, []byte(receiptSeed(1) + "\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens, ReceiptKeyFile:keyFile})
+    call := func(token, method, path string, result interface{}) {
+        req := httptest.NewRequest(method, path, nil)
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        _ = json.Unmarshal(recorder.Body.Bytes(), result)
+    }
+    verify := func(receipt *Receipt) error {
+        var published ReceiptKeysResponse
+        call("", "GET", "/.well-known/receipt-keys", &published)
+        for _, key := range published.Keys {
+            if key.ID == receipt.Payload.KeyID {
+                public, _ := base64.StdEncoding.DecodeString(key.PublicKey)
+                signature, _ := base64.StdEncoding.DecodeString(receipt.Signature)
+                message, _ := json.Marshal(receipt.Payload)
+                if !ed25519.Verify(public, message, signature) {
+                    return fmt.Errorf("invalid signature")
+                }
+                return nil
+            }
+        }
+        return fmt.Errorf("key %s is not published", receipt.Payload.KeyID)
+    }
+
+    var missing Response
+    if call("alice", "GET", "/v1/payments/1/receipt", &missing); missing["code"] != codeInvalidState {
+        t.Errorf("the receipt should not be signed before the key is loaded: %v", missing)
+    }
+    if keys, _ := api.shared.SigningKeys(); len(keys) != 0 {
+        t.Errorf("reading the receipt should not create a key: %+v", keys)
+    }
+    for i := 0; i < 2; i++ {
+        if err := api.InitReceiptKey(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    keys, _ := api.shared.SigningKeys()
+    if len(keys) != 1 || keys[0].PrivateKey != nil {
+        t.Errorf("the public key should be published once at startup: %+v", keys)
+    }
+
+    var first ReceiptResponse
+    call("alice", "GET", "/v1/payments/1/receipt", &first)
+    if first.Receipt == nil || first.Receipt.Payload.PaymentID != 1 || first.Receipt.Payload.Amount != 1000 {
+        t.Fatalf("the completed payment should have a receipt: %+v", first.Receipt)
+    }
+    if err := verify(first.Receipt); err != nil {
+        t.Errorf("the receipt should be verified: %s", err)
+    }
+    var detail PaymentDetailResponse
+    call("alice", "GET", "/v1/payments/1", &detail)
+    if detail.Receipt == nil || detail.Receipt.Signature != first.Receipt.Signature {
+        t.Errorf("the payment should carry the same receipt: %+v", detail.Receipt)
+    }
+
+    var denied Response
+    if call("alice", "POST", "/v1/receipt-keys/rotate", &denied); denied["code"] != codeForbidden {
+        t.Errorf("a client should not rotate the keys: %v", denied)
+    }
+    var unchanged ReceiptKeyResponse
+    if call("ops", "POST", "/v1/receipt-keys/rotate", &unchanged); unchanged.Key.ID != first.Receipt.Payload.KeyID {
+        t.Errorf("the active key should be kept until the configured key is changed: %+v", unchanged)
+    }
+    if err := os.WriteFile(keyFile, []byte(receiptSeed(2)), 0600); err != nil {
+        t.Fatal(err)
+    }
+    var rotated ReceiptKeyResponse
+    call("ops", "POST", "/v1/receipt-keys/rotate", &rotated)
+    var second ReceiptResponse
+    call("alice", "GET", "/v1/payments/1/receipt", &second)
+    if second.Receipt.Payload.KeyID != rotated.Key.ID || second.Receipt.Payload.KeyID == first.Receipt.Payload.KeyID {
+        t.Errorf("the receipt should be signed with the new key: %+v", second.Receipt)
+    }
+    if err := verify(first.Receipt); err != nil {
+        t.Errorf("the receipt signed with the retired key should be verified: %s", err)
+    }
+    tampered := *second.Receipt
+    tampered.Payload.Amount = 100000
+    if err := verify(&tampered); err == nil {
+        t.Errorf("the tampered receipt should not be verified")
+    }
+}
+
+func TestReceipt_RequiresCompletedPayment(t *testing.T) {
+    private, _ := ParseReceiptKey(receiptSeed(1))
+    payment := Payment{ID:3, From:"A", To:"B", Amount:100, Currency:"USD", Status:statusPending}
+    if _, err := signReceipt(payment, newSigningKey(private, time.Now())); err == nil || err.(managerError).code != codeInvalidState {
+        t.Errorf("the pending payment should not have a receipt: %v", err)
+    }
+    if _, err := ParseReceiptKey(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+        t.Errorf("the key should be a 32-byte seed")
+    }
+}
+
+// receiptSeed returns a base64-encoded receipt key filled with the byte.
+func receiptSeed(b byte) string {
+    return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, ed25519.SeedSize))
+}
+
+func TestV1_Statement(t *testing.T) {
+    api := NewBillingAPI(Config{})
+    get := func(path string) *httptest.ResponseRecorder {
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+        return recorder
+    }
+    transfer := httptest.NewRequest("POST", "/v1/transfers", strings.NewReader(`{"from": "A", "to": "B", "amount": 300}`))
+    api.Handler.ServeHTTP(httptest.NewRecorder(), transfer)
+    now := time.Now().UTC()
+    path := fmt.Sprintf("/v1/accounts/A/statement?from=%s&to=%s",
+        now.AddDate(0, 0, -1).Format(dateLayout), now.Format(dateLayout))
+
+    // A has the balance of 10000 after +1000, -1000 and -300 booked within the period
+    recorder := get(path + "&format=jsonl")
+    if recorder.Header().Get("Content-Type") != "application/jsonl" {
+        t.Fatalf("JSON Lines were expected: %s", recorder.Body)
+    }
+    var lines []map[string]interface{}
+    for _, line := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n") {
+        var record map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &record); err != nil {
+            t.Fatalf("invalid line %q: %s", line, err)
+        }
+        lines = append(lines, record)
+    }
+    if len(lines) != 5 || lines[0]["type"] != "opening" || lines[0]["opening_balance"] != float64(10300) {
+        t.Fatalf("the statement should open with the balance before the period: %v", lines)
+    }
+    var balances []float64
+    for _, line := range lines[1:4] {
+        balances = append(balances, line["balance"].(float64))
+    }
+    if fmt.Sprint(balances) != "[11300 10300 10000]" || lines[1]["counterparty"] != "B" {
+        t.Errorf("the payments should have the running balance: %v", lines[1:4])
+    }
+    closing := lines[4]
+    if closing["type"] != "closing" || closing["closing_balance"] != float64(10000) ||
+        closing["total_in"] != float64(1000) || closing["total_out"] != float64(1300) {
+        t.Errorf("the statement should close with the totals: %v", closing)
+    }
+
+    rows, err := csv.NewReader(get(path).Body).ReadAll()
+    if err != nil || len(rows) != 6 || rows[1][2] != "opening_balance" || rows[5][6] != "10000" || rows[5][8] != "1300" {
+        t.Errorf("the CSV statement should have the same lines: %v (%v)", rows, err)
+    }
+
+    recorder = get(path + "&format=pdf")
+    document := recorder.Body.String()
+    if !strings.HasPrefix(document, "%PDF-") || !strings.Contains(document, "(Closing balance: 100.00)") {
+        t.Errorf("the PDF statement should be printed: %.200s", document)
+    }
+
+    recorder = get(path + "&format=camt053")
+    root, err := parseXML(recorder.Body)
+    if err != nil || recorder.Header().Get("Content-Type") != "application/xml" {
+        t.Fatalf("the camt.053 statement was expected: %s", err)
+    }
+    if errs := camt053Schema.validate(root); len(errs) > 0 {
+        t.Errorf("the camt.053 statement should be valid against the schema: %v", errs)
+    }
+    var camt struct {
+        Balances []string `xml:"BkToCstmrStmt>Stmt>Bal>Amt"`
+        Entries int       `xml:"BkToCstmrStmt>Stmt>TxsSummry>TtlNtries>NbOfNtries"`
+        Debtors []string  `xml:"BkToCstmrStmt>Stmt>Ntry>NtryDtls>TxDtls>RltdPties>DbtrAcct>Id>Othr>Id"`
+    }
+    _ = xml.Unmarshal([]byte(get(path + "&format=camt053").Body.String()), &camt)
+    if fmt.Sprint(camt.Balances) != "[103.00 100.00]" || camt.Entries != 3 || fmt.Sprint(camt.Debtors) != "[B A A]" {
+        t.Errorf("the camt.053 statement should have the balances and the entries: %+v", camt)
+    }
+
+    response := Response{}
+    _ = json.Unmarshal(get("/v1/accounts/A/statement?from=2019-03-31&to=2019-03-01").Body.Bytes(), &response)
+    if response["code"] != codeValidationFailed {
+        t.Errorf("the reversed period should be rejected: %v", response)
+    }
+}
+
+func TestV1_Search(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,ops:ops:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens})
+    call := func(token, method, path string, body interface{}) Response {
+        encoded, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+        req.Header.Set("Authorization", "Bearer "+token)
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        var response Response
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response
+    }
+    search := func(query string) Response {
+        return call("ops", "GET", "/v1/payments/search?q="+url.QueryEscape(query), nil)
+    }
+
+    transfers := []map[string]interface{}{
+        {"from": "A", "to": "B", "amount": 150, "reference": "INV-2026-042", "memo": "Invoice 42 for March"},
+        {"from": "A", "to": "B", "amount": 50, "memo": "invoice 43"},
+        {"from": "B", "to": "A", "amount": 500, "reference": "REFUND-7"},
+    }
+    for _, body := range transfers {
+        if response := call("ops", "POST", "/v1/transfers", body); response["payment"] == nil {
+            t.Fatalf("transfer failed: %v", response)
+        }
+    }
+    if response := call("alice", "GET", "/v1/payments/search?q=invoice", nil); response["code"] != codeForbidden {
+        t.Errorf("the clients should not search the payments: %v", response)
+    }
+
+    today := time.Now().UTC().Format(dateLayout)
+    var testCases = []struct{
+        query string
+        count int
+    }{
+        {`amount>100 currency:USD memo:"invoice 42"`, 1},
+        {`memo:"42 invoice"`, 0},
+        {`inv-2026`, 1},
+        {`invoice`, 2},
+        {`"for march"`, 1},
+        {`amount<=100`, 1},
+        {`amount=500`, 1},
+        {`account:B amount>=500`, 3},
+        {`from:B`, 2},
+        {`currency:eur`, 0},
+        {`kind:transfer status:completed`, 5},
+        {`date<=` + today, 5},
+        {`date>` + today, 0},
+        {``, 5},
+    }
+    for _, test := range testCases {
+        response := search(test.query)
+        if items, _ := response["payments"].([]interface{}); len(items) != test.count {
+            t.Errorf("%s: %d payments were expected: %v", test.query, test.count, response)
+        }
+    }
+    for _, query := range []string{`amount>x`, `colour:red`, `memo:"open`, `reference>5`, `date:March`} {
+        if response := search(query); response["code"] != codeValidationFailed {
+            t.Errorf("%s: validation error was expected: %v", query, response)
+        }
+    }
+
+    first := call("ops", "GET", "/v1/payments/search?limit=3&q=currency:USD", nil)
+    cursor, _ := first["next_cursor"].(string)
+    if items, _ := first["payments"].([]interface{}); len(items) != 3 || cursor == "" {
+        t.Fatalf("the first page with the cursor was expected: %v", first)
+    }
+    second := call("ops", "GET", "/v1/payments/search?limit=3&q=currency:USD&cursor="+cursor, nil)
+    if items, _ := second["payments"].([]interface{}); len(items) != 2 || second["next_cursor"] != "" {
+        t.Errorf("the last page was expected: %v", second)
+    }
+}
+
+func TestParseSearch(t *testing.T) {
+    search, err := ParseSearch(`amount>100 amount<=500 amount>=50 "net 30" memo:"invoice 42" currency=eur date:2026-03-01`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if *search.MinAmount != 101 || *search.MaxAmount != 500 {
+        t.Errorf("the amounts should be within [101, 500]: %v, %v", *search.MinAmount, *search.MaxAmount)
+    }
+    if len(search.Texts) != 1 || search.Texts[0] != "net 30" || search.Memo != "invoice 42" || search.Currency != "EUR" {
+        t.Errorf("invalid search: %+v", search)
+    }
+    day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+    if !search.Since.Equal(day) || !search.Until.Equal(day.AddDate(0, 0, 1)) {
+        t.Errorf("the payments of the day were expected: %v, %v", search.Since, search.Until)
+    }
+    if _, err := ParseSearch(strings.Repeat("a ", maxSearchTerms + 1)); err == nil {
+        t.Errorf("too many terms should be rejected")
+    }
+}
+
+func TestV1_Reconciliation(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,ops:ops:operator,root:root:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens})
+    call := func(token, method, path string, body interface{}) Response {
+        encoded, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+        req.Header.Set("Authorization", "Bearer "+token)
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        var response Response
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response
+    }
+    discrepancies := func() map[string]interface{} {
+        response := call("ops", "GET", "/v1/reconciliation", nil)
+        report, _ := response["report"].(map[string]interface{})
+        found := make(map[string]interface{})
+        list, _ := report["discrepancies"].([]interface{})
+        for _, item := range list {
+            r := item.(map[string]interface{})
+            found[r["account"].(string)] = r["discrepancy"]
+        }
+        return found
+    }
+
+    if response := call("alice", "GET", "/v1/reconciliation", nil); response["code"] != codeForbidden {
+        t.Errorf("the clients should not reconcile the balances: %v", response)
+    }
+    // the fixture payments between A and B cancel out, and only B has the opening entry
+    if found := discrepancies(); len(found) != 2 || found["A"] != float64(10000) || found["C"] != float64(5000) {
+        t.Fatalf("the balances without opening entries should be reported: %v", found)
+    }
+
+    response := call("ops", "POST", "/v1/reconciliation/adjustments", map[string]interface{}{"accounts": []string{"A", "C"}})
+    report, _ := response["report"].(map[string]interface{})
+    adjustments, _ := report["adjustments"].([]interface{})
+    if len(adjustments) != 2 {
+        t.Fatalf("the adjustments should be requested: %v", response)
+    }
+    adjustment := adjustments[0].(map[string]interface{})
+    if adjustment["kind"] != approvalAdjustment || adjustment["from"] != "A" || adjustment["amount"] != float64(10000) ||
+        adjustment["status"] != approvalPending || adjustment["initiator"] != "ops" {
+        t.Errorf("the adjustment of A should be pending: %v", adjustment)
+    }
+    path := fmt.Sprintf("/v1/approvals/%v", adjustment["id"])
+    if response := call("alice", "POST", path+"/approve", nil); response["code"] != codeForbidden {
+        t.Errorf("the clients should not approve the adjustments: %v", response)
+    }
+    if response := call("ops", "POST", path+"/approve", nil); response["code"] != codeForbidden {
+        t.Errorf("the initiator should not approve the adjustment: %v", response)
+    }
+    response = call("root", "POST", path+"/approve", nil)
+    if approval, _ := response["approval"].(map[string]interface{}); approval["status"] != approvalExecuted {
+        t.Fatalf("the approved adjustment should be recorded: %v", response)
+    }
+    if found := discrepancies(); len(found) != 1 || found["C"] != float64(5000) {
+        t.Errorf("the adjustment should resolve the discrepancy: %v", found)
+    }
+
+    // the discrepancy of C is resolved by another adjustment before the first one is
+    // approved
+    second := call("ops", "POST", "/v1/reconciliation/adjustments", map[string]interface{}{"accounts": []string{"C"}})
+    report, _ = second["report"].(map[string]interface{})
+    adjustments, _ = report["adjustments"].([]interface{})
+    call("root", "POST", fmt.Sprintf("/v1/approvals/%v/approve", adjustments[0].(map[string]interface{})["id"]), nil)
+    response = call("root", "POST", fmt.Sprintf("/v1/approvals/%v/approve", adjustment["id"].(float64)+1), nil)
+    if approval, _ := response["approval"].(map[string]interface{}); approval["status"] != approvalFailed ||
+        approval["error_code"] != codeInvalidState {
+        t.Errorf("the outdated adjustment should fail: %v", response)
+    }
+    if found := discrepancies(); len(found) != 0 {
+        t.Errorf("the discrepancies should be resolved: %v", found)
+    }
+}
+
+func TestV1_Analytics(t *testing.T) {
+    tokens, err := ParseTokens("alice:alice:client:A,ops:ops:operator")
+    if err != nil {
+        t.Fatal(err)
+    }
+    api := NewBillingAPI(Config{Tokens:tokens})
+    call := func(token, method, path string, body interface{}) Response {
+        encoded, _ := json.Marshal(body)
+        req := httptest.NewRequest(method, path, bytes.NewBuffer(encoded))
+        req.Header.Set("Authorization", "Bearer "+token)
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, req)
+        var response Response
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response
+    }
+    now := time.Now().UTC()
+    period := fmt.Sprintf("from=%s&to=%s", now.AddDate(0, 0, -1).Format(dateLayout), now.Format(dateLayout))
+    // totals sums the points of the volume report up by the currency.
+    totals := func(token, query string) map[string][2]float64 {
+        response := call(token, "GET", "/v1/analytics/volume?"+period+query, nil)
+        points, ok := response["points"].([]interface{})
+        if !ok {
+            t.Fatalf("%s: the points were expected: %v", query, response)
+        }
+        found := make(map[string][2]float64)
+        for _, item := range points {
+            point := item.(map[string]interface{})
+            total := found[point["currency"].(string)]
+            found[point["currency"].(string)] = [2]float64{total[0] + point["count"].(float64), total[1] + point["amount"].(float64)}
+        }
+        return found
+    }
+
+    // the fixture payments move 1000 from B to A and back, and A sends 300 more to B
+    body := map[string]interface{}{"from": "A", "to": "B", "amount": 300}
+    if response := call("alice", "POST", "/v1/transfers", body); response["payment"] == nil {
+        t.Fatalf("transfer failed: %v", response)
+    }
+    check := func() {
+        if found := totals("ops", "&bucket=hour"); found["USD"] != [2]float64{3, 2300} || len(found) != 1 {
+            t.Errorf("the volume of all accounts was expected: %v", found)
+        }
+        if found := totals("alice", "&bucket=month&account=A"); found["USD"] != [2]float64{3, 2300} {
+            t.Errorf("the volume of the account was expected: %v", found)
+        }
+        response := call("alice", "GET", "/v1/accounts/A/counterparties?"+period, nil)
+        counterparties, _ := response["counterparties"].([]interface{})
+        if len(counterparties) != 1 {
+            t.Fatalf("the only counterparty was expected: %v", response)
+        }
+        if top := counterparties[0].(map[string]interface{}); top["counterparty"] != "B" || top["sent_count"] != float64(2) ||
+            top["sent_amount"] != float64(1300) || top["received_amount"] != float64(1000) || top["amount"] != float64(2300) {
+            t.Errorf("the volume of B was expected: %v", top)
+        }
+    }
+    check()
+
+    // the reports should not change when the payments are rolled up
+    m, _ := api.manager()
+    if n, err := m.RollupPayments(now.Add(-rollupDelay), 100); err != nil || n == 0 {
+        t.Fatalf("the closed hours should be rolled up: %d, %v", n, err)
+    }
+    if n, _ := m.RollupPayments(now.Add(-rollupDelay), 100); n != 0 {
+        t.Errorf("the hours should be rolled up once: %d", n)
+    }
+    check()
+
+    response := call("ops", "GET", "/v1/analytics/volume?"+period+"&bucket=day&account=C", nil)
+    if points, _ := response["points"].([]interface{}); len(points) != 0 || response["from"] != now.AddDate(0, 0, -1).Format(dateLayout)+"T00:00:00Z" {
+        t.Errorf("no volume of C was expected: %v", response)
+    }
+    var testCases = []struct{
+        token, path, code string
+    }{
+        {"alice", "/v1/analytics/volume?" + period, codeForbidden},
+        {"alice", "/v1/analytics/volume?account=B&" + period, codeForbidden},
+        {"ops", "/v1/analytics/volume?account=X&" + period, codeAccountNotFound},
+        {"ops", "/v1/analytics/volume?bucket=year&" + period, codeValidationFailed},
+        {"ops", "/v1/analytics/volume?bucket=hour&from=2019-01-01&to=2019-12-31", codeValidationFailed},
+        {"ops", "/v1/accounts/A/counterparties?from=2019-03-01", codeValidationFailed},
+        {"alice", "/v1/accounts/B/counterparties?" + period, codeForbidden},
+    }
+    for _, test := range testCases {
+        if response := call(test.token, "GET", test.path, nil); response["code"] != test.code {
+            t.Errorf("%s: %s was expected: %v", test.path, test.code, response)
+        }
+    }
+}
+
+func TestV1_Balance(t *testing.T) {
+    api := NewBillingAPI(Config{})
+    balance := func(at time.Time) Response {
+        path := "/v1/accounts/A/balance"
+        if !at.IsZero() {
+            path += "?at=" + at.Format(time.RFC3339Nano)
+        }
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+        response := Response{}
+        _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+        return response
+    }
+    now := time.Now().UTC()
+
+    // A has the balance of 10000 after +1000 two hours ago and -1000 an hour ago
+    if response := balance(time.Time{}); response["balance"] != float64(10000) || response["currency"] != "USD" {
+        t.Errorf("the current balance was expected: %v", response)
+    }
+    if response := balance(now.Add(-90*time.Minute)); response["balance"] != float64(11000) {
+        t.Errorf("the balance before the outgoing payment was expected: %v", response)
+    }
+    if response := balance(now.Add(-3*time.Hour)); response["balance"] != float64(10000) {
+        t.Errorf("the balance before both payments was expected: %v", response)
+    }
+
+    m, _ := api.manager()
+    yesterday := dayStart(now.AddDate(0, 0, -1))
+    for _, day := range []time.Time{now, yesterday, yesterday} {
+        if _, err := m.SnapshotBalances(day, 100); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n, _ := m.SnapshotBalances(now, 100); n != 0 {
+        t.Errorf("the snapshots should be taken once a day: %d", n)
+    }
+    response := balance(now.Add(-90*time.Minute))
+    if response["balance"] != float64(11000) || response["snapshot"] != yesterday.Format(dateLayout) &&
+        response["snapshot"] != now.Format(dateLayout) {
+        t.Errorf("the balance should be computed from the snapshot: %v", response)
+    }
+    if response := balance(now); response["balance"] != float64(10000) || response["snapshot"] != now.Format(dateLayout) {
+        t.Errorf("the balance at now should match the live balance: %v", response)
+    }
+
+    if response := balance(now.Add(time.Hour)); response["code"] != codeValidationFailed {
+        t.Errorf("the future should be rejected: %v", response)
+    }
+}
+
+func TestPDFWriter_Offsets(t *testing.T) {
+    var buf bytes.Buffer
+    pdf := newPDFWriter(&buf)
+    for i := 0; i < pdfLinesPerPage*2 + 1; i++ {
+        pdf.println(fmt.Sprintf("line (%d)", i))
+    }
+    if err := pdf.close(); err != nil {
+        t.Fatal(err)
+    }
+    document := buf.String()
+    if !strings.Contains(document, "/Count 3") || !strings.Contains(document, `(line \(128\))`) {
+        t.Errorf("three pages with the escaped text were expected")
+    }
+    xref := strings.Index(document, "xref\n")
+    if !strings.HasSuffix(document, fmt.Sprintf("startxref\n%d\n%%%%EOF\n", xref)) {
+        t.Errorf("startxref should point to the cross-reference table")
+    }
+    entries := strings.Split(document[xref:], "\n")[3:3+len(pdf.offsets)]
+    for i, entry := range entries {
+        var offset int
+        _, _ = fmt.Sscanf(entry, "%d", &offset)
+        if !strings.HasPrefix(document[offset:], fmt.Sprintf("%d 0 obj", i+1)) {
+            t.Errorf("the offset of object %d is wrong: %s", i+1, entry)
+        }
+    }
+}
+
+// pain001File builds a pain.001 file with a single payment information block from
+// the debtor account; every transfer is given as "creditor amount currency".
+func pain001File(msgId, debtor string, transfers ...string) string {
+    var instructions strings.Builder
+    for i, transfer := range transfers {
+        var creditor, amount, currency string
+        _, _ = fmt.Sscan(transfer, &creditor, &amount, &currency)
+        fmt.Fprintf(&instructions, `
+      <CdtTrfTxInf>
+        <PmtId><EndToEndId>E2E-%d</EndToEndId></PmtId>
+        <Amt><InstdAmt Ccy="%s">%s</InstdAmt></Amt>
+        <CdtrAcct><Id><Othr><Id>%s</Id></Othr></Id></CdtrAcct>
+        <RmtInf><Ustrd>Invoice %d</Ustrd></RmtInf>
+      </CdtTrfTxInf>`, i+1, currency, amount, creditor, i+1)
+    }
+    return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.03">
+  <CstmrCdtTrfInitn>
+    <GrpHdr>
+      <MsgId>%s</MsgId>
+      <CreDtTm>2019-03-01T10:00:00</CreDtTm>
+      <NbOfTxs>%d</NbOfTxs>
+      <InitgPty><Nm>Payroll</Nm></InitgPty>
+    </GrpHdr>
+    <PmtInf>
+      <PmtInfId>%s-1</PmtInfId>
+      <PmtMtd>TRF</PmtMtd>
+      <ReqdExctnDt>2019-03-01</ReqdExctnDt>
+      <Dbtr><Nm>Debtor</Nm></Dbtr>
+      <DbtrAcct><Id><Othr><Id>%s</Id></Othr></Id></DbtrAcct>
+      <DbtrAgt><FinInstnId/></DbtrAgt>%s
+    </PmtInf>
+  </CstmrCdtTrfInitn>
+</Document>`, msgId, len(transfers), msgId, debtor, instructions.String())
+}
+
+var pain001Example = pain001File("example", "A", "B 1.00 USD")
+
+// pain002Statuses validates the status report and returns the status of the group
+// and the statuses, the reasons and the references of the transfers.
+func pain002Statuses(t *testing.T, report []byte) (group string, statuses, reasons, references []string) {
+    root, err := parseXML(bytes.NewReader(report))
+    if err != nil {
+        t.Fatalf("invalid report: %s", err)
+    }
+    if errs := pain002Schema.validate(root); len(errs) > 0 {
+        t.Errorf("the report should be valid against the schema: %v", errs)
+    }
+    var doc pain002Document
+    _ = xml.Unmarshal(report, &doc)
+    for _, payment := range doc.Payments {
+        for _, transfer := range payment.Transfers {
+            statuses = append(statuses, transfer.Status)
+            references = append(references, transfer.Reference)
+            for _, reason := range transfer.Reasons {
+                reasons = append(reasons, reason.Code)
+            }
+        }
+    }
+    return doc.Group.Status, statuses, reasons, references
+}
+
+func TestV1_Pain001(t *testing.T) {
+    api := NewBillingAPI(Config{})
+    upload := func(file string) *httptest.ResponseRecorder {
+        recorder := httptest.NewRecorder()
+        api.Handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/v1/transfers/pain001", strings.NewReader(file)))
+        return recorder
+    }
+
+    file := pain001File("payroll-7", "A", "B 2.50 USD", "C 1.00 USD", "Unknown 1.00 USD", "B 1000000.00 USD")
+    recorder := upload(file)
+    if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/xml" {
+        t.Fatalf("the pain.002 report was expected: %d %s", recorder.Code, recorder.Body)
+    }
+    group, statuses, reasons, references := pain002Statuses(t, recorder.Body.Bytes())
+    if group != isoPartial || fmt.Sprint(statuses) != "[ACSC RJCT RJCT RJCT]" {
+        t.Errorf("only the first transfer should be accepted: %s %v", group, statuses)
+    }
+    if fmt.Sprint(reasons) != "[AM03 AC01 AM04]" || references[0] != "101" {
+        t.Errorf("the rejections should have the ISO reasons: %v %v", reasons, references)
+    }
+    m, _ := api.manager()
+    payment, _ := m.GetPayment(101)
+    if payment == nil || payment.Amount != 250 || !strings.HasPrefix(payment.IdempotencyKey.String, "pain001:") {
+        t.Errorf("the transfer should be made with the derived idempotency key: %+v", payment)
+    }
+
+    recorder = upload(strings.Replace(file, "<NbOfTxs>4</NbOfTxs>", "<NbOfTxs>3</NbOfTxs>", 1))
+    if group, statuses, _, _ := pain002Statuses(t, recorder.Body.Bytes()); group != isoRejected || statuses != nil {
+        t.Errorf("the file with the wrong number of transactions should be rejected: %s", recorder.Body)
+    }
+    if payment, _ := m.GetPayment(102); payment != nil {
+        t.Errorf("no transfers should be made: %+v", payment)
+    }
+
+    response := Response{}
+    recorder = upload(strings.Replace(pain001Example, "<EndToEndId>E2E-1</EndToEndId>", "", 1))
+    _ = json.Unmarshal(recorder.Body.Bytes(), &response)
+    fields, _ := response["fields"].([]interface{})
+    if response["code"] != codeValidationFailed || len(fields) != 1 ||
+        fields[0].(map[string]interface{})["field"] != "/Document/CstmrCdtTrfInitn/PmtInf/CdtTrfTxInf/PmtId/EndToEndId" {
+        t.Errorf("the file should be validated against the schema: %s", recorder.Body)
+    }
+}
+
+func TestXSDSchema_Validate(t *testing.T) {
+    cases := map[string]string{
+        "USD 1.00":                               "",
+        "usd 1.00":                               "/Document/Amt/@Ccy: should match",
+        "USD 1.123456":                           "/Document/Amt: should have at most 5 fraction digits",
+        "USD -1":                                 "/Document/Amt: should be at least 0",
+        "USD 1.00</Amt><Sts>LOST</Sts><Amt>":     "/Document/Sts: should be one of BOOK, PDNG, INFO",
+        "USD 1.00</Amt><Unknown/><Amt>":          "/Document/Unknown: is not expected here",
+    }
+    schema, err := parseSchema([]byte(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" targetNamespace="urn:test">
+        <xs:element name="Document" type="Document"/>
+        <xs:complexType name="Document">
+            <xs:sequence>
+                <xs:element name="Amt" type="Amount" maxOccurs="2"/>
+                <xs:element name="Sts" type="Status" minOccurs="0"/>
+            </xs:sequence>
+        </xs:complexType>
+        <xs:complexType name="Amount">
+            <xs:simpleContent>
+                <xs:extension base="AmountValue">
+                    <xs:attribute name="Ccy" type="Currency" use="required"/>
+                </xs:extension>
+            </xs:simpleContent>
+        </xs:complexType>
+        <xs:simpleType name="AmountValue">
+            <xs:restriction base="xs:decimal">
+                <xs:minInclusive value="0"/>
+                <xs:fractionDigits value="5"/>
+            </xs:restriction>
+        </xs:simpleType>
+        <xs:simpleType name="Currency">
+            <xs:restriction base="xs:string"><xs:pattern value="[A-Z]{3}"/></xs:restriction>
+        </xs:simpleType>
+        <xs:simpleType name="Status">
+            <xs:restriction base="xs:string">
+                <xs:enumeration value="BOOK"/><xs:enumeration value="PDNG"/><xs:enumeration value="INFO"/>
+            </xs:restriction>
+        </xs:simpleType>
+    </xs:schema>`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for amount, expected := range cases {
+        var currency, value string
+        _, _ = fmt.Sscan(amount, &currency, &value)
+        document := fmt.Sprintf(`<Document xmlns="urn:test"><Amt Ccy="%s">%s</Amt></Document>`,
+            currency, strings.TrimPrefix(amount, currency + " "))
+        root, err := parseXML(strings.NewReader(document))
+        if err != nil {
+            t.Fatalf("%s: %s", document, err)
+        }
+        var problems []string
+        for _, e := range schema.validate(root) {
+            problems = append(problems, e.Field + ": " + e.Message)
+        }
+        if actual := strings.Join(problems, "; "); !strings.HasPrefix(actual, expected) || (expected == "") != (actual == "") {
+            t.Errorf("%s: %q was expected, got %q", document, expected, actual)
+        }
+    }
+    root, _ := parseXML(strings.NewReader(`<Document xmlns="urn:other"/>`))
+    if errs := schema.validate(root); len(errs) != 1 || !strings.Contains(errs[0].Message, "namespace") {
+        t.Errorf("the namespace should be checked: %v", errs)
+    }
+}
+
+func TestV1_Events(t *testing.T) {
+    heartbeatInterval = 50*time.Millisecond
+    makeRequest(t, func(client TestClient) {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+
+        events := client.Stream(ctx, "v1/accounts/A/events", map[string]string{"Last-Event-ID": "1"})
+        if event := events.Next(); event["id"] != "2" || event["event"] != eventPaymentReceived {
+            t.Errorf("the missed payment was expected: %v", event)
+        }
+
+        body := map[string]interface{}{"from": "A", "to": "B", "amount": 100}
+        response := client.Request("POST", "v1/transfers", body, nil)
+        payment := response["payment"].(map[string]interface{})
+
+        event := events.Next()
+        if event["event"] != eventPaymentSent || event["id"] != fmt.Sprint(payment["id"]) {
+            t.Errorf("payment.sent event was expected: %v", event)
+        }
+        if event := events.Next(); event["comment"] != "heartbeat" {
+            t.Errorf("heartbeat was expected: %v", event)
+        }
+    })
+}
+
+func TestBus_DropsSlowSubscribers(t *testing.T) {
+    bus := NewBus()
+    slow, other := bus.Subscribe("A"), bus.Subscribe("C")
+    defer other.Close()
+    for i := 0; i <= subscriptionBuffer; i++ {
+        bus.Publish(Payment{ID:i, From:"A", To:"B"})
+    }
+    received := 0
+    for range slow.C {
+        received++
+    }
+    if received != subscriptionBuffer {
+        t.Errorf("the subscriber should be dropped after %d payments: %d", subscriptionBuffer, received)
+    }
+    slow.Close() // it is safe to close a dropped subscription
+}
+
+
+// -----------
+// Test client
+// -----------
+
+
+func makeRequest(t *testing.T, testCase func(client TestClient)) {
+    api := NewBillingAPI(Config{Port:8080, ReceiptKey:receiptSeed(1)})
+    if err := api.InitReceiptKey(); err != nil {
+        t.Fatal(err)
+    }
+    group := sync.WaitGroup{}
+    group.Add(1)
+
+    listener, err := net.Listen("tcp", api.Config.Addr())
+    if err != nil { t.Fatalf("cannot listen: %s", err) }
+
+    go func() {
+        if err := api.Serve(listener); err != http.ErrServerClosed {
+            t.Errorf("server error: %s", err)
+        }
+        group.Done()
+    }()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go api.RunEventFeed(ctx)
+
+    testCase(TestClient{"http://localhost:8080", t})
+    _ = api.Shutdown(context.TODO())
+    group.Wait()
+}
+
+type TestClient struct {
+    Schema string
+    Test *testing.T
+}
+
+func (c *TestClient) JSONRequest(method, endpoint string, query map[string]string) Response {
+    return c.Request(method, endpoint, query, nil)
+}
+
+func (c *TestClient) Request(method, endpoint string, body interface{}, headers map[string]string) Response {
+    url := c.URL(endpoint)
+    encoded, _ := json.Marshal(body)
+    req, err := http.NewRequest(method, url, bytes.NewBuffer(encoded))
+    if err != nil { c.Test.Fatal(err) }
+
+    req.Header.Set("Content-Type", "application/json")
+    req.Close = true // don't reuse connections to servers from the previous tests
+    for key, value := range headers {
+        req.Header.Set(key, value)
+    }
+    client := http.Client{}
+    resp, err := client.Do(req)
+    if err != nil { c.Test.Fatal(err) }
+    defer resp.Body.Close()
+
+    var result Response
+    err = json.NewDecoder(resp.Body).Decode(&result)
+    if err != nil { c.Test.Error(err) }
+    return result
+}
+
+// EventStream reads Server-Sent Events from the response body.
+type EventStream struct {
+    scanner *bufio.Scanner
+    test *testing.T
+}
+
+// Stream opens an event stream; the stream is closed when the context is cancelled.
+func (c *TestClient) Stream(ctx context.Context, endpoint string, headers map[string]string) *EventStream {
+    req, err := http.NewRequestWithContext(ctx, "GET", c.URL(endpoint), nil)
+    if err != nil { c.Test.Fatal(err) }
+    req.Close = true
+    for key, value := range headers {
+        req.Header.Set(key, value)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { c.Test.Fatal(err) }
+    if resp.StatusCode != http.StatusOK {
+        c.Test.Fatalf("stream is not opened: %s", resp.Status)
+    }
+    return &EventStream{bufio.NewScanner(resp.Body), c.Test}
+}
+
+// Next returns the fields of the next event, or the text of a comment with the
+// "comment" key.
+func (s *EventStream) Next() map[string]string {
+    event := make(map[string]string)
+    for s.scanner.Scan() {
+        line := s.scanner.Text()
+        if line == "" {
+            if len(event) > 0 && event["retry"] == "" {
+                return event
+            }
+            event = make(map[string]string)
+            continue
+        }
+        if strings.HasPrefix(line, ":") {
+            event["comment"] = strings.TrimSpace(line[1:])
+            continue
+        }
+        parts := strings.SplitN(line, ": ", 2)
+        event[parts[0]] = parts[1]
+    }
+    s.test.Errorf("stream is closed: %v", s.scanner.Err())
+    return event
+}
+
+// Get makes a plain GET request; the caller should close the response body.
+func (c *TestClient) Get(endpoint string) (*http.Response, error) {
+    req, err := http.NewRequest("GET", c.URL(endpoint), nil)
+    if err != nil { return nil, err }
+    req.Close = true
+    return http.DefaultClient.Do(req)
+}
+
+func (c *TestClient) URL(endpoint string) string {
+    return fmt.Sprintf("%s/%s", c.Schema, endpoint)
+}
+
+
+// ---------------------
+// Manager class mockery
+// ---------------------
+
+
+var items = map[string]Account{
+    "A": {ID:1, Identifier:"A", Currency:"USD", Amount:Cents(10000), Created:time.Now()},
+    "B": {ID:2, Identifier:"B", Currency:"USD", Amount:Cents(1000), Created:time.Now()},
+    "C": {ID:3, Identifier:"C", Currency:"EUR", Amount:Cents(5000), Created:time.Now()}}
+
+var payments = []Payment{
+    {ID:1, From:"A", To:"B", Time:time.Now().Add(-1*time.Hour), Amount:1000, Currency:"USD", Kind:paymentTransfer, Status:statusCompleted},
+    {ID:2, From:"B", To:"A", Time:time.Now().Add(-2*time.Hour), Amount:1000, Currency:"USD", Kind:paymentTransfer, Status:statusCompleted}}
+
+
+// A MockManager type replaces real database management with mock implementation.
+// The MockManager starts with the predefined Accounts and payments. The balances of the
+// accounts are never changed, while the created payments and holds are kept in memory,
+// so the flows built on top of the payments can be tested.
+type MockManager struct {
+    Accounts map[string]Account
+    *MockWebhooks
+    state *mockState
+    // actor and requestId are recorded in the audit entries of the changes.
+    actor string
+    requestId string
+}
+
+type mockState struct {
+    mu sync.Mutex
+    // lastPaymentID is used to assign IDs to the created payments.
+    lastPaymentID int64
+    payments []Payment
+    holds []Hold
+    history map[int][]StatusChange
+    schedules []Schedule
+    runs []ScheduleRun
+    leased bool
+    feeSchedules []FeeSchedule
+    tiers map[string]string
+    limits []LimitRule
+    // overdrafts keeps the overdraft limits and the interest rates of the accounts.
+    overdrafts map[string]Account
+    accrued map[string]bool
+    approvals []Approval
+    approvalEvents map[int][]ApprovalEvent
+    audit []AuditEntry
+    // signingKeys are the receipt keys, newest first.
+    signingKeys []SigningKey
+    // snapshots are the balance snapshots; the At time is the day of the snapshot.
+    snapshots []HistoricalBalance
+    ledger []LedgerEntry
+    // rollups are the rollups of the hours before the rolledUp time.
+    rollups []mockRollup
+    rolledUp time.Time
+}
+
+// mockRollup is a row of the payment_rollup table.
+type mockRollup struct {
+    Hour time.Time
+    Account, Counterparty, Currency string
+    SentCount, ReceivedCount int64
+    SentAmount, ReceivedAmount Cents
+}
+
+// newMockState returns the fixture payments, two active holds of 100 cents from A to B,
+// two pending approvals of 5000 cents from A to B initiated by alice, and the opening
+// balance of B. The IDs of the created payments start from 101.
+func newMockState() *mockState {
+    now := time.Now().UTC()
+    hold := Hold{From:"A", To:"B", Amount:100, Currency:"USD", Status:holdActive, Created:now, Expires:now.Add(time.Hour)}
+    first, second := hold, hold
+    first.ID, second.ID = 1, 2
+    approval := Approval{
+        Kind:approvalTransfer, From:"A", To:"B", Amount:5000, Currency:"USD", Status:approvalPending, Initiator:"alice",
+        Created:now, Expires:now.Add(time.Hour)}
+    firstApproval, secondApproval := approval, approval
+    firstApproval.ID, secondApproval.ID = 1, 2
+    state := &mockState{
+        lastPaymentID:100,
+        holds:[]Hold{first, second},
+        approvals:[]Approval{firstApproval, secondApproval},
+        approvalEvents:map[int][]ApprovalEvent{
+            1: {{ApprovalID:1, Action:approvalRequested, Principal:"alice", Created:now}},
+            2: {{ApprovalID:2, Action:approvalRequested, Principal:"alice", Created:now}}},
+        history:make(map[int][]StatusChange),
+        tiers:make(map[string]string),
+        overdrafts:make(map[string]Account),
+        accrued:make(map[string]bool),
+        ledger:[]LedgerEntry{{ID:1, Account:"B", Kind:entryOpening, Amount:1000, Created:now}}}
+    for _, p := range payments {
+        state.add(p)
+    }
+    return state
+}
+
+// add stores the payment and starts its status history; the caller should hold the lock.
+func (s *mockState) add(payment Payment) {
+    s.payments = append(s.payments, payment)
+    s.history[payment.ID] = []StatusChange{{PaymentID:payment.ID, Status:payment.Status, Changed:payment.Time}}
+}
+
+func NewMockManager(_ string) (Manager, error) {
+    var manager Manager = MockManager{Accounts:items, MockWebhooks:newMockWebhooksWithFixtures(), state:newMockState()}
+    return manager, nil
+}
+
+func (m MockManager) Close() error { return nil }
+
+func (m MockManager) GetAvailableAccounts() ([]Account, error) {
+    accounts := make([]Account, 0)
+    for id := range m.Accounts {
+        accounts = append(accounts, m.account(id))
+    }
+    return accounts, nil
+}
+
+func (m MockManager) GetAccounts(identifiers []string) ([]Account, error) {
+    filtered := make([]Account, 0)
+    for _, id := range identifiers {
+        filtered = append(filtered, m.account(id))
+    }
+    return filtered, nil
+}
+
+func (m MockManager) GetAccount(identifier string) (*Account, error) {
+    if _, ok := m.Accounts[identifier]; !ok {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    acc := m.account(identifier)
+    return &acc, nil
+}
+
+// account returns the account with the sum of its active holds and unsettled payments.
+func (m MockManager) account(identifier string) Account {
+    acc := m.Accounts[identifier]
+    now := time.Now().UTC()
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    acc.Tier = defaultTier
+    if tier, ok := m.state.tiers[identifier]; ok {
+        acc.Tier = tier
+    }
+    if overdraft, ok := m.state.overdrafts[identifier]; ok {
+        acc.Overdraft, acc.InterestBps = overdraft.Overdraft, overdraft.InterestBps
+    }
+    for _, hold := range m.state.holds {
+        if hold.From == identifier && hold.effective(now).Status == holdActive {
+            acc.Held += hold.Amount
+        }
+    }
+    for _, p := range m.state.payments {
+        if p.From == identifier && (p.Status == statusPending || p.Status == statusProcessing) {
+            acc.Held += p.Amount
+        }
+    }
+    return acc
+}
+
+func (m MockManager) Transfer(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error) {
+    return m.transfer(fromId, toId, amount, idempotencyKey, statusCompleted, details)
+}
+
+func (m MockManager) TransferPending(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error) {
+    return m.transfer(fromId, toId, amount, idempotencyKey, statusPending, details)
+}
+
+func (m MockManager) transfer(fromId, toId string, amount Cents, idempotencyKey, status string, details PaymentDetails) (*Payment, error) {
+    first, ok := m.Accounts[fromId]
+    if !ok {
+        return nil, inputError(codeAccountNotFound, "fromId is missing")
+    }
+    first = m.account(fromId)
+
+    second, ok := m.Accounts[toId]
+    if !ok {
+        return nil, inputError(codeAccountNotFound, "toId is missing")
+    }
+
+    if first.Currency != second.Currency {
+        return nil, inputError(codeCurrencyMismatch, "invalid configuration")
+    }
+
+    if first.Available() < amount {
+        return nil, inputError(codeInsufficientFunds, "invalid configuration")
+    }
+    if err := m.checkLimits(first, amount, nil); err != nil {
+        return nil, err
+    }
+    if err := m.checkReference(fromId, details, nil); err != nil {
+        return nil, err
+    }
+    var fees []Fee
+    if status == statusCompleted {
+        schedules, _ := m.ListFeeSchedules()
+        fees = transferFees(schedules, first, m.account(toId), amount)
+    }
+    for _, fee := range fees {
+        available := m.account(fee.Payer).Available()
+        if fee.Payer == fromId {
+            available -= amount
+        } else {
+            available += amount
+        }
+        if available < fee.Amount {
+            return nil, inputError(codeInsufficientFunds, "invalid configuration")
+        }
+    }
+
+    payment := Payment{
+        ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+        From:first.Identifier,
+        To:second.Identifier,
+        Time:time.Now().UTC(),
+        Amount:amount,
+        Currency:first.Currency,
+        Kind:paymentTransfer,
+        Status:status,
+        IdempotencyKey:nullString(idempotencyKey),
+        PaymentDetails:details}
+
+    m.record(payment)
+    m.chargeFees(&payment, fees)
+    m.audit("payment.created", paymentResource(payment.ID), nil, &payment)
+    return &payment, nil
+}
+
+// checkReference rejects the unique reference used by the sender's payments or by the
+// preceding transfers of the batch.
+func (m MockManager) checkReference(fromId string, details PaymentDetails, preceding []BatchTransfer) error {
+    if !details.UniqueReference || details.Reference == "" {
+        return nil
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    used := false
+    for _, p := range m.state.payments {
+        used = used || p.From == fromId && p.Reference == details.Reference
+    }
+    for _, t := range preceding {
+        used = used || t.From == fromId && t.Details.Reference == details.Reference
+    }
+    if used {
+        return inputError(codeDuplicateReference, "invalid configuration")
+    }
+    return nil
+}
+
+// chargeFees records the payments charging the fees of the payment.
+func (m MockManager) chargeFees(payment *Payment, fees []Fee) {
+    for _, fee := range fees {
+        charged := Payment{
+            ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+            From:fee.Payer,
+            To:fee.Revenue,
+            Time:payment.Time,
+            Amount:fee.Amount,
+            Currency:payment.Currency,
+            Kind:paymentFee,
+            Status:statusCompleted,
+            ParentID:&payment.ID}
+        m.record(charged)
+        payment.Fees = append(payment.Fees, charged)
+    }
+}
+
+// TransferBatch checks the whole atomic batch against the balances changed by its
+// transfers before making any of them.
+func (m MockManager) TransferBatch(transfers []BatchTransfer, allOrNothing bool) ([]BatchResult, error) {
+    if !allOrNothing {
+        return transferEach(m.Transfer, transfers), nil
+    }
+    changes := make(map[string]Cents)
+    running := make(map[string]*Usage)
+    for i, t := range transfers {
+        from, okFrom := m.Accounts[t.From]
+        to, okTo := m.Accounts[t.To]
+        var err error
+        switch {
+        case !okFrom || !okTo || t.From == t.To:
+            err = inputError(codeAccountNotFound, "cannot find the accounts")
+        case from.Currency != to.Currency:
+            err = inputError(codeCurrencyMismatch, "invalid configuration")
+        case m.account(t.From).Available() + changes[t.From] < t.Amount:
+            err = inputError(codeInsufficientFunds, "invalid configuration")
+        default:
+            err = m.checkLimits(from, t.Amount, running)
+        }
+        if err == nil {
+            err = m.checkReference(t.From, t.Details, transfers[:i])
+        }
+        if err != nil {
+            return nil, batchError(i, err)
+        }
+        changes[t.From] -= t.Amount
+        changes[t.To] += t.Amount
+    }
+    schedules, _ := m.ListFeeSchedules()
+    results := make([]BatchResult, len(transfers))
+    for i, t := range transfers {
+        payment := Payment{
+            ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+            From:t.From,
+            To:t.To,
+            Time:time.Now().UTC(),
+            Amount:t.Amount,
+            Currency:m.Accounts[t.From].Currency,
+            Kind:paymentTransfer,
+            Status:statusCompleted,
+            IdempotencyKey:nullString(t.IdempotencyKey),
+            PaymentDetails:t.Details}
+        m.record(payment)
+        m.chargeFees(&payment, transferFees(schedules, m.account(t.From), m.account(t.To), t.Amount))
+        m.audit("payment.created", paymentResource(payment.ID), nil, &payment)
+        results[i] = BatchResult{Payment:&payment}
+    }
+    return results, nil
+}
+
+func (m MockManager) Split(fromId string, legs []SplitLeg, _ string) (*Payment, []Payment, error) {
+    from, ok := m.Accounts[fromId]
+    if !ok {
+        return nil, nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    var total Cents
+    for _, leg := range legs {
+        to, ok := m.Accounts[leg.To]
+        if !ok || leg.To == fromId {
+            return nil, nil, inputError(codeAccountNotFound, "cannot find the accounts")
+        }
+        if to.Currency != from.Currency {
+            return nil, nil, inputError(codeCurrencyMismatch, "invalid configuration")
+        }
+        total += leg.Amount
+    }
+    if m.account(fromId).Available() < total {
+        return nil, nil, inputError(codeInsufficientFunds, "invalid configuration")
+    }
+    if err := m.checkLimits(from, total, nil); err != nil {
+        return nil, nil, err
+    }
+    now := time.Now().UTC()
+    parent := Payment{
+        ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+        From:fromId,
+        To:fromId,
+        Time:now,
+        Amount:total,
+        Currency:from.Currency,
+        Kind:paymentSplit,
+        Status:statusCompleted}
+    m.record(parent)
+    payments := make([]Payment, len(legs))
+    for i, leg := range legs {
+        payments[i] = Payment{
+            ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+            From:fromId,
+            To:leg.To,
+            Time:now,
+            Amount:leg.Amount,
+            Currency:from.Currency,
+            Kind:paymentSplitLeg,
+            Status:statusCompleted,
+            ParentID:&parent.ID}
+        m.record(payments[i])
+    }
+    after := struct {
+        Payment *Payment `json:"payment"`
+        Legs []Payment   `json:"legs"`
+    }{&parent, payments}
+    m.audit("split.created", paymentResource(parent.ID), nil, &after)
+    return &parent, payments, nil
+}
+
+func (m MockManager) GetChildren(parentId int) ([]Payment, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    children := make([]Payment, 0)
+    for _, p := range m.state.payments {
+        if p.ParentID != nil && *p.ParentID == parentId {
+            children = append(children, p)
+        }
+    }
+    return children, nil
+}
+
+func (m MockManager) SetLimits(currency, accountId string, limits Limits) (*LimitRule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    rule := LimitRule{Currency:currency, AccountID:nullString(accountId), Limits:limits, Updated:time.Now().UTC()}
+    resource := "limits/" + currency
+    if accountId != "" {
+        resource += "/" + accountId
+    }
+    for i, r := range m.state.limits {
+        if r.Currency == currency && r.AccountID == rule.AccountID {
+            rule.ID = r.ID
+            m.state.limits[i] = rule
+            m.auditLocked("limits.changed", resource, &r, &rule)
+            return &rule, nil
+        }
+    }
+    rule.ID = len(m.state.limits) + 1
+    m.state.limits = append(m.state.limits, rule)
+    m.auditLocked("limits.changed", resource, nil, &rule)
+    return &rule, nil
+}
+
+func (m MockManager) GetLimitRule(currency, accountId string) (*LimitRule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    for _, rule := range m.state.limits {
+        if rule.Currency == currency && rule.AccountID == nullString(accountId) {
+            return &rule, nil
+        }
+    }
+    return nil, nil
+}
+
+func (m MockManager) GetLimits(accountId string, now time.Time) (*Limits, *Usage, error) {
+    acc, err := m.GetAccount(accountId)
+    if err != nil {
+        return nil, nil, err
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var limits Limits
+    for _, scope := range []string{"", accountId} {
+        for _, r := range m.state.limits {
+            if r.Currency == acc.Currency && r.AccountID.String == scope {
+                limits = limits.merge(r.Limits)
+            }
+        }
+    }
+    var usage Usage
+    for _, p := range m.state.payments {
+        if p.From != accountId || (p.Kind != paymentTransfer && p.Kind != paymentSplit) ||
+            p.Status == statusFailed || p.Status == statusCancelled {
+            continue
+        }
+        if !p.Time.Before(monthStart(now)) {
+            usage.Monthly += p.Amount
+        }
+        if !p.Time.Before(dayStart(now)) {
+            usage.Daily += p.Amount
+        }
+        if p.Time.After(now.Add(-time.Hour)) {
+            usage.add(0, p.Time)
+        }
+    }
+    return &limits, &usage, nil
+}
+
+// checkLimits verifies the limits of the sender. The running usage of the senders
+// of an atomic batch includes the preceding transfers of the batch.
+func (m MockManager) checkLimits(from Account, amount Cents, running map[string]*Usage) error {
+    now := time.Now().UTC()
+    limits, usage, err := m.GetLimits(from.Identifier, now)
+    if err != nil {
+        return err
+    }
+    if running != nil {
+        if running[from.Identifier] == nil {
+            running[from.Identifier] = usage
+        }
+        usage = running[from.Identifier]
+    }
+    if err := limits.check(*usage, amount, now); err != nil {
+        return err
+    }
+    usage.add(amount, now)
+    return nil
+}
+
+func (m MockManager) CreateFeeSchedule(schedule FeeSchedule) (*FeeSchedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    for _, s := range m.state.feeSchedules {
+        if s.Active && s.Currency == schedule.Currency && s.Tier == schedule.Tier && s.Payer == schedule.Payer {
+            return nil, inputError(codeInvalidState, "there is an active fee schedule for the currency, tier and payer")
+        }
+    }
+    schedule.ID = len(m.state.feeSchedules) + 1
+    m.state.feeSchedules = append(m.state.feeSchedules, schedule)
+    m.auditLocked("fee_schedule.created", feeScheduleResource(schedule.ID), nil, &schedule)
+    return &schedule, nil
+}
+
+func (m MockManager) ListFeeSchedules() ([]FeeSchedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    schedules := make([]FeeSchedule, 0)
+    for _, s := range m.state.feeSchedules {
+        if s.Active {
+            schedules = append(schedules, s)
+        }
+    }
+    return schedules, nil
+}
+
+func (m MockManager) DeleteFeeSchedule(id int) (*FeeSchedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id < 1 || id > len(m.state.feeSchedules) || !m.state.feeSchedules[id-1].Active {
+        return nil, feeScheduleNotFound()
+    }
+    before := m.state.feeSchedules[id-1]
+    m.state.feeSchedules[id-1].Active = false
+    schedule := m.state.feeSchedules[id-1]
+    m.auditLocked("fee_schedule.deleted", feeScheduleResource(id), &before, &schedule)
+    return &schedule, nil
+}
+
+func (m MockManager) SetAccountTier(identifier, tier string) (*Account, error) {
+    if _, ok := m.Accounts[identifier]; !ok {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    before := m.account(identifier)
+    m.state.mu.Lock()
+    m.state.tiers[identifier] = tier
+    m.state.mu.Unlock()
+    after := m.account(identifier)
+    m.audit("account.tier_changed", "account/" + identifier, &before, &after)
+    return &after, nil
+}
+
+func (m MockManager) SetOverdraft(identifier string, limit Cents, interestBps int64) (*Account, error) {
+    if _, ok := m.Accounts[identifier]; !ok {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    before := m.account(identifier)
+    m.state.mu.Lock()
+    m.state.overdrafts[identifier] = Account{Overdraft:limit, InterestBps:interestBps}
+    m.state.mu.Unlock()
+    after := m.account(identifier)
+    m.audit("account.overdraft_changed", "account/" + identifier, &before, &after)
+    return &after, nil
+}
+
+// AccrueInterest charges the interest on the static balances of the accounts, once
+// for every account and day.
+func (m MockManager) AccrueInterest(day time.Time, interestId string, limit int) ([]Payment, error) {
+    revenue, ok := m.Accounts[interestId]
+    if !ok {
+        return nil, inputError(codeAccountNotFound, "cannot find the interest account")
+    }
+    day = dayStart(day)
+    identifiers := make([]string, 0, len(m.Accounts))
+    for id := range m.Accounts {
+        identifiers = append(identifiers, id)
+    }
+    sort.Strings(identifiers)
+    var charged []Payment
+    for _, id := range identifiers {
+        acc := m.account(id)
+        key := id + day.Format("2006-01-02")
+        m.state.mu.Lock()
+        due := !m.state.accrued[key] && id != interestId && acc.Amount < 0 && acc.InterestBps > 0
+        if due {
+            m.state.accrued[key] = true
+        }
+        m.state.mu.Unlock()
+        if !due {
+            continue
+        }
+        interest := dailyInterest(acc.Amount, acc.InterestBps)
+        if interest == 0 || acc.Currency != revenue.Currency {
+            continue
+        }
+        payment := Payment{
+            ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+            From:id,
+            To:interestId,
+            Time:time.Now().UTC(),
+            Amount:interest,
+            Currency:acc.Currency,
+            Kind:paymentInterest,
+            Status:statusCompleted}
+        m.record(payment)
+        m.audit("interest.charged", paymentResource(payment.ID), nil, &payment)
+        if charged = append(charged, payment); len(charged) == limit {
+            break
+        }
+    }
+    return charged, nil
+}
+
+func (m MockManager) RequestApproval(approval Approval) (*Approval, error) {
+    from, okFrom := m.Accounts[approval.From]
+    to, okTo := m.Accounts[approval.To]
+    if !okFrom || !okTo {
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if from.Currency != to.Currency {
+        return nil, inputError(codeCurrencyMismatch, "invalid configuration")
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    for _, existing := range m.state.approvals {
+        if approval.IdempotencyKey.Valid && existing.From == approval.From && existing.IdempotencyKey == approval.IdempotencyKey {
+            return checkApprovalReplay(&existing, approval, nil)
+        }
+    }
+    if approval.Kind == "" {
+        approval.Kind = approvalTransfer
+    }
+    approval.ID = len(m.state.approvals) + 1
+    approval.Currency, approval.Status = from.Currency, approvalPending
+    m.state.approvals = append(m.state.approvals, approval)
+    m.state.approvalEvents[approval.ID] = []ApprovalEvent{
+        {ApprovalID:approval.ID, Action:approvalRequested, Principal:approval.Initiator, Created:approval.Created}}
+    m.auditLocked("approval.requested", approvalResource(approval.ID), nil, &approval)
+    return &approval, nil
+}
+
+func (m MockManager) GetApproval(id int) (*Approval, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.approvals) {
+        return nil, approvalNotFound()
+    }
+    approval := m.state.approvals[id-1].effective(time.Now().UTC())
+    return &approval, nil
+}
+
+func (m MockManager) ListApprovals(status string, accounts []string, limit int) ([]Approval, error) {
+    now := time.Now().UTC()
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var approvals []Approval
+    for _, approval := range m.state.approvals {
+        approval = approval.effective(now)
+        if approval.Status == status && (accounts == nil || contains(accounts, approval.From)) && len(approvals) < limit {
+            approvals = append(approvals, approval)
+        }
+    }
+    return approvals, nil
+}
+
+func (m MockManager) DecideApproval(id int, status, principal, reason string) (*Approval, error) {
+    now := time.Now().UTC()
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.approvals) {
+        return nil, approvalNotFound()
+    }
+    approval := &m.state.approvals[id-1]
+    if err := checkDecision(*approval, status, principal, now); err != nil {
+        return nil, err
+    }
+    if approval.Status != status {
+        before := *approval
+        approval.Status, approval.DecidedBy, approval.Reason, approval.Decided = status, principal, reason, &now
+        m.state.approvalEvents[id] = append(m.state.approvalEvents[id],
+            ApprovalEvent{ApprovalID:id, Action:status, Principal:principal, Reason:reason, Created:now})
+        m.auditLocked("approval." + status, approvalResource(id), &before, approval)
+    }
+    result := *approval
+    return &result, nil
+}
+
+func (m MockManager) CompleteApproval(id int, paymentId *int, errorCode, errorMessage string) (*Approval, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    approval := &m.state.approvals[id-1]
+    if approval.Status == approvalApproved {
+        before := *approval
+        approval.Status, approval.PaymentID = approvalExecuted, paymentId
+        if errorCode != "" {
+            approval.Status, approval.ErrorCode, approval.Error = approvalFailed, errorCode, errorMessage
+        }
+        m.state.approvalEvents[id] = append(m.state.approvalEvents[id],
+            ApprovalEvent{ApprovalID:id, Action:approval.Status, Reason:errorMessage, Created:time.Now().UTC()})
+        m.auditLocked("approval." + approval.Status, approvalResource(id), &before, approval)
+    }
+    result := *approval
+    return &result, nil
+}
+
+func (m MockManager) ExpireApprovals(now time.Time) (int, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    expired := 0
+    for i, approval := range m.state.approvals {
+        if approval.effective(now).Status != approval.Status {
+            m.state.approvals[i].Status = approvalExpired
+            m.state.approvalEvents[approval.ID] = append(m.state.approvalEvents[approval.ID],
+                ApprovalEvent{ApprovalID:approval.ID, Action:approvalExpired, Created:approval.Expires})
+            expired++
+        }
+    }
+    return expired, nil
+}
 
-// -----------
-// Test client
-// -----------
+func (m MockManager) GetApprovalHistory(id int) ([]ApprovalEvent, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    return append([]ApprovalEvent(nil), m.state.approvalEvents[id]...), nil
+}
 
+func (m MockManager) Reconcile(accounts []string) ([]Reconciliation, error) {
+    var ids []string
+    for id := range m.Accounts {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var reconciled []Reconciliation
+    for _, id := range ids {
+        listed := accounts == nil
+        for _, account := range accounts {
+            listed = listed || account == id
+        }
+        if !listed {
+            continue
+        }
+        r := Reconciliation{
+            Account:id,
+            Currency:m.Accounts[id].Currency,
+            Balance:m.Accounts[id].Amount,
+            Payments:m.state.booked(id, time.Time{}, endOfTime)}
+        for _, entry := range m.state.ledger {
+            switch {
+            case entry.Account != id:
+            case entry.Kind == entryOpening:
+                r.Opening += entry.Amount
+            default:
+                r.Adjustments += entry.Amount
+            }
+        }
+        reconciled = append(reconciled, r.reconciled())
+    }
+    return reconciled, nil
+}
 
-func makeRequest(t *testing.T, testCase func(client TestClient)) {
-    api := NewBillingAPI(Config{"",8080,""})
-    group := sync.WaitGroup{}
-    group.Add(1)
+func (m MockManager) RecordAdjustment(approval Approval) (*LedgerEntry, error) {
+    m.state.mu.Lock()
+    for _, entry := range m.state.ledger {
+        if entry.ApprovalID != nil && *entry.ApprovalID == approval.ID {
+            m.state.mu.Unlock()
+            return &entry, nil
+        }
+    }
+    m.state.mu.Unlock()
+    reconciled, _ := m.Reconcile([]string{approval.From})
+    if len(reconciled) == 0 {
+        return nil, inputError(codeAccountNotFound, "account is not found")
+    }
+    if err := checkAdjustment(reconciled[0], approval.Amount); err != nil {
+        return nil, err
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    entry := LedgerEntry{
+        ID:len(m.state.ledger) + 1,
+        Account:approval.From,
+        Kind:entryAdjustment,
+        Amount:approval.Amount,
+        ApprovalID:&approval.ID,
+        Created:time.Now().UTC()}
+    m.state.ledger = append(m.state.ledger, entry)
+    m.auditLocked("ledger.adjusted", "account/" + approval.From, nil, &entry)
+    return &entry, nil
+}
 
-    go func() {
-        if err := api.ListenAndServe(); err != http.ErrServerClosed {
-            t.Errorf("server error: %s", err)
+func (m MockManager) AppendAudit(entry AuditEntry) (*AuditEntry, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    return m.state.appendAudit(entry), nil
+}
+
+// appendAudit links the entry to the end of the chain; the caller holds the lock.
+func (s *mockState) appendAudit(entry AuditEntry) *AuditEntry {
+    var prev *AuditEntry
+    if len(s.audit) > 0 {
+        prev = &s.audit[len(s.audit)-1]
+    }
+    entry = entry.link(prev)
+    s.audit = append(s.audit, entry)
+    return &entry
+}
+
+func (m MockManager) Audited(actor, requestId string) Manager {
+    m.actor, m.requestId = actor, requestId
+    return m
+}
+
+// audit records the change on behalf of the actor.
+func (m MockManager) audit(action, resource string, before, after interface{}) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    m.auditLocked(action, resource, before, after)
+}
+
+// auditLocked records the change made while holding the lock, the same way as the
+// entry is appended within the transaction of the change.
+func (m MockManager) auditLocked(action, resource string, before, after interface{}) {
+    m.state.appendAudit(newAuditEntry(m.actor, m.requestId, action, resource, before, after))
+}
+
+func (m MockManager) ListAudit(page PageRequest) ([]AuditEntry, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var entries []AuditEntry
+    for i := len(m.state.audit) - 1; i >= 0 && len(entries) < page.Limit; i-- {
+        if page.Before == 0 || m.state.audit[i].Seq < page.Before {
+            entries = append(entries, m.state.audit[i])
         }
-        group.Done()
-    }()
+    }
+    return entries, nil
+}
 
-    testCase(TestClient{"http://localhost:8080", t})
-    _ = api.Shutdown(context.TODO())
-    group.Wait()
+func (m MockManager) VerifyAudit() (*AuditReport, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    chain := newAuditChain()
+    for _, entry := range m.state.audit {
+        if !chain.next(entry) {
+            break
+        }
+    }
+    return &chain.report, nil
 }
 
-type TestClient struct {
-    Schema string
-    Test *testing.T
+func (m MockManager) Statement(
+    accountId string,
+    from, to time.Time,
+    open func(Account, StatementBalance) error,
+    entry func(StatementEntry) error,
+) error {
+    account, err := m.GetAccount(accountId)
+    if err != nil {
+        return err
+    }
+    m.state.mu.Lock()
+    var booked []StatementEntry
+    balance := StatementBalance{Opening:account.Amount}
+    for _, p := range m.state.payments {
+        if p.Kind == paymentSplit || p.From != accountId && p.To != accountId {
+            continue
+        }
+        for _, change := range m.state.history[p.ID] {
+            if change.Status != statusCompleted || change.Changed.Before(from) {
+                continue
+            }
+            if p.To == accountId {
+                balance.Opening -= p.Amount
+            } else {
+                balance.Opening += p.Amount
+            }
+            if !change.Changed.Before(to) {
+                continue
+            }
+            booked = append(booked, StatementEntry{p, change.Changed})
+            if p.To == accountId {
+                balance.Credits += p.Amount
+                balance.CreditCount++
+            } else {
+                balance.Debits += p.Amount
+                balance.DebitCount++
+            }
+        }
+    }
+    m.state.mu.Unlock()
+    sort.SliceStable(booked, func(i, j int) bool { return booked[i].Booked.Before(booked[j].Booked) })
+    if err := open(*account, balance); err != nil {
+        return err
+    }
+    for _, e := range booked {
+        if err := entry(e); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
-func (c *TestClient) JSONRequest(method, endpoint string, query map[string]string) Response {
-    url := c.URL(endpoint)
-    encoded, _ := json.Marshal(query)
-    req, err := http.NewRequest(method, url, bytes.NewBuffer(encoded))
-    if err != nil { c.Test.Error(err) }
+// endOfTime bounds the periods which are not bounded.
+var endOfTime = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
 
-    req.Header.Set("Content-Type", "application/json")
-    client := http.Client{}
-    resp, err := client.Do(req)
-    if err != nil { c.Test.Error(err) }
-    defer resp.Body.Close()
+// booked returns the net amount of the payments of the account booked from the from
+// time up to the to time, exclusive; the caller should hold the lock.
+func (s *mockState) booked(accountId string, from, to time.Time) Cents {
+    var net Cents
+    for _, p := range s.payments {
+        if p.Kind == paymentSplit || p.From != accountId && p.To != accountId {
+            continue
+        }
+        for _, change := range s.history[p.ID] {
+            if change.Status != statusCompleted || change.Changed.Before(from) || !change.Changed.Before(to) {
+                continue
+            }
+            if p.To == accountId {
+                net += p.Amount
+            } else {
+                net -= p.Amount
+            }
+        }
+    }
+    return net
+}
 
-    var result Response
-    err = json.NewDecoder(resp.Body).Decode(&result)
-    if err != nil { c.Test.Error(err) }
-    return result
+func (m MockManager) BalanceAt(accountId string, at time.Time) (*HistoricalBalance, error) {
+    account, err := m.GetAccount(accountId)
+    if err != nil {
+        return nil, err
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    balance := &HistoricalBalance{
+        Account:accountId,
+        Currency:account.Currency,
+        At:at,
+        Amount:account.Amount - m.state.booked(accountId, at, endOfTime)}
+    for _, snapshot := range m.state.snapshots {
+        if snapshot.Account != accountId || snapshot.At.After(at) ||
+            balance.Snapshot != nil && balance.Snapshot.After(snapshot.At) {
+            continue
+        }
+        day := snapshot.At
+        balance.Amount, balance.Snapshot = snapshot.Amount + m.state.booked(accountId, day, at), &day
+    }
+    return balance, nil
 }
 
-func (c *TestClient) URL(endpoint string) string {
-    return fmt.Sprintf("%s/%s", c.Schema, endpoint)
+func (m MockManager) SnapshotBalances(day time.Time, limit int) (int, error) {
+    day = dayStart(day)
+    var ids []string
+    for id := range m.Accounts {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    recorded := 0
+    for _, id := range ids {
+        taken := false
+        for _, snapshot := range m.state.snapshots {
+            taken = taken || snapshot.Account == id && snapshot.At.Equal(day)
+        }
+        if taken || recorded == limit {
+            continue
+        }
+        account := m.Accounts[id]
+        m.state.snapshots = append(m.state.snapshots, HistoricalBalance{
+            Account:id,
+            Currency:account.Currency,
+            At:day,
+            Amount:account.Amount - m.state.booked(id, day, endOfTime)})
+        recorded++
+    }
+    return recorded, nil
 }
 
+// movements sums the payments booked within [from, to) up by the hour, the account and
+// the counterparty; the caller should hold the lock.
+func (s *mockState) movements(from, to time.Time) []mockRollup {
+    var rollups []mockRollup
+    add := func(movement mockRollup) {
+        for i, r := range rollups {
+            if r.Hour.Equal(movement.Hour) && r.Account == movement.Account && r.Counterparty == movement.Counterparty {
+                rollups[i].SentCount += movement.SentCount
+                rollups[i].SentAmount += movement.SentAmount
+                rollups[i].ReceivedCount += movement.ReceivedCount
+                rollups[i].ReceivedAmount += movement.ReceivedAmount
+                return
+            }
+        }
+        rollups = append(rollups, movement)
+    }
+    for _, p := range s.payments {
+        if p.Kind == paymentSplit {
+            continue
+        }
+        for _, change := range s.history[p.ID] {
+            if change.Status != statusCompleted || change.Changed.Before(from) || !change.Changed.Before(to) {
+                continue
+            }
+            hour := change.Changed.UTC().Truncate(time.Hour)
+            add(mockRollup{Hour:hour, Account:p.From, Counterparty:p.To, Currency:p.Currency, SentCount:1, SentAmount:p.Amount})
+            add(mockRollup{Hour:hour, Account:p.To, Counterparty:p.From, Currency:p.Currency, ReceivedCount:1, ReceivedAmount:p.Amount})
+        }
+    }
+    return rollups
+}
 
-// ---------------------
-// Manager class mockery
-// ---------------------
+// rollupsWithin returns the rollups within [from, to) of the account, or of all accounts
+// if it's empty, like the paymentRollups query; the caller should hold the lock.
+func (s *mockState) rollupsWithin(account string, from, to time.Time) []mockRollup {
+    var rollups []mockRollup
+    since := from
+    if s.rolledUp.After(since) {
+        since = s.rolledUp
+    }
+    for _, r := range append(append([]mockRollup(nil), s.rollups...), s.movements(since, to)...) {
+        if !r.Hour.Before(from.Truncate(time.Hour)) && r.Hour.Before(to) && (account == "" || r.Account == account) {
+            rollups = append(rollups, r)
+        }
+    }
+    return rollups
+}
 
+func (m MockManager) RollupPayments(until time.Time, limit int) (int, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    hour := m.state.rolledUp
+    if hour.IsZero() {
+        for _, changes := range m.state.history {
+            for _, change := range changes {
+                if change.Status == statusCompleted && (hour.IsZero() || change.Changed.Before(hour)) {
+                    hour = change.Changed.UTC().Truncate(time.Hour)
+                }
+            }
+        }
+        if hour.IsZero() {
+            return 0, nil
+        }
+    }
+    rolled := 0
+    for ; rolled < limit && !hour.Add(time.Hour).After(until); rolled++ {
+        m.state.rollups = append(m.state.rollups, m.state.movements(hour, hour.Add(time.Hour))...)
+        hour = hour.Add(time.Hour)
+        m.state.rolledUp = hour
+    }
+    return rolled, nil
+}
 
-var items = map[string]Account{
-    "A": {1, "A", "USD", Cents(10000), time.Now()},
-    "B": {2, "B", "USD", Cents(1000), time.Now()},
-    "C": {3, "C", "EUR", Cents(5000), time.Now()}}
+func (m MockManager) PaymentVolume(account, bucket string, from, to time.Time) ([]VolumePoint, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    points := make([]VolumePoint, 0)
+    for _, r := range m.state.rollupsWithin(account, from, to) {
+        point := VolumePoint{Start:bucketStart(r.Hour, bucket), Currency:r.Currency, Count:r.SentCount, Amount:r.SentAmount}
+        if account != "" {
+            point.Count, point.Amount = r.SentCount + r.ReceivedCount, r.SentAmount + r.ReceivedAmount
+        }
+        found := false
+        for i, p := range points {
+            if p.Start.Equal(point.Start) && p.Currency == point.Currency {
+                points[i].Count += point.Count
+                points[i].Amount += point.Amount
+                found = true
+            }
+        }
+        if !found && point.Count > 0 {
+            points = append(points, point)
+        }
+    }
+    sort.Slice(points, func(i, j int) bool {
+        if !points[i].Start.Equal(points[j].Start) {
+            return points[i].Start.Before(points[j].Start)
+        }
+        return points[i].Currency < points[j].Currency
+    })
+    return points, nil
+}
 
-var payments = []Payment{
-    {1, "A", "B", time.Now().Add(-1*time.Hour), 1000, "USD"},
-    {2, "B", "A", time.Now().Add(-2*time.Hour), 1000, "USD"}}
+func (m MockManager) TopCounterparties(account string, from, to time.Time, limit int) ([]CounterpartyVolume, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    counterparties := make([]CounterpartyVolume, 0)
+    for _, r := range m.state.rollupsWithin(account, from, to) {
+        found := false
+        for i, c := range counterparties {
+            if c.Counterparty == r.Counterparty {
+                counterparties[i].SentCount += r.SentCount
+                counterparties[i].SentAmount += r.SentAmount
+                counterparties[i].ReceivedCount += r.ReceivedCount
+                counterparties[i].ReceivedAmount += r.ReceivedAmount
+                counterparties[i].Amount += r.SentAmount + r.ReceivedAmount
+                found = true
+            }
+        }
+        if !found {
+            counterparties = append(counterparties, CounterpartyVolume{
+                Counterparty:r.Counterparty,
+                Currency:r.Currency,
+                SentCount:r.SentCount,
+                SentAmount:r.SentAmount,
+                ReceivedCount:r.ReceivedCount,
+                ReceivedAmount:r.ReceivedAmount,
+                Amount:r.SentAmount + r.ReceivedAmount})
+        }
+    }
+    sort.Slice(counterparties, func(i, j int) bool {
+        if counterparties[i].Amount != counterparties[j].Amount {
+            return counterparties[i].Amount > counterparties[j].Amount
+        }
+        return counterparties[i].Counterparty < counterparties[j].Counterparty
+    })
+    if len(counterparties) > limit {
+        counterparties = counterparties[:limit]
+    }
+    return counterparties, nil
+}
 
+func (m MockManager) SigningKeys() ([]SigningKey, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    return append([]SigningKey(nil), m.state.signingKeys...), nil
+}
 
-// A MockManager type replaces real database management with mock implementation.
-// The MockManager uses two in-memory arrays, Accounts and Payments, with the predefined data.
-// It doesn't store the performed changes and expected to be stateless.
-type MockManager struct {
-    Accounts map[string]Account
-    Payments []Payment
+func (m MockManager) RotateSigningKey(key SigningKey) (*SigningKey, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    public := key
+    public.PrivateKey = nil
+    keys := []SigningKey{public}
+    var before *ReceiptKeyView
+    for _, stored := range m.state.signingKeys {
+        if stored.Retired == nil && before == nil {
+            view := newReceiptKeyView(stored)
+            before = &view
+        }
+        if stored.ID == key.ID {
+            continue
+        }
+        if stored.Retired == nil {
+            stored.Retired = &key.Created
+        }
+        keys = append(keys, stored)
+    }
+    m.state.signingKeys = keys
+    after := newReceiptKeyView(key)
+    m.auditLocked("receipt_key.rotated", "receipt_key/" + key.ID, before, &after)
+    return &key, nil
 }
 
-func NewMockManager(_ string) (Manager, error) {
-    var manager Manager = MockManager{items, payments}
-    return manager, nil
+// record stores the created payment and writes its event to the outbox.
+func (m MockManager) record(payment Payment) {
+    m.state.mu.Lock()
+    m.state.add(payment)
+    m.state.mu.Unlock()
+    m.enqueue(eventPaymentCreated, payment, payment.Time)
 }
 
-func (m MockManager) Close() error { return nil }
+func (m MockManager) GetPayments(accountId string) ([]Payment, error) {
+    payments := make([]Payment, 0)
+    if _, ok := m.Accounts[accountId]; !ok {
+        return nil, fmt.Errorf("account is not found")
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    for _, p := range m.state.payments {
+        if (p.From == accountId || p.To == accountId) && p.Kind != paymentSplit {
+            payments = append(payments, p)
+        }
+    }
+    return payments, nil
+}
 
-func (m MockManager) GetAvailableAccounts() ([]Account, error) {
-    accounts := make([]Account, 0)
-    for _, acc := range m.Accounts {
-        accounts = append(accounts, acc)
+func (m MockManager) ListPayments(accountId string, page PageRequest, filter PaymentFilter) ([]Payment, error) {
+    payments, err := m.GetPayments(accountId)
+    if err != nil {
+        return nil, err
     }
-    return accounts, nil
+    result := make([]Payment, 0)
+    for i := len(payments) - 1; i >= 0 && len(result) < page.Limit; i-- {
+        if (page.Before == 0 || payments[i].ID < page.Before) && filter.matches(payments[i]) {
+            result = append(result, payments[i])
+        }
+    }
+    return result, nil
 }
 
-func (m MockManager) GetAccounts(identifiers []string) ([]Account, error) {
-    filtered := make([]Account, 0)
-    for _, id := range identifiers {
-        filtered = append(filtered, m.Accounts[id])
+func (m MockManager) SearchPayments(search PaymentSearch, page PageRequest) ([]Payment, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    result := make([]Payment, 0)
+    for i := len(m.state.payments) - 1; i >= 0 && len(result) < page.Limit; i-- {
+        p := m.state.payments[i]
+        if (page.Before == 0 || p.ID < page.Before) && search.matches(p) {
+            result = append(result, p)
+        }
     }
-    return filtered, nil
+    return result, nil
 }
 
-func (m MockManager) Transfer(fromId, toId string, amount Cents) (*Payment, error) {
-    first, ok := m.Accounts[fromId]
-    if !ok {
-        return nil, fmt.Errorf("fromId is missing")
+func (m MockManager) Authorize(fromId, toId string, amount Cents, ttl time.Duration) (*Hold, error) {
+    from, okFrom := m.Accounts[fromId]
+    to, okTo := m.Accounts[toId]
+    if !okFrom || !okTo {
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if from.Currency != to.Currency {
+        return nil, inputError(codeCurrencyMismatch, "invalid configuration")
+    }
+    if m.account(fromId).Available() < amount {
+        return nil, inputError(codeInsufficientFunds, "invalid configuration")
+    }
+    if err := m.checkLimits(m.account(fromId), amount, nil); err != nil {
+        return nil, err
     }
+    now := time.Now().UTC()
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    hold := Hold{
+        ID:len(m.state.holds) + 1,
+        From:fromId,
+        To:toId,
+        Amount:amount,
+        Currency:from.Currency,
+        Status:holdActive,
+        Created:now,
+        Expires:now.Add(ttl)}
+    m.state.holds = append(m.state.holds, hold)
+    m.auditLocked("hold.created", holdResource(hold.ID), nil, &hold)
+    return &hold, nil
+}
 
-    second, ok := m.Accounts[toId]
-    if !ok {
-        return nil, fmt.Errorf("toId is missing")
+func (m MockManager) GetHold(id int) (*Hold, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.holds) {
+        return nil, holdNotFound()
     }
+    hold := m.state.holds[id-1].effective(time.Now().UTC())
+    return &hold, nil
+}
 
-    if first.Amount < amount || first.Currency != second.Currency {
-        return nil, fmt.Errorf("invalid configuration")
+func (m MockManager) Capture(id int, amount Cents) (*Hold, *Payment, error) {
+    m.state.mu.Lock()
+    if id > len(m.state.holds) {
+        m.state.mu.Unlock()
+        return nil, nil, holdNotFound()
+    }
+    hold := m.state.holds[id-1]
+    amount, err := checkCapture(hold, amount, time.Now().UTC())
+    m.state.mu.Unlock()
+    if err == nil {
+        err = m.checkLimits(m.account(hold.From), amount, nil)
     }
+    if err != nil {
+        return nil, nil, err
+    }
+    schedules, _ := m.ListFeeSchedules()
+    fees := transferFees(schedules, m.account(hold.From), m.account(hold.To), amount)
 
+    before := hold
+    m.state.mu.Lock()
+    captured := &m.state.holds[id-1]
+    captured.Status, captured.Captured = holdCaptured, amount
+    hold = *captured
+    m.state.mu.Unlock()
     payment := Payment{
-        From:first.Identifier,
-        To:second.Identifier,
+        ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+        From:hold.From,
+        To:hold.To,
         Time:time.Now().UTC(),
         Amount:amount,
-        Currency:first.Currency}
+        Currency:hold.Currency,
+        Kind:paymentTransfer,
+        Status:statusCompleted}
+    m.record(payment)
+    m.chargeFees(&payment, fees)
+    m.audit("hold.captured", holdResource(id), &before, &hold)
+    m.audit("payment.created", paymentResource(payment.ID), nil, &payment)
+    return &hold, &payment, nil
+}
+
+func (m MockManager) Void(id int) (*Hold, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.holds) {
+        return nil, holdNotFound()
+    }
+    hold := &m.state.holds[id-1]
+    if status := hold.effective(time.Now().UTC()).Status; status != holdActive {
+        return nil, inputError(codeInvalidState, "cannot void a hold which is " + status)
+    }
+    before := *hold
+    hold.Status = holdVoided
+    result := *hold
+    m.auditLocked("hold.voided", holdResource(id), &before, &result)
+    return &result, nil
+}
+
+func (m MockManager) ExpireHolds(now time.Time) (int, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    expired := 0
+    for i, hold := range m.state.holds {
+        if hold.effective(now).Status != hold.Status {
+            m.state.holds[i].Status = holdExpired
+            expired++
+        }
+    }
+    return expired, nil
+}
+
+func (m MockManager) GetPayment(id int) (*Payment, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    for _, p := range m.state.payments {
+        if p.ID == id {
+            return &p, nil
+        }
+    }
+    return nil, paymentNotFound()
+}
+
+func (m MockManager) GetRefunds(paymentId int) ([]Payment, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var refunds []Payment
+    for _, p := range m.state.payments {
+        if p.OriginalID != nil && *p.OriginalID == paymentId {
+            refunds = append(refunds, p)
+        }
+    }
+    return refunds, nil
+}
+
+func (m MockManager) Refund(paymentId int, amount Cents, idempotencyKey string) (*Payment, error) {
+    return m.compensate(paymentId, amount, paymentRefund)
+}
 
+func (m MockManager) Reverse(paymentId int) (*Payment, error) {
+    return m.compensate(paymentId, 0, paymentReversal)
+}
+
+func (m MockManager) compensate(paymentId int, amount Cents, kind string) (*Payment, error) {
+    original, err := m.GetPayment(paymentId)
+    if err != nil {
+        return nil, err
+    }
+    refunds, _ := m.GetRefunds(paymentId)
+    if amount, err = checkRefund(*original, refunds, amount, kind); err != nil {
+        return nil, err
+    }
+    if m.account(original.To).Available() < amount {
+        return nil, inputError(codeInsufficientFunds, "invalid configuration")
+    }
+    payment := Payment{
+        ID:int(atomic.AddInt64(&m.state.lastPaymentID, 1)),
+        From:original.To,
+        To:original.From,
+        Time:time.Now().UTC(),
+        Amount:amount,
+        Currency:original.Currency,
+        Kind:kind,
+        OriginalID:&original.ID,
+        Status:statusCompleted}
+    m.record(payment)
+    if kind == paymentReversal {
+        m.changeStatus(original.ID, statusReversed, "")
+    }
+    m.audit(kind + ".created", paymentResource(payment.ID), nil, &payment)
     return &payment, nil
 }
 
-func (m MockManager) GetPayments(accountId string) ([]Payment, error) {
-    payments := make([]Payment, 0)
-    if _, ok := m.Accounts[accountId]; !ok {
-        return nil, fmt.Errorf("account is not found")
+func (m MockManager) SetPaymentStatus(id int, status, reason string) (*Payment, error) {
+    payment, err := m.GetPayment(id)
+    if err != nil {
+        return nil, err
     }
-    for _, p := range m.Payments {
-        if p.From == accountId || p.To == accountId {
-            payments = append(payments, p)
+    if err = checkTransition(payment.Status, status); err != nil {
+        return nil, err
+    }
+    var fees []Fee
+    if status == statusCompleted {
+        from := m.account(payment.From)
+        if from.Available() < 0 {
+            return nil, inputError(codeInsufficientFunds, "invalid configuration")
         }
+        schedules, _ := m.ListFeeSchedules()
+        fees = transferFees(schedules, from, m.account(payment.To), payment.Amount)
     }
-    return payments, nil
+    before := *payment
+    payment = m.changeStatus(id, status, reason)
+    m.chargeFees(payment, fees)
+    m.audit("payment.status_changed", paymentResource(id), &before, payment)
+    return payment, nil
+}
+
+// changeStatus updates the payment's status and history, and writes the event to the
+// outbox.
+func (m MockManager) changeStatus(id int, status, reason string) *Payment {
+    now := time.Now().UTC()
+    m.state.mu.Lock()
+    var payment Payment
+    for i := range m.state.payments {
+        if m.state.payments[i].ID == id {
+            m.state.payments[i].Status = status
+            payment = m.state.payments[i]
+        }
+    }
+    change := StatusChange{PaymentID:id, Status:status, Reason:reason, Changed:now}
+    m.state.history[id] = append(m.state.history[id], change)
+    m.state.mu.Unlock()
+    m.enqueue(eventPaymentStatusChanged, payment, now)
+    return &payment
+}
+
+func (m MockManager) GetStatusHistory(id int) ([]StatusChange, error) {
+    if _, err := m.GetPayment(id); err != nil {
+        return nil, err
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    return append([]StatusChange(nil), m.state.history[id]...), nil
+}
+
+func (m MockManager) CreateSchedule(schedule Schedule) (*Schedule, error) {
+    from, okFrom := m.Accounts[schedule.From]
+    to, okTo := m.Accounts[schedule.To]
+    if !okFrom || !okTo || schedule.From == schedule.To {
+        return nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    if from.Currency != to.Currency {
+        return nil, inputError(codeCurrencyMismatch, "invalid configuration")
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    schedule.ID = len(m.state.schedules) + 1
+    m.state.schedules = append(m.state.schedules, schedule)
+    m.auditLocked("schedule.created", scheduleResource(schedule.ID), nil, &schedule)
+    return &schedule, nil
+}
+
+func (m MockManager) GetSchedule(id int) (*Schedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.schedules) {
+        return nil, scheduleNotFound()
+    }
+    schedule := m.state.schedules[id-1]
+    return &schedule, nil
+}
+
+func (m MockManager) CancelSchedule(id int) (*Schedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if id > len(m.state.schedules) {
+        return nil, scheduleNotFound()
+    }
+    schedule := &m.state.schedules[id-1]
+    if schedule.Status != scheduleActive {
+        return nil, inputError(codeInvalidState, "cannot cancel a schedule which is " + schedule.Status)
+    }
+    before := *schedule
+    schedule.Status, schedule.NextRun = scheduleCancelled, nil
+    result := *schedule
+    m.auditLocked("schedule.cancelled", scheduleResource(id), &before, &result)
+    return &result, nil
+}
+
+func (m MockManager) GetScheduleRuns(id int) ([]ScheduleRun, error) {
+    if _, err := m.GetSchedule(id); err != nil {
+        return nil, err
+    }
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var runs []ScheduleRun
+    for _, run := range m.state.runs {
+        if run.ScheduleID == id {
+            runs = append(runs, run)
+        }
+    }
+    return runs, nil
+}
+
+func (m MockManager) DueSchedules(now time.Time, limit int) ([]Schedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    var due []Schedule
+    for _, schedule := range m.state.schedules {
+        if schedule.Status == scheduleActive && !schedule.NextRun.After(now) && len(due) < limit {
+            due = append(due, schedule)
+        }
+    }
+    return due, nil
+}
+
+func (m MockManager) RecordRun(run ScheduleRun) (*Schedule, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if run.ScheduleID > len(m.state.schedules) {
+        return nil, scheduleNotFound()
+    }
+    schedule := &m.state.schedules[run.ScheduleID-1]
+    if schedule.Runs + 1 == run.Occurrence {
+        before := *schedule
+        run.ID = len(m.state.runs) + 1
+        m.state.runs = append(m.state.runs, run)
+        *schedule = schedule.advance()
+        m.auditLocked("schedule.run", scheduleResource(run.ScheduleID), &before, schedule)
+    }
+    result := *schedule
+    return &result, nil
+}
+
+func (m MockManager) CreateWebhook(hook Webhook) (*Webhook, error) {
+    created, err := m.MockWebhooks.CreateWebhook(hook)
+    if err == nil {
+        view := newWebhookView(*created)
+        m.audit("webhook.created", "webhook/" + strconv.Itoa(created.ID), nil, &view)
+    }
+    return created, err
+}
+
+func (m MockManager) DeleteWebhook(id int) (*Webhook, error) {
+    hook, err := m.MockWebhooks.DeleteWebhook(id)
+    if err == nil {
+        before, after := newWebhookView(*hook), newWebhookView(*hook)
+        before.Active = true
+        m.audit("webhook.deleted", "webhook/" + strconv.Itoa(id), &before, &after)
+    }
+    return hook, err
+}
+
+func (m MockManager) Redeliver(deliveryId int, at time.Time) (*WebhookDelivery, error) {
+    delivery, err := m.MockWebhooks.Redeliver(deliveryId, at)
+    if err == nil {
+        view := newDeliveryView(*delivery)
+        m.audit("delivery.redelivered", "delivery/" + strconv.Itoa(deliveryId), nil, &view)
+    }
+    return delivery, err
+}
+
+// TryLead grants the leadership to a single caller until the lease is released.
+func (m MockManager) TryLead(ctx context.Context, job string) (Lease, error) {
+    m.state.mu.Lock()
+    defer m.state.mu.Unlock()
+    if m.state.leased {
+        return nil, nil
+    }
+    m.state.leased = true
+    return mockLease{m.state}, nil
+}
+
+type mockLease struct {
+    state *mockState
+}
+
+func (l mockLease) Alive(ctx context.Context) bool { return true }
+
+func (l mockLease) Release() {
+    l.state.mu.Lock()
+    l.state.leased = false
+    l.state.mu.Unlock()
 }
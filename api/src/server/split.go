@@ -0,0 +1,288 @@
+// Split payments.
+//
+// A split pays several recipients from one sender, e.g. the seller, the platform and
+// the courier of a marketplace order. The split is recorded as a parent payment of
+// the split kind, which doesn't move funds by itself, and the legs moving the funds
+// to the recipients. The parent is not listed in the accounts' payments: the sender
+// sees the legs it has paid, and every recipient sees its own leg.
+//
+// The legs are defined either by exact amounts, or by percentages of the total amount.
+// A percentage leg gets the amount rounded down to a cent; the cents left after the
+// rounding are given one by one to the legs with the largest rounded off fractions,
+// and to the earlier legs if the fractions are equal.
+package server
+
+import (
+    "fmt"
+    "github.com/jmoiron/sqlx"
+    "math"
+    "net/http"
+    "sort"
+    "time"
+)
+
+// Kinds of the split payments.
+const (
+    paymentSplit = "split"
+    paymentSplitLeg = "split_leg"
+)
+
+// SplitManager implements the split payments.
+type SplitManager interface {
+    // Split pays the amounts of the legs from the account fromId. The idempotency key
+    // works the same way as in Transfer; it is stored with the parent payment.
+    Split(fromId string, legs []SplitLeg, idempotencyKey string) (*Payment, []Payment, error)
+}
+
+// SplitLeg is a part of a split payment going to a single recipient.
+type SplitLeg struct {
+    To string
+    Amount Cents
+}
+
+// splitAmounts divides the total amount according to the shares given in basis
+// points, i.e. hundredths of a percent, which sum up to 10000.
+func splitAmounts(total Cents, shares []int64) []Cents {
+    amounts := make([]Cents, len(shares))
+    remainders := make([]int64, len(shares))
+    left := total
+    for i, share := range shares {
+        amounts[i] = Cents(int64(total)*share/10000)
+        remainders[i] = int64(total)*share%10000
+        left -= amounts[i]
+    }
+    order := make([]int, len(shares))
+    for i := range order {
+        order[i] = i
+    }
+    sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+    for i := 0; left > 0; i++ {
+        amounts[order[i%len(order)]]++
+        left--
+    }
+    return amounts
+}
+
+// legs verifies the legs of a split payment and returns their amounts.
+func (r SplitRequest) legs() ([]SplitLeg, error) {
+    var errs []FieldError
+    var total Cents
+    shares := make([]int64, len(r.Legs))
+    percents := 0
+    for i, leg := range r.Legs {
+        if (leg.Amount == 0) == (leg.Percent == 0) {
+            errs = append(errs, FieldError{fmt.Sprintf("legs[%d]", i), "must have either amount or percent"})
+            continue
+        }
+        if leg.To == r.From {
+            errs = append(errs, FieldError{fmt.Sprintf("legs[%d].to", i), "must differ from the sender"})
+        }
+        if leg.Percent == 0 {
+            total += leg.Amount
+            continue
+        }
+        percents++
+        shares[i] = int64(math.Round(leg.Percent*100))
+        if math.Abs(leg.Percent*100 - float64(shares[i])) > 1e-6 {
+            errs = append(errs, FieldError{fmt.Sprintf("legs[%d].percent", i), "must have at most two decimal places"})
+        }
+    }
+    if len(errs) == 0 {
+        errs = r.checkTotal(total, shares, percents)
+    }
+    if len(errs) > 0 {
+        return nil, validationError(errs)
+    }
+
+    legs := make([]SplitLeg, len(r.Legs))
+    amounts := splitAmounts(r.Amount, shares)
+    for i, leg := range r.Legs {
+        legs[i] = SplitLeg{leg.To, leg.Amount}
+        if percents > 0 {
+            legs[i].Amount = amounts[i]
+        }
+    }
+    return legs, nil
+}
+
+// checkTotal verifies that the legs add up to the total amount. The legs cannot mix
+// amounts and percentages.
+func (r SplitRequest) checkTotal(total Cents, shares []int64, percents int) []FieldError {
+    switch {
+    case percents > 0 && percents < len(r.Legs):
+        return []FieldError{{"legs", "must all have either amounts or percents"}}
+    case percents > 0:
+        var sum int64
+        for _, share := range shares {
+            sum += share
+        }
+        if sum != 10000 {
+            return []FieldError{{"legs", "percents must sum up to 100"}}
+        }
+    case total != r.Amount:
+        return []FieldError{{"amount", fmt.Sprintf("must be equal to the sum of the legs %d", total)}}
+    }
+    return nil
+}
+
+// Split locks the accounts of the sender and all recipients in the order of the
+// identifiers, and makes the parent payment and its legs in a single transaction.
+func (m BillingManager) Split(fromId string, legs []SplitLeg, idempotencyKey string) (*Payment, []Payment, error) {
+    if idempotencyKey != "" {
+        if parent, err := m.findIdempotent(fromId, idempotencyKey); err != nil {
+            return nil, nil, err
+        } else if parent != nil {
+            return m.replaySplit(parent, legs)
+        }
+    }
+
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, nil, internalError(err)
+    }
+    ids := []string{fromId}
+    var total Cents
+    for _, leg := range legs {
+        ids = append(ids, leg.To)
+        total += leg.Amount
+    }
+    now := time.Now().UTC()
+    locked, err := lockAccounts(tx, ids, now)
+    if err != nil {
+        mustRollback(tx)
+        return nil, nil, err
+    }
+    accounts := make(map[string]*Account, len(locked))
+    for i := range locked {
+        accounts[locked[i].Identifier] = &locked[i]
+    }
+
+    parent, payments, err := splitTx(tx, accounts, fromId, legs, Payment{
+        Time:now,
+        Amount:total,
+        Kind:paymentSplit,
+        IdempotencyKey:nullString(idempotencyKey)})
+    if err == nil {
+        after := struct {
+            Payment *Payment `json:"payment"`
+            Legs []Payment   `json:"legs"`
+        }{parent, payments}
+        err = m.audit(tx, "split.created", paymentResource(parent.ID), nil, &after)
+    }
+    if err != nil {
+        mustRollback(tx)
+        if isUniqueViolation(err) && idempotencyKey != "" {
+            // A concurrent request with the same key has won the race.
+            if existing, _ := m.findIdempotent(fromId, idempotencyKey); existing != nil {
+                return m.replaySplit(existing, legs)
+            }
+        }
+        return nil, nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, nil, internalError(err)
+    }
+    return parent, payments, nil
+}
+
+func splitTx(tx *sqlx.Tx, accounts map[string]*Account, fromId string, legs []SplitLeg, parent Payment) (*Payment, []Payment, error) {
+    from := accounts[fromId]
+    if from == nil {
+        return nil, nil, inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    for _, leg := range legs {
+        to := accounts[leg.To]
+        if to == nil || leg.To == fromId {
+            return nil, nil, inputError(codeAccountNotFound, "cannot find the accounts")
+        }
+        if to.Currency != from.Currency {
+            return nil, nil, inputError(codeCurrencyMismatch, "cannot transfer money between accounts with different currency")
+        }
+    }
+    if from.Available() < parent.Amount {
+        return nil, nil, inputError(codeInsufficientFunds, "cannot make a transaction: insufficient funds")
+    }
+    if err := checkLimits(tx, *from, parent.Amount, parent.Time); err != nil {
+        return nil, nil, err
+    }
+
+    created, err := insertPayment(tx, *from, *from, parent)
+    if err != nil {
+        return nil, nil, err
+    }
+    payments := make([]Payment, len(legs))
+    for i, leg := range legs {
+        to := accounts[leg.To]
+        payment, err := move(tx, *from, *to, Payment{
+            Time:parent.Time,
+            Amount:leg.Amount,
+            Kind:paymentSplitLeg,
+            ParentID:&created.ID})
+        if err != nil {
+            return nil, nil, err
+        }
+        from.Amount -= leg.Amount
+        to.Amount += leg.Amount
+        payments[i] = *payment
+    }
+    return created, payments, nil
+}
+
+// replaySplit returns the split payment created with the same idempotency key if it
+// was made with the same legs.
+func (m BillingManager) replaySplit(parent *Payment, legs []SplitLeg) (*Payment, []Payment, error) {
+    payments, err := m.GetChildren(parent.ID)
+    if err != nil {
+        return nil, nil, err
+    }
+    if parent.Kind != paymentSplit || len(payments) != len(legs) {
+        return nil, nil, inputError(codeIdempotencyConflict, "idempotency key was already used with different parameters")
+    }
+    for i, leg := range legs {
+        if payments[i].To != leg.To || payments[i].Amount != leg.Amount {
+            return nil, nil, inputError(codeIdempotencyConflict, "idempotency key was already used with different parameters")
+        }
+    }
+    return parent, payments, nil
+}
+
+// createSplit pays several recipients from the caller's account; the Idempotency-Key
+// header is honored.
+//
+// Example of possible request's body:
+//
+//     {"from": "buyer", "amount": 1000, "legs": [
+//         {"to": "seller", "percent": 85}, {"to": "platform", "percent": 10},
+//         {"to": "courier", "percent": 5}]}
+func (api *BillingAPI) createSplit(m Manager, resp *Responder, req *http.Request) {
+    var body SplitRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    legs, err := body.legs()
+    if err == nil {
+        err = authorize(req.Context(), body.From)
+    }
+    if err == nil {
+        var total Cents
+        for _, leg := range legs {
+            total += leg.Amount
+        }
+        err = api.checkThreshold(total)
+    }
+    key := req.Header.Get("Idempotency-Key")
+    if err == nil && len(key) > maxIdempotencyKeyLength {
+        err = validationError([]FieldError{{"Idempotency-Key", "must have length at most 64"}})
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    parent, payments, err := m.Split(body.From, legs, key)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(SplitResponse{parent, payments})
+}
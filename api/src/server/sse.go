@@ -0,0 +1,123 @@
+// Server-Sent Events stream of the account's payments.
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// heartbeatInterval defines how often a comment is sent to the idle event streams
+// to keep the connection open through the proxies.
+var heartbeatInterval = 15*time.Second
+
+// Types of the events sent to the account's stream.
+const (
+    eventPaymentSent = "payment.sent"
+    eventPaymentReceived = "payment.received"
+)
+
+// accountEvents streams the account's payments as Server-Sent Events.
+//
+// Every event has the payment ID as the event ID, the payment.sent or payment.received
+// type, and the JSON-encoded payment as data. A reconnecting client sends the ID of
+// the last received event in the Last-Event-ID header, and the stream resumes with
+// the payments that were missed.
+func (api *BillingAPI) accountEvents(m Manager, resp *Responder, req *http.Request) {
+    accountId := req.PathValue("id")
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if _, err := m.GetAccount(accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    var after int
+    if value := req.Header.Get("Last-Event-ID"); value != "" {
+        id, err := strconv.Atoi(value)
+        if err != nil || id < 0 {
+            writeManagerError(validationError([]FieldError{{"Last-Event-ID", "must be a payment ID"}}), resp)
+            return
+        }
+        after = id
+    }
+
+    flusher, ok := resp.ResponseWriter.(http.Flusher)
+    if !ok {
+        resp.SendServerError("streaming is not supported")
+        return
+    }
+
+    // subscribe before the replay so no payment is lost in between
+    sub := api.Events.Subscribe(accountId)
+    defer sub.Close()
+
+    header := resp.Header()
+    header.Set("Content-Type", "text/event-stream")
+    header.Set("Cache-Control", "no-cache")
+    header.Set("X-Accel-Buffering", "no")
+    resp.WriteHeader(http.StatusOK)
+    _, _ = fmt.Fprint(resp, "retry: 3000\n\n")
+    flusher.Flush()
+
+    send := func(p Payment) error {
+        if err := writeEvent(resp, accountId, p); err != nil {
+            return err
+        }
+        flusher.Flush()
+        return nil
+    }
+
+    last := after
+    if after > 0 {
+        var err error
+        if last, err = replay(m, accountId, after, send); err != nil {
+            log.Printf("event stream of %s: %s", accountId, err)
+            return
+        }
+    }
+
+    heartbeat := time.NewTicker(heartbeatInterval)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case <-req.Context().Done():
+            return
+        case p, ok := <-sub.C:
+            if !ok {
+                return // the client is too slow; it will reconnect and catch up
+            }
+            if p.ID <= last {
+                continue
+            }
+            if err := send(p); err != nil {
+                return
+            }
+            last = p.ID
+        case <-heartbeat.C:
+            if _, err := fmt.Fprint(resp, ": heartbeat\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        }
+    }
+}
+
+// writeEvent writes a payment event in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, accountId string, p Payment) error {
+    event := eventPaymentReceived
+    if p.From == accountId {
+        event = eventPaymentSent
+    }
+    data, err := json.Marshal(p)
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", p.ID, event, data)
+    return err
+}
@@ -0,0 +1,414 @@
+// Account statements.
+//
+// A statement lists the payments booked on an account within a period of UTC days,
+// with the running balance, between the opening and the closing balances, and the
+// totals of the incoming payments, the outgoing payments and the fees. A payment is
+// booked when it is completed: a pending payment appears on the statement of the day
+// it is settled, and the failed and the cancelled payments never appear. The parent of
+// a split doesn't move funds, so only its legs are listed.
+//
+// The statement is rendered as CSV, JSON Lines, PDF or ISO 20022 camt.053 XML while
+// the payments are read from the database, so a long period is never loaded into the
+// memory. An error which happens after the first line is sent can't be reported to
+// the client anymore; the output is cut short and the error is logged.
+package server
+
+import (
+    "context"
+    "database/sql"
+    "encoding/csv"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Formats of the statements.
+const (
+    statementCSV = "csv"
+    statementJSONL = "jsonl"
+    statementPDF = "pdf"
+)
+
+// dateLayout is the format of the statement periods' days.
+const dateLayout = "2006-01-02"
+
+// StatementManager reads the payments of the account statements.
+type StatementManager interface {
+    // Statement calls open with the account and its balance over the period, and then
+    // entry for every payment booked on the account from the from time up to the to
+    // time, exclusive, in the order of booking. An error returned by a callback stops
+    // the reading.
+    Statement(accountId string, from, to time.Time, open func(Account, StatementBalance) error, entry func(StatementEntry) error) error
+}
+
+// StatementBalance is the balance at the start of a period and the totals of the
+// payments booked within it, which some formats need before the payments.
+type StatementBalance struct {
+    Opening Cents   `db:"opening"`
+    Credits Cents   `db:"credits"`
+    CreditCount int `db:"credit_count"`
+    Debits Cents    `db:"debits"`
+    DebitCount int  `db:"debit_count"`
+}
+
+// Closing returns the balance at the end of the period.
+func (b StatementBalance) Closing() Cents {
+    return b.Opening + b.Credits - b.Debits
+}
+
+// StatementEntry is a payment booked on the account at the Booked time.
+type StatementEntry struct {
+    Payment
+    Booked time.Time `db:"booked_at"`
+}
+
+// bookedPayments selects the payments of the account $1 booked since the time $2.
+const bookedPayments = `
+    FROM payment p
+    JOIN payment_status s ON s.payment_id = p.payment_id AND s.status = 'completed'
+    WHERE (p.from_id = $1 OR p.to_id = $1) AND p.kind <> 'split' AND s.changed_at >= $2`
+
+// Statement reads the balance and the payments in a read-only transaction with the
+// repeatable read isolation, so they are consistent with each other. The opening
+// balance is the current balance minus the payments booked since the start of the
+// period.
+func (m BillingManager) Statement(
+    accountId string,
+    from, to time.Time,
+    open func(Account, StatementBalance) error,
+    entry func(StatementEntry) error,
+) error {
+    tx, err := m.DB.BeginTxx(context.Background(), &sql.TxOptions{Isolation:sql.LevelRepeatableRead, ReadOnly:true})
+    if err != nil {
+        return internalError(err)
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    var accounts []Account
+    if err = tx.Select(&accounts, accountQuery + " WHERE a.identifier = $2", time.Now().UTC(), accountId); err != nil {
+        return internalError(err)
+    }
+    if len(accounts) == 0 {
+        return inputError(codeAccountNotFound, "account is not found")
+    }
+    var balance StatementBalance
+    err = tx.Get(&balance, `
+        SELECT
+            $4::BIGINT - COALESCE(SUM(CASE WHEN p.to_id = $1 THEN p.amount ELSE -p.amount END), 0) AS opening,
+            COALESCE(SUM(p.amount) FILTER (WHERE p.to_id = $1 AND s.changed_at < $3), 0) AS credits,
+            COUNT(*) FILTER (WHERE p.to_id = $1 AND s.changed_at < $3) AS credit_count,
+            COALESCE(SUM(p.amount) FILTER (WHERE p.to_id <> $1 AND s.changed_at < $3), 0) AS debits,
+            COUNT(*) FILTER (WHERE p.to_id <> $1 AND s.changed_at < $3) AS debit_count` +
+        bookedPayments, accountId, from, to, accounts[0].Amount)
+    if err != nil {
+        return internalError(err)
+    }
+    if err = open(accounts[0], balance); err != nil {
+        return err
+    }
+
+    rows, err := tx.Queryx("SELECT p.*, s.changed_at AS booked_at" + bookedPayments + `
+        AND s.changed_at < $3
+        ORDER BY s.changed_at, p.payment_id`, accountId, from, to)
+    if err != nil {
+        return internalError(err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var booked StatementEntry
+        if err = rows.StructScan(&booked); err != nil {
+            return internalError(err)
+        }
+        if err = entry(booked); err != nil {
+            return err
+        }
+    }
+    if err = rows.Err(); err != nil {
+        return internalError(err)
+    }
+    return nil
+}
+
+// StatementSummary describes the statement's period and balances. The To day is the
+// last day of the period.
+type StatementSummary struct {
+    Account string  `json:"account"`
+    Currency string `json:"currency"`
+    From string     `json:"from"`
+    To string       `json:"to"`
+    Opening Cents   `json:"opening_balance"`
+    Closing Cents   `json:"closing_balance"`
+    TotalIn Cents   `json:"total_in"`
+    TotalOut Cents  `json:"total_out"`
+    TotalFees Cents `json:"total_fees"`
+}
+
+// StatementLine is a payment of the statement. The Amount is positive for the
+// incoming payments and negative for the outgoing ones.
+type StatementLine struct {
+    Booked time.Time    `json:"booked"`
+    PaymentID int       `json:"payment_id"`
+    Kind string         `json:"kind"`
+    Counterparty string `json:"counterparty"`
+    Reference string    `json:"reference"`
+    Memo string         `json:"memo,omitempty"`
+    Amount Cents        `json:"amount"`
+    Balance Cents       `json:"balance"`
+}
+
+// add books the entry on the summary and returns its line with the running balance.
+// The fees paid by the account are counted separately from the other outgoing payments.
+func (s *StatementSummary) add(entry StatementEntry) StatementLine {
+    line := StatementLine{
+        Booked:entry.Booked.UTC(),
+        PaymentID:entry.ID,
+        Kind:entry.Kind,
+        Counterparty:entry.To,
+        Reference:statementReference(entry.Payment),
+        Memo:entry.Memo,
+        Amount:-entry.Amount}
+    switch {
+    case entry.To == s.Account:
+        line.Counterparty, line.Amount = entry.From, entry.Amount
+        s.TotalIn += entry.Amount
+    case entry.Kind == paymentFee:
+        s.TotalFees += entry.Amount
+    default:
+        s.TotalOut += entry.Amount
+    }
+    s.Closing += line.Amount
+    line.Balance = s.Closing
+    return line
+}
+
+// statementReference describes the payment for the statement's reader: the sender's
+// reference, if any, or the payment's kind and its relation to the other payments.
+func statementReference(p Payment) string {
+    switch {
+    case p.Reference != "":
+        return p.Reference
+    case p.OriginalID != nil:
+        return fmt.Sprintf("%s of payment %d", p.Kind, *p.OriginalID)
+    case p.Kind == paymentFee && p.ParentID != nil:
+        return fmt.Sprintf("fee for payment %d", *p.ParentID)
+    case p.Kind == paymentSplitLeg && p.ParentID != nil:
+        return fmt.Sprintf("part of split %d", *p.ParentID)
+    case p.Kind == paymentInterest:
+        return "overdraft interest"
+    }
+    return p.Kind
+}
+
+// statementWriter renders a statement in one of the formats: the summary with the
+// opening balance, then the lines, then the summary with the closing balance and
+// the totals. The balance over the whole period is given upfront for the formats
+// which put the totals before the lines.
+type statementWriter interface {
+    open(s StatementSummary, b StatementBalance) error
+    line(l StatementLine) error
+    close(s StatementSummary) error
+}
+
+// newStatementWriter returns the writer of the format and its content type.
+func newStatementWriter(format string, w io.Writer) (statementWriter, string) {
+    switch format {
+    case statementJSONL:
+        return &jsonlStatement{json.NewEncoder(w)}, "application/jsonl"
+    case statementPDF:
+        return &pdfStatement{pdf:newPDFWriter(w)}, "application/pdf"
+    case statementCAMT053:
+        return &camtStatement{encoder:xml.NewEncoder(w)}, "application/xml"
+    }
+    return &csvStatement{csv.NewWriter(w)}, "text/csv"
+}
+
+// csvStatement writes a row per payment between the rows of the opening and the
+// closing balances; the totals are written in the closing row.
+type csvStatement struct {
+    w *csv.Writer
+}
+
+var statementColumns = []string{
+    "booked", "payment_id", "kind", "counterparty", "reference", "amount", "balance",
+    "total_in", "total_out", "total_fees", "memo"}
+
+func (s *csvStatement) open(summary StatementSummary, _ StatementBalance) error {
+    _ = s.w.Write(statementColumns)
+    return s.write([]string{summary.From, "", "opening_balance", "", "", "", cents(summary.Opening)})
+}
+
+func (s *csvStatement) line(l StatementLine) error {
+    return s.write([]string{
+        l.Booked.Format(time.RFC3339), strconv.Itoa(l.PaymentID), l.Kind, l.Counterparty, l.Reference,
+        cents(l.Amount), cents(l.Balance), "", "", "", l.Memo})
+}
+
+func (s *csvStatement) close(summary StatementSummary) error {
+    err := s.write([]string{
+        summary.To, "", "closing_balance", "", "", "", cents(summary.Closing),
+        cents(summary.TotalIn), cents(summary.TotalOut), cents(summary.TotalFees)})
+    s.w.Flush()
+    return err
+}
+
+// write pads the record to the number of columns.
+func (s *csvStatement) write(record []string) error {
+    for len(record) < len(statementColumns) {
+        record = append(record, "")
+    }
+    _ = s.w.Write(record)
+    return s.w.Error()
+}
+
+func cents(c Cents) string {
+    return strconv.FormatInt(int64(c), 10)
+}
+
+// jsonlStatement writes a JSON object per line; the type field tells the opening
+// line, the payments and the closing line apart.
+type jsonlStatement struct {
+    encoder *json.Encoder
+}
+
+// statementRecord is a payment or the closing line of the JSON Lines statement.
+type statementRecord struct {
+    Type string `json:"type"`
+    *StatementSummary
+    *StatementLine
+}
+
+func (s *jsonlStatement) open(summary StatementSummary, _ StatementBalance) error {
+    return s.encoder.Encode(map[string]interface{}{
+        "type": "opening", "account": summary.Account, "currency": summary.Currency,
+        "from": summary.From, "to": summary.To, "opening_balance": summary.Opening})
+}
+
+func (s *jsonlStatement) line(l StatementLine) error {
+    return s.encoder.Encode(statementRecord{Type:"payment", StatementLine:&l})
+}
+
+func (s *jsonlStatement) close(summary StatementSummary) error {
+    return s.encoder.Encode(statementRecord{Type:"closing", StatementSummary:&summary})
+}
+
+// pdfStatement prints the statement as a table with a fixed-width font.
+type pdfStatement struct {
+    pdf *pdfWriter
+}
+
+const pdfRow = "%-20s %8s %-10s %-12s %-26s %12s %12s"
+
+func (s *pdfStatement) open(summary StatementSummary, _ StatementBalance) error {
+    s.pdf.println(fmt.Sprintf("Statement of account %s (%s)", summary.Account, summary.Currency))
+    s.pdf.println(fmt.Sprintf("Period: %s - %s", summary.From, summary.To))
+    s.pdf.println("")
+    s.pdf.println(fmt.Sprintf("Opening balance: %s", decimal(summary.Opening)))
+    s.pdf.println("")
+    s.pdf.println(fmt.Sprintf(pdfRow, "Booked", "Payment", "Kind", "Counterparty", "Reference", "Amount", "Balance"))
+    return s.pdf.err
+}
+
+func (s *pdfStatement) line(l StatementLine) error {
+    s.pdf.println(fmt.Sprintf(pdfRow,
+        l.Booked.Format("2006-01-02 15:04:05"), strconv.Itoa(l.PaymentID), clip(l.Kind, 10),
+        clip(l.Counterparty, 12), clip(l.Reference, 26), decimal(l.Amount), decimal(l.Balance)))
+    return s.pdf.err
+}
+
+func (s *pdfStatement) close(summary StatementSummary) error {
+    s.pdf.println("")
+    s.pdf.println(fmt.Sprintf("Total in:        %s", decimal(summary.TotalIn)))
+    s.pdf.println(fmt.Sprintf("Total out:       %s", decimal(summary.TotalOut)))
+    s.pdf.println(fmt.Sprintf("Total fees:      %s", decimal(summary.TotalFees)))
+    s.pdf.println(fmt.Sprintf("Closing balance: %s", decimal(summary.Closing)))
+    return s.pdf.close()
+}
+
+// decimal formats the cents as a decimal number of the money units.
+func decimal(c Cents) string {
+    sign := ""
+    if c < 0 {
+        sign, c = "-", -c
+    }
+    return fmt.Sprintf("%s%d.%02d", sign, int64(c / 100), int64(c % 100))
+}
+
+// clip shortens the text to the width of the column.
+func clip(text string, width int) string {
+    if len(text) > width {
+        return text[:width-1] + "~"
+    }
+    return text
+}
+
+// parsePeriod converts the from and to days, inclusive, into the period [from, to).
+func parsePeriod(fromDay, toDay string) (from, to time.Time, err error) {
+    var errs []FieldError
+    if from, err = time.Parse(dateLayout, fromDay); err != nil {
+        errs = append(errs, FieldError{"from", "should be a date like 2019-03-01"})
+    }
+    if to, err = time.Parse(dateLayout, toDay); err != nil {
+        errs = append(errs, FieldError{"to", "should be a date like 2019-03-31"})
+    } else if !to.Before(from) {
+        to = to.AddDate(0, 0, 1)
+    } else {
+        errs = append(errs, FieldError{"to", "should not be before the from date"})
+    }
+    if len(errs) > 0 {
+        return from, to, validationError(errs)
+    }
+    return from, to, nil
+}
+
+// accountStatement streams the statement of the account for the period given by the
+// from and to days, inclusive, in the format given by the format parameter.
+func (api *BillingAPI) accountStatement(m Manager, resp *Responder, req *http.Request) {
+    accountId := req.PathValue("id")
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    query := StatementQuery{Format:statementCSV}
+    if err := decodeQuery(req, &query); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    from, to, err := parsePeriod(query.From, query.To)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    writer, contentType := newStatementWriter(query.Format, resp.ResponseWriter)
+    extension := query.Format
+    if query.Format == statementCAMT053 {
+        extension = "xml"
+    }
+    summary := StatementSummary{Account:accountId, From:query.From, To:query.To}
+    started := false
+    err = m.Statement(accountId, from, to, func(account Account, balance StatementBalance) error {
+        summary.Currency, summary.Opening, summary.Closing = account.Currency, balance.Opening, balance.Opening
+        header := resp.Header()
+        header.Set("Content-Type", contentType)
+        header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s-%s.%s"`,
+            accountId, query.From, query.To, extension))
+        resp.WriteHeader(http.StatusOK)
+        started = true
+        return writer.open(summary, balance)
+    }, func(entry StatementEntry) error {
+        return writer.line(summary.add(entry))
+    })
+    if err == nil {
+        err = writer.close(summary)
+    }
+    if err != nil && !started {
+        writeManagerError(err, resp)
+    } else if err != nil {
+        log.Printf("statement of %s is cut short: %s", accountId, err)
+    }
+}
@@ -0,0 +1,230 @@
+// Statuses of the payments.
+//
+// A payment created by a transfer is completed at once, unless it is created as
+// pending: the pending payment reserves the amount on the sender's account, the same
+// way as a hold does, and the funds are moved when the payment is completed later,
+// e.g. after an approval or at the scheduled time. A pending or processing payment
+// which fails or is cancelled releases the reserved funds. A completed payment
+// becomes reversed when the reversal is made. Every status change is recorded in
+// the payment's status history.
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+)
+
+// Statuses of the payments.
+const (
+    statusPending = "pending"
+    statusProcessing = "processing"
+    statusCompleted = "completed"
+    statusFailed = "failed"
+    statusReversed = "reversed"
+    statusCancelled = "cancelled"
+)
+
+// paymentTransitions lists the statuses each status can be changed to. The failed,
+// reversed and cancelled statuses are final.
+var paymentTransitions = map[string][]string{
+    statusPending: {statusProcessing, statusCompleted, statusFailed, statusCancelled},
+    statusProcessing: {statusCompleted, statusFailed},
+    statusCompleted: {statusReversed},
+}
+
+// StatusManager implements the payments settled after their creation.
+type StatusManager interface {
+    // TransferPending creates a pending payment reserving the amount on the sender's
+    // account. The preconditions and the idempotency key work the same way as in
+    // Transfer, but the funds are moved only when the payment is completed.
+    TransferPending(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error)
+    // SetPaymentStatus changes the status of the payment. The reversed status is set
+    // by Reverse only, since it creates a compensating payment.
+    SetPaymentStatus(id int, status, reason string) (*Payment, error)
+    // GetStatusHistory returns the status changes of the payment, oldest first.
+    GetStatusHistory(id int) ([]StatusChange, error)
+}
+
+// StatusChange is a record of the payment's status history.
+type StatusChange struct {
+    ID int            `db:"status_id" json:"-"`
+    PaymentID int     `db:"payment_id" json:"-"`
+    Status string     `db:"status" json:"status"`
+    Reason string     `db:"reason" json:"reason,omitempty"`
+    Changed time.Time `db:"changed_at" json:"changed"`
+}
+
+// checkTransition verifies that the payment can be moved from one status to another.
+func checkTransition(from, to string) error {
+    if to == statusReversed {
+        return inputError(codeInvalidState, "payments are reversed with the reversal endpoint")
+    }
+    if !contains(paymentTransitions[from], to) {
+        return inputError(codeInvalidState, fmt.Sprintf("cannot change the status of a %s payment to %s", from, to))
+    }
+    return nil
+}
+
+func (m BillingManager) TransferPending(fromId, toId string, amount Cents, idempotencyKey string, details PaymentDetails) (*Payment, error) {
+    return m.transfer(fromId, toId, amount, idempotencyKey, statusPending, details)
+}
+
+func (m BillingManager) SetPaymentStatus(id int, status, reason string) (*Payment, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    payment, err := lockPayment(tx, id)
+    var before Payment
+    if err == nil {
+        before = *payment
+        err = setStatusTx(tx, payment, status, reason)
+    }
+    if err == nil {
+        err = m.audit(tx, "payment.status_changed", paymentResource(id), &before, payment)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return payment, nil
+}
+
+// setStatusTx changes the status of the locked payment within the transaction tx.
+func setStatusTx(tx *sqlx.Tx, payment *Payment, status, reason string) error {
+    if err := checkTransition(payment.Status, status); err != nil {
+        return err
+    }
+    now := time.Now().UTC()
+    if status == statusCompleted {
+        if err := complete(tx, payment, now); err != nil {
+            return err
+        }
+    }
+    return changeStatus(tx, payment, status, reason, now)
+}
+
+// complete moves the funds of the locked pending or processing payment and charges
+// its fees.
+func complete(tx *sqlx.Tx, payment *Payment, now time.Time) error {
+    schedules, err := listFeeSchedules(tx)
+    if err != nil {
+        return err
+    }
+    locked, err := lockWithFees(tx, schedules, [][2]string{{payment.From, payment.To}}, now)
+    if err != nil {
+        return err
+    }
+    fromAcc, toAcc, ok := pickPair(locked, payment.From, payment.To)
+    if !ok {
+        return inputError(codeAccountNotFound, "cannot find the accounts")
+    }
+    // the payment is still pending, so its amount is included in the held amount
+    if fromAcc.Available() < 0 {
+        return inputError(codeInsufficientFunds, "cannot complete the payment: insufficient funds")
+    }
+    if err = shift(tx, fromAcc, toAcc, payment.Amount); err != nil {
+        return err
+    }
+    accounts := accountMap(locked)
+    accounts[payment.From].Amount -= payment.Amount
+    accounts[payment.From].Held -= payment.Amount
+    accounts[payment.To].Amount += payment.Amount
+    return chargeFees(tx, accounts, payment, transferFees(schedules, fromAcc, toAcc, payment.Amount), now)
+}
+
+// lockPayment selects the payment for update within the transaction tx.
+func lockPayment(tx *sqlx.Tx, id int) (*Payment, error) {
+    var payments []Payment
+    if err := tx.Select(&payments, "SELECT * FROM payment WHERE payment_id = $1 FOR UPDATE", id); err != nil {
+        return nil, err
+    }
+    if len(payments) == 0 {
+        return nil, paymentNotFound()
+    }
+    return &payments[0], nil
+}
+
+// changeStatus updates the status of the locked payment, records the change in its
+// history and writes the payment.status_changed event to the outbox.
+func changeStatus(tx *sqlx.Tx, payment *Payment, status, reason string, now time.Time) error {
+    if _, err := tx.Exec("UPDATE payment SET status = $2 WHERE payment_id = $1", payment.ID, status); err != nil {
+        return err
+    }
+    payment.Status = status
+    if err := recordStatus(tx, payment.ID, status, reason, now); err != nil {
+        return err
+    }
+    return enqueueEvent(tx, eventPaymentStatusChanged, payment, now)
+}
+
+// recordStatus appends the status to the payment's history.
+func recordStatus(tx *sqlx.Tx, paymentId int, status, reason string, now time.Time) error {
+    _, err := tx.Exec(
+        "INSERT INTO payment_status (payment_id, status, reason, changed_at) VALUES ($1, $2, $3, $4)",
+        paymentId, status, reason, now)
+    return err
+}
+
+func (m BillingManager) GetStatusHistory(id int) ([]StatusChange, error) {
+    if _, err := m.GetPayment(id); err != nil {
+        return nil, err
+    }
+    var history []StatusChange
+    err := m.DB.Select(&history, "SELECT * FROM payment_status WHERE payment_id = $1 ORDER BY status_id", id)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return history, nil
+}
+
+// setPaymentStatus changes the status of the payment. The sender can cancel its own
+// pending payment; the other changes are made by the operators.
+//
+// Example of possible request's body:
+//
+//     {"status": "failed", "reason": "rejected by the bank"}
+func (api *BillingAPI) setPaymentStatus(m Manager, resp *Responder, req *http.Request) {
+    var body StatusRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    payment, err := accessiblePayment(m, req)
+    if err == nil && (body.Status != statusCancelled || !PrincipalFrom(req.Context()).CanAccess(payment.From)) {
+        err = requireOperator(req.Context())
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if payment, err = m.SetPaymentStatus(payment.ID, body.Status, body.Reason); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(TransferResponse{Payment:payment})
+}
+
+// paymentHistory returns the status history of the payment.
+func (api *BillingAPI) paymentHistory(m Manager, resp *Responder, req *http.Request) {
+    payment, err := accessiblePayment(m, req)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    history, err := m.GetStatusHistory(payment.ID)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if history == nil {
+        history = make([]StatusChange, 0)
+    }
+    resp.SendSuccess(StatusHistoryResponse{payment.ID, payment.Status, history})
+}
@@ -1,15 +1,134 @@
 package server
 
-import "fmt"
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+)
 
-// CheckParameters verifies that dict dictionary has all expected keys.
-// If any key from the keys list is missing, the error is returned.
-func CheckParameters(dict map[string]string, keys ...string) error {
-    for _, key := range keys {
-        if _, ok := dict[key]; !ok {
-            return fmt.Errorf("required key '%s' is missing", key)
+// maxBodySize limits the size of the request body accepted by the endpoints.
+const maxBodySize = 1 << 20
+
+// decodeRequest strictly decodes JSON request body into dst and validates it.
+//
+// The body size is capped with maxBodySize, the unknown fields and the values of
+// wrong types are rejected. The returned error is a managerError listing the
+// problems with each field.
+func decodeRequest(w http.ResponseWriter, req *http.Request, dst interface{}) error {
+    decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(dst); err != nil {
+        return decodingError(err)
+    }
+    if _, err := decoder.Token(); err != io.EOF {
+        return inputError(codeInvalidRequest, "request body should contain a single JSON object")
+    }
+    return validationResult(dst)
+}
+
+// decodeQuery fills the fields of dst marked with the `query` tag from the URL
+// query parameters and validates the result.
+func decodeQuery(req *http.Request, dst interface{}) error {
+    query := req.URL.Query()
+    v := reflect.ValueOf(dst).Elem()
+    var errs []FieldError
+    for i := 0; i < v.NumField(); i++ {
+        field := v.Type().Field(i)
+        name := field.Tag.Get("query")
+        if name == "" || !query.Has(name) {
+            continue
+        }
+        if err := setFromString(v.Field(i), query.Get(name)); err != nil {
+            errs = append(errs, FieldError{name, err.Error()})
+        }
+    }
+    if len(errs) > 0 {
+        return validationError(errs)
+    }
+    return validationResult(dst)
+}
+
+// setFromString parses a query parameter value into a field.
+func setFromString(v reflect.Value, value string) error {
+    if u, ok := v.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+        if err := u.UnmarshalText([]byte(value)); err != nil {
+            return fmt.Errorf("has invalid format")
+        }
+        return nil
+    }
+    switch v.Kind() {
+    case reflect.String:
+        v.SetString(value)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil {
+            return fmt.Errorf("must be an integer")
+        }
+        v.SetInt(n)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return fmt.Errorf("must be a boolean")
         }
+        v.SetBool(b)
+    default:
+        panic(fmt.Sprintf("unsupported query parameter type: %s", v.Type()))
+    }
+    return nil
+}
+
+func validationResult(dst interface{}) error {
+    if errs := Validate(dst); len(errs) > 0 {
+        return validationError(errs)
     }
     return nil
 }
 
+// decodingError converts the JSON decoder's errors into a client-friendly form.
+func decodingError(err error) error {
+    var (
+        typeErr *json.UnmarshalTypeError
+        syntaxErr *json.SyntaxError
+        sizeErr *http.MaxBytesError
+    )
+    switch {
+    case errors.As(err, &sizeErr):
+        return inputError(codeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", sizeErr.Limit))
+    case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+        return inputError(codeInvalidRequest, "request body is not a valid JSON")
+    case errors.Is(err, io.EOF):
+        return inputError(codeInvalidRequest, "request body is empty")
+    case errors.As(err, &typeErr):
+        if typeErr.Field == "" {
+            return inputError(codeInvalidRequest, "request body should be a JSON object")
+        }
+        return validationError([]FieldError{{typeErr.Field, "must be " + jsonTypeName(typeErr.Type)}})
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+        return validationError([]FieldError{{field, "is not allowed"}})
+    }
+    return validationError([]FieldError{{"", err.Error()}})
+}
+
+// jsonTypeName describes the expected JSON type of a Go value.
+func jsonTypeName(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "an integer"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Map, reflect.Struct:
+        return "an object"
+    }
+    return "a string"
+}
@@ -0,0 +1,164 @@
+// Version 1 of the payment API.
+//
+// The endpoints from this file use resource-oriented URLs, report amounts as integer
+// number of cents, and paginate long lists. The typed client from the client package
+// is built on top of them.
+package server
+
+import (
+    "net/http"
+    "strconv"
+)
+
+const (
+    defaultPageSize = 50
+    maxPageSize = 100
+    maxIdempotencyKeyLength = 64
+)
+
+// listAccounts returns all available accounts.
+func (api *BillingAPI) listAccounts(m Manager, resp *Responder, req *http.Request) {
+    accounts, err := m.GetAvailableAccounts()
+    if err != nil {
+        writeManagerError(internalError(err), resp)
+        return
+    }
+    result := make([]AccountView, 0, len(accounts))
+    for _, acc := range accessible(req.Context(), accounts) {
+        result = append(result, newAccountView(acc))
+    }
+    resp.SendSuccess(AccountListResponse{result})
+}
+
+// getAccount returns a single account identified by the path parameter.
+func (api *BillingAPI) getAccount(m Manager, resp *Responder, req *http.Request) {
+    if err := authorize(req.Context(), req.PathValue("id")); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    acc, err := m.GetAccount(req.PathValue("id"))
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(AccountResponse{newAccountView(*acc)})
+}
+
+// listPayments returns account's payments page by page, starting from the newest one.
+//
+// The endpoint accepts the following query parameters:
+//     * limit: maximal number of payments on the page, up to 100 (50 by default)
+//     * cursor: an opaque value taken from the next_cursor field of the previous page
+//     * reference: the sender's reference of the payments
+//     * metadata_key, metadata_value: the metadata key of the payments, and its value
+//
+// The next_cursor field is empty when there are no more pages.
+func (api *BillingAPI) listPayments(m Manager, resp *Responder, req *http.Request) {
+    query := PaymentQuery{Limit:defaultPageSize}
+    err := decodeQuery(req, &query)
+    if err == nil && query.MetadataValue != "" && query.MetadataKey == "" {
+        err = validationError([]FieldError{{"metadata_value", "requires metadata_key"}})
+    }
+    var page PageRequest
+    if err == nil {
+        page, err = pageRequest(query.Limit, query.Cursor)
+    }
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    filter := PaymentFilter{query.Reference, query.MetadataKey, query.MetadataValue}
+
+    accountId := req.PathValue("id")
+    if err := authorize(req.Context(), accountId); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    limit := page.Limit
+    page.Limit++ // fetch one extra item to find out if there is a next page
+    payments, err := m.ListPayments(accountId, page, filter)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    next := ""
+    if len(payments) > limit {
+        payments = payments[:limit]
+        next = strconv.Itoa(payments[limit-1].ID)
+    }
+    if payments == nil {
+        payments = make([]Payment, 0)
+    }
+    resp.SendSuccess(PaymentPageResponse{accountId, payments, next})
+}
+
+// createTransfer moves funds between two accounts.
+//
+// Example of possible request's body:
+//
+//     {"from": "account_1", "to": "account_2", "amount": 1000}
+//
+// The optional Idempotency-Key header makes the request safe to retry: the transfer
+// is performed once, and the repeated requests receive the same payment. With
+// "pending": true the payment reserves the funds and is settled later. A transfer
+// above the approval threshold returns the approval waiting for a second principal.
+func (api *BillingAPI) createTransfer(m Manager, resp *Responder, req *http.Request) {
+    var body TransferRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    if err := authorize(req.Context(), body.From); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    key := req.Header.Get("Idempotency-Key")
+    if len(key) > maxIdempotencyKeyLength {
+        writeManagerError(validationError([]FieldError{{"Idempotency-Key", "must have length at most 64"}}), resp)
+        return
+    }
+    if api.checkThreshold(body.Amount) != nil {
+        approval, err := api.requestApproval(m, req, body, key)
+        if err != nil {
+            writeManagerError(err, resp)
+            return
+        }
+        resp.SendSuccess(TransferResponse{Approval:approval})
+        return
+    }
+    transfer := m.Transfer
+    if body.Pending {
+        transfer = m.TransferPending
+    }
+    payment, err := transfer(body.From, body.To, body.Amount, key, body.PaymentDetails)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(TransferResponse{Payment:payment})
+}
+
+// parsePage reads pagination parameters from the request's query string.
+func parsePage(req *http.Request) (PageRequest, error) {
+    query := PageQuery{Limit:defaultPageSize}
+    if err := decodeQuery(req, &query); err != nil {
+        return PageRequest{}, err
+    }
+    return pageRequest(query.Limit, query.Cursor)
+}
+
+// pageRequest converts the pagination parameters into a PageRequest.
+func pageRequest(limit int, cursor string) (PageRequest, error) {
+    page := PageRequest{Limit:limit}
+    if cursor != "" {
+        before, err := strconv.Atoi(cursor)
+        if err != nil || before <= 0 {
+            return page, validationError([]FieldError{{"cursor", "is malformed"}})
+        }
+        page.Before = before
+    }
+    return page, nil
+}
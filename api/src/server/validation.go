@@ -0,0 +1,189 @@
+// Declarative validation of the request structures.
+//
+// The rules are declared with the `validate` tag of the struct fields and checked with
+// the Validate function. Every violated rule is reported as a separate FieldError so
+// the client gets the full list of problems at once.
+package server
+
+import (
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// FieldError describes a problem with a single field of the request.
+type FieldError struct {
+    Field string   `json:"field"`
+    Message string `json:"message"`
+}
+
+// Validate checks a struct against the rules declared in its `validate` tags.
+//
+// The following rules are supported:
+//     * required: the field should not have a zero value
+//     * min=N, max=N: the bounds of a number, or of the length of a string, a slice or
+//       a map
+//     * keymax=N, valuemax=N: the bounds of the lengths of a string map's keys and values
+//     * oneof=a|b|c: a string should be equal to one of the listed options
+//
+// Rules other than required are skipped for zero values, so optional fields can be
+// omitted. Nested structs and slices of structs are validated recursively; the field
+// names are taken from the `json` or `query` tags, and the fields of the embedded
+// structs are named as the fields of the struct embedding them.
+func Validate(value interface{}) []FieldError {
+    v := reflect.Indirect(reflect.ValueOf(value))
+    return validateStruct(v, "")
+}
+
+func validateStruct(v reflect.Value, prefix string) []FieldError {
+    var errs []FieldError
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        if field.PkgPath != "" {
+            continue
+        }
+        fv := v.Field(i)
+        if field.Anonymous && fv.Kind() == reflect.Struct {
+            errs = append(errs, validateStruct(fv, prefix)...)
+            continue
+        }
+        name := prefix + fieldName(field)
+        if message := checkRules(fv, field.Tag.Get("validate")); message != "" {
+            errs = append(errs, FieldError{name, message})
+            continue
+        }
+        errs = append(errs, validateNested(fv, name)...)
+    }
+    return errs
+}
+
+func validateNested(v reflect.Value, name string) []FieldError {
+    switch v.Kind() {
+    case reflect.Ptr:
+        if !v.IsNil() {
+            return validateNested(v.Elem(), name)
+        }
+    case reflect.Struct:
+        if v.Type().NumField() > 0 && v.Type().Field(0).PkgPath == "" {
+            return validateStruct(v, name+".")
+        }
+    case reflect.Slice:
+        var errs []FieldError
+        for i := 0; i < v.Len(); i++ {
+            errs = append(errs, validateNested(v.Index(i), fmt.Sprintf("%s[%d]", name, i))...)
+        }
+        return errs
+    }
+    return nil
+}
+
+// checkRules returns a description of the first violated rule or an empty string.
+func checkRules(v reflect.Value, tag string) string {
+    if tag == "" {
+        return ""
+    }
+    rules := strings.Split(tag, ",")
+    if v.IsZero() {
+        for _, rule := range rules {
+            if rule == "required" {
+                return "is required"
+            }
+        }
+        return ""
+    }
+    for _, rule := range rules {
+        name, arg := rule, ""
+        if i := strings.Index(rule, "="); i >= 0 {
+            name, arg = rule[:i], rule[i+1:]
+        }
+        var message string
+        switch name {
+        case "required":
+        case "min", "max":
+            message = checkBound(v, name, arg)
+        case "keymax", "valuemax":
+            message = checkEntries(v, name, arg)
+        case "oneof":
+            message = checkOneOf(v, strings.Split(arg, "|"))
+        default:
+            panic(fmt.Sprintf("unknown validation rule: %s", rule))
+        }
+        if message != "" {
+            return message
+        }
+    }
+    return ""
+}
+
+func checkBound(v reflect.Value, rule, arg string) string {
+    bound, err := strconv.ParseFloat(arg, 64)
+    if err != nil {
+        panic(fmt.Sprintf("invalid validation rule argument: %s=%s", rule, arg))
+    }
+    var (
+        actual float64
+        what = "be"
+    )
+    switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        actual = float64(v.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        actual = float64(v.Uint())
+    case reflect.Float32, reflect.Float64:
+        actual = v.Float()
+    case reflect.String:
+        actual, what = float64(utf8.RuneCountInString(v.String())), "have length"
+    case reflect.Slice, reflect.Map:
+        actual, what = float64(v.Len()), "have size"
+    default:
+        return ""
+    }
+    if rule == "min" && actual < bound {
+        return fmt.Sprintf("must %s at least %s", what, arg)
+    }
+    if rule == "max" && actual > bound {
+        return fmt.Sprintf("must %s at most %s", what, arg)
+    }
+    return ""
+}
+
+func checkEntries(v reflect.Value, rule, arg string) string {
+    bound, err := strconv.Atoi(arg)
+    if err != nil || v.Kind() != reflect.Map {
+        panic(fmt.Sprintf("invalid validation rule: %s=%s", rule, arg))
+    }
+    iter := v.MapRange()
+    for iter.Next() {
+        key, value := iter.Key().String(), iter.Value().String()
+        if rule == "keymax" && utf8.RuneCountInString(key) > bound {
+            return fmt.Sprintf("must have keys of length at most %s", arg)
+        }
+        if rule == "valuemax" && utf8.RuneCountInString(value) > bound {
+            return fmt.Sprintf("must have values of length at most %s", arg)
+        }
+    }
+    return ""
+}
+
+func checkOneOf(v reflect.Value, options []string) string {
+    value := fmt.Sprint(v.Interface())
+    for _, option := range options {
+        if value == option {
+            return ""
+        }
+    }
+    return fmt.Sprintf("must be one of: %s", strings.Join(options, ", "))
+}
+
+// fieldName returns the name of the field as the client sees it.
+func fieldName(field reflect.StructField) string {
+    for _, key := range []string{"json", "query"} {
+        if name := strings.Split(field.Tag.Get(key), ",")[0]; name != "" && name != "-" {
+            return name
+        }
+    }
+    return field.Name
+}
@@ -0,0 +1,445 @@
+// Webhook subscriptions and the transactional outbox.
+//
+// Every event which should be delivered to the partners is written to the outbox_event
+// table in the same transaction as the change it describes, so an event is never lost
+// and never sent for a rolled back change. In the same transaction, a delivery is
+// queued for every active subscription to the event's type. The deliveries are sent
+// by the Dispatcher, see dispatcher.go.
+package server
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/jmoiron/sqlx"
+    "github.com/lib/pq"
+)
+
+// Types of the events delivered to the webhooks.
+const (
+    eventPaymentCreated = "payment.created"
+    eventPaymentStatusChanged = "payment.status_changed"
+)
+
+// webhookEvents lists the event types a webhook can subscribe to.
+var webhookEvents = []string{eventPaymentCreated, eventPaymentStatusChanged}
+
+// Statuses of the webhook deliveries.
+const (
+    deliveryPending = "pending"
+    deliveryDelivered = "delivered"
+    deliveryDead = "dead"
+)
+
+// Webhook is a subscription of a partner's URL to the events of the given types.
+// The payloads are signed with the Secret, see signPayload.
+type Webhook struct {
+    ID int                    `db:"webhook_id"`
+    URL string                `db:"url"`
+    EventTypes pq.StringArray `db:"event_types"`
+    Secret string             `db:"secret"`
+    Active bool               `db:"active"`
+    Created time.Time         `db:"created_on"`
+}
+
+// WebhookDelivery is an attempt to deliver an outbox event to a webhook.
+//
+// Pending deliveries are sent when their NextAttempt comes; after too many failed
+// attempts, the delivery becomes dead and is kept until it is redelivered manually.
+type WebhookDelivery struct {
+    ID int                 `db:"delivery_id"`
+    WebhookID int          `db:"webhook_id"`
+    EventID int            `db:"event_id"`
+    Status string          `db:"status"`
+    Attempts int           `db:"attempts"`
+    NextAttempt time.Time  `db:"next_attempt_at"`
+    LastError sql.NullString `db:"last_error"`
+    Delivered sql.NullTime `db:"delivered_at"`
+    EventType string       `db:"event_type"`
+    Payload []byte         `db:"payload"`
+    URL string             `db:"url"`
+    Secret string          `db:"secret"`
+}
+
+// WebhookStore keeps the webhook subscriptions and the queue of their deliveries.
+type WebhookStore interface {
+    CreateWebhook(hook Webhook) (*Webhook, error)
+    ListWebhooks() ([]Webhook, error)
+    // DeleteWebhook deactivates the subscription; its pending deliveries are not sent.
+    DeleteWebhook(id int) (*Webhook, error)
+    ListDeliveries(status string, limit int) ([]WebhookDelivery, error)
+    // Redeliver queues the delivery to be sent again at the given time, with
+    // the attempts counter reset.
+    Redeliver(deliveryId int, at time.Time) (*WebhookDelivery, error)
+    // ClaimDeliveries picks up to limit pending deliveries which are due at now,
+    // counts an attempt for each of them, and postpones them by the lease, so no
+    // other dispatcher picks them until the attempt is finished or has timed out.
+    ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+    CompleteDelivery(id int, at time.Time) error
+    // FailDelivery records a failed attempt; the delivery is retried at retryAt
+    // unless it is dead.
+    FailDelivery(id int, reason string, retryAt time.Time, dead bool) error
+}
+
+// webhookNotFound is returned when a webhook or a delivery doesn't exist.
+func webhookNotFound(what string) managerError {
+    return inputError(codeNotFound, what+" is not found")
+}
+
+// enqueueEvent writes the event to the outbox, notifies the event feeds and queues its
+// deliveries to the subscribed webhooks as a part of the transaction tx.
+func enqueueEvent(tx *sqlx.Tx, eventType string, data interface{}, at time.Time) error {
+    payload, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    var eventId int
+    err = tx.Get(&eventId, `
+        INSERT INTO outbox_event (event_type, payload, created_on) VALUES ($1, $2, $3)
+        RETURNING event_id`, eventType, payload, at)
+    if err != nil {
+        return err
+    }
+    // the notification is delivered to the listeners when the transaction is committed
+    if _, err = tx.Exec("SELECT pg_notify($1, $2)", outboxChannel, strconv.Itoa(eventId)); err != nil {
+        return err
+    }
+    _, err = tx.Exec(`
+        INSERT INTO webhook_delivery (webhook_id, event_id, status, attempts, next_attempt_at)
+        SELECT webhook_id, $1, $2, 0, $3 FROM webhook WHERE active AND $4 = ANY(event_types)`,
+        eventId, deliveryPending, at, eventType)
+    return err
+}
+
+// deliveryQuery selects the deliveries with their events and webhooks.
+const deliveryQuery = `
+    SELECT d.*, e.event_type, e.payload, w.url, w.secret
+    FROM webhook_delivery d
+    JOIN outbox_event e ON e.event_id = d.event_id
+    JOIN webhook w ON w.webhook_id = d.webhook_id`
+
+func (m BillingManager) CreateWebhook(hook Webhook) (*Webhook, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    stmt, err := tx.PrepareNamed(`
+        INSERT INTO webhook (url, event_types, secret, active, created_on)
+        VALUES (:url, :event_types, :secret, :active, :created_on)
+        RETURNING webhook_id`)
+    if err == nil {
+        err = stmt.Get(&hook.ID, hook)
+    }
+    if err == nil {
+        view := newWebhookView(hook)
+        err = m.audit(tx, "webhook.created", "webhook/" + strconv.Itoa(hook.ID), nil, &view)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &hook, nil
+}
+
+func (m BillingManager) ListWebhooks() ([]Webhook, error) {
+    var hooks []Webhook
+    err := m.DB.Select(&hooks, "SELECT * FROM webhook WHERE active ORDER BY webhook_id")
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return hooks, nil
+}
+
+func (m BillingManager) DeleteWebhook(id int) (*Webhook, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    var hooks []Webhook
+    err = tx.Select(&hooks, "UPDATE webhook SET active = FALSE WHERE webhook_id = $1 AND active RETURNING *", id)
+    if err == nil && len(hooks) == 0 {
+        err = webhookNotFound("webhook")
+    }
+    if err == nil {
+        before, after := newWebhookView(hooks[0]), newWebhookView(hooks[0])
+        before.Active = true
+        err = m.audit(tx, "webhook.deleted", "webhook/" + strconv.Itoa(id), &before, &after)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &hooks[0], nil
+}
+
+func (m BillingManager) ListDeliveries(status string, limit int) ([]WebhookDelivery, error) {
+    var deliveries []WebhookDelivery
+    err := m.DB.Select(&deliveries, deliveryQuery + `
+        WHERE $1 = '' OR d.status = $1
+        ORDER BY d.delivery_id DESC
+        LIMIT $2`, status, limit)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return deliveries, nil
+}
+
+func (m BillingManager) Redeliver(deliveryId int, at time.Time) (*WebhookDelivery, error) {
+    tx, err := m.DB.Beginx()
+    if err != nil {
+        return nil, internalError(err)
+    }
+    result, err := tx.Exec(`
+        UPDATE webhook_delivery SET status = $2, attempts = 0, next_attempt_at = $3, delivered_at = NULL
+        WHERE delivery_id = $1`, deliveryId, deliveryPending, at)
+    if err == nil {
+        if n, _ := result.RowsAffected(); n == 0 {
+            err = webhookNotFound("delivery")
+        }
+    }
+    var deliveries []WebhookDelivery
+    if err == nil {
+        err = tx.Select(&deliveries, deliveryQuery + " WHERE d.delivery_id = $1", deliveryId)
+    }
+    if err == nil {
+        view := newDeliveryView(deliveries[0])
+        err = m.audit(tx, "delivery.redelivered", "delivery/" + strconv.Itoa(deliveryId), nil, &view)
+    }
+    if err != nil {
+        mustRollback(tx)
+        return nil, internalError(err)
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, internalError(err)
+    }
+    return &deliveries[0], nil
+}
+
+// ClaimDeliveries locks the due rows with SKIP LOCKED, so several dispatchers can
+// share the queue without sending the same delivery twice.
+func (m BillingManager) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+    var deliveries []WebhookDelivery
+    err := m.DB.Select(&deliveries, `
+        WITH claimed AS (
+            UPDATE webhook_delivery SET attempts = attempts + 1, next_attempt_at = $2
+            WHERE delivery_id IN (
+                SELECT delivery_id FROM webhook_delivery
+                WHERE status = $4 AND next_attempt_at <= $1
+                  AND webhook_id IN (SELECT webhook_id FROM webhook WHERE active)
+                ORDER BY next_attempt_at
+                LIMIT $3
+                FOR UPDATE SKIP LOCKED)
+            RETURNING *)
+        SELECT d.*, e.event_type, e.payload, w.url, w.secret
+        FROM claimed d
+        JOIN outbox_event e ON e.event_id = d.event_id
+        JOIN webhook w ON w.webhook_id = d.webhook_id
+        ORDER BY d.next_attempt_at`, now, now.Add(lease), limit, deliveryPending)
+    if err != nil {
+        return nil, internalError(err)
+    }
+    return deliveries, nil
+}
+
+func (m BillingManager) CompleteDelivery(id int, at time.Time) error {
+    _, err := m.DB.Exec(
+        "UPDATE webhook_delivery SET status = $2, delivered_at = $3, last_error = NULL WHERE delivery_id = $1",
+        id, deliveryDelivered, at)
+    if err != nil {
+        return internalError(err)
+    }
+    return nil
+}
+
+func (m BillingManager) FailDelivery(id int, reason string, retryAt time.Time, dead bool) error {
+    status := deliveryPending
+    if dead {
+        status = deliveryDead
+    }
+    _, err := m.DB.Exec(
+        "UPDATE webhook_delivery SET status = $2, last_error = $3, next_attempt_at = $4 WHERE delivery_id = $1",
+        id, status, reason, retryAt)
+    if err != nil {
+        return internalError(err)
+    }
+    return nil
+}
+
+// newWebhookSecret generates a random signing secret.
+func newWebhookSecret() string {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        panic(fmt.Sprintf("cannot generate a secret: %s", err))
+    }
+    return "whsec_" + hex.EncodeToString(buf)
+}
+
+// createWebhook subscribes a URL to the events. The signing secret is generated
+// unless it is given in the request, and it is returned only in this response.
+//
+// Example of possible request's body:
+//
+//     {"url": "https://partner.example.com/hooks", "event_types": ["payment.created"]}
+func (api *BillingAPI) createWebhook(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    var body WebhookRequest
+    if err := decodeRequest(resp, req, &body); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    if err := body.check(); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+
+    hook := Webhook{
+        URL:body.URL,
+        EventTypes:body.EventTypes,
+        Secret:body.Secret,
+        Active:true,
+        Created:time.Now().UTC()}
+    if hook.Secret == "" {
+        hook.Secret = newWebhookSecret()
+    }
+    created, err := m.CreateWebhook(hook)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    view := newWebhookView(*created)
+    view.Secret = created.Secret
+    resp.SendSuccess(WebhookResponse{view})
+}
+
+// listWebhooks returns the active subscriptions.
+func (api *BillingAPI) listWebhooks(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    hooks, err := m.ListWebhooks()
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    result := make([]WebhookView, 0, len(hooks))
+    for _, hook := range hooks {
+        result = append(result, newWebhookView(hook))
+    }
+    resp.SendSuccess(WebhookListResponse{result})
+}
+
+// deleteWebhook deactivates the subscription identified by the path parameter.
+func (api *BillingAPI) deleteWebhook(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    id, err := pathID(req, "id")
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    hook, err := m.DeleteWebhook(id)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(WebhookResponse{newWebhookView(*hook)})
+}
+
+// listDeliveries returns the newest deliveries, optionally filtered by status.
+// The dead-lettered deliveries are listed with status=dead.
+func (api *BillingAPI) listDeliveries(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    query := DeliveryQuery{Limit:defaultPageSize}
+    if err := decodeQuery(req, &query); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    deliveries, err := m.ListDeliveries(query.Status, query.Limit)
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    result := make([]DeliveryView, 0, len(deliveries))
+    for _, d := range deliveries {
+        result = append(result, newDeliveryView(d))
+    }
+    resp.SendSuccess(DeliveryListResponse{result})
+}
+
+// redeliver queues the delivery to be sent again right away. It is used to resend
+// the dead-lettered deliveries once the partner's endpoint is fixed.
+func (api *BillingAPI) redeliver(m Manager, resp *Responder, req *http.Request) {
+    if err := requireOperator(req.Context()); err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    id, err := pathID(req, "id")
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    delivery, err := m.Redeliver(id, time.Now().UTC())
+    if err != nil {
+        writeManagerError(err, resp)
+        return
+    }
+    resp.SendSuccess(DeliveryResponse{newDeliveryView(*delivery)})
+}
+
+// check verifies the URL and the event types which cannot be expressed with
+// the validation rules.
+func (r WebhookRequest) check() error {
+    var errs []FieldError
+    if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        errs = append(errs, FieldError{"url", "must be an absolute http(s) URL"})
+    }
+    for i, eventType := range r.EventTypes {
+        if !contains(webhookEvents, eventType) {
+            errs = append(errs, FieldError{fmt.Sprintf("event_types[%d]", i), "is not a known event type"})
+        }
+    }
+    if len(errs) > 0 {
+        return validationError(errs)
+    }
+    return nil
+}
+
+// pathID parses a numeric path parameter.
+func pathID(req *http.Request, name string) (int, error) {
+    id, err := strconv.Atoi(req.PathValue(name))
+    if err != nil || id <= 0 {
+        return 0, inputError(codeNotFound, "resource is not found")
+    }
+    return id, nil
+}
+
+func contains(list []string, value string) bool {
+    for _, item := range list {
+        if item == value {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestDispatcher_SignedDelivery(t *testing.T) {
+    var received []*http.Request
+    var bodies [][]byte
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        body, _ := io.ReadAll(req.Body)
+        received, bodies = append(received, req), append(bodies, body)
+    }))
+    defer receiver.Close()
+
+    store := NewMockWebhooks()
+    hook, _ := store.CreateWebhook(Webhook{URL:receiver.URL, EventTypes:[]string{eventPaymentCreated}, Secret:"s3cr3t", Active:true})
+    store.enqueue(eventPaymentCreated, payments[0], time.Now())
+
+    dispatcher := NewDispatcher(store)
+    if n, err := dispatcher.DispatchOnce(context.Background()); err != nil || n != 1 {
+        t.Fatalf("one delivery was expected: %d, %v", n, err)
+    }
+    if len(received) != 1 {
+        t.Fatalf("invalid number of requests: %d", len(received))
+    }
+
+    header := received[0].Header.Get(headerSignature)
+    timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(header, ",")[0], "t="), 10, 64)
+    if expected := signPayload(hook.Secret, timestamp, bodies[0]); header != expected {
+        t.Errorf("invalid signature: %s, expected %s", header, expected)
+    }
+    var event WebhookEvent
+    if err := json.Unmarshal(bodies[0], &event); err != nil || event.Type != eventPaymentCreated {
+        t.Errorf("invalid event: %s, %v", bodies[0], err)
+    }
+    var payment Payment
+    if err := json.Unmarshal(event.Data, &payment); err != nil || payment.ID != payments[0].ID {
+        t.Errorf("invalid payment: %s, %v", event.Data, err)
+    }
+
+    deliveries, _ := store.ListDeliveries(deliveryDelivered, 10)
+    if len(deliveries) != 1 || deliveries[0].Attempts != 1 {
+        t.Errorf("the delivery was not completed: %v", deliveries)
+    }
+}
+
+func TestDispatcher_RetriesAndDeadLetters(t *testing.T) {
+    var calls int
+    var failing = true
+    receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        calls++
+        if failing {
+            w.WriteHeader(http.StatusInternalServerError)
+        }
+    }))
+    defer receiver.Close()
+
+    store := NewMockWebhooks()
+    _, _ = store.CreateWebhook(Webhook{URL:receiver.URL, EventTypes:[]string{eventPaymentCreated}, Secret:"s3cr3t", Active:true})
+    store.enqueue(eventPaymentCreated, payments[0], time.Now())
+
+    clock := time.Now()
+    dispatcher := NewDispatcher(store)
+    dispatcher.MaxAttempts = 3
+    dispatcher.now = func() time.Time { return clock }
+
+    var delays []time.Duration
+    for attempt := 1; attempt <= 3; attempt++ {
+        if n, err := dispatcher.DispatchOnce(context.Background()); err != nil || n != 0 {
+            t.Fatalf("attempt %d should fail: %d, %v", attempt, n, err)
+        }
+        // nothing is due until the backoff has passed
+        if n, _ := dispatcher.DispatchOnce(context.Background()); n != 0 || calls != attempt {
+            t.Fatalf("attempt %d was retried too early", attempt)
+        }
+        delivery := store.deliveries[0]
+        delays = append(delays, delivery.NextAttempt.Sub(clock))
+        clock = delivery.NextAttempt
+    }
+    if delays[0] != dispatcher.Backoff || delays[1] != 2*dispatcher.Backoff {
+        t.Errorf("exponential backoff was expected: %v", delays)
+    }
+
+    dead, _ := store.ListDeliveries(deliveryDead, 10)
+    if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError.String == "" {
+        t.Fatalf("the delivery should be dead-lettered: %v", dead)
+    }
+    if _, _ = dispatcher.DispatchOnce(context.Background()); calls != 3 {
+        t.Errorf("a dead delivery should not be sent: %d calls", calls)
+    }
+
+    failing = false
+    if _, err := store.Redeliver(dead[0].ID, clock); err != nil {
+        t.Fatal(err)
+    }
+    if n, err := dispatcher.DispatchOnce(context.Background()); err != nil || n != 1 {
+        t.Errorf("the redelivery should succeed: %d, %v", n, err)
+    }
+}
+
+func TestV1_Webhooks(t *testing.T) {
+    makeRequest(t, func(client TestClient) {
+        response := client.Request("POST", "v1/webhooks",
+            map[string]interface{}{"url": "ftp://example.com", "event_types": []string{"payment.unknown"}}, nil)
+        if response["code"] != codeValidationFailed || len(response["fields"].([]interface{})) != 2 {
+            t.Errorf("validation error was expected: %v", response)
+        }
+
+        response = client.Request("POST", "v1/webhooks",
+            map[string]interface{}{"url": "https://example.com/hook", "event_types": []string{eventPaymentCreated}}, nil)
+        webhook := response["webhook"].(map[string]interface{})
+        if !strings.HasPrefix(fmt.Sprint(webhook["secret"]), "whsec_") {
+            t.Errorf("a generated secret was expected: %v", webhook)
+        }
+
+        client.Request("POST", "v1/transfers", map[string]interface{}{"from": "A", "to": "B", "amount": 100}, nil)
+        response = client.Request("GET", "v1/webhooks/deliveries?status=pending", nil, nil)
+        queued := 0
+        for _, item := range response["deliveries"].([]interface{}) {
+            if item.(map[string]interface{})["webhook_id"] == webhook["id"] {
+                queued++
+            }
+        }
+        if queued != 1 {
+            t.Errorf("the transfer should queue a delivery: %v", response)
+        }
+
+        response = client.Request("GET", "v1/webhooks", nil, nil)
+        for _, item := range response["webhooks"].([]interface{}) {
+            if _, ok := item.(map[string]interface{})["secret"]; ok {
+                t.Errorf("the secret should not be listed: %v", item)
+            }
+        }
+
+        response = client.Request("DELETE", fmt.Sprintf("v1/webhooks/%v", webhook["id"]), nil, nil)
+        if response["webhook"].(map[string]interface{})["active"] != false {
+            t.Errorf("the webhook should be deactivated: %v", response)
+        }
+        response = client.Request("POST", "v1/webhooks/deliveries/999/redeliver", nil, nil)
+        if response["code"] != codeNotFound {
+            t.Errorf("not_found was expected: %v", response)
+        }
+    })
+}
+
+// ----------------------------
+// In-memory webhook store mock
+// ----------------------------
+
+// MockWebhooks implements the WebhookStore in memory.
+type MockWebhooks struct {
+    mu sync.Mutex
+    webhooks []Webhook
+    events []WebhookEvent
+    deliveries []WebhookDelivery
+}
+
+func NewMockWebhooks() *MockWebhooks {
+    return &MockWebhooks{}
+}
+
+// newMockWebhooksWithFixtures returns a store with a single dead delivery.
+func newMockWebhooksWithFixtures() *MockWebhooks {
+    store := NewMockWebhooks()
+    _, _ = store.CreateWebhook(Webhook{URL:"http://127.0.0.1:1/hook", EventTypes:[]string{eventPaymentCreated}, Secret:"fixture", Active:true})
+    store.enqueue(eventPaymentCreated, payments[0], time.Now().UTC())
+    store.deliveries[0].Status = deliveryDead
+    store.deliveries[0].Attempts = 8
+    return store
+}
+
+// enqueue writes the event to the outbox the way the Transfer's transaction does.
+func (s *MockWebhooks) enqueue(eventType string, data interface{}, at time.Time) {
+    payload, _ := json.Marshal(data)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    event := WebhookEvent{ID:len(s.events) + 1, Type:eventType, Data:payload}
+    s.events = append(s.events, event)
+    for _, hook := range s.webhooks {
+        if hook.Active && contains(hook.EventTypes, eventType) {
+            s.deliveries = append(s.deliveries, WebhookDelivery{
+                ID:len(s.deliveries) + 1,
+                WebhookID:hook.ID,
+                EventID:event.ID,
+                Status:deliveryPending,
+                NextAttempt:at})
+        }
+    }
+}
+
+// FeedPayments polls the events enqueued after the call.
+func (s *MockWebhooks) FeedPayments(ctx context.Context, publish func(Payment)) error {
+    s.mu.Lock()
+    next := len(s.events)
+    s.mu.Unlock()
+    ticker := time.NewTicker(10*time.Millisecond)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-ticker.C:
+        }
+        s.mu.Lock()
+        events := s.events[next:]
+        next = len(s.events)
+        s.mu.Unlock()
+        for _, event := range events {
+            var payment Payment
+            if event.Type == eventPaymentCreated && json.Unmarshal(event.Data, &payment) == nil && payment.Kind != paymentSplit {
+                publish(payment)
+            }
+        }
+    }
+}
+
+// joined fills the event's and the webhook's fields of the delivery.
+func (s *MockWebhooks) joined(d WebhookDelivery) WebhookDelivery {
+    event, hook := s.events[d.EventID-1], s.webhooks[d.WebhookID-1]
+    d.EventType, d.Payload, d.URL, d.Secret = event.Type, event.Data, hook.URL, hook.Secret
+    return d
+}
+
+func (s *MockWebhooks) CreateWebhook(hook Webhook) (*Webhook, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    hook.ID = len(s.webhooks) + 1
+    s.webhooks = append(s.webhooks, hook)
+    return &hook, nil
+}
+
+func (s *MockWebhooks) ListWebhooks() ([]Webhook, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var hooks []Webhook
+    for _, hook := range s.webhooks {
+        if hook.Active {
+            hooks = append(hooks, hook)
+        }
+    }
+    return hooks, nil
+}
+
+func (s *MockWebhooks) DeleteWebhook(id int) (*Webhook, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if id > len(s.webhooks) || !s.webhooks[id-1].Active {
+        return nil, webhookNotFound("webhook")
+    }
+    s.webhooks[id-1].Active = false
+    hook := s.webhooks[id-1]
+    return &hook, nil
+}
+
+func (s *MockWebhooks) ListDeliveries(status string, limit int) ([]WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var result []WebhookDelivery
+    for i := len(s.deliveries) - 1; i >= 0 && len(result) < limit; i-- {
+        if status == "" || s.deliveries[i].Status == status {
+            result = append(result, s.joined(s.deliveries[i]))
+        }
+    }
+    return result, nil
+}
+
+func (s *MockWebhooks) Redeliver(deliveryId int, at time.Time) (*WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if deliveryId > len(s.deliveries) {
+        return nil, webhookNotFound("delivery")
+    }
+    d := &s.deliveries[deliveryId-1]
+    d.Status, d.Attempts, d.NextAttempt, d.Delivered.Valid = deliveryPending, 0, at, false
+    result := s.joined(*d)
+    return &result, nil
+}
+
+func (s *MockWebhooks) ClaimDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var claimed []WebhookDelivery
+    for i := range s.deliveries {
+        d := &s.deliveries[i]
+        if len(claimed) == limit {
+            break
+        }
+        if d.Status == deliveryPending && !d.NextAttempt.After(now) && s.webhooks[d.WebhookID-1].Active {
+            d.Attempts++
+            d.NextAttempt = now.Add(lease)
+            claimed = append(claimed, s.joined(*d))
+        }
+    }
+    return claimed, nil
+}
+
+func (s *MockWebhooks) CompleteDelivery(id int, at time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := &s.deliveries[id-1]
+    d.Status, d.LastError.Valid = deliveryDelivered, false
+    d.Delivered.Time, d.Delivered.Valid = at, true
+    return nil
+}
+
+func (s *MockWebhooks) FailDelivery(id int, reason string, retryAt time.Time, dead bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := &s.deliveries[id-1]
+    d.LastError.String, d.LastError.Valid = reason, true
+    d.NextAttempt = retryAt
+    if dead {
+        d.Status = deliveryDead
+    }
+    return nil
+}
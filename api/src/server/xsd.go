@@ -0,0 +1,504 @@
+// Validation of the XML documents against the bundled XML schemas.
+//
+// The validator supports the subset of XML Schema which the ISO 20022 message
+// schemas are written in: global elements, named complex types with a sequence or a
+// choice of elements, or with a simple content and attributes, and named simple types
+// restricting the built-in types with the pattern, enumeration, length, minInclusive,
+// fractionDigits and totalDigits facets. The content of the elements of the xs:anyType
+// type is not checked. The schemas are parsed once, when the package is loaded; a
+// schema using anything else fails to load.
+package server
+
+import (
+    "embed"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "math/big"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+//go:embed schemas/*.xsd
+var schemaFiles embed.FS
+
+// maxSchemaErrors is the number of the problems reported for a document; the rest
+// are dropped, as they are usually caused by the first ones.
+const maxSchemaErrors = 20
+
+const xsdAnyType = "xs:anyType"
+
+// xsdSchema is a parsed schema.
+type xsdSchema struct {
+    namespace string
+    elements map[string]string
+    complexTypes map[string]*xsdComplexType
+    simpleTypes map[string]*xsdSimpleType
+}
+
+// xsdParticle is an element declared in a sequence or a choice. The max is -1 for
+// the unbounded elements.
+type xsdParticle struct {
+    Name string      `xml:"name,attr"`
+    Type string      `xml:"type,attr"`
+    MinOccurs string `xml:"minOccurs,attr"`
+    MaxOccurs string `xml:"maxOccurs,attr"`
+    min, max int
+}
+
+type xsdGroup struct {
+    Elements []xsdParticle `xml:"element"`
+}
+
+type xsdAttribute struct {
+    Name string `xml:"name,attr"`
+    Type string `xml:"type,attr"`
+    Use string  `xml:"use,attr"`
+}
+
+type xsdSimpleContent struct {
+    Base string               `xml:"base,attr"`
+    Attributes []xsdAttribute `xml:"attribute"`
+}
+
+type xsdComplexType struct {
+    Name string                     `xml:"name,attr"`
+    Sequence *xsdGroup              `xml:"sequence"`
+    Choice *xsdGroup                `xml:"choice"`
+    SimpleContent *xsdSimpleContent `xml:"simpleContent>extension"`
+}
+
+type xsdRestriction struct {
+    Base string       `xml:"base,attr"`
+    Facets []xsdFacet `xml:",any"`
+}
+
+type xsdSimpleType struct {
+    Name string                `xml:"name,attr"`
+    Restriction xsdRestriction `xml:"restriction"`
+    pattern *regexp.Regexp
+}
+
+type xsdFacet struct {
+    XMLName xml.Name
+    Value string `xml:"value,attr"`
+}
+
+// mustLoadSchema parses a bundled schema.
+func mustLoadSchema(name string) *xsdSchema {
+    data, err := schemaFiles.ReadFile(name)
+    if err == nil {
+        var schema *xsdSchema
+        if schema, err = parseSchema(data); err == nil {
+            return schema
+        }
+    }
+    panic(fmt.Sprintf("cannot load schema %s: %s", name, err))
+}
+
+func parseSchema(data []byte) (*xsdSchema, error) {
+    var doc struct {
+        TargetNamespace string         `xml:"targetNamespace,attr"`
+        Elements []xsdParticle         `xml:"element"`
+        ComplexTypes []*xsdComplexType `xml:"complexType"`
+        SimpleTypes []*xsdSimpleType   `xml:"simpleType"`
+    }
+    if err := xml.Unmarshal(data, &doc); err != nil {
+        return nil, err
+    }
+    schema := &xsdSchema{
+        namespace:doc.TargetNamespace,
+        elements:make(map[string]string),
+        complexTypes:make(map[string]*xsdComplexType),
+        simpleTypes:make(map[string]*xsdSimpleType)}
+    for _, element := range doc.Elements {
+        schema.elements[element.Name] = element.Type
+    }
+    for _, t := range doc.ComplexTypes {
+        schema.complexTypes[t.Name] = t
+    }
+    for _, t := range doc.SimpleTypes {
+        schema.simpleTypes[t.Name] = t
+    }
+    for _, t := range doc.ComplexTypes {
+        if err := schema.compileComplex(t); err != nil {
+            return nil, fmt.Errorf("type %s: %s", t.Name, err)
+        }
+    }
+    for _, t := range doc.SimpleTypes {
+        if err := schema.compileSimple(t); err != nil {
+            return nil, fmt.Errorf("type %s: %s", t.Name, err)
+        }
+    }
+    for name, t := range schema.elements {
+        if !schema.known(t) {
+            return nil, fmt.Errorf("element %s: unknown type %s", name, t)
+        }
+    }
+    return schema, nil
+}
+
+func (s *xsdSchema) compileComplex(t *xsdComplexType) error {
+    switch {
+    case t.Sequence != nil:
+        return s.compileParticles(t.Sequence.Elements)
+    case t.Choice != nil:
+        return s.compileParticles(t.Choice.Elements)
+    case t.SimpleContent != nil:
+        if _, ok := s.simpleTypes[t.SimpleContent.Base]; !ok && !xsdBuiltin(t.SimpleContent.Base) {
+            return fmt.Errorf("unknown base type %s", t.SimpleContent.Base)
+        }
+        for _, attribute := range t.SimpleContent.Attributes {
+            if _, ok := s.simpleTypes[attribute.Type]; !ok && !xsdBuiltin(attribute.Type) {
+                return fmt.Errorf("attribute %s: unknown type %s", attribute.Name, attribute.Type)
+            }
+        }
+        return nil
+    }
+    return fmt.Errorf("unsupported content")
+}
+
+func (s *xsdSchema) compileParticles(particles []xsdParticle) error {
+    for i := range particles {
+        p := &particles[i]
+        if !s.known(p.Type) {
+            return fmt.Errorf("element %s: unknown type %s", p.Name, p.Type)
+        }
+        p.min, p.max = 1, 1
+        if p.MinOccurs != "" {
+            p.min, _ = strconv.Atoi(p.MinOccurs)
+        }
+        if p.MaxOccurs == "unbounded" {
+            p.max = -1
+        } else if p.MaxOccurs != "" {
+            p.max, _ = strconv.Atoi(p.MaxOccurs)
+        }
+    }
+    return nil
+}
+
+func (s *xsdSchema) compileSimple(t *xsdSimpleType) error {
+    if _, ok := s.simpleTypes[t.Restriction.Base]; !ok && !xsdBuiltin(t.Restriction.Base) {
+        return fmt.Errorf("unknown base type %s", t.Restriction.Base)
+    }
+    for _, facet := range t.Restriction.Facets {
+        switch facet.XMLName.Local {
+        case "pattern":
+            pattern, err := regexp.Compile("^(?:" + facet.Value + ")$")
+            if err != nil {
+                return err
+            }
+            t.pattern = pattern
+        case "enumeration", "minLength", "maxLength", "minInclusive", "fractionDigits", "totalDigits":
+        default:
+            return fmt.Errorf("unsupported facet %s", facet.XMLName.Local)
+        }
+    }
+    return nil
+}
+
+func (s *xsdSchema) known(t string) bool {
+    _, complex := s.complexTypes[t]
+    _, simple := s.simpleTypes[t]
+    return complex || simple || t == xsdAnyType || xsdBuiltin(t)
+}
+
+func xsdBuiltin(t string) bool {
+    switch t {
+    case "xs:string", "xs:decimal", "xs:date", "xs:dateTime", "xs:boolean":
+        return true
+    }
+    return false
+}
+
+// xmlNode is an element of the validated document.
+type xmlNode struct {
+    name xml.Name
+    attrs []xml.Attr
+    children []*xmlNode
+    text strings.Builder
+}
+
+// parseXML reads the document into a tree of elements.
+func parseXML(r io.Reader) (*xmlNode, error) {
+    decoder := xml.NewDecoder(r)
+    var root *xmlNode
+    var stack []*xmlNode
+    for {
+        token, err := decoder.Token()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        switch token := token.(type) {
+        case xml.StartElement:
+            node := &xmlNode{name:token.Name, attrs:token.Attr}
+            if len(stack) > 0 {
+                parent := stack[len(stack)-1]
+                parent.children = append(parent.children, node)
+            } else if root == nil {
+                root = node
+            } else {
+                return nil, fmt.Errorf("more than one root element")
+            }
+            stack = append(stack, node)
+        case xml.EndElement:
+            stack = stack[:len(stack)-1]
+        case xml.CharData:
+            if len(stack) > 0 {
+                stack[len(stack)-1].text.Write(token)
+            }
+        }
+    }
+    if root == nil {
+        return nil, fmt.Errorf("no root element")
+    }
+    return root, nil
+}
+
+// validate checks the document against the schema. The problems are reported with
+// the paths of the elements, like /Document/GrpHdr/MsgId, as the field names.
+func (s *xsdSchema) validate(root *xmlNode) []FieldError {
+    v := &xsdValidator{schema:s}
+    path := "/" + root.name.Local
+    if root.name.Space != s.namespace {
+        v.fail(path, fmt.Sprintf("should be in the namespace %s", s.namespace))
+    } else if t, ok := s.elements[root.name.Local]; !ok {
+        v.fail(path, "is not a document of this schema")
+    } else {
+        v.element(root, t, path)
+    }
+    return v.errs
+}
+
+type xsdValidator struct {
+    schema *xsdSchema
+    errs []FieldError
+}
+
+func (v *xsdValidator) fail(path, message string) {
+    if len(v.errs) < maxSchemaErrors {
+        v.errs = append(v.errs, FieldError{path, message})
+    }
+}
+
+func (v *xsdValidator) element(node *xmlNode, t string, path string) {
+    if t == xsdAnyType {
+        return
+    }
+    complex, ok := v.schema.complexTypes[t]
+    if !ok {
+        if len(node.children) > 0 {
+            v.fail(path, "should not have child elements")
+            return
+        }
+        v.value(node.text.String(), t, path)
+        return
+    }
+    if complex.SimpleContent != nil {
+        if len(node.children) > 0 {
+            v.fail(path, "should not have child elements")
+            return
+        }
+        v.value(node.text.String(), complex.SimpleContent.Base, path)
+        for _, attribute := range complex.SimpleContent.Attributes {
+            value, found := xmlAttr(node, attribute.Name)
+            if !found && attribute.Use == "required" {
+                v.fail(path, fmt.Sprintf("should have the %s attribute", attribute.Name))
+            } else if found {
+                v.value(value, attribute.Type, path + "/@" + attribute.Name)
+            }
+        }
+        return
+    }
+    if strings.TrimSpace(node.text.String()) != "" {
+        v.fail(path, "should not have text")
+    }
+    for _, child := range node.children {
+        if child.name.Space != v.schema.namespace {
+            v.fail(path + "/" + child.name.Local, fmt.Sprintf("should be in the namespace %s", v.schema.namespace))
+            return
+        }
+    }
+    if complex.Choice != nil {
+        v.choice(node, complex.Choice.Elements, path)
+    } else {
+        v.sequence(node, complex.Sequence.Elements, path)
+    }
+}
+
+// sequence matches the children with the particles in order, each taking as many
+// consecutive elements of its name as it allows.
+func (v *xsdValidator) sequence(node *xmlNode, particles []xsdParticle, path string) {
+    i := 0
+    for _, p := range particles {
+        count := 0
+        for i < len(node.children) && node.children[i].name.Local == p.Name && (p.max < 0 || count < p.max) {
+            child := node.children[i]
+            count++
+            v.element(child, p.Type, childPath(node, i, path))
+            i++
+        }
+        if count < p.min {
+            v.fail(path + "/" + p.Name, "is required")
+        }
+    }
+    if i < len(node.children) {
+        v.fail(childPath(node, i, path), "is not expected here")
+    }
+}
+
+// choice expects exactly one child of one of the particles.
+func (v *xsdValidator) choice(node *xmlNode, particles []xsdParticle, path string) {
+    if len(node.children) != 1 {
+        names := make([]string, 0, len(particles))
+        for _, p := range particles {
+            names = append(names, p.Name)
+        }
+        v.fail(path, "should have one of " + strings.Join(names, ", "))
+        return
+    }
+    child := node.children[0]
+    for _, p := range particles {
+        if p.Name == child.name.Local {
+            v.element(child, p.Type, path + "/" + p.Name)
+            return
+        }
+    }
+    v.fail(path + "/" + child.name.Local, "is not expected here")
+}
+
+// childPath is the path of the child, with its position among the siblings of the
+// same name if there are several.
+func childPath(node *xmlNode, i int, path string) string {
+    name := node.children[i].name.Local
+    position, count := 0, 0
+    for j, sibling := range node.children {
+        if sibling.name.Local == name {
+            count++
+            if j <= i {
+                position++
+            }
+        }
+    }
+    if count > 1 {
+        return fmt.Sprintf("%s/%s[%d]", path, name, position)
+    }
+    return path + "/" + name
+}
+
+func xmlAttr(node *xmlNode, name string) (string, bool) {
+    for _, attr := range node.attrs {
+        if attr.Name.Space == "" && attr.Name.Local == name {
+            return attr.Value, true
+        }
+    }
+    return "", false
+}
+
+// value checks the text against the simple type and the facets of its base types.
+func (v *xsdValidator) value(text, t string, path string) {
+    var facets []xsdFacet
+    var patterns []*regexp.Regexp
+    for !xsdBuiltin(t) {
+        simple := v.schema.simpleTypes[t]
+        facets = append(facets, simple.Restriction.Facets...)
+        if simple.pattern != nil {
+            patterns = append(patterns, simple.pattern)
+        }
+        t = simple.Restriction.Base
+    }
+    if t != "xs:string" {
+        text = strings.TrimSpace(text)
+    }
+    if message := checkBuiltin(text, t); message != "" {
+        v.fail(path, message)
+        return
+    }
+    for _, pattern := range patterns {
+        if !pattern.MatchString(text) {
+            v.fail(path, fmt.Sprintf("should match %s", pattern))
+            return
+        }
+    }
+    var options []string
+    for _, facet := range facets {
+        if facet.XMLName.Local == "enumeration" {
+            options = append(options, facet.Value)
+        } else if message := checkFacet(text, facet); message != "" {
+            v.fail(path, message)
+            return
+        }
+    }
+    if len(options) > 0 && !contains(options, text) {
+        v.fail(path, "should be one of " + strings.Join(options, ", "))
+    }
+}
+
+var xsdDecimal = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+func checkBuiltin(text, t string) string {
+    switch t {
+    case "xs:decimal":
+        if !xsdDecimal.MatchString(text) {
+            return "should be a decimal number"
+        }
+    case "xs:date":
+        if _, err := time.Parse(dateLayout, text); err != nil {
+            return "should be a date like 2019-03-01"
+        }
+    case "xs:dateTime":
+        if _, err := time.Parse(time.RFC3339, text); err != nil {
+            if _, err = time.Parse("2006-01-02T15:04:05", text); err != nil {
+                return "should be a date and time like 2019-03-01T10:00:00"
+            }
+        }
+    case "xs:boolean":
+        if !contains([]string{"true", "false", "1", "0"}, text) {
+            return "should be true or false"
+        }
+    }
+    return ""
+}
+
+func checkFacet(text string, facet xsdFacet) string {
+    limit, _ := strconv.Atoi(facet.Value)
+    switch facet.XMLName.Local {
+    case "minLength":
+        if utf8.RuneCountInString(text) < limit {
+            return fmt.Sprintf("should have at least %d characters", limit)
+        }
+    case "maxLength":
+        if utf8.RuneCountInString(text) > limit {
+            return fmt.Sprintf("should have at most %d characters", limit)
+        }
+    case "minInclusive":
+        value, _ := new(big.Rat).SetString(text)
+        bound, _ := new(big.Rat).SetString(facet.Value)
+        if value.Cmp(bound) < 0 {
+            return fmt.Sprintf("should be at least %s", facet.Value)
+        }
+    case "fractionDigits":
+        if _, fraction := decimalDigits(text); fraction > limit {
+            return fmt.Sprintf("should have at most %d fraction digits", limit)
+        }
+    case "totalDigits":
+        if integer, fraction := decimalDigits(text); integer + fraction > limit {
+            return fmt.Sprintf("should have at most %d digits", limit)
+        }
+    }
+    return ""
+}
+
+// decimalDigits counts the significant digits of a decimal number before and after
+// the point.
+func decimalDigits(text string) (integer, fraction int) {
+    text = strings.TrimLeft(text, "+-")
+    whole, part, _ := strings.Cut(text, ".")
+    return len(strings.TrimLeft(whole, "0")), len(strings.TrimRight(part, "0"))
+}
@@ -7,16 +7,29 @@ CREATE TABLE account (
   identifier VARCHAR(36) UNIQUE NOT NULL,
   currency currency NOT NULL,
   amount DECIMAL DEFAULT 0,
-  created_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+  created_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  tier VARCHAR(16) NOT NULL DEFAULT 'standard',
+  overdraft_limit DECIMAL NOT NULL DEFAULT 0,
+  interest_bps INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE payment (
   payment_id serial PRIMARY KEY,
-  from_id VARCHAR(36) UNIQUE NOT NULL,
-  to_id VARCHAR(36) UNIQUE NOT NULL,
+  from_id VARCHAR(36) NOT NULL,
+  to_id VARCHAR(36) NOT NULL,
   amount DECIMAL NOT NULL,
   transaction_time_utc TIMESTAMP NOT NULL,
   currency currency NOT NULL,
+  idempotency_key VARCHAR(64),
+  kind VARCHAR(16) NOT NULL DEFAULT 'transfer',
+  original_id INTEGER REFERENCES payment (payment_id),
+  status VARCHAR(16) NOT NULL DEFAULT 'completed',
+  parent_id INTEGER REFERENCES payment (payment_id),
+  reference VARCHAR(64) NOT NULL DEFAULT '',
+  unique_reference BOOLEAN NOT NULL DEFAULT FALSE,
+  memo VARCHAR(140) NOT NULL DEFAULT '',
+  metadata JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT payment_idempotency_key_uq UNIQUE (from_id, idempotency_key),
   CONSTRAINT payment_from_id_fk FOREIGN KEY (from_id)
       REFERENCES account (identifier) MATCH SIMPLE
       ON UPDATE NO ACTION ON DELETE NO ACTION,
@@ -25,9 +38,298 @@ CREATE TABLE payment (
       ON UPDATE NO ACTION ON DELETE NO ACTION
 );
 
+CREATE INDEX payment_original_id_idx ON payment (original_id);
+CREATE INDEX payment_parent_id_idx ON payment (parent_id);
+CREATE INDEX payment_reference_idx ON payment (reference) WHERE reference <> '';
+CREATE INDEX payment_metadata_idx ON payment USING GIN (metadata);
+CREATE INDEX payment_unsettled_idx ON payment (from_id) WHERE status IN ('pending', 'processing');
+
+CREATE TABLE payment_status (
+  status_id serial PRIMARY KEY,
+  payment_id INTEGER NOT NULL REFERENCES payment (payment_id),
+  status VARCHAR(16) NOT NULL,
+  reason VARCHAR(256) NOT NULL DEFAULT '',
+  changed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX payment_status_payment_id_idx ON payment_status (payment_id);
+
+CREATE TABLE hold (
+  hold_id serial PRIMARY KEY,
+  from_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  to_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  amount DECIMAL NOT NULL,
+  currency currency NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  captured DECIMAL NOT NULL DEFAULT 0,
+  payment_id INTEGER REFERENCES payment (payment_id),
+  created_on TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX hold_active_idx ON hold (from_id, expires_at) WHERE status = 'active';
+
+CREATE TABLE schedule (
+  schedule_id serial PRIMARY KEY,
+  from_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  to_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  amount DECIMAL NOT NULL,
+  recurrence VARCHAR(16) NOT NULL,
+  day_of_month INTEGER NOT NULL DEFAULT 0,
+  start_at TIMESTAMP NOT NULL,
+  end_at TIMESTAMP,
+  max_runs INTEGER NOT NULL DEFAULT 0,
+  runs INTEGER NOT NULL DEFAULT 0,
+  next_run_at TIMESTAMP,
+  status VARCHAR(16) NOT NULL,
+  created_on TIMESTAMP NOT NULL
+);
+
+CREATE INDEX schedule_due_idx ON schedule (next_run_at) WHERE status = 'active';
+
+CREATE TABLE schedule_run (
+  run_id serial PRIMARY KEY,
+  schedule_id INTEGER NOT NULL REFERENCES schedule (schedule_id),
+  occurrence INTEGER NOT NULL,
+  scheduled_at TIMESTAMP NOT NULL,
+  executed_at TIMESTAMP NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  payment_id INTEGER REFERENCES payment (payment_id),
+  error_code VARCHAR(64) NOT NULL DEFAULT '',
+  error TEXT NOT NULL DEFAULT '',
+  CONSTRAINT schedule_run_occurrence_uq UNIQUE (schedule_id, occurrence)
+);
+
+CREATE TABLE fee_schedule (
+  fee_schedule_id serial PRIMARY KEY,
+  currency currency NOT NULL,
+  tier VARCHAR(16) NOT NULL DEFAULT '',
+  payer VARCHAR(16) NOT NULL,
+  kind VARCHAR(16) NOT NULL,
+  flat DECIMAL NOT NULL DEFAULT 0,
+  rate_bps INTEGER NOT NULL DEFAULT 0,
+  min_fee DECIMAL NOT NULL DEFAULT 0,
+  max_fee DECIMAL NOT NULL DEFAULT 0,
+  brackets JSONB,
+  revenue_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_on TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX fee_schedule_active_uq ON fee_schedule (currency, tier, payer) WHERE active;
+
+CREATE TABLE transfer_limit (
+  limit_id serial PRIMARY KEY,
+  currency currency NOT NULL,
+  account_id VARCHAR(36) REFERENCES account (identifier),
+  max_transfer DECIMAL NOT NULL DEFAULT 0,
+  daily DECIMAL NOT NULL DEFAULT 0,
+  monthly DECIMAL NOT NULL DEFAULT 0,
+  hourly_count INTEGER NOT NULL DEFAULT 0,
+  updated_on TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX transfer_limit_scope_uq ON transfer_limit (currency, COALESCE(account_id, ''));
+CREATE INDEX payment_from_time_idx ON payment (from_id, transaction_time_utc);
+
+CREATE TABLE interest_accrual (
+  accrual_id serial PRIMARY KEY,
+  account_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  day DATE NOT NULL,
+  balance DECIMAL NOT NULL,
+  interest_bps INTEGER NOT NULL,
+  amount DECIMAL NOT NULL,
+  payment_id INTEGER REFERENCES payment (payment_id),
+  accrued_at TIMESTAMP NOT NULL,
+  UNIQUE (account_id, day)
+);
+
+CREATE TABLE approval (
+  approval_id serial PRIMARY KEY,
+  kind VARCHAR(16) NOT NULL DEFAULT 'transfer',
+  from_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  to_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  amount DECIMAL NOT NULL,
+  currency currency NOT NULL,
+  pending BOOLEAN NOT NULL DEFAULT FALSE,
+  status VARCHAR(16) NOT NULL,
+  initiator VARCHAR(64) NOT NULL,
+  decided_by VARCHAR(64) NOT NULL DEFAULT '',
+  reason VARCHAR(256) NOT NULL DEFAULT '',
+  payment_id INTEGER REFERENCES payment (payment_id),
+  error_code VARCHAR(32) NOT NULL DEFAULT '',
+  error TEXT NOT NULL DEFAULT '',
+  idempotency_key VARCHAR(64),
+  created_on TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP NOT NULL,
+  decided_at TIMESTAMP,
+  reference VARCHAR(64) NOT NULL DEFAULT '',
+  unique_reference BOOLEAN NOT NULL DEFAULT FALSE,
+  memo VARCHAR(140) NOT NULL DEFAULT '',
+  metadata JSONB NOT NULL DEFAULT '{}',
+  UNIQUE (from_id, idempotency_key)
+);
+
+CREATE INDEX approval_status_idx ON approval (status, approval_id);
+
+CREATE TABLE approval_event (
+  event_id serial PRIMARY KEY,
+  approval_id INTEGER NOT NULL REFERENCES approval (approval_id),
+  action VARCHAR(16) NOT NULL,
+  principal VARCHAR(64) NOT NULL DEFAULT '',
+  reason TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE audit_log (
+  seq BIGINT PRIMARY KEY,
+  created_at TIMESTAMP NOT NULL,
+  actor VARCHAR(64) NOT NULL,
+  request_id VARCHAR(64) NOT NULL DEFAULT '',
+  action VARCHAR(64) NOT NULL,
+  resource VARCHAR(128) NOT NULL,
+  before_value TEXT NOT NULL DEFAULT '',
+  after_value TEXT NOT NULL DEFAULT '',
+  prev_hash CHAR(64) NOT NULL DEFAULT '',
+  hash CHAR(64) NOT NULL
+);
+
+-- The audit log is append-only: the application's role can only read and insert the
+-- entries, see the grants below, and the changes made by the owner fail. A change made
+-- bypassing the trigger breaks the hash chain.
+CREATE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_change BEFORE UPDATE OR DELETE ON audit_log
+  FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE signing_key (
+  key_id VARCHAR(32) PRIMARY KEY,
+  public_key BYTEA NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  retired_at TIMESTAMP
+);
+
+-- a single key is active
+CREATE UNIQUE INDEX signing_key_active ON signing_key ((retired_at IS NULL)) WHERE retired_at IS NULL;
+
+CREATE TABLE webhook (
+  webhook_id serial PRIMARY KEY,
+  url VARCHAR(2048) NOT NULL,
+  event_types VARCHAR(64)[] NOT NULL,
+  secret VARCHAR(128) NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE outbox_event (
+  event_id serial PRIMARY KEY,
+  event_type VARCHAR(64) NOT NULL,
+  payload JSONB NOT NULL,
+  created_on TIMESTAMP NOT NULL
+);
+
+CREATE TABLE webhook_delivery (
+  delivery_id serial PRIMARY KEY,
+  webhook_id INTEGER NOT NULL REFERENCES webhook (webhook_id),
+  event_id INTEGER NOT NULL REFERENCES outbox_event (event_id),
+  status VARCHAR(16) NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP NOT NULL,
+  last_error TEXT,
+  delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_delivery_due_idx ON webhook_delivery (next_attempt_at) WHERE status = 'pending';
+
+-- The balance of an account at the start of a UTC day.
+CREATE TABLE balance_snapshot (
+  account_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  day DATE NOT NULL,
+  amount DECIMAL NOT NULL,
+  taken_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (account_id, day)
+);
+
+CREATE INDEX payment_status_booked_idx ON payment_status (changed_at) WHERE status = 'completed';
+
+-- The opening balances and the adjustments of the accounts, which explain their balances
+-- together with the payments.
+CREATE TABLE ledger_entry (
+  entry_id serial PRIMARY KEY,
+  account_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  kind VARCHAR(16) NOT NULL,
+  amount DECIMAL NOT NULL,
+  approval_id INTEGER UNIQUE REFERENCES approval (approval_id),
+  created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX ledger_entry_account_id_idx ON ledger_entry (account_id);
+
+-- The indexes of the payment search: the trigram index finds the references by their
+-- parts, and the full-text index finds the memos by their words.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX payment_reference_trgm_idx ON payment USING GIN (reference gin_trgm_ops);
+CREATE INDEX payment_memo_fts_idx ON payment USING GIN (to_tsvector('simple', memo));
+CREATE INDEX payment_time_idx ON payment (transaction_time_utc);
+
+-- The hourly totals of the payments booked between an account and a counterparty, and
+-- the rolled up hours, see analytics.go.
+CREATE TABLE payment_rollup (
+  hour TIMESTAMP NOT NULL,
+  account_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  counterparty_id VARCHAR(36) NOT NULL REFERENCES account (identifier),
+  currency currency NOT NULL,
+  sent_count INTEGER NOT NULL,
+  sent_amount DECIMAL NOT NULL,
+  received_count INTEGER NOT NULL,
+  received_amount DECIMAL NOT NULL,
+  PRIMARY KEY (account_id, hour, counterparty_id)
+);
+
+CREATE INDEX payment_rollup_hour_idx ON payment_rollup (hour);
+
+CREATE TABLE rollup_hour (
+  hour TIMESTAMP PRIMARY KEY,
+  rolled_at TIMESTAMP NOT NULL
+);
+
 INSERT INTO account (identifier, currency, amount) VALUES
 ('first', 'USD', 1000),
 ('second', 'USD', 0),
 ('third', 'EUR', 10);
 
-GRANT ALL PRIVILEGES on TABLE account TO docker;
+INSERT INTO ledger_entry (account_id, kind, amount, created_at)
+SELECT identifier, 'opening', amount, created_on FROM account;
+
+-- The tables are owned by the docker role, which creates them; the application
+-- connects with the billing role, which cannot change the audit log.
+CREATE ROLE billing LOGIN PASSWORD 'billing';
+
+GRANT ALL PRIVILEGES on TABLE account TO billing;
+GRANT ALL PRIVILEGES on TABLE payment TO billing;
+GRANT ALL PRIVILEGES on TABLE payment_status TO billing;
+GRANT ALL PRIVILEGES on TABLE hold TO billing;
+GRANT ALL PRIVILEGES on TABLE schedule TO billing;
+GRANT ALL PRIVILEGES on TABLE schedule_run TO billing;
+GRANT ALL PRIVILEGES on TABLE fee_schedule TO billing;
+GRANT ALL PRIVILEGES on TABLE transfer_limit TO billing;
+GRANT ALL PRIVILEGES on TABLE interest_accrual TO billing;
+GRANT ALL PRIVILEGES on TABLE approval TO billing;
+GRANT ALL PRIVILEGES on TABLE approval_event TO billing;
+GRANT SELECT, INSERT on TABLE audit_log TO billing;
+GRANT ALL PRIVILEGES on TABLE signing_key TO billing;
+GRANT ALL PRIVILEGES on TABLE webhook TO billing;
+GRANT ALL PRIVILEGES on TABLE outbox_event TO billing;
+GRANT ALL PRIVILEGES on TABLE webhook_delivery TO billing;
+GRANT ALL PRIVILEGES on TABLE balance_snapshot TO billing;
+GRANT ALL PRIVILEGES on TABLE ledger_entry TO billing;
+GRANT ALL PRIVILEGES on TABLE payment_rollup TO billing;
+GRANT ALL PRIVILEGES on TABLE rollup_hour TO billing;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO billing;